@@ -0,0 +1,196 @@
+package tcpf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLog writes a line for every HTTP/1.x request the realms given it
+// with WithAccessLog forward, in the combined log format prefixed with the
+// Host header, like Apache's vhost_combined:
+//
+//	host client - - [time] "request line" status bytes "referer" "user agent"
+//
+// where bytes counts the whole response, header included. Requests whose
+// response isn't seen, e.g. when the tunnel closes first, are logged with
+// status "-". An AccessLog may be shared by several realms.
+type AccessLog struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// NewAccessLog makes an AccessLog writing to writer
+func NewAccessLog(writer io.Writer) *AccessLog {
+	return &AccessLog{writer: writer}
+}
+
+// Format of the time of the requests in the access log
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+func (log *AccessLog) write(client string, exchange *exchange, status string, bytes int64) {
+	line := fmt.Sprintf("%s %s - - [%s] %s %s %d %s %s\n", orDash(exchange.host), client, exchange.time.Format(accessLogTime),
+		quote(exchange.requestLine), status, bytes, quote(exchange.referer), quote(exchange.userAgent))
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if _, err := io.WriteString(log.writer, line); err != nil {
+		logEvent(LevelWarn, "access_log_error", Fields{"error": err}, "Can't write the access log: %v", err)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote quotes s as the fields of the combined log format are: in double
+// quotes escaped with backslashes, "-" if empty
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// exchange is an HTTP request and what the access log needs of it
+type exchange struct {
+	time        time.Time
+	requestLine string
+	method      string
+	host        string
+	referer     string
+	userAgent   string
+}
+
+// exchanges queues the requests of a tunnel until their responses are seen,
+// as requests may be pipelined
+type exchanges struct {
+	lock   sync.Mutex
+	queue  []*exchange
+	client string
+	log    *AccessLog
+}
+
+func newExchanges(conn net.Conn, log *AccessLog) *exchanges {
+	client := conn.RemoteAddr().String()
+	if ip, ok := clientIP(conn.RemoteAddr()); ok {
+		client = ip.String()
+	}
+	return &exchanges{client: client, log: log}
+}
+
+func (e *exchanges) push(exchange *exchange) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.queue = append(e.queue, exchange)
+}
+
+// pop returns the oldest request without a response, or nil
+func (e *exchanges) pop() *exchange {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.queue) == 0 {
+		return nil
+	}
+	exchange := e.queue[0]
+	e.queue = e.queue[1:]
+	return exchange
+}
+
+// responseConn is a destination connection whose HTTP/1.x responses are
+// parsed as they are read, to log them along with their requests
+type responseConn struct {
+	net.Conn
+	httpStream
+	exchanges *exchanges
+	// Request of the response being read, and its status
+	current *exchange
+	status  string
+}
+
+// newResponseConn wraps the destination connection so that its responses
+// are matched with the requests queued to exchanges and logged
+func newResponseConn(conn net.Conn, exchanges *exchanges) net.Conn {
+	wrapped := &responseConn{Conn: conn, exchanges: exchanges}
+	wrapped.reader = bufio.NewReader(conn)
+	wrapped.onHeader = wrapped.parse
+	wrapped.onEnd = wrapped.finish
+	return wrapped
+}
+
+func (conn *responseConn) Read(b []byte) (int, error) {
+	n, err := conn.read(b)
+	if err != nil {
+		conn.flush()
+	}
+	return n, err
+}
+
+func (conn *responseConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+// parse matches the response with its request, and tells how its body is
+// framed
+func (conn *responseConn) parse(header []byte) ([]byte, int, int64) {
+	lines := headerLines(header)
+	_, status, _ := strings.Cut(string(lines[0]), " ")
+	status, _, _ = strings.Cut(strings.TrimSpace(status), " ")
+	code, err := strconv.Atoi(status)
+	if !strings.HasPrefix(string(lines[0]), "HTTP/1.") || err != nil {
+		return header, httpPassthrough, 0
+	}
+	if code >= 100 && code < 200 && code != 101 {
+		// Interim responses, e.g. 100 Continue, precede the final one
+		return header, httpBody, 0
+	}
+	conn.current, conn.status = conn.exchanges.pop(), status
+	if conn.current == nil {
+		conn.current = &exchange{time: time.Now()}
+	}
+	var length int64 = -1
+	var chunked bool
+	for _, line := range lines[1 : len(lines)-1] {
+		switch name, value := headerField(line); name {
+		case "content-length":
+			length, _ = strconv.ParseInt(value, 10, 64)
+		case "transfer-encoding":
+			chunked = strings.HasSuffix(strings.ToLower(value), "chunked")
+		}
+	}
+	switch method := conn.current.method; {
+	case code == 101 || method == "CONNECT" && code < 300:
+		return header, httpPassthrough, 0
+	case method == "HEAD" || code == 204 || code == 304:
+		return header, httpBody, 0
+	case chunked:
+		return header, httpChunkSize, 0
+	case length >= 0:
+		return header, httpBody, length
+	}
+	return header, httpUntilClose, 0
+}
+
+// finish logs the response read
+func (conn *responseConn) finish() {
+	if conn.current != nil {
+		conn.exchanges.log.write(conn.exchanges.client, conn.current, conn.status, conn.messageBytes)
+		conn.current = nil
+	}
+}
+
+// flush logs the response being read when the destination closes the
+// connection, and the requests left without a response
+func (conn *responseConn) flush() {
+	conn.finish()
+	for exchange := conn.exchanges.pop(); exchange != nil; exchange = conn.exchanges.pop() {
+		conn.exchanges.log.write(conn.exchanges.client, exchange, "-", 0)
+	}
+}
@@ -0,0 +1,131 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Responses of the destination of TestAccessLog by request path
+var accessLogResponses = map[string]string{
+	"/length":   "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+	"/chunked":  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+	"/continue": "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n",
+	"/missing":  "HTTP/1.1 404 Not Found\r\nContent-Length: 9\r\n\r\nnot found",
+}
+
+// accessLogLines returns the lines of the access log once it has n of them,
+// with the time of the requests replaced by T
+func accessLogLines(t *testing.T, log *AccessLog, buf *bytes.Buffer, n int) []string {
+	t.Helper()
+	var lines []string
+	waitFor(t, fmt.Sprintf("%d access log lines", n), func() bool {
+		log.lock.Lock()
+		defer log.lock.Unlock()
+		lines = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		return len(lines) >= n && lines[0] != ""
+	})
+	time := regexp.MustCompile(`\[\d\d/\w\w\w/\d{4}:\d\d:\d\d:\d\d [-+]\d{4}\]`)
+	for i, line := range lines {
+		lines[i] = time.ReplaceAllString(line, "[T]")
+	}
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	// The destination answers the requests by their path, and closes the
+	// connection without answering /silent
+	dst := startServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		for {
+			request, err := http.ReadRequest(reader)
+			if err != nil || request.URL.Path == "/silent" {
+				return
+			}
+			io.Copy(io.Discard, request.Body)
+			response := accessLogResponses[request.URL.Path]
+			if request.Method == http.MethodHead {
+				response, _, _ = strings.Cut(response, "\r\n\r\n")
+				response += "\r\n\r\n"
+			}
+			io.WriteString(conn, response)
+		}
+	})
+	var buf bytes.Buffer
+	log := NewAccessLog(&buf)
+	_, addr := startRealm(t, dst, WithAccessLog(log))
+	conn := dialRealm(t, addr)
+	// The requests are pipelined, and logged in order once answered
+	requests := []string{
+		"GET /length HTTP/1.1\r\nHost: dest.test\r\nReferer: http://ref.test/\r\nUser-Agent: agent \"quoted\" \\o/\r\n\r\n",
+		"HEAD /length HTTP/1.1\r\nHost: dest.test\r\n\r\n",
+		"GET /chunked HTTP/1.1\r\nHost: dest.test\r\n\r\n",
+		"POST /continue HTTP/1.1\r\nHost: dest.test\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\nbody",
+		"GET /missing HTTP/1.1\r\nHost: dest.test\r\n\r\n",
+		"GET /silent HTTP/1.0\r\n\r\n",
+		"GET /after HTTP/1.1\r\nHost: dest.test\r\n\r\n",
+	}
+	io.WriteString(conn, strings.Join(requests, ""))
+	io.ReadAll(conn)
+
+	head, _, _ := strings.Cut(accessLogResponses["/length"], "hello")
+	want := []string{
+		fmt.Sprintf(`dest.test 127.0.0.1 - - [T] "GET /length HTTP/1.1" 200 %d "http://ref.test/" "agent \"quoted\" \\o/"`, len(accessLogResponses["/length"])),
+		fmt.Sprintf(`dest.test 127.0.0.1 - - [T] "HEAD /length HTTP/1.1" 200 %d "-" "-"`, len(head)),
+		fmt.Sprintf(`dest.test 127.0.0.1 - - [T] "GET /chunked HTTP/1.1" 200 %d "-" "-"`, len(accessLogResponses["/chunked"])),
+		// The interim response doesn't count
+		fmt.Sprintf(`dest.test 127.0.0.1 - - [T] "POST /continue HTTP/1.1" 201 %d "-" "-"`, len("HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n")),
+		fmt.Sprintf(`dest.test 127.0.0.1 - - [T] "GET /missing HTTP/1.1" 404 %d "-" "-"`, len(accessLogResponses["/missing"])),
+		// Requests left without a response when the connection closes
+		`- 127.0.0.1 - - [T] "GET /silent HTTP/1.0" - 0 "-" "-"`,
+		`dest.test 127.0.0.1 - - [T] "GET /after HTTP/1.1" - 0 "-" "-"`,
+	}
+	lines := accessLogLines(t, log, &buf, len(want))
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d lines, want %d:\n%v", len(lines), len(want), strings.Join(lines, "\n"))
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d is\n\t%v\nwant\n\t%v", i+1, lines[i], want[i])
+		}
+	}
+}
+
+func TestAccessLogNotHTTP(t *testing.T) {
+	// Traffic which isn't HTTP passes through without being logged
+	var buf bytes.Buffer
+	log := NewAccessLog(&buf)
+	_, addr := startRealm(t, startEcho(t), WithAccessLog(log))
+	msg := []byte("\x16\x03\x01 not HTTP\r\n\r\n")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if buf.Len() > 0 {
+		t.Errorf("logged %q", buf.String())
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", `"-"`},
+		{"plain", `"plain"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\path`, `"C:\\path"`},
+	}
+	for _, test := range tests {
+		if got := quote(test.s); got != test.want {
+			t.Errorf("quote(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+}
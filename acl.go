@@ -0,0 +1,114 @@
+package tcpf
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// clientIP returns the IP address of a client, or false for clients which
+// aren't connected over IP (e.g. over a Unix socket)
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// permitted tells whether a client may open a tunnel according to the allow
+// and deny lists of the realm, TCP or UDP: denied networks take precedence
+// over allowed ones, and an empty allow list allows all the networks not
+// denied
+func (o *options) permitted(addr net.Addr) bool {
+	if len(o.allow) == 0 && len(o.deny) == 0 {
+		return true
+	}
+	ip, ok := clientIP(addr)
+	if !ok {
+		return len(o.allow) == 0
+	}
+	for _, prefix := range o.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(o.allow) == 0 {
+		return true
+	}
+	for _, prefix := range o.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipCounts counts the tunnels or sessions of every client IP against the
+// limit set with WithMaxConnsPerIP
+type ipCounts struct {
+	counts map[netip.Addr]int
+	lock   sync.Mutex
+}
+
+// acquire counts a tunnel of the client against the limit; it returns false
+// if the client's IP has reached the limit already
+func (c *ipCounts) acquire(addr net.Addr, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	ip, ok := clientIP(addr)
+	if !ok {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts[ip] >= limit {
+		return false
+	}
+	if c.counts == nil {
+		c.counts = make(map[netip.Addr]int)
+	}
+	c.counts[ip]++
+	return true
+}
+
+// release stops counting a tunnel of the client against the limit
+func (c *ipCounts) release(addr net.Addr, limit int) {
+	if limit <= 0 {
+		return
+	}
+	ip, ok := clientIP(addr)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// IPs without tunnels are forgotten, so the map doesn't grow forever
+	if c.counts[ip]--; c.counts[ip] <= 0 {
+		delete(c.counts, ip)
+	}
+}
+
+// ParsePrefixes parses a comma separated list of networks in CIDR notation,
+// where a single IP address stands for a network of just that address
+func ParsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q, expected CIDR notation or an IP address", item)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,164 @@
+package tcpf
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPermitted(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny string
+		addr        string
+		want        bool
+	}{
+		{"no lists", "", "", "192.0.2.1:1000", true},
+		{"allowed v4", "192.0.2.0/24", "", "192.0.2.1:1000", true},
+		{"not allowed v4", "192.0.2.0/24", "", "198.51.100.1:1000", false},
+		{"denied v4", "", "192.0.2.0/24", "192.0.2.1:1000", false},
+		{"not denied v4", "", "192.0.2.0/24", "198.51.100.1:1000", true},
+		{"single IP", "192.0.2.7", "", "192.0.2.7:1000", true},
+		{"deny wins", "192.0.2.0/24", "192.0.2.128/25", "192.0.2.200:1000", false},
+		{"allowed v6", "2001:db8::/32", "", "[2001:db8::1]:1000", true},
+		{"not allowed v6", "2001:db8::/32", "", "[2001:db9::1]:1000", false},
+		{"denied v6", "", "2001:db8:1::/48", "[2001:db8:1::5]:1000", false},
+		{"mapped v4", "192.0.2.0/24", "", "[::ffff:192.0.2.1]:1000", true},
+		{"v4 list and v6 client", "192.0.2.0/24", "", "[2001:db8::1]:1000", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allow, err := ParsePrefixes(test.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			deny, err := ParsePrefixes(test.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := newOptions([]Option{WithAllow(allow), WithDeny(deny)})
+			addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(test.addr))
+			if got := o.permitted(addr); got != test.want {
+				t.Errorf("permitted(%v) = %v, want %v", test.addr, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePrefixesInvalid(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.0/8,,fd00::/129"} {
+		if _, err := ParsePrefixes(list); err == nil {
+			t.Errorf("ParsePrefixes(%q) succeeded", list)
+		}
+	}
+}
+
+func TestDeniedClientIsRefused(t *testing.T) {
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	_, addr := startRealm(t, startEcho(t), WithDeny(loopback))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a realm denying the client", n)
+	}
+}
+
+func TestUDPAccessLists(t *testing.T) {
+	dst := startUDPEcho(t)
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	tests := []struct {
+		name string
+		opts []Option
+		want bool
+	}{
+		{"open", nil, true},
+		{"allowed", []Option{WithAllow(loopback)}, true},
+		{"denied", []Option{WithDeny(loopback)}, false},
+		{"not allowed", []Option{WithAllow([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			realm, addr := startUDPRealm(t, dst, test.opts...)
+			conn, err := net.DialUDP("udp", nil, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			msg := []byte("ping")
+			timeout := 2 * time.Second
+			if !test.want {
+				timeout = 200 * time.Millisecond
+			}
+			reply := udpExchange(t, conn, msg, timeout)
+			if got := bytes.Equal(reply, msg); got != test.want {
+				t.Errorf("forwarded = %v, want %v", got, test.want)
+			}
+			if sessions := len(realm.listSessions()); !test.want && sessions != 0 {
+				t.Errorf("%d sessions opened for a refused client", sessions)
+			}
+		})
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	realm, addr := startRealm(t, startEcho(t), WithMaxConnsPerIP(2))
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitFor(t, "the tunnels to open", func() bool { return len(realm.Tunnels()) == 2 })
+	refused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	refused.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := refused.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a third tunnel of the client", n)
+	}
+	// Closing a tunnel makes room for another one
+	conns[0].Close()
+	waitFor(t, "the tunnel to close", func() bool { return len(realm.Tunnels()) == 1 })
+	msg := []byte("again")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+}
+
+func TestUDPMaxSessionsPerIP(t *testing.T) {
+	realm, addr := startUDPRealm(t, startUDPEcho(t), WithMaxConnsPerIP(1), WithIdleTimeout(200*time.Millisecond))
+	msg := []byte("ping")
+	first, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if reply := udpExchange(t, first, msg, 2*time.Second); !bytes.Equal(reply, msg) {
+		t.Fatalf("got %q back, want %q", reply, msg)
+	}
+	// Another port of the same IP would be another session
+	second, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if reply := udpExchange(t, second, msg, 200*time.Millisecond); reply != nil {
+		t.Errorf("got %q back from a second session of the client", reply)
+	}
+	// Once the first session expires the client may open another one
+	waitFor(t, "the session to expire", func() bool { return len(realm.listSessions()) == 0 })
+	if reply := udpExchange(t, second, msg, 2*time.Second); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back after the first session expired, want %q", reply, msg)
+	}
+}
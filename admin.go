@@ -0,0 +1,79 @@
+package tcpf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// CloseTunnel closes the tunnel with the given ID, and reports whether the
+// realm has such a tunnel
+func (realm *TunnelRealm) CloseTunnel(id string) bool {
+	realm.tunnelsLock.RLock()
+	tunnel, ok := realm.tunnels[id]
+	realm.tunnelsLock.RUnlock()
+	if ok {
+		logEvent(LevelInfo, "kill", tunnel.fields(), "Closing tunnel on request: [%v]", tunnel)
+		tunnel.closeTunnel()
+	}
+	return ok
+}
+
+// adminTunnel is the JSON form of a tunnel in the admin API
+type adminTunnel struct {
+	ID       string  `json:"id"`
+	Realm    string  `json:"realm"`
+	Src      string  `json:"src"`
+	Dst      string  `json:"dst"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Age      float64 `json:"age"`
+}
+
+// AdminHandler returns an HTTP handler managing the tunnels of the realms:
+// GET /tunnels lists them as JSON, with their age in seconds, and
+// DELETE /tunnels/{id} closes one
+func AdminHandler(realms ...*TunnelRealm) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tunnels := []adminTunnel{}
+		for _, realm := range realms {
+			for _, info := range realm.Stats().Tunnels {
+				tunnels = append(tunnels, adminTunnel{
+					ID:       info.ID,
+					Realm:    realm.String(),
+					Src:      info.Src,
+					Dst:      info.Dst,
+					BytesIn:  info.BytesIn,
+					BytesOut: info.BytesOut,
+					Age:      info.Age.Seconds(),
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(tunnels)
+	})
+	mux.HandleFunc("/tunnels/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/tunnels/")
+		for _, realm := range realms {
+			if realm.CloseTunnel(id) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "no such tunnel", http.StatusNotFound)
+	})
+	return mux
+}
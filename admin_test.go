@@ -0,0 +1,74 @@
+package tcpf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	dst := startEcho(t)
+	realm, addr := startRealm(t, dst)
+	conn := dialRealm(t, addr)
+	converse(t, conn, []byte("hello"), []byte("hello"))
+	handler := AdminHandler(realm)
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	response := serve(http.MethodGet, "/tunnels")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /tunnels = %v with %v", response.Code, response.Header().Get("Content-Type"))
+	}
+	var tunnels []adminTunnel
+	if err := json.Unmarshal(response.Body.Bytes(), &tunnels); err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 {
+		t.Fatalf("listed %d tunnels, want 1", len(tunnels))
+	}
+	tunnel, info := tunnels[0], realm.Tunnels()[0]
+	if tunnel.ID != info.ID || tunnel.Realm != realm.String() || tunnel.Src != conn.LocalAddr().String() || tunnel.Dst != dst ||
+		tunnel.BytesIn > info.BytesIn || tunnel.BytesOut > info.BytesOut || tunnel.Age <= 0 {
+		t.Errorf("listed %+v, want %+v", tunnel, info)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{http.MethodPost, "/tunnels", http.StatusMethodNotAllowed, http.MethodGet},
+		{http.MethodDelete, "/tunnels", http.StatusMethodNotAllowed, http.MethodGet},
+		{http.MethodGet, "/tunnels/" + tunnel.ID, http.StatusMethodNotAllowed, http.MethodDelete},
+		{http.MethodDelete, "/tunnels/unknown", http.StatusNotFound, ""},
+		{http.MethodGet, "/realms", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			response := serve(test.method, test.path)
+			if response.Code != test.status || response.Header().Get("Allow") != test.allow {
+				t.Errorf("got %v allowing %q, want %v allowing %q", response.Code, response.Header().Get("Allow"), test.status, test.allow)
+			}
+		})
+	}
+	if n := realm.TunnelCount(); n != 1 {
+		t.Fatalf("%d tunnels open after the refused requests, want 1", n)
+	}
+
+	// Deleting the tunnel closes it
+	if response := serve(http.MethodDelete, "/tunnels/"+tunnel.ID); response.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /tunnels/%v = %v", tunnel.ID, response.Code)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a closed tunnel", n)
+	}
+	waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 0 })
+	if response := serve(http.MethodGet, "/tunnels"); response.Body.String() != "[]\n" {
+		t.Errorf("listed %q without tunnels", response.Body)
+	}
+}
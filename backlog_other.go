@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tcpf
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setBacklog is only available on Linux and BSDs
+func setBacklog(c syscall.RawConn, backlog int) error {
+	return errors.ErrUnsupported
+}
+
+func maxBacklog() int {
+	return 0
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tcpf
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setBacklog sets the backlog of the listening socket. ListenConfig.Control
+// runs before Go listens on the socket with the largest backlog the system
+// allows, but listening again on the socket replaces the backlog.
+func setBacklog(c syscall.RawConn, backlog int) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.Listen(int(fd), backlog)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// maxBacklog returns the backlog Linux caps the ones of listening sockets at,
+// net.core.somaxconn, or 0 if it isn't known
+func maxBacklog() int {
+	b, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
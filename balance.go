@@ -0,0 +1,299 @@
+package tcpf
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balance is the algorithm a TunnelRealm picks the destination of a new
+// tunnel with
+type Balance int
+
+const (
+	// BalanceRoundRobin picks the destinations in turn, proportionally to
+	// their weights
+	BalanceRoundRobin Balance = iota
+	// BalanceLeastConn picks the destination serving the fewest tunnels
+	// relative to its weight
+	BalanceLeastConn
+	// BalanceSticky picks the destination by consistent hashing of the
+	// client IP, so that a client keeps hitting the same destination
+	BalanceSticky
+)
+
+// Number of points every unit of weight puts a destination on the hash ring
+const ringReplicas = 100
+
+// ParseBalance returns the Balance named roundrobin, leastconn or sticky
+func ParseBalance(name string) (Balance, error) {
+	switch name {
+	case "roundrobin":
+		return BalanceRoundRobin, nil
+	case "leastconn":
+		return BalanceLeastConn, nil
+	case "sticky":
+		return BalanceSticky, nil
+	}
+	return 0, fmt.Errorf("unknown balance algorithm %q", name)
+}
+
+// destination is one of the addresses a TunnelRealm forwards traffic to,
+// along with its share of the tunnels
+type destination struct {
+	address string
+	weight  int
+	// current is the smooth weighted round-robin state of the destination
+	current int
+	// down is set by the health checker after failures consecutive failed
+	// checks, and cleared by the first successful one
+	down     bool
+	failures int
+	// Number of tunnels currently open to the destination
+	active int
+	// The circuit breaker is open until openUntil after dialFailures failed
+	// dials in a row, then half-open while the tunnel probing it dials
+	dialFailures int
+	openUntil    time.Time
+	probing      bool
+}
+
+func (dst *destination) String() string {
+	if dst.weight == 1 {
+		return dst.address
+	}
+	return dst.address + "=" + strconv.Itoa(dst.weight)
+}
+
+// ringPoint is a point of a destination on the consistent hash ring
+type ringPoint struct {
+	hash uint32
+	dst  *destination
+}
+
+// balancer distributes tunnels across destinations with the Balance
+// algorithm of the realm
+type balancer struct {
+	mutex        sync.Mutex
+	balance      Balance
+	destinations []*destination
+	// Rotates the ties between least loaded destinations
+	next int
+	// Points of the destinations sorted by hash, for BalanceSticky
+	ring []ringPoint
+}
+
+// splitDestinations parses a comma separated list of hosts sharing the same
+// port, each optionally with a weight as host=weight
+func splitDestinations(dstHost string, dstPort string, balance Balance) *balancer {
+	b := &balancer{balance: balance}
+	for _, host := range strings.Split(dstHost, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		weight := 1
+		if i := strings.LastIndex(host, "="); i >= 0 {
+			if n, err := strconv.Atoi(host[i+1:]); err == nil && n > 0 {
+				host, weight = host[:i], n
+			}
+		}
+		b.destinations = append(b.destinations, &destination{address: joinEndpoint(host, dstPort), weight: weight})
+	}
+	if balance == BalanceSticky {
+		b.buildRing()
+	}
+	return b
+}
+
+// buildRing places every destination on the hash ring at points derived
+// from its address only, so that adding or removing a destination moves
+// just the clients whose points it takes over or leaves
+func (b *balancer) buildRing() {
+	for _, dst := range b.destinations {
+		for i := 0; i < dst.weight*ringReplicas; i++ {
+			b.ring = append(b.ring, ringPoint{hash: hashString(dst.address + "#" + strconv.Itoa(i)), dst: dst})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+// hashString hashes the ring points and client IPs with FNV-1a, whose bits
+// are then mixed with the finalizer of MurmurHash3: FNV-1a alone hardly
+// spreads strings which differ in their last bytes, as the points of a
+// destination and the IPs of a subnet do
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+func (b *balancer) String() string {
+	names := make([]string, len(b.destinations))
+	for i, dst := range b.destinations {
+		names[i] = dst.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// candidates returns the destination addresses in the order they should be
+// tried for a new tunnel from client: the one picked by the balance algorithm
+// first, then the rest in turn as fallbacks. Destinations marked down are
+// skipped, unless all of them are down.
+func (b *balancer) candidates(client net.Addr) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.balance == BalanceSticky {
+		return b.sticky(client)
+	}
+	healthy := make([]*destination, 0, len(b.destinations))
+	for _, dst := range b.destinations {
+		if !dst.down {
+			healthy = append(healthy, dst)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = b.destinations
+	}
+	n := len(healthy)
+	if n == 0 {
+		return nil
+	}
+	var picked int
+	switch b.balance {
+	case BalanceLeastConn:
+		picked = b.leastLoaded(healthy)
+	default:
+		picked = b.smoothWeighted(healthy)
+	}
+	order := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, healthy[(picked+i)%n].address)
+	}
+	return order
+}
+
+// sticky returns the destinations in the order they follow each other on the
+// hash ring from the point of the client IP. A client whose destination is
+// down falls through to the next one on the ring, and returns to its own
+// destination once it is up again.
+func (b *balancer) sticky(client net.Addr) []string {
+	if len(b.ring) == 0 {
+		return nil
+	}
+	key := client.String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	hash := hashString(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+	var healthy, down []string
+	seen := make(map[*destination]bool, len(b.destinations))
+	for i := 0; i < len(b.ring) && len(seen) < len(b.destinations); i++ {
+		dst := b.ring[(start+i)%len(b.ring)].dst
+		if seen[dst] {
+			continue
+		}
+		seen[dst] = true
+		if dst.down {
+			down = append(down, dst.address)
+		} else {
+			healthy = append(healthy, dst.address)
+		}
+	}
+	if len(healthy) == 0 {
+		return down
+	}
+	return healthy
+}
+
+// smoothWeighted returns the index of the next destination picked by the
+// smooth weighted round-robin
+func (b *balancer) smoothWeighted(destinations []*destination) int {
+	picked, total := 0, 0
+	for i, dst := range destinations {
+		dst.current += dst.weight
+		total += dst.weight
+		if dst.current > destinations[picked].current {
+			picked = i
+		}
+	}
+	destinations[picked].current -= total
+	return picked
+}
+
+// leastLoaded returns the index of the destination with the fewest active
+// tunnels per unit of weight
+func (b *balancer) leastLoaded(destinations []*destination) int {
+	n := len(destinations)
+	b.next = (b.next + 1) % n
+	picked := b.next
+	for i := 1; i < n; i++ {
+		j := (b.next + i) % n
+		// active/weight < picked.active/picked.weight, without division
+		if destinations[j].active*destinations[picked].weight < destinations[picked].active*destinations[j].weight {
+			picked = j
+		}
+	}
+	return picked
+}
+
+// acquire records a tunnel opened to the destination address, release one
+// closed; addresses which aren't the realm's destinations are ignored
+func (b *balancer) acquire(address string) {
+	b.add(address, 1)
+}
+
+func (b *balancer) release(address string) {
+	b.add(address, -1)
+}
+
+func (b *balancer) add(address string, delta int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if dst := b.find(address); dst != nil {
+		dst.active += delta
+	}
+}
+
+// connect opens a tunnel for conn to the first of the destination addresses
+// which can be dialed, falling back to the backup destination if none can.
+// Destinations whose circuit breaker is open are skipped without dialing.
+// The ports dialed are moved by offset, for realms listening on port ranges.
+func (realm *TunnelRealm) connect(conn net.Conn, addresses []string, backup bool, offset int) (*TCPTunnel, error) {
+	if backup && realm.backup != "" {
+		addresses = append(addresses, realm.backup)
+	}
+	var err error
+	for i, address := range addresses {
+		var tunnel *TCPTunnel
+		if realm.breakerFailures > 0 && !realm.destinations.allow(address) {
+			err = fmt.Errorf("circuit breaker of destination %v is open", address)
+			continue
+		}
+		tunnel, err = newTCPTunnel(realm.ctx, conn, realm, address, offset)
+		if realm.breakerFailures > 0 {
+			realm.destinations.dialed(address, err, realm.breakerFailures, realm.breakerCooldown)
+		}
+		if err == nil {
+			if backup && address == realm.backup {
+				logEvent(LevelWarn, "failover", Fields{"src": conn.RemoteAddr(), "dst": address}, "Tunnel for %v failed over to backup destination %v", conn.RemoteAddr(), address)
+			}
+			return tunnel, nil
+		}
+		if i < len(addresses)-1 {
+			logEvent(LevelWarn, "dial_error", Fields{"src": conn.RemoteAddr(), "dst": address, "error": err}, "Can't open tunnel for %v, trying next destination: %v", conn.RemoteAddr(), err)
+		}
+	}
+	return nil, err
+}
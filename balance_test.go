@@ -0,0 +1,338 @@
+package tcpf
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEchoes runs echo servers on the same free port of the loopback
+// addresses, counting the connections each of them accepts, and returns the
+// port. The test is skipped where the loopback interface has only 127.0.0.1.
+func startEchoes(t *testing.T, ips ...string) (string, []*atomic.Int64) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes all of 127.0.0.0/8 to the loopback interface")
+	}
+	var port string
+	counts := make([]*atomic.Int64, len(ips))
+	for i, ip := range ips {
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("can't listen on %v: %v", ip, err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+		accepted := &atomic.Int64{}
+		counts[i] = accepted
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				accepted.Add(1)
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+	}
+	return port, counts
+}
+
+// picks returns how many times each destination comes first in n calls of
+// candidates
+func picks(b *balancer, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[b.candidates(nil)[0]]++
+	}
+	return counts
+}
+
+func TestBackup(t *testing.T) {
+	backup, backupConns := startCountingEcho(t)
+	// Without a destination to dial, the tunnels fail over to the backup
+	_, addr := startRealm(t, closedPort(t), WithBackup(backup))
+	msg := []byte("failed over")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+	if n := backupConns.Load(); n != 1 {
+		t.Errorf("backup accepted %d connections, want 1", n)
+	}
+	// which isn't dialed as long as the destination can be
+	dst, dstConns := startCountingEcho(t)
+	_, addr = startRealm(t, dst, WithBackup(backup))
+	roundTrip(t, addr, msg)
+	if n := backupConns.Load(); n != 1 || dstConns.Load() != 1 {
+		t.Errorf("backup accepted %d and destination %d connections, want 1 and 1", n, dstConns.Load())
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	b := splitDestinations("a=3, b,c=2,bad=0", "80", BalanceRoundRobin)
+	if got := b.String(); got != "a:80=3,b:80,c:80=2,bad=0:80" {
+		t.Errorf("destinations are %v", got)
+	}
+	counts := picks(b, 14)
+	if counts["a:80"] != 6 || counts["b:80"] != 2 || counts["c:80"] != 4 || counts["bad=0:80"] != 2 {
+		t.Errorf("picked %v in 14 tunnels, want 6, 2, 4 and 2", counts)
+	}
+	// The other destinations follow the one picked, to fall back on
+	if candidates := b.candidates(nil); len(candidates) != 4 {
+		t.Errorf("candidates are %v, want all 4 destinations", candidates)
+	}
+	// Smooth round-robin spreads the picks of a heavy destination, rather
+	// than picking it several times in a row
+	b = splitDestinations("a=2,b", "80", BalanceRoundRobin)
+	var order string
+	for i := 0; i < 6; i++ {
+		order += b.candidates(nil)[0][:1]
+	}
+	if order != "abaaba" {
+		t.Errorf("picked %v, want abaaba", order)
+	}
+}
+
+func TestWeightedRealm(t *testing.T) {
+	port, counts := startEchoes(t, "127.0.0.1", "127.0.0.2")
+	_, addr := startRealm(t, net.JoinHostPort("127.0.0.1=2,127.0.0.2", port))
+	for i := 0; i < 6; i++ {
+		roundTrip(t, addr, []byte(strconv.Itoa(i)))
+	}
+	if counts[0].Load() != 4 || counts[1].Load() != 2 {
+		t.Errorf("destinations accepted %d and %d of 6 tunnels, want 4 and 2", counts[0].Load(), counts[1].Load())
+	}
+}
+
+func TestHealthReport(t *testing.T) {
+	b := splitDestinations("a,b", "80", BalanceRoundRobin)
+	a := b.destinations[0]
+	// A destination is down after the threshold of failed checks in a row,
+	// and up again after one successful check
+	for i, err := range []error{io.EOF, nil, io.EOF, io.EOF} {
+		b.report(a, err, 2)
+		if down := i == 3; a.down != down {
+			t.Fatalf("down is %v after check %d", a.down, i+1)
+		}
+	}
+	if candidates := b.candidates(nil); len(candidates) != 1 || candidates[0] != "b:80" {
+		t.Errorf("candidates are %v with a:80 down", candidates)
+	}
+	b.report(b.destinations[1], io.EOF, 1)
+	// With all of them down, they are all tried anyway
+	if candidates := b.candidates(nil); len(candidates) != 2 {
+		t.Errorf("candidates are %v with all destinations down", candidates)
+	}
+	b.report(a, nil, 2)
+	if health := b.health(); !health["a:80"] || health["b:80"] {
+		t.Errorf("health is %v", health)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	port, _ := startEchoes(t, "127.0.0.1")
+	realm, addr := startRealm(t, net.JoinHostPort("127.0.0.1,127.0.0.2", port), WithHealthCheck(20*time.Millisecond, 2))
+	down := net.JoinHostPort("127.0.0.2", port)
+	waitFor(t, down+" to be down", func() bool { return !realm.DestinationHealth()[down] })
+	// The tunnels skip the destination down without dialing it
+	dialErrors := realm.Stats().DialErrors
+	for i := 0; i < 4; i++ {
+		roundTrip(t, addr, []byte(strconv.Itoa(i)))
+	}
+	if n := realm.Stats().DialErrors - dialErrors; n != 0 {
+		t.Errorf("%d dials failed with %v down", n, down)
+	}
+	if !realm.Ready() {
+		t.Error("realm with a destination up isn't ready")
+	}
+	// The destination is up again once it accepts connections
+	listener, err := net.Listen("tcp", down)
+	if err != nil {
+		t.Skipf("can't listen on %v: %v", down, err)
+	}
+	defer listener.Close()
+	waitFor(t, down+" to be up", func() bool { return realm.DestinationHealth()[down] })
+
+	// A realm whose destinations are all down isn't ready
+	realm, _ = startRealm(t, closedPort(t), WithHealthCheck(20*time.Millisecond, 1))
+	waitFor(t, "the realm not to be ready", func() bool { return !realm.Ready() })
+}
+
+func TestLeastConn(t *testing.T) {
+	b := splitDestinations("a,b=2,c", "80", BalanceLeastConn)
+	for _, address := range []string{"a:80", "a:80", "b:80", "b:80", "b:80", "c:80", "c:80"} {
+		b.acquire(address)
+	}
+	// b with its weight of 2 has fewer tunnels per unit of weight than the
+	// others
+	if picked := b.candidates(nil)[0]; picked != "b:80" {
+		t.Errorf("picked %v, want the least loaded b:80", picked)
+	}
+	b.acquire("b:80")
+	// Ties, with two tunnels per unit of weight for all, are picked in turn
+	counts := picks(b, 6)
+	if counts["a:80"] != 2 || counts["b:80"] != 2 || counts["c:80"] != 2 {
+		t.Errorf("picked %v, want all the destinations in turn", counts)
+	}
+	b.release("a:80")
+	b.release("a:80")
+	if picked := b.candidates(nil)[0]; picked != "a:80" {
+		t.Errorf("picked %v, want a:80 without tunnels", picked)
+	}
+	// Addresses of other destinations, e.g. the backup, are ignored
+	b.acquire("backup:80")
+	if picked := b.candidates(nil)[0]; picked != "a:80" {
+		t.Errorf("picked %v after a tunnel to the backup, want a:80", picked)
+	}
+}
+
+func TestLeastConnRealm(t *testing.T) {
+	port, counts := startEchoes(t, "127.0.0.1", "127.0.0.2")
+	realm, addr := startRealm(t, net.JoinHostPort("127.0.0.1,127.0.0.2", port), WithBalance(BalanceLeastConn))
+	// While a tunnel stays open to one destination, the new ones go to the
+	// other, which is left with none each time
+	held := dialRealm(t, addr)
+	held.Write([]byte("x"))
+	held.Read(make([]byte, 1))
+	for i := 0; i < 3; i++ {
+		roundTrip(t, addr, []byte(strconv.Itoa(i)))
+		waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 1 })
+	}
+	if n0, n1 := counts[0].Load(), counts[1].Load(); n0+n1 != 4 || min(n0, n1) != 1 {
+		t.Errorf("destinations accepted %d and %d tunnels, want 1 and 3", n0, n1)
+	}
+}
+
+// stickyClients returns the destination candidates(client)[0] picks for
+// each of n client IPs
+func stickyClients(b *balancer, n int) map[string]string {
+	picked := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String()
+		picked[ip] = b.candidates(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1024 + i})[0]
+	}
+	return picked
+}
+
+func TestSticky(t *testing.T) {
+	b := splitDestinations("a,b,c", "80", BalanceSticky)
+	picked := stickyClients(b, 3000)
+	// A client keeps the same destination whatever its port, and the
+	// clients spread evenly
+	counts := make(map[string]int)
+	for ip, dst := range picked {
+		for _, port := range []int{1, 40000} {
+			if again := b.candidates(&net.TCPAddr{IP: net.ParseIP(ip), Port: port})[0]; again != dst {
+				t.Fatalf("client %v went to %v, then to %v", ip, dst, again)
+			}
+		}
+		counts[dst]++
+	}
+	for _, address := range []string{"a:80", "b:80", "c:80"} {
+		if n := counts[address]; n < 700 || n > 1300 {
+			t.Errorf("%v got %d of 3000 clients, want about 1000", address, n)
+		}
+	}
+	// Every client has all the destinations to fall back to, its own first
+	if candidates := b.candidates(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}); len(candidates) != 3 || candidates[0] != picked["10.0.0.1"] {
+		t.Errorf("candidates are %v", candidates)
+	}
+
+	// Adding a destination only moves the clients it takes over
+	added := stickyClients(splitDestinations("a,b,c,d", "80", BalanceSticky), 3000)
+	moved := 0
+	for ip, dst := range added {
+		if dst != picked[ip] {
+			moved++
+			if dst != "d:80" {
+				t.Fatalf("client %v moved from %v to %v, not to the new destination", ip, picked[ip], dst)
+			}
+		}
+	}
+	if moved < 450 || moved > 1050 {
+		t.Errorf("%d of 3000 clients moved to the new destination, want about 750", moved)
+	}
+
+	// A weight of 2 takes about twice the share
+	counts = make(map[string]int)
+	for _, dst := range stickyClients(splitDestinations("a=2,b", "80", BalanceSticky), 3000) {
+		counts[dst]++
+	}
+	if n := counts["a:80"]; n < 1700 || n > 2300 {
+		t.Errorf("a:80 with a weight of 2 got %d of 3000 clients, want about 2000", n)
+	}
+}
+
+func TestStickyDown(t *testing.T) {
+	b := splitDestinations("a,b,c", "80", BalanceSticky)
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	order := b.candidates(client)
+	others := stickyClients(b, 300)
+	// The clients of a destination down fall through to the next one on
+	// the ring, while the others stay where they are
+	b.report(b.find(order[0]), io.EOF, 1)
+	if candidates := b.candidates(client); len(candidates) != 2 || candidates[0] != order[1] || candidates[1] != order[2] {
+		t.Errorf("candidates are %v with %v down, want %v", candidates, order[0], order[1:])
+	}
+	for ip, dst := range stickyClients(b, 300) {
+		if others[ip] != order[0] && dst != others[ip] {
+			t.Fatalf("client %v moved from %v to %v", ip, others[ip], dst)
+		}
+	}
+	// and they come back once it is up
+	b.report(b.find(order[0]), nil, 1)
+	if picked := b.candidates(client)[0]; picked != order[0] {
+		t.Errorf("picked %v once %v is up again", picked, order[0])
+	}
+	// With all of them down, they are all tried anyway in the ring order
+	for _, dst := range b.destinations {
+		b.report(dst, io.EOF, 1)
+	}
+	if candidates := b.candidates(client); strings.Join(candidates, ",") != strings.Join(order, ",") {
+		t.Errorf("candidates are %v with all destinations down, want %v", candidates, order)
+	}
+}
+
+func TestStickyRealm(t *testing.T) {
+	port, counts := startEchoes(t, "127.0.0.1", "127.0.0.2")
+	// 127.0.0.3 refuses the connections
+	realm, addr := startRealm(t, net.JoinHostPort("127.0.0.1,127.0.0.2,127.0.0.3", port), WithBalance(BalanceSticky))
+	refusing := net.JoinHostPort("127.0.0.3", port)
+	for _, ip := range []string{"127.0.0.10", "127.0.0.11", "127.0.0.12", "127.0.0.13", "127.0.0.14", "127.0.0.15"} {
+		candidates := realm.destinations.candidates(&net.TCPAddr{IP: net.ParseIP(ip)})
+		want := candidates[0]
+		if want == refusing {
+			want = candidates[1]
+		}
+		before := []int64{counts[0].Load(), counts[1].Load()}
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}, Timeout: time.Second}
+		for i := 0; i < 3; i++ {
+			conn, err := dialer.Dial("tcp", addr)
+			if err != nil {
+				t.Skipf("can't dial from %v: %v", ip, err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			converse(t, conn, []byte("sticky"), []byte("sticky"))
+			conn.Close()
+		}
+		// Every tunnel of the client went to its destination, or to the
+		// next one on the ring if it refused
+		i := 0
+		if want == net.JoinHostPort("127.0.0.2", port) {
+			i = 1
+		}
+		if n := counts[i].Load() - before[i]; n != 3 {
+			t.Errorf("%d of the 3 tunnels from %v went to %v", n, ip, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tcpf
+
+import (
+	"time"
+)
+
+// allow tells whether a tunnel may dial the destination address, which it
+// may not while the circuit breaker of the destination is open. Once the
+// cooldown of an open breaker is over, a single tunnel at a time is let
+// through to probe the destination. Addresses which are not among the
+// destinations, e.g. the backup, are always allowed.
+func (b *balancer) allow(address string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	dst := b.find(address)
+	if dst == nil || dst.openUntil.IsZero() {
+		return true
+	}
+	if dst.probing || time.Now().Before(dst.openUntil) {
+		return false
+	}
+	dst.probing = true
+	return true
+}
+
+// dialed records the result of dialing the destination address, opening its
+// circuit breaker for cooldown after threshold failures in a row or after a
+// failed probe, and closing it after a successful dial
+func (b *balancer) dialed(address string, err error, threshold int, cooldown time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	dst := b.find(address)
+	if dst == nil {
+		return
+	}
+	if err == nil {
+		if !dst.openUntil.IsZero() {
+			logEvent(LevelInfo, "breaker_close", Fields{"dst": address}, "Circuit breaker of destination %v is closed", address)
+		}
+		dst.dialFailures, dst.openUntil, dst.probing = 0, time.Time{}, false
+		return
+	}
+	dst.dialFailures++
+	if dst.probing || (dst.openUntil.IsZero() && dst.dialFailures >= threshold) {
+		logEvent(LevelWarn, "breaker_open", Fields{"dst": address, "failures": dst.dialFailures, "error": err}, "Circuit breaker of destination %v is open for %v after %d failed dials: %v", address, cooldown, dst.dialFailures, err)
+		dst.openUntil, dst.probing = time.Now().Add(cooldown), false
+	}
+}
+
+// breakers returns whether the circuit breaker of each destination is open
+func (b *balancer) breakers() map[string]bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	breakers := make(map[string]bool, len(b.destinations))
+	for _, dst := range b.destinations {
+		breakers[dst.address] = !dst.openUntil.IsZero()
+	}
+	return breakers
+}
+
+// find returns the destination with the address, or nil if there is none
+func (b *balancer) find(address string) *destination {
+	for _, dst := range b.destinations {
+		if dst.address == address {
+			return dst
+		}
+	}
+	return nil
+}
+
+// DestinationBreakers returns whether the circuit breaker of each of the
+// realm's destination addresses is open, so new tunnels fail fast instead of
+// dialing it, or nil unless circuit breakers are enabled with
+// WithCircuitBreaker
+func (realm *TunnelRealm) DestinationBreakers() map[string]bool {
+	if realm.breakerFailures == 0 {
+		return nil
+	}
+	return realm.destinations.breakers()
+}
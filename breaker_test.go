@@ -0,0 +1,133 @@
+package tcpf
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := splitDestinations("a", "80", BalanceRoundRobin)
+	// The breaker opens after the threshold of failed dials in a row
+	for i := 0; i < 3; i++ {
+		if !b.allow("a:80") {
+			t.Fatalf("dial %d not allowed", i+1)
+		}
+		b.dialed("a:80", io.EOF, 3, 50*time.Millisecond)
+	}
+	if b.allow("a:80") {
+		t.Fatal("dial allowed with the breaker open")
+	}
+	// After the cooldown a single probe goes through, and its failure opens
+	// the breaker again
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow("a:80") || b.allow("a:80") {
+		t.Fatal("not a single probe allowed after the cooldown")
+	}
+	b.dialed("a:80", io.EOF, 3, 50*time.Millisecond)
+	if b.allow("a:80") {
+		t.Fatal("dial allowed after a failed probe")
+	}
+	// A successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	b.allow("a:80")
+	b.dialed("a:80", nil, 3, 50*time.Millisecond)
+	if !b.allow("a:80") || !b.allow("a:80") || b.breakers()["a:80"] {
+		t.Error("breaker still open after a successful probe")
+	}
+	// Other addresses, e.g. the backup, have no breaker
+	b.dialed("backup:80", io.EOF, 1, time.Minute)
+	if !b.allow("backup:80") {
+		t.Error("dial to the backup not allowed")
+	}
+}
+
+func TestCircuitBreakerRealm(t *testing.T) {
+	dst := closedPort(t)
+	realm, addr := startRealm(t, dst, WithCircuitBreaker(2, 100*time.Millisecond))
+	refused := func() {
+		t.Helper()
+		conn := dialRealm(t, addr)
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes from a tunnel to a closed port", n)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		refused()
+	}
+	waitFor(t, "the breaker to open", func() bool { return realm.DestinationBreakers()[dst] })
+	// Meanwhile tunnels fail without dialing the destination
+	dialErrors := realm.Stats().DialErrors
+	refused()
+	if n := realm.Stats().DialErrors - dialErrors; n != 0 {
+		t.Errorf("%d dials with the breaker open", n)
+	}
+
+	listener, err := net.Listen("tcp", dst)
+	if err != nil {
+		t.Skipf("can't listen on the closed port again: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// The tunnel probing the destination after the cooldown closes the
+	// breaker
+	time.Sleep(150 * time.Millisecond)
+	if reply := roundTrip(t, addr, []byte("probe")); string(reply) != "probe" {
+		t.Errorf("got %q back, want %q", reply, "probe")
+	}
+	if realm.DestinationBreakers()[dst] {
+		t.Error("breaker still open after a successful probe")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	dst := closedPort(t)
+	// Retries of a tunnel count as a single failure
+	realm, addr := startRealm(t, dst, WithCircuitBreaker(2, 100*time.Millisecond), WithDialRetries(2, 10*time.Millisecond))
+	refused := func() {
+		t.Helper()
+		conn := dialRealm(t, addr)
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes from a tunnel to a closed port", n)
+		}
+	}
+	refused()
+	if realm.DestinationBreakers()[dst] {
+		t.Fatal("breaker open after a single tunnel failed")
+	}
+	if n := realm.Stats().DialErrors; n != 3 {
+		t.Errorf("%d dial errors, want a dial and 2 retries", n)
+	}
+	refused()
+	if !realm.DestinationBreakers()[dst] {
+		t.Fatal("breaker closed after 2 tunnels failed")
+	}
+
+	// Every cooldown lets a single tunnel probe the destination, which still
+	// refuses, so the breaker opens again
+	for round := 0; round < 2; round++ {
+		time.Sleep(150 * time.Millisecond)
+		dialErrors := realm.Stats().DialErrors
+		for i := 0; i < 3; i++ {
+			refused()
+		}
+		if n := realm.Stats().DialErrors - dialErrors; n != 3 {
+			t.Errorf("%d dials after the cooldown, want those of the probe alone", n)
+		}
+		if !realm.DestinationBreakers()[dst] {
+			t.Error("breaker closed after a failed probe")
+		}
+	}
+}
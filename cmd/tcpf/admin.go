@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/baburkin/tcpf"
+)
+
+// Largest request body the admin API reads
+const maxAdminBody = 1 << 20
+
+// adminHandler serves the admin API of tcpf: the tunnels of tcpf.AdminHandler
+// along with the realms of the forwarding rules. GET /realms lists the realms
+// as JSON, POST /realms starts a realm for the rule in the body, in the form
+// of the rules of a -config file, and DELETE /realms/{id} stops one, closing
+// its tunnels. POST /realms/{id}/pause and /realms/{id}/resume pause and
+// resume a TCP realm. Realms are only kept in memory, so a reload of -config
+// replaces the ones added.
+func adminHandler(s *servers) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.infos())
+		case http.MethodPost:
+			var rule Rule
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&rule); err != nil {
+				http.Error(w, "invalid rule: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := rule.validate(); err != nil {
+				http.Error(w, "invalid rule: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// The same rule given with or without the default protocol is one rule
+			rule.Proto = rule.protocol()
+			id, err := s.add(rule)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			for _, info := range s.infos() {
+				if info.ID == id {
+					writeJSON(w, http.StatusCreated, info)
+					return
+				}
+			}
+			// The realm has stopped right away
+			http.Error(w, "realm stopped right after starting, see the log", http.StatusInternalServerError)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/realms/", func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/realms/"), "/")
+		switch action {
+		case "":
+			if r.Method != http.MethodDelete {
+				w.Header().Set("Allow", http.MethodDelete)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if !s.remove(id) {
+				http.Error(w, "no such realm", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "pause", "resume":
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			found := s.find(id)
+			if found == nil {
+				http.Error(w, "no such realm", http.StatusNotFound)
+				return
+			}
+			tunnelRealm, ok := found.(*tcpf.TunnelRealm)
+			if !ok {
+				http.Error(w, "only TCP realms can be paused", http.StatusBadRequest)
+				return
+			}
+			if action == "pause" {
+				tunnelRealm.Pause()
+			} else {
+				tunnelRealm.Resume()
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	// The realms change, so the tunnels handler looks them up every time
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		tcpf.AdminHandler(s.tunnelRealms()...).ServeHTTP(w, r)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baburkin/tcpf"
+)
+
+// freePort returns a port of the loopback interface nothing listens on
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func TestAdminHandler(t *testing.T) {
+	tcpf.SetLogger(tcpf.NewJSONLogger(io.Discard))
+	logger = tcpf.NewJSONLogger(io.Discard)
+	s := newServers(func(rule Rule) realm { return newRealm(rule, nil, nil) })
+	defer s.shutdown(time.Second)
+	admin, health := adminHandler(s), tcpf.HealthHandler(s.ready)
+	serve := func(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+	listRealms := func() []realmInfo {
+		t.Helper()
+		var infos []realmInfo
+		if err := json.Unmarshal(serve(admin, http.MethodGet, "/realms", "").Body.Bytes(), &infos); err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+	if response := serve(health, http.MethodGet, "/readyz", ""); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %v without rules", response.Code)
+	}
+
+	port, dstPort := freePort(t), freePort(t)
+	tcpRule := `{"bind": "127.0.0.1", "port": "` + port + `", "dstHost": "127.0.0.1", "dstPort": "` + dstPort + `"}`
+	udpRule := `{"proto": "udp", "bind": "127.0.0.1", "port": "` + freePort(t) + `", "dstHost": "127.0.0.1", "dstPort": "` + dstPort + `"}`
+	for _, rule := range []string{tcpRule, udpRule} {
+		response := serve(admin, http.MethodPost, "/realms", rule)
+		var info realmInfo
+		if err := json.Unmarshal(response.Body.Bytes(), &info); response.Code != http.StatusCreated || err != nil {
+			t.Fatalf("POST /realms = %v %q", response.Code, response.Body)
+		}
+	}
+	infos := listRealms()
+	if len(infos) != 2 || infos[0].ID != "1" || infos[0].Rule.Port != port || infos[1].ID != "2" || infos[1].Rule.Proto != "udp" {
+		t.Fatalf("GET /realms = %+v, want the TCP and the UDP realm", infos)
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("timed out waiting for %v", what)
+			}
+		}
+	}
+	waitFor("the realms to be ready", func() bool {
+		return serve(health, http.MethodGet, "/readyz", "").Code == http.StatusOK
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		allow  string
+	}{
+		{http.MethodPost, "/realms", tcpRule, http.StatusConflict, ""},
+		{http.MethodPost, "/realms", "{", http.StatusBadRequest, ""},
+		{http.MethodPost, "/realms", `{"bind": "127.0.0.1", "port": "1", "unknown": true}`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/realms", `{"proto": "sctp", "bind": "127.0.0.1", "port": "1", "dstHost": "127.0.0.1", "dstPort": "1"}`, http.StatusBadRequest, ""},
+		{http.MethodPut, "/realms", tcpRule, http.StatusMethodNotAllowed, "GET, POST"},
+		{http.MethodGet, "/realms/1", "", http.StatusMethodNotAllowed, http.MethodDelete},
+		{http.MethodDelete, "/realms/3", "", http.StatusNotFound, ""},
+		{http.MethodGet, "/realms/1/pause", "", http.StatusMethodNotAllowed, http.MethodPost},
+		{http.MethodGet, "/realms/1/resume", "", http.StatusMethodNotAllowed, http.MethodPost},
+		{http.MethodPost, "/realms/3/pause", "", http.StatusNotFound, ""},
+		{http.MethodPost, "/realms/2/pause", "", http.StatusBadRequest, ""},
+		{http.MethodPost, "/realms/1/restart", "", http.StatusNotFound, ""},
+		// The tunnels are those of tcpf.AdminHandler
+		{http.MethodPost, "/tunnels", "", http.StatusMethodNotAllowed, http.MethodGet},
+		{http.MethodDelete, "/tunnels/unknown", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			response := serve(admin, test.method, test.path, test.body)
+			if response.Code != test.status || response.Header().Get("Allow") != test.allow {
+				t.Errorf("got %v %q allowing %q, want %v allowing %q", response.Code, response.Body, response.Header().Get("Allow"), test.status, test.allow)
+			}
+		})
+	}
+	if infos := listRealms(); len(infos) != 2 || infos[0].Paused {
+		t.Fatalf("GET /realms = %+v after the refused requests", infos)
+	}
+	if response := serve(admin, http.MethodGet, "/tunnels", ""); response.Code != http.StatusOK || response.Body.String() != "[]\n" {
+		t.Errorf("GET /tunnels = %v %q", response.Code, response.Body)
+	}
+
+	// A paused realm keeps listening, but closes the connections it accepts
+	// and isn't ready until it is resumed
+	if response := serve(admin, http.MethodPost, "/realms/1/pause", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("POST /realms/1/pause = %v %q", response.Code, response.Body)
+	}
+	if infos := listRealms(); !infos[0].Paused || infos[0].Ready || infos[1].Paused {
+		t.Errorf("GET /realms = %+v, want the TCP realm paused", infos)
+	}
+	response := serve(health, http.MethodGet, "/readyz", "")
+	if response.Code != http.StatusServiceUnavailable || !strings.Contains(response.Body.String(), infos[0].Realm) {
+		t.Errorf("/readyz = %v %q while paused, want the paused realm not ready", response.Code, response.Body)
+	}
+	if response := serve(health, http.MethodGet, "/healthz", ""); response.Code != http.StatusOK {
+		t.Errorf("/healthz = %v while paused", response.Code)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("paused realm doesn't listen: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a paused realm", n)
+	}
+	conn.Close()
+	if response := serve(admin, http.MethodPost, "/realms/1/resume", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("POST /realms/1/resume = %v %q", response.Code, response.Body)
+	}
+	if infos := listRealms(); infos[0].Paused || !infos[0].Ready {
+		t.Errorf("GET /realms = %+v, want the TCP realm resumed", infos)
+	}
+	if response := serve(health, http.MethodGet, "/readyz", ""); response.Code != http.StatusOK {
+		t.Errorf("/readyz = %v %q after resuming", response.Code, response.Body)
+	}
+
+	// Deleting a realm stops it and frees its port
+	if response := serve(admin, http.MethodDelete, "/realms/1", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /realms/1 = %v %q", response.Code, response.Body)
+	}
+	if infos := listRealms(); len(infos) != 1 || infos[0].ID != "2" {
+		t.Errorf("GET /realms = %+v after deleting realm 1", infos)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("port of the deleted realm is still bound: %v", err)
+	}
+	listener.Close()
+	if response := serve(admin, http.MethodDelete, "/realms/1", ""); response.Code != http.StatusNotFound {
+		t.Errorf("second DELETE /realms/1 = %v", response.Code)
+	}
+}
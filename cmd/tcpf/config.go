@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/baburkin/tcpf"
+)
+
+// Rule describes a single forwarding rule: protocol, local bind interface
+// and port and the destination IP/hostname and port the traffic is forwarded to
+type Rule struct {
+	Proto   string `json:"proto,omitempty"`
+	Bind    string `json:"bind"`
+	Port    string `json:"port"`
+	DstHost string `json:"dstHost,omitempty"`
+	DstPort string `json:"dstPort,omitempty"`
+	// Mode is set for proxy modes in which clients choose the destination
+	Mode string `json:"mode,omitempty"`
+	// Reverse is the host:port of the control server to accept connections
+	// from instead of listening on Bind and Port
+	Reverse string `json:"reverse,omitempty"`
+}
+
+// Proxy modes of a rule
+const (
+	modeSOCKS5      = "socks5"
+	modeHTTPConnect = "http-connect"
+	modeMuxServer   = "mux-server"
+)
+
+// Config is the content of a configuration file passed with -config
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+func (rule Rule) String() string {
+	if rule.Reverse != "" {
+		return fmt.Sprintf("%v reverse %v => %v", rule.protocol(), rule.Reverse, endpoint(rule.DstHost, rule.DstPort))
+	}
+	if rule.Mode != "" {
+		return fmt.Sprintf("%v %v => %v", rule.protocol(), rule.listens(), rule.Mode)
+	}
+	return fmt.Sprintf("%v %v => %v", rule.protocol(), rule.listens(), endpoint(rule.DstHost, rule.DstPort))
+}
+
+// binds returns the addresses of the comma separated Bind
+func (rule Rule) binds() []string {
+	binds := strings.Split(rule.Bind, ",")
+	for i := range binds {
+		binds[i] = strings.TrimSpace(binds[i])
+	}
+	return binds
+}
+
+// listens returns the comma separated endpoints the rule listens on
+func (rule Rule) listens() string {
+	var endpoints []string
+	for _, bind := range rule.binds() {
+		endpoints = append(endpoints, endpoint(bind, rule.Port))
+	}
+	return strings.Join(endpoints, ",")
+}
+
+// endpoint returns the address of host:port, or host itself if it is a Unix
+// socket given in the form of unix:/path/to.sock
+func endpoint(host string, port string) string {
+	if isUnix(host) {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func isUnix(host string) bool {
+	return strings.HasPrefix(host, "unix:")
+}
+
+// protocol returns the rule's protocol, which is TCP unless specified
+func (rule Rule) protocol() string {
+	if rule.Proto == "" {
+		return "tcp"
+	}
+	return rule.Proto
+}
+
+func (rule Rule) validate() error {
+	if proto := rule.protocol(); proto != "tcp" && proto != "udp" {
+		return fmt.Errorf("unsupported protocol: %q", rule.Proto)
+	}
+	binds := rule.binds()
+	if len(binds) > 1 && rule.protocol() != "tcp" {
+		return fmt.Errorf("only TCP rules can listen on several addresses")
+	}
+	if (isUnix(rule.Bind) || isUnix(rule.DstHost)) && rule.protocol() != "tcp" {
+		return fmt.Errorf("only TCP can be forwarded over Unix sockets")
+	}
+	needsPort := false
+	for _, bind := range binds {
+		if !isUnix(bind) {
+			needsPort = true
+		}
+	}
+	if rule.Reverse != "" {
+		if rule.protocol() != "tcp" || rule.Mode != "" {
+			return fmt.Errorf("reverse tunnels only forward TCP to fixed destinations")
+		}
+		if _, port, err := net.SplitHostPort(rule.Reverse); err != nil || !validPort(port) {
+			return fmt.Errorf("invalid control server address %q, expected host:port", rule.Reverse)
+		}
+	} else if _, _, ok := tcpf.ParsePortRange(rule.Port); needsPort && !ok {
+		return fmt.Errorf("invalid or missing local port or port range: %q", rule.Port)
+	}
+	first, last, _ := tcpf.ParsePortRange(rule.Port)
+	ranged := rule.Reverse == "" && first < last
+	if ranged && rule.protocol() != "tcp" {
+		return fmt.Errorf("only TCP rules can listen on port ranges")
+	}
+	switch rule.Mode {
+	case "":
+	case modeSOCKS5, modeHTTPConnect, modeMuxServer:
+		if rule.protocol() != "tcp" {
+			return fmt.Errorf("%v mode requires TCP", rule.Mode)
+		}
+		// The destination is chosen by clients
+		return nil
+	default:
+		return fmt.Errorf("unsupported mode: %q", rule.Mode)
+	}
+	if rule.DstHost == "" {
+		return fmt.Errorf("missing destination host")
+	}
+	if isUnix(rule.DstHost) {
+		return nil
+	}
+	dstFirst, dstLast, ok := tcpf.ParsePortRange(rule.DstPort)
+	if !ok || dstFirst < dstLast && !ranged {
+		return fmt.Errorf("invalid or missing destination port: %q", rule.DstPort)
+	}
+	if ranged && dstFirst < dstLast && dstLast-dstFirst != last-first {
+		return fmt.Errorf("destination port range %v is not as long as local port range %v", rule.DstPort, rule.Port)
+	}
+	if ranged && dstFirst+last-first > 65535 {
+		return fmt.Errorf("local port range %v shifted to destination port %v goes past port 65535", rule.Port, rule.DstPort)
+	}
+	return nil
+}
+
+// ports returns every port of the rule's local port range
+func (rule Rule) ports() []string {
+	first, last, ok := tcpf.ParsePortRange(rule.Port)
+	if !ok {
+		return []string{rule.Port}
+	}
+	var ports []string
+	for port := first; port <= last; port++ {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return ports
+}
+
+// check tells whether the rule can be served by binding its listeners for a
+// moment. Unix sockets left by a running tcpf are fine, as they are replaced,
+// and reverse rules don't listen at all.
+func (rule Rule) check() error {
+	if rule.Reverse != "" {
+		return nil
+	}
+	for _, bind := range rule.binds() {
+		ports := rule.ports()
+		if isUnix(bind) {
+			ports = ports[:1]
+		}
+		for _, port := range ports {
+			if err := rule.checkBind(bind, port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rule Rule) checkBind(bind string, port string) error {
+	switch {
+	case rule.protocol() == "udp":
+		conn, err := net.ListenPacket("udp", endpoint(bind, port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case isUnix(bind):
+		path := strings.TrimPrefix(bind, "unix:")
+		if info, err := os.Stat(path); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return fmt.Errorf("%v exists and is not a socket", path)
+			}
+			// A stale socket, which refuses connections, is replaced when
+			// the rule starts
+			conn, err := net.DialTimeout("unix", path, time.Second)
+			if err == nil {
+				conn.Close()
+				return fmt.Errorf("%v is in use by another process: %w", path, syscall.EADDRINUSE)
+			}
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				return fmt.Errorf("can't tell whether %v is stale: %w", path, err)
+			}
+			return nil
+		}
+		// Closing the listener removes the socket file
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		return listener.Close()
+	}
+	listener, err := net.Listen("tcp", endpoint(bind, port))
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// loadConfig reads a JSON configuration file of the following form:
+//
+//	{"rules": [{"proto": "tcp", "bind": "127.0.0.1", "port": "8080", "dstHost": "example.com", "dstPort": "80"}]}
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(config.Rules) == 0 {
+		return nil, fmt.Errorf("%v: no forwarding rules defined", path)
+	}
+	for i, rule := range config.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%v: rule #%d: %v", path, i+1, err)
+		}
+	}
+	return config, nil
+}
+
+// parseForward parses a forwarding rule given in the form of
+// [bind:]port:dstHost:dstPort; bindIF is used when bind is omitted
+func parseForward(value string, proto string, bindIF string) (Rule, error) {
+	parts := strings.Split(value, ":")
+	var rule Rule
+	switch len(parts) {
+	case 3:
+		rule = Rule{Proto: proto, Bind: bindIF, Port: parts[0], DstHost: parts[1], DstPort: parts[2]}
+	case 4:
+		rule = Rule{Proto: proto, Bind: parts[0], Port: parts[1], DstHost: parts[2], DstPort: parts[3]}
+	default:
+		return rule, fmt.Errorf("invalid forwarding rule %q, expected [bind:]port:dstHost:dstPort", value)
+	}
+	if err := rule.validate(); err != nil {
+		return rule, fmt.Errorf("invalid forwarding rule %q: %v", value, err)
+	}
+	return rule, nil
+}
+
+// listFlag collects the values of a repeatable flag
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCheckBindUnix(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "live.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: live, Net: "unix"})
+	if err != nil {
+		t.Skipf("can't listen on a Unix socket: %v", err)
+	}
+	defer listener.Close()
+	stale := filepath.Join(dir, "stale.sock")
+	left, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	left.SetUnlinkOnClose(false)
+	left.Close()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := Rule{DstHost: "127.0.0.1", DstPort: "80"}
+	if err := rule.checkBind("unix:"+live, ""); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("checkBind() = %v on a socket in use, want an address in use error", err)
+	}
+	if err := rule.checkBind("unix:"+stale, ""); err != nil {
+		t.Errorf("checkBind() = %v on a stale socket", err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("checking removed the stale socket: %v", err)
+	}
+	if err := rule.checkBind("unix:"+file, ""); err == nil {
+		t.Error("checkBind() succeeded on a file which is not a socket")
+	}
+	if err := rule.checkBind("unix:"+filepath.Join(dir, "new.sock"), ""); err != nil {
+		t.Errorf("checkBind() = %v on a new socket", err)
+	}
+}
+
+func TestCheckRelays(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags flags
+		rule  Rule
+		ok    bool
+	}{
+		{"mux server", flags{}, Rule{Mode: modeMuxServer}, false},
+		{"allowed hosts", flags{allowHosts: "10.0.0.0/8"}, Rule{Mode: modeMuxServer}, true},
+		{"allowed ports", flags{allowPorts: "443"}, Rule{Mode: modeMuxServer}, true},
+		{"denied ports only", flags{denyPorts: "25"}, Rule{Mode: modeMuxServer}, false},
+		{"socks5", flags{}, Rule{Mode: modeSOCKS5}, true},
+		{"fixed destination", flags{}, Rule{DstHost: "127.0.0.1", DstPort: "80"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.flags.checkRelays([]Rule{test.rule})
+			if (err == nil) != test.ok {
+				t.Errorf("checkRelays() = %v", err)
+			}
+		})
+	}
+}
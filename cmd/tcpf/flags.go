@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// flags holds the command line options of tcpf
+type flags struct {
+	showVersion      bool
+	check            bool
+	configPath       string
+	bindIF           string
+	bindPort         string
+	dstHost          string
+	dstPort          string
+	proto            string
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	maxLifetime      time.Duration
+	maxBytes         int64
+	idleTimeout      time.Duration
+	dstTLS           bool
+	dstTLSInsecure   bool
+	dstTLSServerName string
+	addXFF           bool
+	compress         bool
+	decompress       bool
+	sendProxy        bool
+	acceptProxy      bool
+	socks5           bool
+	httpConnect      bool
+	muxServer        bool
+	muxAddr          string
+	socks5User       string
+	socks5Pass       string
+	allowPorts       string
+	denyPorts        string
+	allowHosts       string
+	keepAlive        time.Duration
+	transparent      bool
+	backlog          int
+	bindRetry        time.Duration
+	reusePort        bool
+	dscp             int
+	noDelay          bool
+	poolSize         int
+	poolLifetime     time.Duration
+	prewarm          int
+	lazyDial         bool
+	resolveTTL       time.Duration
+	resolverAddr     string
+	srcAddr          string
+	fallbackDelay    time.Duration
+	dialTimeout      time.Duration
+	dialRetries      int
+	dialRetryBackoff time.Duration
+	dstBackup        string
+	pcapFile         string
+	accessLogPath    string
+	pcapSize         int64
+	upstreamSOCKS5   string
+	upstreamHTTP     string
+	upstreamUser     string
+	upstreamPass     string
+	reverse          string
+	routes           string
+	sniRoutes        string
+	hostRoutes       string
+	mirrorAddr       string
+	balanceName      string
+	healthInterval   time.Duration
+	healthFailures   int
+	breakerFailures  int
+	breakerCooldown  time.Duration
+	bufSize          int
+	bufSizeIn        int
+	bufSizeOut       int
+	rateLimit        int64
+	totalRate        int64
+	allow            string
+	deny             string
+	geoIPFile        string
+	allowCountries   string
+	denyCountries    string
+	geoIPFailOpen    bool
+	maxConns         int
+	connRate         int
+	maxConnsPerIP    int
+	adminAddr        string
+	grpcAddr         string
+	healthAddr       string
+	durationBuckets  string
+	byteBuckets      string
+	metricsAddr      string
+	logFormat        string
+	logLevelName     string
+	logFile          string
+	logMaxSize       int64
+	logMaxBackups    int
+	uuidIDs          bool
+	drainTimeout     time.Duration
+	forwards         listFlag
+	tlsCerts         listFlag
+	tlsKeys          listFlag
+	replaces         listFlag
+	tlsClientCA      string
+}
+
+// parseFlags defines the command line options and parses them
+func parseFlags() *flags {
+	f := &flags{}
+	flag.BoolVar(&f.showVersion, "version", false, "print the version of tcpf and exit")
+	flag.BoolVar(&f.check, "check", false, "validate the options and rules and try binding every listener, then exit without forwarding")
+	flag.StringVar(&f.configPath, "config", "", "path to a JSON file with forwarding rules")
+	flag.StringVar(&f.bindIF, "bind", "127.0.0.1", "local interface to bind to, or a comma separated list of them")
+	flag.StringVar(&f.bindPort, "port", "", "local port to listen on, or a range of ports first-last forwarded to the destination ports at the same offsets")
+	flag.StringVar(&f.dstHost, "dst-host", "", "destination host to forward traffic to, or a comma separated list of hosts (optionally host=weight) to balance across")
+	flag.StringVar(&f.dstPort, "dst-port", "", "destination port to forward traffic to")
+	flag.StringVar(&f.proto, "proto", "tcp", "protocol to forward: tcp or udp")
+	flag.DurationVar(&f.readTimeout, "read-timeout", 0, "time a tunnel may wait to read from either side before it is closed, 0 means no limit")
+	flag.DurationVar(&f.writeTimeout, "write-timeout", 0, "time a write to either side of a tunnel may block before the tunnel is closed, 0 means no limit")
+	flag.DurationVar(&f.maxLifetime, "max-lifetime", 0, "time after which tunnels are closed however active, 0 means no limit")
+	flag.Int64Var(&f.maxBytes, "max-bytes", 0, "bytes a tunnel may forward in both directions together before it is closed, 0 means no limit")
+	flag.DurationVar(&f.idleTimeout, "idle-timeout", 0, "time after which idle tunnels are closed (default is none for TCP, 1m for UDP)")
+	flag.BoolVar(&f.dstTLS, "dst-tls", false, "connect to the destination over TLS")
+	flag.BoolVar(&f.dstTLSInsecure, "dst-tls-insecure", false, "skip verification of the destination's TLS certificate")
+	flag.StringVar(&f.dstTLSServerName, "dst-tls-servername", "", "server name to verify the destination's TLS certificate against (default is the destination host)")
+	flag.BoolVar(&f.addXFF, "add-xff", false, "append the client's IP address to the X-Forwarded-For header of the HTTP requests forwarded")
+	flag.BoolVar(&f.compress, "compress", false, "compress the traffic to the destination, which has to be a tcpf instance run with -decompress")
+	flag.BoolVar(&f.decompress, "decompress", false, "decompress the traffic of the clients, which have to be a tcpf instance run with -compress")
+	flag.BoolVar(&f.sendProxy, "send-proxy", false, "send the PROXY protocol v1 header to the destination")
+	flag.BoolVar(&f.acceptProxy, "accept-proxy", false, "expect the PROXY protocol v2 header on accepted connections")
+	flag.BoolVar(&f.socks5, "socks5", false, "act as a SOCKS5 proxy, clients choose the destination")
+	flag.BoolVar(&f.httpConnect, "http-connect", false, "act as an HTTP CONNECT proxy, clients choose the destination")
+	flag.BoolVar(&f.muxServer, "mux-server", false, "accept tunnels multiplexed by tcpf instances run with -mux, forwarding them to the destinations they were opened to; requires -allow-hosts or -allow-ports")
+	flag.StringVar(&f.muxAddr, "mux", "", "`host:port` of a tcpf instance run with -mux-server to multiplex all tunnels to over one connection")
+	flag.StringVar(&f.socks5User, "socks5-user", "", "username SOCKS5 clients have to authenticate with")
+	flag.StringVar(&f.socks5Pass, "socks5-pass", "", "password SOCKS5 clients have to authenticate with")
+	flag.StringVar(&f.allowPorts, "allow-ports", "", "comma separated `ports` and ranges first-last which clients of -socks5, -http-connect and -mux-server may connect to (default is any)")
+	flag.StringVar(&f.denyPorts, "deny-ports", "", "comma separated `ports` and ranges first-last which clients of -socks5, -http-connect and -mux-server may not connect to, even if allowed")
+	flag.StringVar(&f.allowHosts, "allow-hosts", "", "comma separated `CIDRs` and host name globs, e.g. *.example.com, which clients of -socks5, -http-connect and -mux-server may connect to (default is any)")
+	flag.DurationVar(&f.keepAlive, "keepalive", 15*time.Second, "interval of TCP keepalive probes on both connections of a tunnel, 0 disables them")
+	flag.BoolVar(&f.transparent, "transparent", false, "accept connections diverted with TPROXY and dial the destinations from the IP addresses of the clients (Linux only, needs CAP_NET_ADMIN)")
+	flag.IntVar(&f.backlog, "backlog", 0, "connections the listening sockets queue until tcpf accepts them, 0 keeps the system's default")
+	flag.DurationVar(&f.bindRetry, "bind-retry", 0, "how long to retry binding the listening sockets, e.g. while the tcpf being replaced still holds the ports")
+	flag.BoolVar(&f.reusePort, "reuseport", false, "set SO_REUSEPORT on the listening sockets, so that a new tcpf can take over while this one drains")
+	flag.IntVar(&f.dscp, "dscp", 0, "DSCP value (1-63) to mark the packets of both connections of a tunnel with, 0 leaves them as is")
+	flag.BoolVar(&f.noDelay, "nodelay", true, "set TCP_NODELAY on both connections of a tunnel, -nodelay=false enables Nagle's algorithm")
+	flag.IntVar(&f.poolSize, "pool-size", 0, "connections to keep dialed ahead to each destination, so tunnels don't wait for a dial; unsafe for stateful protocols (0 disables)")
+	flag.DurationVar(&f.poolLifetime, "pool-lifetime", time.Minute, "time a pooled connection may stay idle before it is replaced")
+	flag.IntVar(&f.prewarm, "prewarm", 0, "connections to dial to each destination at startup, before accepting clients, replaced as tunnels take them; only safe for stateless destinations (0 disables)")
+	flag.BoolVar(&f.lazyDial, "lazy-dial", false, "dial the destination only once the client has sent its first bytes")
+	flag.DurationVar(&f.resolveTTL, "resolve-ttl", 0, "cache the addresses destination hosts resolve to for this long and dial them in turn, 0 resolves on every dial")
+	flag.StringVar(&f.resolverAddr, "resolver", "", "DNS server `address` to resolve destination hosts with instead of the system resolver")
+	flag.StringVar(&f.srcAddr, "src-addr", "", "local IP `address` to dial the destinations from")
+	flag.DurationVar(&f.fallbackDelay, "fallback-delay", 300*time.Millisecond, "time to wait on the preferred address family of a dual-stack destination before racing the other one, negative disables the fallback")
+	flag.DurationVar(&f.dialTimeout, "dial-timeout", 10*time.Second, "time to wait for the destination to accept a connection")
+	flag.IntVar(&f.dialRetries, "dial-retries", 0, "number of times to retry a failed dial to the destination")
+	flag.DurationVar(&f.dialRetryBackoff, "dial-retry-backoff", 100*time.Millisecond, "delay before the first dial retry, doubled for every next one")
+	flag.StringVar(&f.dstBackup, "dst-backup", "", "backup destination `host:port` to dial when the destination can't be dialed")
+	flag.StringVar(&f.pcapFile, "pcap", "", "pcap `file` to record the bytes of all tunnels to")
+	flag.StringVar(&f.accessLogPath, "access-log", "", "`file` to append a line for every HTTP request forwarded to, in the combined log format, - for stdout")
+	flag.Int64Var(&f.pcapSize, "pcap-size", 100<<20, "size in bytes at which the pcap file is rotated, 0 disables rotation")
+	flag.StringVar(&f.upstreamSOCKS5, "upstream-socks5", "", "`host:port` of a SOCKS5 proxy to dial the destinations through")
+	flag.StringVar(&f.upstreamHTTP, "upstream-http-proxy", "", "`host:port` of an HTTP proxy to dial the destinations through with CONNECT")
+	flag.StringVar(&f.upstreamUser, "upstream-user", "", "username to authenticate with the upstream proxy")
+	flag.StringVar(&f.upstreamPass, "upstream-pass", "", "password to authenticate with the upstream proxy")
+	flag.StringVar(&f.reverse, "reverse", "", "`host:port` of a control server to connect to and accept relayed connections from, instead of listening on -port")
+	flag.StringVar(&f.routes, "route", "", "comma separated `protocol=host:port` routes of the connections speaking tls, http or ssh; others go to the destination")
+	flag.StringVar(&f.sniRoutes, "sni", "", "comma separated `name=host:port` routes of the TLS connections by their server name, which may be a *.example.com wildcard; others go to the destination")
+	flag.StringVar(&f.hostRoutes, "http-host", "", "comma separated `name=host:port` routes of the HTTP connections by the Host header of their first request, which may be a *.example.com wildcard; others go to the destination")
+	flag.StringVar(&f.mirrorAddr, "mirror", "", "`host:port` to send a copy of the bytes from every client to, discarding its responses")
+	flag.StringVar(&f.balanceName, "balance", "roundrobin", "algorithm to balance tunnels across destinations with: roundrobin, leastconn or sticky")
+	flag.DurationVar(&f.healthInterval, "health-interval", 0, "interval between health checks of the destinations, 0 disables them")
+	flag.IntVar(&f.healthFailures, "health-failures", 3, "number of failed health checks in a row which mark a destination down")
+	flag.IntVar(&f.breakerFailures, "breaker-failures", 0, "number of failed dials in a row which open the circuit breaker of a destination, 0 disables circuit breakers")
+	flag.DurationVar(&f.breakerCooldown, "breaker-cooldown", 30*time.Second, "time the circuit breaker of a destination stays open before it is probed again")
+	flag.IntVar(&f.bufSize, "buf-size", 1024, "size in bytes of the buffers tunnel traffic is copied through, 32768-65536 suit bulk transfers")
+	flag.IntVar(&f.bufSizeIn, "buf-size-in", 0, "size in bytes of the buffers the traffic from the clients to the destinations is copied through (default -buf-size)")
+	flag.IntVar(&f.bufSizeOut, "buf-size-out", 0, "size in bytes of the buffers the traffic from the destinations back to the clients is copied through (default -buf-size)")
+	flag.Int64Var(&f.rateLimit, "rate-limit", 0, "maximum bytes per second every tunnel forwards in each direction, 0 means no limit")
+	flag.Int64Var(&f.totalRate, "total-rate", 0, "maximum bytes per second all tunnels of a rule forward together in each direction, 0 means no limit")
+	flag.StringVar(&f.allow, "allow", "", "comma separated `CIDRs` clients may connect from (default is anywhere)")
+	flag.StringVar(&f.deny, "deny", "", "comma separated `CIDRs` clients may not connect from, even if allowed")
+	flag.StringVar(&f.geoIPFile, "geoip", "", "MaxMind DB `file` to look up the countries of clients in for -allow-countries and -deny-countries")
+	flag.StringVar(&f.allowCountries, "allow-countries", "", "comma separated ISO 3166-1 `codes` of the countries clients may connect from, with -geoip")
+	flag.StringVar(&f.denyCountries, "deny-countries", "", "comma separated ISO 3166-1 `codes` of the countries clients may not connect from, with -geoip")
+	flag.BoolVar(&f.geoIPFailOpen, "geoip-fail-open", false, "let in clients whose country can't be looked up, instead of refusing them")
+	flag.IntVar(&f.maxConns, "max-conns", 0, "maximum number of concurrent tunnels per rule, 0 means no limit")
+	flag.IntVar(&f.connRate, "conn-rate", 0, "maximum number of new tunnels per rule per second, 0 means no limit")
+	flag.IntVar(&f.maxConnsPerIP, "max-conns-per-ip", 0, "maximum number of concurrent tunnels per rule from a single client IP, 0 means no limit")
+	flag.StringVar(&f.adminAddr, "admin-addr", "", "`address` to serve the admin API on, e.g. 127.0.0.1:9101 (disabled by default)")
+	flag.StringVar(&f.grpcAddr, "grpc-addr", "", "`address` to serve the gRPC control API on, e.g. 127.0.0.1:9102 (disabled by default)")
+	flag.StringVar(&f.healthAddr, "health-addr", "", "`address` to serve the /healthz and /readyz probes on, e.g. :8086 (disabled by default)")
+	flag.StringVar(&f.durationBuckets, "duration-buckets", "", "comma separated ascending `durations` bounding the buckets of the tunnel lifetime histogram of -metrics-addr (default 100ms to 1h)")
+	flag.StringVar(&f.byteBuckets, "bytes-buckets", "", "comma separated ascending `bytes` bounding the buckets of the tunnel bytes histogram of -metrics-addr (default 1KB to 1GB in steps of 4)")
+	flag.StringVar(&f.metricsAddr, "metrics-addr", "", "`address` to serve Prometheus metrics on at /metrics, e.g. :9100 (disabled by default)")
+	flag.StringVar(&f.logFormat, "log-format", "text", "format of the log: text or json lines")
+	flag.StringVar(&f.logLevelName, "log-level", "info", "most verbose level of the log: error, warn, info or debug")
+	flag.StringVar(&f.logFile, "log-file", "", "`file` to append the log to instead of stderr")
+	flag.Int64Var(&f.logMaxSize, "log-max-size", 100<<20, "size in bytes at which the -log-file is rotated, 0 disables rotation")
+	flag.IntVar(&f.logMaxBackups, "log-max-backups", 3, "number of rotated log files to keep")
+	flag.BoolVar(&f.uuidIDs, "uuid-ids", false, "identify tunnels with random UUIDs, unique across realms and restarts, instead of sequence numbers")
+	flag.DurationVar(&f.drainTimeout, "drain-timeout", 10*time.Second, "time to wait for active tunnels to finish on shutdown")
+	flag.Var(&f.forwards, "forward", "forwarding rule `[bind:]port:dstHost:dstPort`, may be repeated")
+	flag.Var(&f.replaces, "replace", "`from=to` byte sequence to replace in the traffic of the tunnels in both directions, may be repeated; breaks length-sensitive protocols")
+	flag.Var(&f.tlsCerts, "tls-cert", "TLS certificate `file` to terminate TLS with, may be repeated for SNI")
+	flag.Var(&f.tlsKeys, "tls-key", "TLS private key `file` matching -tls-cert, may be repeated")
+	flag.StringVar(&f.tlsClientCA, "tls-client-ca", "", "CA bundle `file` to require and verify client certificates against")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -port <local-port> -dst-host <remote-host> -dst-port <remote-port>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -forward <local-port>:<remote-host>:<remote-port> [-forward ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -socks5 -port <local-port>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -http-connect -port <local-port>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -mux-server -allow-hosts <hosts> -port <local-port>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -reverse <control-host:port> -dst-host <remote-host> -dst-port <remote-port>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -config <config-file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	return f
+}
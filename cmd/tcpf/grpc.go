@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/baburkin/tcpf"
+	"github.com/baburkin/tcpf/controlpb"
+)
+
+// controlServer serves the gRPC control API of -grpc-addr for the TCP realms
+// of the servers, whose tunnels join and leave through events
+type controlServer struct {
+	controlpb.UnimplementedControlServer
+	servers *servers
+	events  *tcpf.Events
+}
+
+func tunnelMessage(realm string, info tcpf.TunnelInfo) *controlpb.Tunnel {
+	return &controlpb.Tunnel{
+		Id:       info.ID,
+		Realm:    realm,
+		Src:      info.Src,
+		Dst:      info.Dst,
+		BytesIn:  info.BytesIn,
+		BytesOut: info.BytesOut,
+		Age:      durationpb.New(info.Age),
+	}
+}
+
+func (c *controlServer) ListTunnels(ctx context.Context, request *controlpb.ListTunnelsRequest) (*controlpb.ListTunnelsResponse, error) {
+	response := &controlpb.ListTunnelsResponse{}
+	for _, realm := range c.servers.tunnelRealms() {
+		for _, info := range realm.Tunnels() {
+			response.Tunnels = append(response.Tunnels, tunnelMessage(realm.String(), info))
+		}
+	}
+	return response, nil
+}
+
+func (c *controlServer) WatchTunnels(request *controlpb.WatchTunnelsRequest, stream controlpb.Control_WatchTunnelsServer) error {
+	ctx := stream.Context()
+	events := c.events.Subscribe(ctx)
+	// The headers tell the client that the events from now on will come
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for event := range events {
+		eventType := controlpb.TunnelEvent_TYPE_JOIN
+		if event.Type == "leave" {
+			eventType = controlpb.TunnelEvent_TYPE_LEAVE
+		}
+		if err := stream.Send(&controlpb.TunnelEvent{Type: eventType, Tunnel: tunnelMessage(event.Realm, event.Tunnel)}); err != nil {
+			return err
+		}
+	}
+	// The events end early for a client which doesn't keep up with them
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return status.Error(codes.ResourceExhausted, "fell too far behind the tunnel events")
+}
+
+func (c *controlServer) CloseTunnel(ctx context.Context, request *controlpb.CloseTunnelRequest) (*controlpb.CloseTunnelResponse, error) {
+	for _, realm := range c.servers.tunnelRealms() {
+		if realm.CloseTunnel(request.Id) {
+			return &controlpb.CloseTunnelResponse{}, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no such tunnel %q", request.Id)
+}
+
+func (c *controlServer) GetStats(ctx context.Context, request *controlpb.GetStatsRequest) (*controlpb.GetStatsResponse, error) {
+	response := &controlpb.GetStatsResponse{}
+	for _, realm := range c.servers.tunnelRealms() {
+		stats := realm.Stats()
+		response.Realms = append(response.Realms, &controlpb.RealmStats{
+			Realm:         realm.String(),
+			ActiveTunnels: int64(stats.ActiveTunnels),
+			TunnelsTotal:  stats.TunnelsTotal,
+			BytesIn:       stats.BytesIn,
+			BytesOut:      stats.BytesOut,
+			DialErrors:    stats.DialErrors,
+			Errors:        stats.Errors,
+			Paused:        stats.Paused,
+		})
+	}
+	return response, nil
+}
+
+// serveGRPC serves the control API on addr in the background
+func serveGRPC(addr string, control *controlServer) {
+	go func() {
+		logf(tcpf.LevelInfo, "grpc", tcpf.Fields{"addr": addr}, "Serving the gRPC control API on %v", addr)
+		listener, err := net.Listen("tcp", addr)
+		if err == nil {
+			server := grpc.NewServer()
+			controlpb.RegisterControlServer(server, control)
+			err = server.Serve(listener)
+		}
+		if err != nil {
+			logf(tcpf.LevelError, "grpc_error", tcpf.Fields{"addr": addr, "error": err}, "Can't serve the gRPC control API: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/baburkin/tcpf"
+	"github.com/baburkin/tcpf/controlpb"
+)
+
+func TestControlServer(t *testing.T) {
+	tcpf.SetLogger(tcpf.NewJSONLogger(io.Discard))
+	logger = tcpf.NewJSONLogger(io.Discard)
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+	_, port, _ := net.SplitHostPort(addr)
+	_, dstPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	events := tcpf.NewEvents()
+	s := newServers(func(rule Rule) realm {
+		return newRealm(rule, []tcpf.Option{tcpf.WithEvents(events)}, nil)
+	})
+	s.start(Rule{Bind: "127.0.0.1", Port: port, DstHost: "127.0.0.1", DstPort: dstPort})
+	defer s.shutdown(time.Second)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	controlpb.RegisterControlServer(server, &controlServer{servers: s, events: events})
+	go server.Serve(listener)
+	defer server.Stop()
+	client, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	control := controlpb.NewControlClient(client)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The events come from the time the headers of the stream do
+	watch, err := control.WatchTunnels(ctx, &controlpb.WatchTunnelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watch.Header(); err != nil {
+		t.Fatal(err)
+	}
+	var conn net.Conn
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err == nil || time.Since(start) > 5*time.Second {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	join, err := watch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := join.Tunnel.GetId()
+	if join.Type != controlpb.TunnelEvent_TYPE_JOIN || join.Tunnel.GetSrc() != conn.LocalAddr().String() {
+		t.Errorf("got %v, want the tunnel from %v joining", join, conn.LocalAddr())
+	}
+
+	tunnels, err := control.ListTunnels(ctx, &controlpb.ListTunnelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels.Tunnels) != 1 || tunnels.Tunnels[0].Id != id {
+		t.Errorf("ListTunnels() = %v, want tunnel %v", tunnels.Tunnels, id)
+	}
+	stats, err := control.GetStats(ctx, &controlpb.GetStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Realms) != 1 || stats.Realms[0].ActiveTunnels != 1 || stats.Realms[0].TunnelsTotal != 1 || stats.Realms[0].Realm != join.Tunnel.Realm {
+		t.Errorf("GetStats() = %v, want the realm of the tunnel with 1 tunnel", stats.Realms)
+	}
+
+	if _, err := control.CloseTunnel(ctx, &controlpb.CloseTunnelRequest{Id: id}); err != nil {
+		t.Fatalf("CloseTunnel() = %v", err)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a closed tunnel", n)
+	}
+	// Spliced tunnels count their bytes as they close
+	leave, err := watch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leave.Type != controlpb.TunnelEvent_TYPE_LEAVE || leave.Tunnel.GetId() != id || leave.Tunnel.GetBytesOut() != 5 {
+		t.Errorf("got %v, want tunnel %v leaving with 5 bytes out", leave, id)
+	}
+	if _, err := control.CloseTunnel(ctx, &controlpb.CloseTunnelRequest{Id: id}); status.Code(err) != codes.NotFound {
+		t.Errorf("CloseTunnel() of a closed tunnel = %v, want %v", err, codes.NotFound)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/baburkin/tcpf"
+)
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// logger writes the events of the utility more severe than logLevel, like
+// tcpf does for the realms
+var (
+	logger   = tcpf.NewTextLogger()
+	logLevel = tcpf.LevelInfo
+)
+
+func logf(level tcpf.Level, event string, fields tcpf.Fields, format string, args ...interface{}) {
+	if level <= logLevel {
+		logger.Log(level, event, fields, fmt.Sprintf(format, args...))
+	}
+}
+
+func usageError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "tcpf: "+format+"\n", args...)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// realm is implemented by both tcpf.TunnelRealm and tcpf.UDPRealm
+type realm interface {
+	Serve() error
+	Shutdown(ctx context.Context) error
+	StopListening()
+	Stop() error
+	Ready() bool
+	String() string
+}
+
+func newRealm(rule Rule, opts []tcpf.Option, socks5Credentials map[string]string) realm {
+	switch rule.Mode {
+	case modeSOCKS5:
+		opts = append(opts, tcpf.WithSOCKS5(socks5Credentials))
+	case modeHTTPConnect:
+		opts = append(opts, tcpf.WithHTTPConnect())
+	case modeMuxServer:
+		opts = append(opts, tcpf.WithMuxServer())
+	}
+	if rule.Reverse != "" {
+		opts = append(opts, tcpf.WithReverse(rule.Reverse))
+	}
+	if rule.protocol() == "udp" {
+		return tcpf.NewUDPRealm(rule.Bind, rule.Port, rule.DstHost, rule.DstPort, opts...)
+	}
+	return tcpf.NewTunnelRealm(rule.Bind, rule.Port, rule.DstHost, rule.DstPort, opts...)
+}
+
+func main() {
+	f := parseFlags()
+	if f.showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	closeLog := setupLogging(f)
+	defer closeLog()
+	rules := f.rules()
+	if err := f.checkRelays(rules); err != nil {
+		usageError("%v", err)
+	}
+	opts, closeOutputs := f.options()
+	defer closeOutputs()
+	if f.check {
+		if !checkRules(rules) {
+			os.Exit(1)
+		}
+		return
+	}
+	serve(f, rules, opts, closeOutputs)
+}
+
+// checkRelays refuses mux-server rules unless the destinations are
+// restricted: the peers choose them, so anyone reaching the port could
+// otherwise relay through it to any host
+func (f *flags) checkRelays(rules []Rule) error {
+	for _, rule := range rules {
+		if rule.Mode == modeMuxServer && f.allowHosts == "" && f.allowPorts == "" {
+			return errors.New("-mux-server requires -allow-hosts or -allow-ports")
+		}
+	}
+	return nil
+}
+
+// setupLogging directs the log of tcpf and of the realms to the -log-file
+// in the -log-format, and returns the function closing the file
+func setupLogging(f *flags) func() {
+	var logOutput io.Writer = os.Stderr
+	closeLog := func() {}
+	if f.logFile != "" {
+		if f.logMaxSize < 0 || f.logMaxBackups < 0 {
+			usageError("-log-max-size and -log-max-backups can't be negative")
+		}
+		file, err := tcpf.OpenLogFile(f.logFile, f.logMaxSize, f.logMaxBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tcpf: %v\n", err)
+			os.Exit(1)
+		}
+		log.SetOutput(file)
+		logOutput = file
+		closeLog = func() { file.Close() }
+	}
+	switch f.logFormat {
+	case "text":
+	case "json":
+		logger = tcpf.NewJSONLogger(logOutput)
+		tcpf.SetLogger(logger)
+	default:
+		usageError("invalid -log-format %q, expected text or json", f.logFormat)
+	}
+	level, err := tcpf.ParseLevel(f.logLevelName)
+	if err != nil {
+		usageError("%v", err)
+	}
+	logLevel = level
+	tcpf.SetLogLevel(level)
+	return closeLog
+}
+
+// rules returns the forwarding rules of the -config file, or else of the
+// command line
+func (f *flags) rules() []Rule {
+	if f.configPath != "" {
+		if flag.NArg() > 0 || len(f.forwards) > 0 || f.bindPort != "" || f.dstHost != "" || f.dstPort != "" || f.reverse != "" {
+			usageError("-config can't be combined with other forwarding options")
+		}
+		config, err := loadConfig(f.configPath)
+		if err != nil {
+			logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't load configuration: %v", err)
+			os.Exit(1)
+		}
+		return config.Rules
+	}
+	var mode string
+	switch {
+	case f.socks5 && f.httpConnect || (f.socks5 || f.httpConnect) && f.muxServer:
+		usageError("-socks5, -http-connect and -mux-server can't be combined")
+	case f.socks5:
+		mode = modeSOCKS5
+	case f.httpConnect:
+		mode = modeHTTPConnect
+	case f.muxServer:
+		mode = modeMuxServer
+	}
+	// Positional arguments are deprecated, but still accepted for backward
+	// compatibility: tcpf <local-port> <remote-host> <remote-port>
+	if flag.NArg() > 0 {
+		if flag.NArg() != 3 || f.bindPort != "" || f.dstHost != "" || f.dstPort != "" {
+			usageError("unexpected arguments: %v", flag.Args())
+		}
+		logf(tcpf.LevelWarn, "deprecated", nil, "Warning: positional arguments are deprecated and will be removed, use -port, -dst-host and -dst-port instead")
+		f.bindPort, f.dstHost, f.dstPort = flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	}
+	var rules []Rule
+	for _, value := range f.forwards {
+		rule, err := parseForward(value, f.proto, f.bindIF)
+		if err != nil {
+			usageError("%v", err)
+		}
+		rule.Mode = mode
+		rules = append(rules, rule)
+	}
+	if len(f.forwards) == 0 || f.bindPort != "" || f.dstHost != "" || f.dstPort != "" {
+		rule := Rule{Proto: f.proto, Bind: f.bindIF, Port: f.bindPort, DstHost: f.dstHost, DstPort: f.dstPort, Mode: mode, Reverse: f.reverse}
+		if err := rule.validate(); err != nil {
+			usageError("%v", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// checkRules tries every rule for -check, and reports whether they can all
+// be served
+func checkRules(rules []Rule) bool {
+	failed := 0
+	for i, rule := range rules {
+		if err := rule.check(); err != nil {
+			logf(tcpf.LevelError, "check_error", tcpf.Fields{"rule": rule, "error": err}, "Rule #%d %v: %v", i+1, rule, err)
+			failed++
+		} else {
+			logf(tcpf.LevelInfo, "check", tcpf.Fields{"rule": rule}, "Rule #%d %v: OK", i+1, rule)
+		}
+	}
+	if failed > 0 {
+		logf(tcpf.LevelError, "check_error", tcpf.Fields{"failed": failed}, "%d of %d rules can't be served", failed, len(rules))
+		return false
+	}
+	return true
+}
+
+// serve runs the rules along with the HTTP endpoints until a signal stops
+// tcpf, or until none of the rules is running
+func serve(f *flags, rules []Rule, opts []tcpf.Option, closeOutputs func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	var socks5Credentials map[string]string
+	if f.socks5User != "" {
+		socks5Credentials = map[string]string{f.socks5User: f.socks5Pass}
+	}
+	// Every realm hands its tunnels to the gRPC API, including the realms
+	// added on reload
+	var events *tcpf.Events
+	if f.grpcAddr != "" {
+		events = tcpf.NewEvents()
+		opts = append(opts, tcpf.WithEvents(events))
+	}
+	servers := newServers(func(rule Rule) realm {
+		return newRealm(rule, opts, socks5Credentials)
+	})
+	for _, rule := range rules {
+		servers.start(rule)
+	}
+	// The realms change on reload, so the handlers look them up every time
+	if f.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tcpf.MetricsHandler(servers.tunnelRealms()...).ServeHTTP(w, r)
+		}))
+		serveHTTP("metrics", "metrics", f.metricsAddr, mux)
+	}
+	if f.healthAddr != "" {
+		serveHTTP("health", "health probes", f.healthAddr, tcpf.HealthHandler(servers.ready))
+	}
+	if f.adminAddr != "" {
+		serveHTTP("admin", "the admin API", f.adminAddr, adminHandler(servers))
+	}
+	if f.grpcAddr != "" {
+		serveGRPC(f.grpcAddr, &controlServer{servers: servers, events: events})
+	}
+
+	for {
+		select {
+		case <-servers.none:
+			logf(tcpf.LevelError, "exit", nil, "No forwarding rules are running, exiting")
+			closeOutputs()
+			os.Exit(1)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if f.configPath == "" {
+					logf(tcpf.LevelWarn, "signal", tcpf.Fields{"signal": sig}, "Received %v, but there is no -config to reload", sig)
+					continue
+				}
+				logf(tcpf.LevelInfo, "signal", tcpf.Fields{"signal": sig}, "Received %v, reloading %v...", sig, f.configPath)
+				config, err := loadConfig(f.configPath)
+				if err != nil {
+					logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't reload configuration, keeping the current one: %v", err)
+					continue
+				}
+				if err := f.checkRelays(config.Rules); err != nil {
+					logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't reload configuration, keeping the current one: %v", err)
+					continue
+				}
+				servers.reload(config.Rules, f.drainTimeout)
+				continue
+			}
+			logf(tcpf.LevelInfo, "signal", tcpf.Fields{"signal": sig}, "Received %v, draining active tunnels for up to %v...", sig, f.drainTimeout)
+			servers.shutdown(f.drainTimeout)
+			logf(tcpf.LevelInfo, "exit", nil, "Shutdown complete")
+			return
+		}
+	}
+}
+
+// serveHTTP serves the handler of one of the HTTP endpoints on addr in the
+// background
+func serveHTTP(event, what, addr string, handler http.Handler) {
+	go func() {
+		logf(tcpf.LevelInfo, event, tcpf.Fields{"addr": addr}, "Serving %v on %v", what, addr)
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			logf(tcpf.LevelError, event+"_error", tcpf.Fields{"addr": addr, "error": err}, "Can't serve %v: %v", what, err)
+		}
+	}()
+}
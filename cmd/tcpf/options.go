@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/baburkin/tcpf"
+)
+
+// options validates the command line options and returns the tcpf options
+// every realm is created with, along with the function closing the files
+// they write to
+func (f *flags) options() ([]tcpf.Option, func()) {
+	opts := f.tunnelOptions()
+	opts = append(opts, f.accessOptions()...)
+	opts = append(opts, f.routingOptions()...)
+	opts = append(opts, f.dialOptions()...)
+	opts = append(opts, f.listenOptions()...)
+	outputs, closeOutputs := f.outputOptions()
+	return append(opts, outputs...), closeOutputs
+}
+
+// tunnelOptions returns the options of how the tunnels forward their bytes
+// and how long they live
+func (f *flags) tunnelOptions() []tcpf.Option {
+	if f.bufSize <= 0 {
+		usageError("invalid -buf-size %d, expected a positive number of bytes", f.bufSize)
+	}
+	if f.bufSizeIn < 0 || f.bufSizeOut < 0 {
+		usageError("invalid -buf-size-in %d or -buf-size-out %d, expected 0 or more bytes", f.bufSizeIn, f.bufSizeOut)
+	}
+	if f.maxBytes < 0 {
+		usageError("invalid -max-bytes %d, expected 0 or more", f.maxBytes)
+	}
+	durations, err := tcpf.ParseDurationBuckets(f.durationBuckets)
+	if err != nil {
+		usageError("invalid -duration-buckets: %v", err)
+	}
+	sizes, err := tcpf.ParseByteBuckets(f.byteBuckets)
+	if err != nil {
+		usageError("invalid -bytes-buckets: %v", err)
+	}
+	var replacements []tcpf.Replacement
+	for _, value := range f.replaces {
+		replacement, err := tcpf.ParseReplacement(value)
+		if err != nil {
+			usageError("invalid -replace: %v", err)
+		}
+		replacements = append(replacements, replacement)
+	}
+	opts := []tcpf.Option{
+		tcpf.WithBufferSize(f.bufSize),
+		tcpf.WithBufferSizes(f.bufSizeIn, f.bufSizeOut),
+		tcpf.WithRateLimit(f.rateLimit),
+		tcpf.WithTotalRateLimit(f.totalRate),
+		tcpf.WithIdleTimeout(f.idleTimeout),
+		tcpf.WithReadWriteTimeouts(f.readTimeout, f.writeTimeout),
+		tcpf.WithMaxBytes(f.maxBytes),
+		tcpf.WithMaxLifetime(f.maxLifetime),
+		tcpf.WithReplacements(replacements),
+		tcpf.WithHistogramBuckets(durations, sizes),
+		tcpf.WithMaxConns(f.maxConns),
+		tcpf.WithMaxConnsPerIP(f.maxConnsPerIP),
+		tcpf.WithConnRate(f.connRate),
+	}
+	if f.uuidIDs {
+		opts = append(opts, tcpf.WithUUIDs())
+	}
+	if f.addXFF {
+		opts = append(opts, tcpf.WithXForwardedFor())
+	}
+	if f.compress {
+		if f.sendProxy {
+			usageError("-send-proxy can't be used with -compress, the peer instance reads the traffic compressed")
+		}
+		opts = append(opts, tcpf.WithCompression())
+	}
+	if f.decompress {
+		opts = append(opts, tcpf.WithDecompression())
+	}
+	return opts
+}
+
+// accessOptions returns the options of which clients may connect, and which
+// destinations the clients of the proxy modes may reach
+func (f *flags) accessOptions() []tcpf.Option {
+	allowed, err := tcpf.ParsePrefixes(f.allow)
+	if err != nil {
+		usageError("invalid -allow: %v", err)
+	}
+	denied, err := tcpf.ParsePrefixes(f.deny)
+	if err != nil {
+		usageError("invalid -deny: %v", err)
+	}
+	opts := []tcpf.Option{tcpf.WithAllow(allowed), tcpf.WithDeny(denied)}
+	allowedPorts, err := tcpf.ParsePortRanges(f.allowPorts)
+	if err != nil {
+		usageError("invalid -allow-ports: %v", err)
+	}
+	deniedPorts, err := tcpf.ParsePortRanges(f.denyPorts)
+	if err != nil {
+		usageError("invalid -deny-ports: %v", err)
+	}
+	allowedHosts, err := tcpf.ParseHostPatterns(f.allowHosts)
+	if err != nil {
+		usageError("invalid -allow-hosts: %v", err)
+	}
+	opts = append(opts, tcpf.WithAllowPorts(allowedPorts), tcpf.WithDenyPorts(deniedPorts), tcpf.WithAllowHosts(allowedHosts))
+	allowedCountries, err := tcpf.ParseCountries(f.allowCountries)
+	if err != nil {
+		usageError("invalid -allow-countries: %v", err)
+	}
+	deniedCountries, err := tcpf.ParseCountries(f.denyCountries)
+	if err != nil {
+		usageError("invalid -deny-countries: %v", err)
+	}
+	if (len(allowedCountries) > 0 || len(deniedCountries) > 0) && f.geoIPFile == "" {
+		usageError("-allow-countries and -deny-countries require -geoip")
+	}
+	if f.geoIPFile != "" {
+		db, err := tcpf.OpenGeoIP(f.geoIPFile)
+		if err != nil {
+			logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't open GeoIP database: %v", err)
+			os.Exit(1)
+		}
+		opts = append(opts, tcpf.WithGeoIP(db, f.geoIPFailOpen), tcpf.WithAllowCountries(allowedCountries), tcpf.WithDenyCountries(deniedCountries))
+	}
+	return opts
+}
+
+// routingOptions returns the options of which destination a tunnel is
+// forwarded to
+func (f *flags) routingOptions() []tcpf.Option {
+	balance, err := tcpf.ParseBalance(f.balanceName)
+	if err != nil {
+		usageError("%v", err)
+	}
+	opts := []tcpf.Option{tcpf.WithBalance(balance)}
+	if f.healthInterval > 0 {
+		opts = append(opts, tcpf.WithHealthCheck(f.healthInterval, f.healthFailures))
+	}
+	if f.dstBackup != "" {
+		if !strings.HasPrefix(f.dstBackup, "unix:") {
+			if _, port, err := net.SplitHostPort(f.dstBackup); err != nil || !validPort(port) {
+				usageError("invalid -dst-backup %q, expected host:port", f.dstBackup)
+			}
+		}
+		opts = append(opts, tcpf.WithBackup(f.dstBackup))
+	}
+	if f.routes != "" {
+		protocolRoutes, err := tcpf.ParseRoutes(f.routes)
+		if err != nil {
+			usageError("invalid -route: %v", err)
+		}
+		for protocol := range protocolRoutes {
+			if protocol != tcpf.ProtocolTLS && protocol != tcpf.ProtocolHTTP && protocol != tcpf.ProtocolSSH {
+				usageError("invalid -route: unknown protocol %q, expected tls, http or ssh", protocol)
+			}
+		}
+		opts = append(opts, tcpf.WithProtocolRoutes(protocolRoutes))
+	}
+	routers := 0
+	for _, list := range []string{f.routes, f.sniRoutes, f.hostRoutes} {
+		if list != "" {
+			routers++
+		}
+	}
+	if routers > 1 {
+		usageError("-route, -sni and -http-host are mutually exclusive")
+	}
+	if f.sniRoutes != "" {
+		if len(f.tlsCerts) > 0 {
+			usageError("-sni routes TLS without terminating it, and can't be used with -tls-cert")
+		}
+		nameRoutes, err := tcpf.ParseRoutes(f.sniRoutes)
+		if err != nil {
+			usageError("invalid -sni: %v", err)
+		}
+		opts = append(opts, tcpf.WithSNIRoutes(nameRoutes))
+	}
+	if f.hostRoutes != "" {
+		nameRoutes, err := tcpf.ParseRoutes(f.hostRoutes)
+		if err != nil {
+			usageError("invalid -http-host: %v", err)
+		}
+		opts = append(opts, tcpf.WithHostRoutes(nameRoutes))
+	}
+	if f.mirrorAddr != "" {
+		if !strings.HasPrefix(f.mirrorAddr, "unix:") {
+			if _, port, err := net.SplitHostPort(f.mirrorAddr); err != nil || !validPort(port) {
+				usageError("invalid -mirror %q, expected host:port", f.mirrorAddr)
+			}
+		}
+		opts = append(opts, tcpf.WithMirror(f.mirrorAddr))
+	}
+	return opts
+}
+
+// dialOptions returns the options of how the destinations are dialed
+func (f *flags) dialOptions() []tcpf.Option {
+	if f.dscp < 0 || f.dscp > 63 {
+		usageError("invalid -dscp %d, expected a value from 0 to 63", f.dscp)
+	}
+	var resolver *net.Resolver
+	if f.resolverAddr != "" {
+		var err error
+		if resolver, err = tcpf.NewResolver(f.resolverAddr); err != nil {
+			usageError("invalid -resolver: %v", err)
+		}
+	}
+	opts := []tcpf.Option{
+		tcpf.WithDialTimeout(f.dialTimeout),
+		tcpf.WithFallbackDelay(f.fallbackDelay),
+		tcpf.WithKeepAlive(f.keepAlive),
+		tcpf.WithNoDelay(f.noDelay),
+		tcpf.WithDSCP(f.dscp),
+		tcpf.WithLazyDial(f.lazyDial),
+		tcpf.WithPool(f.poolSize, f.poolLifetime),
+		tcpf.WithPrewarm(f.prewarm),
+		tcpf.WithResolveTTL(f.resolveTTL),
+		tcpf.WithResolver(resolver),
+		tcpf.WithDialRetries(f.dialRetries, f.dialRetryBackoff),
+		tcpf.WithCircuitBreaker(f.breakerFailures, f.breakerCooldown),
+	}
+	if f.muxAddr != "" {
+		if _, port, err := net.SplitHostPort(f.muxAddr); err != nil || !validPort(port) {
+			usageError("invalid -mux %q, expected host:port", f.muxAddr)
+		}
+		if f.sendProxy || f.healthInterval > 0 {
+			usageError("-send-proxy and -health-interval can't be used with -mux, the destinations are dialed by the mux peer")
+		}
+		opts = append(opts, tcpf.WithMux(f.muxAddr))
+	}
+	if f.upstreamSOCKS5 != "" {
+		if _, port, err := net.SplitHostPort(f.upstreamSOCKS5); err != nil || !validPort(port) {
+			usageError("invalid -upstream-socks5 %q, expected host:port", f.upstreamSOCKS5)
+		}
+		opts = append(opts, tcpf.WithUpstreamSOCKS5(f.upstreamSOCKS5, f.upstreamUser, f.upstreamPass))
+	}
+	if f.upstreamHTTP != "" {
+		if f.upstreamSOCKS5 != "" {
+			usageError("-upstream-socks5 and -upstream-http-proxy can't be combined")
+		}
+		if _, port, err := net.SplitHostPort(f.upstreamHTTP); err != nil || !validPort(port) {
+			usageError("invalid -upstream-http-proxy %q, expected host:port", f.upstreamHTTP)
+		}
+		opts = append(opts, tcpf.WithUpstreamHTTPProxy(f.upstreamHTTP, f.upstreamUser, f.upstreamPass))
+	}
+	if f.srcAddr != "" {
+		addr, err := netip.ParseAddr(f.srcAddr)
+		if err != nil {
+			usageError("invalid -src-addr %q, expected an IP address", f.srcAddr)
+		}
+		// Binding a listener tells whether the address belongs to the host
+		listener, err := net.Listen("tcp", net.JoinHostPort(addr.String(), "0"))
+		if err != nil {
+			usageError("invalid -src-addr %q: %v", f.srcAddr, err)
+		}
+		listener.Close()
+		opts = append(opts, tcpf.WithSourceAddress(addr))
+	}
+	if f.transparent {
+		if f.srcAddr != "" || f.upstreamSOCKS5 != "" || f.upstreamHTTP != "" || f.muxAddr != "" {
+			usageError("-transparent dials the destinations from the addresses of the clients, and can't be used with -src-addr, -upstream-socks5, -upstream-http-proxy or -mux")
+		}
+		opts = append(opts, tcpf.WithTransparent())
+	}
+	if f.sendProxy {
+		opts = append(opts, tcpf.WithSendProxy())
+	}
+	if f.dstTLS {
+		opts = append(opts, tcpf.WithDestinationTLS(&tls.Config{
+			InsecureSkipVerify: f.dstTLSInsecure,
+			ServerName:         f.dstTLSServerName,
+		}))
+	}
+	return opts
+}
+
+// listenOptions returns the options of the listening sockets and of how the
+// accepted connections are read
+func (f *flags) listenOptions() []tcpf.Option {
+	var opts []tcpf.Option
+	if len(f.tlsCerts) > 0 || len(f.tlsKeys) > 0 {
+		tlsConfig, err := tcpf.LoadTLSConfig(f.tlsCerts, f.tlsKeys)
+		if err != nil {
+			logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't configure TLS: %v", err)
+			os.Exit(1)
+		}
+		if f.tlsClientCA != "" {
+			if tlsConfig.ClientCAs, err = tcpf.LoadClientCAs(f.tlsClientCA); err != nil {
+				logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't configure TLS: %v", err)
+				os.Exit(1)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, tcpf.WithTLS(tlsConfig))
+	} else if f.tlsClientCA != "" {
+		usageError("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	if f.reusePort {
+		opts = append(opts, tcpf.WithReusePort())
+	}
+	if f.backlog < 0 || f.backlog > 65535 {
+		usageError("invalid -backlog %d, expected a value from 0 to 65535", f.backlog)
+	}
+	opts = append(opts, tcpf.WithBacklog(f.backlog))
+	if f.bindRetry < 0 {
+		usageError("invalid -bind-retry %v, expected 0 or more", f.bindRetry)
+	}
+	opts = append(opts, tcpf.WithBindRetry(f.bindRetry))
+	if f.acceptProxy {
+		opts = append(opts, tcpf.WithAcceptProxy())
+	}
+	return opts
+}
+
+// outputOptions opens the -pcap file and the -access-log, unless only
+// checking the rules, and returns their options along with the function
+// closing them
+func (f *flags) outputOptions() ([]tcpf.Option, func()) {
+	var opts []tcpf.Option
+	var closers []func() error
+	closeOutputs := func() {
+		for _, closer := range closers {
+			closer()
+		}
+	}
+	if f.pcapFile != "" && !f.check {
+		pcap, err := tcpf.NewPcapWriter(f.pcapFile, f.pcapSize)
+		if err != nil {
+			logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't capture tunnels: %v", err)
+			os.Exit(1)
+		}
+		closers = append(closers, pcap.Close)
+		opts = append(opts, tcpf.WithCapture(pcap))
+	}
+	if f.accessLogPath == "-" {
+		opts = append(opts, tcpf.WithAccessLog(tcpf.NewAccessLog(os.Stdout)))
+	} else if f.accessLogPath != "" && !f.check {
+		file, err := os.OpenFile(f.accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			logf(tcpf.LevelError, "config_error", tcpf.Fields{"error": err}, "Can't open the access log: %v", err)
+			os.Exit(1)
+		}
+		closers = append(closers, file.Close)
+		opts = append(opts, tcpf.WithAccessLog(tcpf.NewAccessLog(file)))
+	}
+	return opts, closeOutputs
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baburkin/tcpf"
+)
+
+// servers runs a realm for each forwarding rule, and replaces the realms
+// when the rules are reloaded
+type servers struct {
+	mutex  sync.Mutex
+	realms map[Rule]realm
+	// IDs the realms are managed by in the admin API
+	ids    map[Rule]string
+	lastID int
+	create func(Rule) realm
+	// Serializes adding realms with reloading, so that a rule gets one realm
+	changing sync.Mutex
+	// Signaled when the last realm running has stopped
+	none    chan struct{}
+	serving sync.WaitGroup
+}
+
+func newServers(create func(Rule) realm) *servers {
+	return &servers{realms: make(map[Rule]realm), ids: make(map[Rule]string), create: create, none: make(chan struct{}, 1)}
+}
+
+// start runs a realm for the rule in the background, and returns its ID
+func (s *servers) start(rule Rule) string {
+	logf(tcpf.LevelInfo, "start", tcpf.Fields{"rule": rule}, "Starting TCPF on %v...", rule)
+	realm := s.create(rule)
+	s.mutex.Lock()
+	s.lastID++
+	id := strconv.Itoa(s.lastID)
+	s.realms[rule], s.ids[rule] = realm, id
+	s.mutex.Unlock()
+	s.serving.Add(1)
+	go func() {
+		defer s.serving.Done()
+		if err := realm.Serve(); err != nil {
+			logf(tcpf.LevelError, "stop", tcpf.Fields{"realm": realm, "error": err}, "Realm [%v] stopped: %v", realm, err)
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		// A realm stopped by reload or removed has been forgotten already
+		if s.realms[rule] != realm {
+			return
+		}
+		delete(s.realms, rule)
+		delete(s.ids, rule)
+		if len(s.realms) == 0 {
+			select {
+			case s.none <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return id
+}
+
+// add runs a realm for a rule which is not running yet, and returns its ID
+func (s *servers) add(rule Rule) (string, error) {
+	s.changing.Lock()
+	defer s.changing.Unlock()
+	s.mutex.Lock()
+	if id, ok := s.ids[rule]; ok {
+		s.mutex.Unlock()
+		return "", fmt.Errorf("rule %v is running already as realm %v", rule, id)
+	}
+	s.mutex.Unlock()
+	// Most of the reasons the realm wouldn't start are found beforehand
+	if err := rule.check(); err != nil {
+		return "", err
+	}
+	return s.start(rule), nil
+}
+
+// remove stops the realm with the ID, closing its tunnels, and reports
+// whether there is such a realm
+func (s *servers) remove(id string) bool {
+	s.mutex.Lock()
+	var found realm
+	for rule, ruleID := range s.ids {
+		if ruleID == id {
+			found = s.realms[rule]
+			delete(s.realms, rule)
+			delete(s.ids, rule)
+			break
+		}
+	}
+	s.mutex.Unlock()
+	if found == nil {
+		return false
+	}
+	logf(tcpf.LevelInfo, "stop", tcpf.Fields{"realm": found}, "Stopping TCPF on %v on request...", found)
+	found.Stop()
+	return true
+}
+
+// find returns the realm with the ID, or nil if there is no such realm
+func (s *servers) find(id string) realm {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for rule, ruleID := range s.ids {
+		if ruleID == id {
+			return s.realms[rule]
+		}
+	}
+	return nil
+}
+
+// realmInfo is the JSON form of a realm in the admin API
+type realmInfo struct {
+	ID     string `json:"id"`
+	Rule   Rule   `json:"rule"`
+	Realm  string `json:"realm"`
+	Ready  bool   `json:"ready"`
+	Paused bool   `json:"paused"`
+}
+
+// infos returns the realms running, ordered by their IDs
+func (s *servers) infos() []realmInfo {
+	s.mutex.Lock()
+	infos := make([]realmInfo, 0, len(s.realms))
+	realms := make([]realm, 0, len(s.realms))
+	for rule, realm := range s.realms {
+		infos = append(infos, realmInfo{ID: s.ids[rule], Rule: rule, Realm: realm.String()})
+		realms = append(realms, realm)
+	}
+	s.mutex.Unlock()
+	for i, realm := range realms {
+		infos[i].Ready = realm.Ready()
+		if tunnelRealm, ok := realm.(*tcpf.TunnelRealm); ok {
+			infos[i].Paused = tunnelRealm.Paused()
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		a, _ := strconv.Atoi(infos[i].ID)
+		b, _ := strconv.Atoi(infos[j].ID)
+		return a < b
+	})
+	return infos
+}
+
+// reload starts realms for the rules which are not running yet and
+// gracefully stops the realms of the rules which are gone, leaving the
+// realms of the other rules and their tunnels alone
+func (s *servers) reload(rules []Rule, drainTimeout time.Duration) {
+	s.changing.Lock()
+	defer s.changing.Unlock()
+	wanted := make(map[Rule]bool, len(rules))
+	var added []Rule
+	s.mutex.Lock()
+	for _, rule := range rules {
+		wanted[rule] = true
+		if _, ok := s.realms[rule]; !ok && !contains(added, rule) {
+			added = append(added, rule)
+		}
+	}
+	var removed []realm
+	for rule, realm := range s.realms {
+		if !wanted[rule] {
+			removed = append(removed, realm)
+			delete(s.realms, rule)
+			delete(s.ids, rule)
+		}
+	}
+	unchanged := len(s.realms)
+	s.mutex.Unlock()
+
+	// The old realms free their addresses, which the new rules may bind, but
+	// their tunnels are drained in the background
+	for _, realm := range removed {
+		logf(tcpf.LevelInfo, "stop", tcpf.Fields{"realm": realm}, "Stopping TCPF on %v...", realm)
+		realm.StopListening()
+	}
+	go shutdown(removed, drainTimeout)
+	for _, rule := range added {
+		s.start(rule)
+	}
+	logf(tcpf.LevelInfo, "reload", tcpf.Fields{"added": len(added), "removed": len(removed), "unchanged": unchanged}, "Configuration reloaded: %d rules added, %d removed, %d unchanged", len(added), len(removed), unchanged)
+}
+
+func contains(rules []Rule, rule Rule) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the realms running
+func (s *servers) list() []realm {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	realms := make([]realm, 0, len(s.realms))
+	for _, realm := range s.realms {
+		realms = append(realms, realm)
+	}
+	return realms
+}
+
+// ready returns why the servers are not ready to accept connections yet (or
+// any longer), or nil once all the realms are
+func (s *servers) ready() error {
+	realms := s.list()
+	if len(realms) == 0 {
+		return errors.New("no forwarding rules are running")
+	}
+	var notReady []string
+	for _, realm := range realms {
+		if !realm.Ready() {
+			notReady = append(notReady, realm.String())
+		}
+	}
+	if len(notReady) > 0 {
+		sort.Strings(notReady)
+		return fmt.Errorf("not ready: %v", strings.Join(notReady, "; "))
+	}
+	return nil
+}
+
+// tunnelRealms returns the TCP realms running
+func (s *servers) tunnelRealms() []*tcpf.TunnelRealm {
+	var tunnelRealms []*tcpf.TunnelRealm
+	for _, realm := range s.list() {
+		if tunnelRealm, ok := realm.(*tcpf.TunnelRealm); ok {
+			tunnelRealms = append(tunnelRealms, tunnelRealm)
+		}
+	}
+	return tunnelRealms
+}
+
+// shutdown gracefully stops all the realms running and waits for them
+func (s *servers) shutdown(drainTimeout time.Duration) {
+	shutdown(s.list(), drainTimeout)
+	s.serving.Wait()
+}
+
+// shutdown gracefully stops the realms at once
+func shutdown(realms []realm, drainTimeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, realm := range realms {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			realm.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+}
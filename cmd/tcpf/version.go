@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version and git commit of the build, set with
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse --short HEAD)"
+var (
+	version = "dev"
+	commit  = "dev"
+)
+
+// versionString describes the build, taking the commit from the build
+// information Go records when it isn't set at build time
+func versionString() string {
+	revision := commit
+	if info, ok := debug.ReadBuildInfo(); ok && revision == "dev" {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	return fmt.Sprintf("tcpf %v (commit %v, %v %v/%v)", version, revision, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
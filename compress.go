@@ -0,0 +1,44 @@
+package tcpf
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+)
+
+// compressedConn is a connection to or from a peer tcpf instance over which
+// the bytes tunnels forward flow compressed with DEFLATE in both directions.
+// Every write is flushed, so that interactive traffic isn't held back waiting
+// for a block to fill up.
+type compressedConn struct {
+	net.Conn
+	reader io.ReadCloser
+	writer *flate.Writer
+}
+
+func newCompressedConn(conn net.Conn) net.Conn {
+	// BestSpeed errs only for invalid levels
+	writer, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &compressedConn{Conn: conn, reader: flate.NewReader(conn), writer: writer}
+}
+
+func (conn *compressedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *compressedConn) Write(b []byte) (int, error) {
+	n, err := conn.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, conn.writer.Flush()
+}
+
+// CloseWrite ends the compressed stream, which the peer reads as EOF, and
+// half-closes the connection
+func (conn *compressedConn) CloseWrite() error {
+	if err := conn.writer.Close(); err != nil {
+		return err
+	}
+	return closeWrite(conn.Conn)
+}
@@ -0,0 +1,59 @@
+package tcpf
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func BenchmarkCompression(b *testing.B) {
+	// Typical payloads are JSON log lines, which compress well, and
+	// encrypted traffic, which doesn't
+	var text strings.Builder
+	for i := 0; text.Len() < 32<<10; i++ {
+		fmt.Fprintf(&text, `{"time":"2024-05-01T12:00:%02d Z","level":"info","path":"/api/items/%d","status":200,"bytes":%d}`+"\n", i%60, i, 1000+i*7)
+	}
+	random := make([]byte, 32<<10)
+	rand.Read(random)
+	payloads := []struct {
+		name  string
+		chunk []byte
+	}{
+		{"json", []byte(text.String())},
+		{"random", random},
+	}
+	dst := startEcho(b)
+	for _, payload := range payloads {
+		b.Run(payload.name, func(b *testing.B) {
+			_, peer := startRealm(b, dst, WithDecompression())
+			// The link between the two instances counts the compressed
+			// bytes crossing it both ways
+			var wire atomic.Int64
+			link := startServer(b, func(conn net.Conn) {
+				upstream, err := net.Dial("tcp", peer)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				sent := make(chan int64, 1)
+				go func() {
+					n, _ := io.Copy(upstream, conn)
+					closeWrite(upstream)
+					sent <- n
+				}()
+				n, _ := io.Copy(conn, upstream)
+				wire.Add(n + <-sent)
+			})
+			_, addr := startRealm(b, link, WithCompression(), WithBufferSize(32<<10))
+			benchmarkEcho(b, addr, payload.chunk)
+			b.StopTimer()
+			waitFor(b, "the link to close", func() bool { return wire.Load() > 0 })
+			// The bytes the tunnel forwarded both ways per byte over the link
+			b.ReportMetric(float64(2*int64(b.N)*int64(len(payload.chunk)))/float64(wire.Load()), "ratio")
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package tcpf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Prefix of endpoints which are Unix domain sockets, e.g. unix:/path/to.sock
+const unixPrefix = "unix:"
+
+// benignError tells whether err is how connections normally end rather than a
+// failure: EOF, the connection closed on this side, or reset or abandoned by
+// the peer, as when a client goes away
+func benignError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE)
+}
+
+// errorLevel returns the level to log err at: debug for the benign errors,
+// which would flood the log in normal operation, and warn for the others
+func errorLevel(err error) Level {
+	if benignError(err) {
+		return LevelDebug
+	}
+	return LevelWarn
+}
+
+// bufferedConn is a connection which has been read through a bufio.Reader,
+// e.g. to parse a request, so the bytes buffered but not consumed yet are
+// read before the rest of the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *bufferedConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+// closeWrite shuts down the writing side of conn, so that the peer reads EOF
+// while it can still send, or returns errors.ErrUnsupported for connections
+// which can't be half-closed
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// newBufferedConn wraps the connection with a bufio.Reader, unless it is
+// already wrapped by one
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	if buffered, ok := conn.(*bufferedConn); ok {
+		return buffered
+	}
+	return &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// joinEndpoint returns the address of host:port, or host itself if it is a
+// Unix socket given in the form of unix:/path/to.sock
+func joinEndpoint(host string, port string) string {
+	if strings.HasPrefix(host, unixPrefix) {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// splitEndpoint returns the network and address to listen on or to dial for
+// an endpoint returned by joinEndpoint
+func splitEndpoint(endpoint string) (network string, address string) {
+	if path, ok := strings.CutPrefix(endpoint, unixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", endpoint
+}
+
+// removeStaleSocket removes the Unix socket file left at the path by a
+// process which didn't clean it up, so that it can be bound again. The socket
+// is only stale if connecting to it is refused; one a process still accepts
+// connections on is in use. Files which are not sockets are left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is in use by another process: %w", path, syscall.EADDRINUSE)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("can't tell whether %v is stale: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// tune applies the TCP keepalive, TCP_NODELAY and DSCP options to conn; conns
+// other than TCP ones are left as is
+func (o *options) tune(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcpConn.SetKeepAlive(o.keepAlive > 0)
+	if o.keepAlive > 0 {
+		tcpConn.SetKeepAlivePeriod(o.keepAlive)
+	}
+	tcpConn.SetNoDelay(o.noDelay)
+	if o.dscp > 0 && dscpSupported {
+		if err := setDSCP(tcpConn, o.dscp); err != nil {
+			logEvent(LevelDebug, "dscp_error", Fields{"src": conn.LocalAddr(), "dst": conn.RemoteAddr(), "error": err}, "Can't set DSCP of connection %v -> %v: %v", conn.LocalAddr(), conn.RemoteAddr(), err)
+		}
+	}
+}
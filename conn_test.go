@@ -0,0 +1,99 @@
+package tcpf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// listenUnix listens on a Unix socket in a temporary directory of the test,
+// skipping the test where Unix sockets aren't supported
+func listenUnix(t *testing.T) (*net.UnixListener, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tcpf.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skipf("can't listen on a Unix socket: %v", err)
+	}
+	return listener, path
+}
+
+// staleSocket leaves a socket file behind which no process listens on
+func staleSocket(t *testing.T) string {
+	t.Helper()
+	listener, path := listenUnix(t)
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+	return path
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	t.Run("stale", func(t *testing.T) {
+		path := staleSocket(t)
+		if err := removeStaleSocket(path); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("stale socket is left: %v", err)
+		}
+	})
+	t.Run("in use", func(t *testing.T) {
+		listener, path := listenUnix(t)
+		defer listener.Close()
+		if err := removeStaleSocket(path); !errors.Is(err, syscall.EADDRINUSE) {
+			t.Errorf("removeStaleSocket() = %v, want an address in use error", err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("the socket in use is gone: %v", err)
+		}
+	})
+	t.Run("not a socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := removeStaleSocket(path); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("the file is gone: %v", err)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		if err := removeStaleSocket(filepath.Join(t.TempDir(), "missing.sock")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUnixRealm(t *testing.T) {
+	path := staleSocket(t)
+	host, port, _ := net.SplitHostPort(startEcho(t))
+	realm := NewTunnelRealm(unixPrefix+path, "", host, port)
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer realm.Stop()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("over a Unix socket")
+	go conn.Write(msg)
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, msg) {
+		t.Errorf("got %q, %v back, want %q", reply, err, msg)
+	}
+	// A second realm may not take the socket over while the first one runs
+	other := NewTunnelRealm(unixPrefix+path, "", host, port)
+	if err := other.Start(); !errors.Is(err, syscall.EADDRINUSE) {
+		other.Stop()
+		t.Errorf("Start() = %v on a socket in use, want an address in use error", err)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tcpf
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// noDelay returns whether TCP_NODELAY is set on the connection
+func noDelay(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value != 0
+}
+
+func TestNoDelay(t *testing.T) {
+	dst := startEcho(t)
+	for _, enabled := range []bool{true, false} {
+		realm, addr := startRealm(t, dst, WithNoDelay(enabled))
+		conn := dialRealm(t, addr)
+		conn.Write([]byte("x"))
+		conn.Read(make([]byte, 1))
+		id := realm.Tunnels()[0].ID
+		realm.tunnelsLock.RLock()
+		tunnel := realm.tunnels[id]
+		realm.tunnelsLock.RUnlock()
+		// Both the client's and the destination's side of the tunnel
+		for _, conn := range []net.Conn{*tunnel.inbound, *tunnel.outbound} {
+			if got := noDelay(t, conn); got != enabled {
+				t.Errorf("TCP_NODELAY of %v -> %v is %v with WithNoDelay(%v)", conn.LocalAddr(), conn.RemoteAddr(), got, enabled)
+			}
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// Package controlpb holds the gRPC stubs of the control API tcpf serves with
+// -grpc-addr, generated from control.proto with protoc-gen-go and
+// protoc-gen-go-grpc
+package controlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
@@ -0,0 +1,155 @@
+package tcpf
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// errTLSHandshake is wrapped by the errors of failed TLS handshakes with the
+// destinations
+var errTLSHandshake = errors.New("TLS handshake failed")
+
+// dial connects to the destination address for the inbound connection, or
+// takes a connection to it from the pool, retrying failed attempts with an
+// exponential backoff when enabled
+func (realm *TunnelRealm) dial(ctx context.Context, address string, inbound net.Conn) (net.Conn, error) {
+	if outbound := realm.pooled(ctx, address); outbound != nil {
+		return outbound, nil
+	}
+	backoff := realm.dialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		var outbound net.Conn
+		var err error
+		if realm.mux != nil {
+			outbound, err = realm.dialMux(ctx, address)
+		} else {
+			outbound, err = realm.dialOnce(ctx, address, inbound)
+		}
+		if err != nil {
+			realm.counters.dialFailed(err)
+		}
+		if err == nil || attempt > realm.dialRetries || ctx.Err() != nil {
+			return outbound, err
+		}
+		logEvent(LevelWarn, "dial_retry", Fields{"src": inbound.RemoteAddr(), "dst": address, "attempt": attempt, "error": err}, "Dial attempt %d to %v failed, retrying in %v: %v", attempt, address, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// dialer returns the dialer of the realm's outbound connections over the
+// network, bound to the source address for TCP if one is set. Host names
+// resolving to both IPv4 and IPv6 addresses are dialed with Happy Eyeballs
+// (RFC 8305): the fallback family is raced against the primary one once
+// fallbackDelay has passed.
+func (o *options) dialer(network string) net.Dialer {
+	dialer := net.Dialer{Timeout: o.dialTimeout, Resolver: o.resolver, FallbackDelay: o.fallbackDelay}
+	if network == "tcp" && o.srcAddr.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: o.srcAddr.AsSlice(), Zone: o.srcAddr.Zone()}
+	}
+	return dialer
+}
+
+// dialOnce connects to the destination address for the inbound connection,
+// directly or through the upstream proxy, sending the PROXY protocol header
+// unless inbound is nil and performing the TLS handshake with the
+// destination when enabled
+func (realm *TunnelRealm) dialOnce(ctx context.Context, address string, inbound net.Conn) (net.Conn, error) {
+	network, endpoint := splitEndpoint(address)
+	dialer := realm.dialer(network)
+	if realm.dnsCache != nil && network == "tcp" {
+		resolved, err := realm.dnsCache.resolve(ctx, endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("destination address %v is not available: %w", address, err)
+		}
+		endpoint = resolved
+	}
+	if realm.upstream != nil && network == "tcp" {
+		return realm.dialUpstream(ctx, dialer, address, endpoint, inbound)
+	}
+	if realm.transparent && inbound != nil && network == "tcp" {
+		// The destination sees the client's IP address, from a port of
+		// tcpf's choosing
+		if ip, ok := clientIP(inbound.RemoteAddr()); ok {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}
+			dialer.Control = transparent
+		}
+	}
+	outbound, err := dialer.DialContext(ctx, network, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("destination address %v is not available: %w", address, err)
+	}
+	return realm.handshake(ctx, outbound, address, inbound)
+}
+
+// dialUpstream connects to the destination endpoint through the realm's
+// upstream proxy, then performs the handshakes dialOnce does
+func (realm *TunnelRealm) dialUpstream(ctx context.Context, dialer net.Dialer, address string, endpoint string, inbound net.Conn) (net.Conn, error) {
+	outbound, err := dialer.DialContext(ctx, "tcp", realm.upstream.address())
+	if err != nil {
+		return nil, fmt.Errorf("%v is not available: %w", realm.upstream, err)
+	}
+	proxied, err := realm.connectUpstream(outbound, endpoint)
+	if err != nil {
+		outbound.Close()
+		return nil, fmt.Errorf("destination address %v is not available through %v: %w", address, realm.upstream, err)
+	}
+	outbound = proxied
+	return realm.handshake(ctx, outbound, address, inbound)
+}
+
+// handshake sends the PROXY protocol header over the connection to the
+// destination address unless inbound is nil, and performs the TLS handshake
+// with the destination, when enabled
+func (realm *TunnelRealm) handshake(ctx context.Context, outbound net.Conn, address string, inbound net.Conn) (net.Conn, error) {
+	realm.tune(outbound)
+	if realm.sendProxy && inbound != nil {
+		if err := sendProxyHeaderV1(inbound, outbound); err != nil {
+			outbound.Close()
+			return nil, fmt.Errorf("can't send PROXY header to destination address %v: %v", address, err)
+		}
+	}
+	if realm.dstTLSConfig == nil {
+		return outbound, nil
+	}
+	config := realm.dstTLSConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(outbound, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		outbound.Close()
+		return nil, fmt.Errorf("%w with destination address %v: %v", errTLSHandshake, address, err)
+	}
+	return tlsConn, nil
+}
+
+// firstData waits for the first bytes from the client of a connection to be
+// replayed to the destination once it is dialed with WithLazyDial. The wait
+// ends with the idle timeout, if any, or when the realm is stopped.
+func (realm *TunnelRealm) firstData(conn net.Conn) ([]byte, error) {
+	if realm.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(realm.idleTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(realm.ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	buf := make([]byte, realm.bufferSize(DirectionIn))
+	n, err := conn.Read(buf)
+	if n == 0 {
+		return nil, err
+	}
+	// An error along with the bytes is returned again by the next read
+	return buf[:n], nil
+}
@@ -0,0 +1,172 @@
+package tcpf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDestinationTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "over TLS")
+	}))
+	defer backend.Close()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(backend.Certificate())
+	tests := []struct {
+		name   string
+		config *tls.Config
+		ok     bool
+	}{
+		{"insecure", &tls.Config{InsecureSkipVerify: true}, true},
+		// The certificate of httptest is valid for 127.0.0.1, the host of
+		// the destination, which is the server name by default
+		{"verified", &tls.Config{RootCAs: trusted}, true},
+		{"verified server name", &tls.Config{RootCAs: trusted, ServerName: "example.com"}, true},
+		{"wrong server name", &tls.Config{RootCAs: trusted, ServerName: "other.test"}, false},
+		{"unknown CA", &tls.Config{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			realm, addr := startRealm(t, backend.Listener.Addr().String(), WithDestinationTLS(test.config))
+			conn := dialRealm(t, addr)
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: backend.test\r\nConnection: close\r\n\r\n")
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if !test.ok {
+				// The client is closed, and the failure counted both as a
+				// dial and a TLS error
+				if err == nil {
+					response.Body.Close()
+					t.Fatalf("got %v through a tunnel whose handshake should fail", response.Status)
+				}
+				waitFor(t, "the TLS error", func() bool {
+					stats := realm.Stats()
+					return stats.DialErrors == 1 && stats.Errors["tls"] == 1 && stats.Errors["dial"] == 0
+				})
+				if n := realm.TunnelCount(); n != 0 {
+					t.Errorf("%d tunnels open after the handshake failed", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if body, _ := io.ReadAll(response.Body); string(body) != "over TLS" {
+				t.Errorf("got %q from the backend", body)
+			}
+			if stats := realm.Stats(); stats.DialErrors != 0 {
+				t.Errorf("%d dial errors", stats.DialErrors)
+			}
+		})
+	}
+}
+
+func TestLazyDial(t *testing.T) {
+	dst, accepted := startCountingEcho(t)
+	realm, addr := startRealm(t, dst, WithLazyDial(true), WithIdleTimeout(200*time.Millisecond))
+	// The destination is dialed once the client sends its first bytes,
+	// which reach it along with the rest
+	conn := dialRealm(t, addr)
+	time.Sleep(50 * time.Millisecond)
+	if n := accepted.Load(); n != 0 {
+		t.Fatalf("destination dialed %d times before the client sent anything", n)
+	}
+	converse(t, conn, []byte("first"), []byte("first"))
+	converse(t, conn, []byte("second"), []byte("second"))
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("destination dialed %d times, want once", n)
+	}
+	conn.Close()
+
+	// Clients which close before sending, or send nothing until the idle
+	// timeout, never reach it
+	silent := dialRealm(t, addr)
+	closing := dialRealm(t, addr)
+	closing.Close()
+	if n, err := silent.Read(make([]byte, 1)); err == nil {
+		t.Errorf("silent client read %d bytes, want the connection closed", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("destination dialed %d times, want only for the client which sent data", n)
+	}
+	if stats := realm.Stats(); stats.TunnelsTotal != 1 || stats.DialErrors != 0 {
+		t.Errorf("%d tunnels and %d dial errors, want 1 tunnel", stats.TunnelsTotal, stats.DialErrors)
+	}
+
+	// Without an idle timeout, stopping the realm doesn't wait for the
+	// clients yet to send
+	realm, addr = startRealm(t, dst, WithLazyDial(true))
+	waiting := dialRealm(t, addr)
+	time.Sleep(50 * time.Millisecond)
+	stopped := make(chan error, 1)
+	go func() { stopped <- realm.Stop() }()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() waited for the client to send")
+	}
+	if n, err := waiting.Read(make([]byte, 1)); err == nil {
+		t.Errorf("waiting client read %d bytes from a stopped realm", n)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("destination dialed %d times, want only for the client which sent data", n)
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	// A destination which always refuses is dialed once and retried, with
+	// the backoff doubled every time
+	dst := closedPort(t)
+	realm, addr := startRealm(t, dst, WithDialRetries(3, 50*time.Millisecond))
+	start := time.Now()
+	conn := dialRealm(t, addr)
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes from a tunnel to a closed port", n)
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("gave up after %v, want the backoffs of 50+100+200ms", elapsed)
+	}
+	if stats := realm.Stats(); stats.DialErrors != 4 || stats.TunnelsTotal != 0 {
+		t.Errorf("%d dial errors and %d tunnels, want a dial and 3 retries failing", stats.DialErrors, stats.TunnelsTotal)
+	}
+
+	// Stopping the realm doesn't wait for the backoff
+	realm, addr = startRealm(t, dst, WithDialRetries(1, time.Minute))
+	dialRealm(t, addr)
+	waitFor(t, "the first dial", func() bool { return realm.Stats().DialErrors == 1 })
+	stopped := make(chan error, 1)
+	go func() { stopped <- realm.Stop() }()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() waited for the dial backoff")
+	}
+
+	// A destination coming up between the retries gets the tunnel
+	realm, addr = startRealm(t, dst, WithDialRetries(5, 50*time.Millisecond))
+	conn = dialRealm(t, addr)
+	waitFor(t, "the first dial", func() bool { return realm.Stats().DialErrors >= 1 })
+	listener, err := net.Listen("tcp", dst)
+	if err != nil {
+		t.Skipf("can't listen on the closed port again: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		if accepted, err := listener.Accept(); err == nil {
+			defer accepted.Close()
+			io.Copy(accepted, accepted)
+		}
+	}()
+	converse(t, conn, []byte("retried"), []byte("retried"))
+	if n := realm.Stats().TunnelsTotal; n != 1 {
+		t.Errorf("%d tunnels opened, want 1", n)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tcpf
+
+import (
+	"errors"
+	"net"
+)
+
+// DSCP can't be set on this platform, WithDSCP is ignored
+const dscpSupported = false
+
+// setDSCP is only available on Linux and BSDs
+func setDSCP(conn *net.TCPConn, dscp int) error {
+	return errors.ErrUnsupported
+}
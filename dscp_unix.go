@@ -0,0 +1,31 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tcpf
+
+import (
+	"net"
+	"syscall"
+)
+
+// DSCP can be set on this platform
+const dscpSupported = true
+
+// setDSCP marks the packets of conn with the DSCP value, which takes the
+// upper six bits of the IPv4 TOS or the IPv6 traffic class field
+func setDSCP(conn *net.TCPConn, dscp int) error {
+	level, option := syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	// IPv4 and IPv4-mapped addresses are marked with IP_TOS, even on IPv6 sockets
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		level, option = syscall.IPPROTO_IP, syscall.IP_TOS
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), level, option, dscp<<2)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package tcpf
+
+import (
+	"context"
+	"sync"
+)
+
+// Events a subscriber may fall behind by before it is dropped
+const eventsBuffer = 256
+
+// TunnelEvent tells of a tunnel joining or leaving a realm
+type TunnelEvent struct {
+	// "join" or "leave", like the events of the log
+	Type  string
+	Realm string
+	// Summary of the tunnel, with the bytes it forwarded so far
+	Tunnel TunnelInfo
+}
+
+// Events hands the tunnels joining and leaving the realms created with
+// WithEvents to its subscribers, e.g. to stream them over an API. An Events
+// may be shared by several realms.
+type Events struct {
+	mutex sync.Mutex
+	// Channels of the subscribers, and the ones closed once they're dropped
+	subscribers map[chan TunnelEvent]chan struct{}
+}
+
+// NewEvents returns Events without subscribers yet
+func NewEvents() *Events {
+	return &Events{subscribers: make(map[chan TunnelEvent]chan struct{})}
+}
+
+// Subscribe returns the channel the events come in on until ctx is done,
+// which closes it. Tunnels don't wait for their subscribers, so the channel
+// is also closed once the subscriber falls too far behind.
+func (events *Events) Subscribe(ctx context.Context) <-chan TunnelEvent {
+	ch, dropped := make(chan TunnelEvent, eventsBuffer), make(chan struct{})
+	events.mutex.Lock()
+	events.subscribers[ch] = dropped
+	events.mutex.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			events.mutex.Lock()
+			defer events.mutex.Unlock()
+			events.drop(ch)
+		case <-dropped:
+		}
+	}()
+	return ch
+}
+
+// drop closes the channel of a subscriber, unless it is closed already;
+// mutex has to be held
+func (events *Events) drop(ch chan TunnelEvent) {
+	if dropped, ok := events.subscribers[ch]; ok {
+		delete(events.subscribers, ch)
+		close(ch)
+		close(dropped)
+	}
+}
+
+func (events *Events) publish(event TunnelEvent) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	for ch := range events.subscribers {
+		select {
+		case ch <- event:
+		default:
+			events.drop(ch)
+		}
+	}
+}
+
+// publish hands the event of the tunnel to the Events of WithEvents, if any
+func (realm *TunnelRealm) publish(event string, tunnel *TCPTunnel) {
+	if realm.events != nil {
+		realm.events.publish(TunnelEvent{Type: event, Realm: realm.String(), Tunnel: tunnel.info()})
+	}
+}
@@ -0,0 +1,80 @@
+package tcpf
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of the channel, failing the test if it
+// doesn't come
+func nextEvent(t *testing.T, events <-chan TunnelEvent) TunnelEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("the events ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return TunnelEvent{}
+}
+
+func TestEvents(t *testing.T) {
+	events := NewEvents()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribed := events.Subscribe(ctx)
+	realm, addr := startRealm(t, startEcho(t), WithEvents(events))
+	conn := dialRealm(t, addr)
+	join := nextEvent(t, subscribed)
+	if join.Type != "join" || join.Realm != realm.String() || join.Tunnel.Src != conn.LocalAddr().String() {
+		t.Errorf("got %+v, want the tunnel from %v joining %v", join, conn.LocalAddr(), realm)
+	}
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// Leaving, the tunnel tells the bytes it forwarded
+	leave := nextEvent(t, subscribed)
+	if leave.Type != "leave" || leave.Tunnel.ID != join.Tunnel.ID || leave.Tunnel.BytesIn != 5 || leave.Tunnel.BytesOut != 5 {
+		t.Errorf("got %+v, want tunnel %v leaving with 5 bytes each way", leave, join.Tunnel.ID)
+	}
+	cancel()
+	select {
+	case event, ok := <-subscribed:
+		if ok {
+			t.Errorf("got %+v after the subscription ended", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the channel wasn't closed when the subscription ended")
+	}
+}
+
+func TestEventsBehind(t *testing.T) {
+	// A subscriber falling too far behind is dropped, the other ones keep
+	// getting the events
+	events := NewEvents()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow, fast := events.Subscribe(ctx), events.Subscribe(ctx)
+	for i := 0; i <= eventsBuffer; i++ {
+		events.publish(TunnelEvent{Type: "join"})
+		nextEvent(t, fast)
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != eventsBuffer {
+		t.Errorf("dropped subscriber got %d events, want the %d buffered", n, eventsBuffer)
+	}
+	events.publish(TunnelEvent{Type: "leave"})
+	if event := nextEvent(t, fast); event.Type != "leave" {
+		t.Errorf("got %+v, want the leave event", event)
+	}
+}
@@ -0,0 +1,341 @@
+package tcpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// GeoIP looks up the countries of IP addresses in a MaxMind DB file, such as
+// GeoLite2-Country.mmdb or GeoIP2-City.mmdb. The whole file is kept in memory.
+type GeoIP struct {
+	path       string
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// Node the IPv4 addresses start at in an IPv6 tree
+	ipv4Start uint
+}
+
+// Marker the metadata section of a MaxMind DB starts after
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errGeoIPNotFound = errors.New("no country found")
+
+// OpenGeoIP reads the MaxMind DB file at path
+func OpenGeoIP(path string) (*GeoIP, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	start := bytes.LastIndex(file, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("%v is not a MaxMind DB file", path)
+	}
+	start += len(mmdbMetadataMarker)
+	metadata, _, err := decodeMMDB(file[start:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("malformed metadata of %v: %v", path, err)
+	}
+	fields, _ := metadata.(map[string]interface{})
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 || ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported MaxMind DB %v: record size %d, IP version %d", path, recordSize, ipVersion)
+	}
+	// The search tree is followed by 16 zero bytes separating it from the
+	// data, which ends where the metadata marker starts
+	end := uint64(start - len(mmdbMetadataMarker))
+	if nodeCount > end || nodeCount*recordSize/4+16 > end {
+		return nil, fmt.Errorf("malformed MaxMind DB %v: search tree is past the end of the file", path)
+	}
+	treeSize := nodeCount * recordSize / 4
+	db := &GeoIP{
+		path:       path,
+		tree:       file[:treeSize],
+		data:       file[treeSize+16 : end],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+func (db *GeoIP) String() string {
+	return db.path
+}
+
+// Country returns the ISO 3166-1 code of the country of the IP address, e.g.
+// "DE", which is the registered country for addresses without a location
+func (db *GeoIP) Country(ip netip.Addr) (string, error) {
+	ip = ip.Unmap()
+	node, bits := uint(0), ip.AsSlice()
+	if ip.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if ip.Is6() && db.ipVersion == 4 {
+		return "", fmt.Errorf("%v is an IPv4 only database", db.path)
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, bits[i/8]>>(7-i%8)&1)
+	}
+	if node == db.nodeCount {
+		return "", errGeoIPNotFound
+	}
+	// Records past the nodes point into the data section, which starts after
+	// the 16 bytes separating it from the tree
+	if node < db.nodeCount+16 || node-db.nodeCount-16 >= uint(len(db.data)) {
+		return "", fmt.Errorf("malformed search tree of %v", db.path)
+	}
+	offset := int(node - db.nodeCount - 16)
+	record, _, err := decodeMMDB(db.data, offset)
+	if err != nil {
+		return "", fmt.Errorf("malformed data of %v: %v", db.path, err)
+	}
+	fields, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]interface{})
+		if code, ok := country["iso_code"].(string); ok {
+			return code, nil
+		}
+	}
+	return "", errGeoIPNotFound
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a search tree node
+func (db *GeoIP) record(node uint, bit byte) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// The middle byte holds the high nibbles of both records
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// Types of the MaxMind DB data section fields
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBTruncated = errors.New("field is past the end of the section")
+
+// Deepest the maps, arrays and pointers of a MaxMind DB field may nest, far
+// beyond what the databases have; pointers back to an enclosing map or array
+// would otherwise be followed forever
+const maxMMDBDepth = 32
+
+// decodeMMDB decodes the field of a MaxMind DB data section at offset, and
+// returns it along with the offset of the next field. Maps decode to
+// map[string]interface{}, arrays to []interface{}, unsigned integers to
+// uint64 and the other fields to their Go counterparts.
+func decodeMMDB(data []byte, offset int) (interface{}, int, error) {
+	return decodeMMDBField(data, offset, 0)
+}
+
+// decodeMMDBField decodes a field nested depth levels deep
+func decodeMMDBField(data []byte, offset int, depth int) (interface{}, int, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, errors.New("fields nested too deep")
+	}
+	if offset < 0 || offset >= len(data) {
+		return nil, 0, errMMDBTruncated
+	}
+	control := data[offset]
+	offset++
+	kind := int(control >> 5)
+	if kind == mmdbPointer {
+		size := int(control>>3) & 3
+		if offset+size+1 > len(data) {
+			return nil, 0, errMMDBTruncated
+		}
+		pointer := 0
+		if size < 3 {
+			pointer = int(control & 7)
+		}
+		for _, b := range data[offset : offset+size+1] {
+			pointer = pointer<<8 | int(b)
+		}
+		pointer += [4]int{0, 2048, 526336, 0}[size]
+		// Pointers may not point to pointers, which could loop forever
+		if pointer < len(data) && int(data[pointer]>>5) == mmdbPointer {
+			return nil, 0, errors.New("pointer to a pointer")
+		}
+		value, _, err := decodeMMDBField(data, pointer, depth+1)
+		return value, offset + size + 1, err
+	}
+	if kind == mmdbExtended {
+		if offset >= len(data) {
+			return nil, 0, errMMDBTruncated
+		}
+		kind = 7 + int(data[offset])
+		offset++
+	}
+	size := int(control & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(data) {
+			return nil, 0, errMMDBTruncated
+		}
+		size = 0
+		for _, b := range data[offset : offset+n] {
+			size = size<<8 | int(b)
+		}
+		size += [4]int{0, 29, 285, 65821}[n]
+		offset += n
+	}
+	// Every entry of a map or an array takes a byte at least, which bounds
+	// what a malformed size makes them allocate
+	if (kind == mmdbMap || kind == mmdbArray) && size > len(data)-offset {
+		return nil, 0, errMMDBTruncated
+	}
+	switch kind {
+	case mmdbMap:
+		fields := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := decodeMMDBField(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key of type %T", key)
+			}
+			if fields[name], offset, err = decodeMMDBField(data, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return fields, offset, nil
+	case mmdbArray:
+		items := make([]interface{}, size)
+		for i := range items {
+			var err error
+			if items[i], offset, err = decodeMMDBField(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return items, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+	if offset+size > len(data) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return b, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128, mmdbInt32:
+		// Integers are stored without their leading zero bytes; the 128-bit
+		// ones only keep their low 64 bits, which suffice for the metadata
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if kind == mmdbInt32 {
+			return int32(n), offset, nil
+		}
+		return n, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown field type %d", kind)
+}
+
+// ParseCountries parses a comma separated list of ISO 3166-1 country codes
+func ParseCountries(list string) ([]string, error) {
+	var countries []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if len(item) != 2 {
+			return nil, fmt.Errorf("invalid country %q, expected a two letter ISO 3166-1 code", item)
+		}
+		countries = append(countries, strings.ToUpper(item))
+	}
+	return countries, nil
+}
+
+// permittedCountry tells whether a client may open a tunnel or a session
+// according to the country lists, and which country the client is from. Denied
+// countries take precedence, and an empty allow list allows the countries not
+// denied. Clients whose country is unknown are allowed with WithGeoIP's
+// failOpen only.
+func (o *options) permittedCountry(addr net.Addr) (string, bool) {
+	if o.geoIP == nil || len(o.allowCountries) == 0 && len(o.denyCountries) == 0 {
+		return "", true
+	}
+	ip, ok := clientIP(addr)
+	if !ok {
+		return "", o.geoIPFailOpen
+	}
+	country, err := o.geoIP.Country(ip)
+	if err != nil {
+		if !errors.Is(err, errGeoIPNotFound) {
+			logEvent(LevelWarn, "geoip_error", Fields{"src": addr, "error": err}, "Can't look up the country of %v: %v", addr, err)
+		}
+		return "", o.geoIPFailOpen
+	}
+	for _, denied := range o.denyCountries {
+		if country == denied {
+			return country, false
+		}
+	}
+	if len(o.allowCountries) == 0 {
+		return country, true
+	}
+	for _, allowed := range o.allowCountries {
+		if country == allowed {
+			return country, true
+		}
+	}
+	return country, false
+}
@@ -0,0 +1,404 @@
+package tcpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// encodeField encodes a field of a MaxMind DB data section
+func encodeField(kind int, size int, payload []byte) []byte {
+	var field []byte
+	control := byte(kind) << 5
+	if kind > 7 {
+		control = 0
+	}
+	switch {
+	case size < 29:
+		field = append(field, control|byte(size))
+	case size < 285:
+		field = append(field, control|29)
+	default:
+		field = append(field, control|30)
+	}
+	if kind > 7 {
+		field = append(field, byte(kind-7))
+	}
+	switch {
+	case size >= 285:
+		field = append(field, byte((size-285)>>8), byte(size-285))
+	case size >= 29:
+		field = append(field, byte(size-29))
+	}
+	return append(field, payload...)
+}
+
+func encodeString(s string) []byte {
+	return encodeField(mmdbString, len(s), []byte(s))
+}
+
+func encodeUint(kind int, n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return encodeField(kind, len(b), b)
+}
+
+// encodeMap encodes a map of the encoded values by key, in the order of the keys
+func encodeMap(entries map[string][]byte) []byte {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	field := encodeField(mmdbMap, len(entries), nil)
+	for _, key := range keys {
+		field = append(field, encodeString(key)...)
+		field = append(field, entries[key]...)
+	}
+	return field
+}
+
+// encodePointer encodes a one byte pointer to offset, which is below 2048
+func encodePointer(offset int) []byte {
+	return []byte{mmdbPointer<<5 | byte(offset>>8), byte(offset)}
+}
+
+// countryRecord encodes a record the way the GeoLite2-Country database does
+func countryRecord(key, code string) []byte {
+	return encodeMap(map[string][]byte{
+		key: encodeMap(map[string][]byte{"iso_code": encodeString(code)}),
+	})
+}
+
+// trieNode is a node of the search tree of a MaxMind DB fixture, with the
+// data section offset of each record that ends there, or -1
+type trieNode struct {
+	children [2]*trieNode
+	data     [2]int
+}
+
+// buildMMDB builds a MaxMind DB with the given record size and IP version,
+// mapping networks to the offsets of their records in data. IPv4 networks of
+// an IPv6 database go under ::/96, as in the MaxMind databases.
+func buildMMDB(recordSize, ipVersion int, networks map[string]int, data []byte) []byte {
+	root := &trieNode{data: [2]int{-1, -1}}
+	for network, offset := range networks {
+		prefix := netip.MustParsePrefix(network)
+		bits, length := prefix.Addr().AsSlice(), prefix.Bits()
+		if prefix.Addr().Is4() && ipVersion == 6 {
+			bits, length = append(make([]byte, 12), bits...), length+96
+		}
+		node := root
+		for i := 0; i < length; i++ {
+			bit := bits[i/8] >> (7 - i%8) & 1
+			if i == length-1 {
+				node.data[bit] = offset
+			} else if node.children[bit] == nil {
+				node.children[bit] = &trieNode{data: [2]int{-1, -1}}
+				node = node.children[bit]
+			} else {
+				node = node.children[bit]
+			}
+		}
+	}
+	// Number the nodes breadth first, the root being 0
+	nodes, ids := []*trieNode{root}, map[*trieNode]int{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				ids[child] = len(nodes)
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	nodeCount := len(nodes)
+	var tree []byte
+	for _, node := range nodes {
+		var records [2]uint32
+		for bit := range records {
+			switch {
+			case node.children[bit] != nil:
+				records[bit] = uint32(ids[node.children[bit]])
+			case node.data[bit] >= 0:
+				records[bit] = uint32(nodeCount + 16 + node.data[bit])
+			default:
+				records[bit] = uint32(nodeCount)
+			}
+		}
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(left>>20&0xf0|right>>24&0x0f), byte(right>>16), byte(right>>8), byte(right))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, left)
+			tree = binary.BigEndian.AppendUint32(tree, right)
+		}
+	}
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, encodeMap(map[string][]byte{
+		"database_type": encodeString("tcpf-test"),
+		"ip_version":    encodeUint(mmdbUint16, uint64(ipVersion)),
+		"node_count":    encodeUint(mmdbUint32, uint64(nodeCount)),
+		"record_size":   encodeUint(mmdbUint16, uint64(recordSize)),
+	})...)
+}
+
+// writeMMDB writes a MaxMind DB file for the test and returns its path
+func writeMMDB(t testing.TB, file []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// countriesMMDB builds a MaxMind DB placing 192.0.2.0/24 and 2001:db8::/32 in
+// Germany, 198.51.100.0/25 in France, and 203.0.113.0/24 only registered in
+// Japan
+func countriesMMDB(recordSize, ipVersion int) []byte {
+	de, fr, jp := countryRecord("country", "DE"), countryRecord("country", "FR"), countryRecord("registered_country", "JP")
+	data := append(append(append([]byte{}, de...), fr...), jp...)
+	networks := map[string]int{
+		"192.0.2.0/24":    0,
+		"198.51.100.0/25": len(de),
+		"203.0.113.0/24":  len(de) + len(fr),
+	}
+	if ipVersion == 6 {
+		networks["2001:db8::/32"] = 0
+	}
+	return buildMMDB(recordSize, ipVersion, networks, data)
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			db, err := OpenGeoIP(writeMMDB(t, countriesMMDB(recordSize, ipVersion)))
+			if err != nil {
+				t.Fatalf("record size %d, IPv%d: %v", recordSize, ipVersion, err)
+			}
+			tests := []struct {
+				ip   string
+				want string
+				err  error
+			}{
+				{"192.0.2.1", "DE", nil},
+				{"192.0.2.255", "DE", nil},
+				{"::ffff:192.0.2.9", "DE", nil},
+				{"198.51.100.1", "FR", nil},
+				{"198.51.100.200", "", errGeoIPNotFound},
+				{"203.0.113.5", "JP", nil},
+				{"10.0.0.1", "", errGeoIPNotFound},
+			}
+			if ipVersion == 6 {
+				tests = append(tests, []struct {
+					ip   string
+					want string
+					err  error
+				}{
+					{"2001:db8::1", "DE", nil},
+					{"2001:db9::1", "", errGeoIPNotFound},
+				}...)
+			}
+			for _, test := range tests {
+				code, err := db.Country(netip.MustParseAddr(test.ip))
+				if code != test.want || !errors.Is(err, test.err) {
+					t.Errorf("record size %d, IPv%d: Country(%v) = %q, %v, want %q, %v",
+						recordSize, ipVersion, test.ip, code, err, test.want, test.err)
+				}
+			}
+			if ipVersion == 4 {
+				if _, err := db.Country(netip.MustParseAddr("2001:db8::1")); err == nil {
+					t.Errorf("record size %d: looked up an IPv6 address in an IPv4 database", recordSize)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenGeoIPMalformed(t *testing.T) {
+	valid := countriesMMDB(24, 6)
+	metadata := func(nodeCount, recordSize, ipVersion uint64) []byte {
+		return append(append([]byte{}, mmdbMetadataMarker...), encodeMap(map[string][]byte{
+			"ip_version":  encodeUint(mmdbUint16, ipVersion),
+			"node_count":  encodeUint(mmdbUint32, nodeCount),
+			"record_size": encodeUint(mmdbUint16, recordSize),
+		})...)
+	}
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"empty", nil},
+		{"no metadata", valid[:len(valid)/2]},
+		{"truncated metadata", valid[:len(valid)-3]},
+		{"record size", metadata(1, 20, 4)},
+		{"IP version", metadata(1, 24, 5)},
+		{"tree past the end", append(make([]byte, 40), metadata(1000, 24, 4)...)},
+		{"node count overflowing", append(make([]byte, 40), metadata(1<<62, 32, 4)...)},
+		{"tree into the marker", append(make([]byte, 17), metadata(1, 24, 4)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := OpenGeoIP(writeMMDB(t, test.file)); err == nil {
+				t.Error("opened a malformed database")
+			}
+		})
+	}
+}
+
+func TestGeoIPCountryMalformed(t *testing.T) {
+	// A map whose only value points back to the map itself
+	cycle := append(encodeField(mmdbMap, 1, nil), encodeString("country")...)
+	cycle = append(cycle, encodePointer(0)...)
+	// A map whose value points to a pointer to the map
+	pointers := append(encodeField(mmdbMap, 1, nil), encodeString("country")...)
+	pointers = append(pointers, encodePointer(len(pointers)+2)...)
+	pointers = append(pointers, encodePointer(0)...)
+	tests := []struct {
+		name    string
+		data    []byte
+		offset  int
+		corrupt func(file []byte)
+	}{
+		{"pointer cycle", cycle, 0, nil},
+		{"pointer to a pointer", pointers, 0, nil},
+		{"map past the end", encodeField(mmdbMap, 1<<16, nil), 0, nil},
+		{"string past the end", encodeField(mmdbString, 10, []byte("DE")), 0, nil},
+		{"map key not a string", append(encodeField(mmdbMap, 1, nil), encodeUint(mmdbUint16, 1)...), 0, nil},
+		{"record past the data", countryRecord("country", "DE"), 100, nil},
+		// Records from nodeCount+1 to nodeCount+15 point into the 16 bytes
+		// separating the tree from the data
+		{"record into the separator", countryRecord("country", "DE"), 0, func(file []byte) {
+			// The tree is a chain of the 120 nodes leading to the network,
+			// whose last bit is 0, so the left record of the last node
+			// holds its data
+			last := 119
+			file[last*6], file[last*6+1], file[last*6+2] = 0, 0, 120+3
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := buildMMDB(24, 6, map[string]int{"192.0.2.0/24": test.offset}, test.data)
+			if test.corrupt != nil {
+				test.corrupt(file)
+			}
+			db, err := OpenGeoIP(writeMMDB(t, file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, err := db.Country(netip.MustParseAddr("192.0.2.1"))
+			if err == nil || errors.Is(err, errGeoIPNotFound) {
+				t.Errorf("Country() = %q, %v, want a malformed database error", code, err)
+			}
+		})
+	}
+}
+
+// FuzzDecodeMMDB checks that no data section makes the decoder panic or
+// recurse forever
+func FuzzDecodeMMDB(f *testing.F) {
+	f.Add(countryRecord("country", "DE"))
+	f.Add(append(append(encodeField(mmdbMap, 1, nil), encodeString("a")...), encodePointer(0)...))
+	f.Add(encodeField(mmdbArray, 2, append(encodeUint(mmdbUint64, 1<<40), encodeField(mmdbBool, 1, nil)...)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeMMDB(data, 0)
+	})
+}
+
+func TestGeoIPTruncatedFiles(t *testing.T) {
+	// No prefix of a database may make the reader panic
+	valid := countriesMMDB(28, 6)
+	for n := range valid {
+		db, err := OpenGeoIP(writeMMDB(t, valid[:n]))
+		if err == nil {
+			db.Country(netip.MustParseAddr("192.0.2.1"))
+		}
+	}
+}
+
+func TestPermittedCountry(t *testing.T) {
+	db, err := OpenGeoIP(writeMMDB(t, countriesMMDB(24, 6)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		allow, deny []string
+		failOpen    bool
+		addr        string
+		want        bool
+	}{
+		{"no lists", nil, nil, false, "10.0.0.1:1000", true},
+		{"allowed", []string{"DE", "FR"}, nil, false, "192.0.2.1:1000", true},
+		{"not allowed", []string{"FR"}, nil, false, "192.0.2.1:1000", false},
+		{"denied", nil, []string{"DE"}, false, "[2001:db8::1]:1000", false},
+		{"not denied", nil, []string{"FR"}, false, "192.0.2.1:1000", true},
+		{"deny wins", []string{"DE"}, []string{"DE"}, false, "192.0.2.1:1000", false},
+		{"registered country", []string{"JP"}, nil, false, "203.0.113.1:1000", true},
+		{"unknown", nil, []string{"FR"}, false, "10.0.0.1:1000", false},
+		{"unknown fail open", nil, []string{"FR"}, true, "10.0.0.1:1000", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newOptions([]Option{WithGeoIP(db, test.failOpen), WithAllowCountries(test.allow), WithDenyCountries(test.deny)})
+			addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(test.addr))
+			if _, got := o.permittedCountry(addr); got != test.want {
+				t.Errorf("permittedCountry(%v) = %v, want %v", test.addr, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUDPCountries(t *testing.T) {
+	// The loopback clients of the test are from Germany
+	db, err := OpenGeoIP(writeMMDB(t, buildMMDB(24, 4, map[string]int{"127.0.0.0/8": 0}, countryRecord("country", "DE"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := startUDPEcho(t)
+	tests := []struct {
+		name string
+		opts []Option
+		want bool
+	}{
+		{"allowed", []Option{WithAllowCountries([]string{"DE"})}, true},
+		{"denied", []Option{WithDenyCountries([]string{"DE"})}, false},
+		{"not allowed", []Option{WithAllowCountries([]string{"FR"})}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			realm, addr := startUDPRealm(t, dst, append(test.opts, WithGeoIP(db, false))...)
+			conn, err := net.DialUDP("udp", nil, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			msg := []byte("ping")
+			timeout := 2 * time.Second
+			if !test.want {
+				timeout = 200 * time.Millisecond
+			}
+			reply := udpExchange(t, conn, msg, timeout)
+			if got := bytes.Equal(reply, msg); got != test.want {
+				t.Errorf("forwarded = %v, want %v", got, test.want)
+			}
+			if sessions := len(realm.listSessions()); !test.want && sessions != 0 {
+				t.Errorf("%d sessions opened for a refused client", sessions)
+			}
+		})
+	}
+}
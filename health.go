@@ -0,0 +1,116 @@
+package tcpf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// check periodically dials every destination of the realm and marks the
+// ones which fail healthFailures checks in a row as down, so that new
+// tunnels skip them until they accept connections again
+func (realm *TunnelRealm) check() {
+	defer realm.running.Done()
+	ticker := time.NewTicker(realm.healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, dst := range realm.destinations.destinations {
+				realm.destinations.report(dst, realm.probe(dst.address), realm.healthFailures)
+			}
+		case <-realm.ctx.Done():
+			return
+		}
+	}
+}
+
+// probe returns the error of connecting to the destination address, if any
+func (realm *TunnelRealm) probe(address string) error {
+	ctx, cancel := context.WithTimeout(realm.ctx, realm.healthInterval)
+	defer cancel()
+	network, endpoint := splitEndpoint(address)
+	dialer := realm.dialer(network)
+	conn, err := dialer.DialContext(ctx, network, endpoint)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// report records the result of a health check of the destination
+func (b *balancer) report(dst *destination, err error, threshold int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		if dst.down {
+			logEvent(LevelInfo, "destination_up", Fields{"dst": dst.address}, "Destination %v is up", dst.address)
+		}
+		dst.down, dst.failures = false, 0
+		return
+	}
+	dst.failures++
+	if !dst.down && dst.failures >= threshold {
+		logEvent(LevelWarn, "destination_down", Fields{"dst": dst.address, "error": err}, "Destination %v is down: %v", dst.address, err)
+		dst.down = true
+	}
+}
+
+// health returns whether each of the destinations is considered up
+func (b *balancer) health() map[string]bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	health := make(map[string]bool, len(b.destinations))
+	for _, dst := range b.destinations {
+		health[dst.address] = !dst.down
+	}
+	return health
+}
+
+// DestinationHealth returns whether each of the realm's destination addresses
+// is considered up by the health checker. All destinations are up unless
+// health checks are enabled with WithHealthCheck.
+func (realm *TunnelRealm) DestinationHealth() map[string]bool {
+	return realm.destinations.health()
+}
+
+// Ready tells whether the realm is accepting connections: it has been
+// started, is still listening and not paused and, with WithHealthCheck, some
+// of its destinations are up
+func (realm *TunnelRealm) Ready() bool {
+	realm.mutex.Lock()
+	listening := realm.listening
+	realm.mutex.Unlock()
+	if !listening || realm.paused.Load() || realm.ctx.Err() != nil {
+		return false
+	}
+	if realm.healthInterval <= 0 || realm.negotiator != nil {
+		return true
+	}
+	for _, up := range realm.DestinationHealth() {
+		if up {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthHandler returns an HTTP handler of the liveness and readiness probes
+// of the process, e.g. for Kubernetes: /healthz answers 200 OK as long as the
+// process serves it, while /readyz answers 200 OK only when ready returns
+// nil, and 503 Service Unavailable with the error otherwise
+func HealthHandler(ready func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
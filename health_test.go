@@ -0,0 +1,58 @@
+package tcpf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	realm, _ := startRealm(t, startEcho(t))
+	handler := HealthHandler(func() error {
+		if !realm.Ready() {
+			return errors.New("realm isn't ready")
+		}
+		return nil
+	})
+	probe := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code, strings.TrimSpace(recorder.Body.String())
+	}
+	tests := []struct {
+		name   string
+		pause  bool
+		ready  int
+		reason string
+	}{
+		{"running", false, http.StatusOK, "ok"},
+		// A paused realm refuses connections, so it isn't ready, while the
+		// process stays alive
+		{"paused", true, http.StatusServiceUnavailable, "realm isn't ready"},
+		{"resumed", false, http.StatusOK, "ok"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.pause {
+				realm.Pause()
+			} else {
+				realm.Resume()
+			}
+			if code, body := probe("/healthz"); code != http.StatusOK || body != "ok" {
+				t.Errorf("/healthz = %v %q", code, body)
+			}
+			if code, body := probe("/readyz"); code != test.ready || body != test.reason {
+				t.Errorf("/readyz = %v %q, want %v %q", code, body, test.ready, test.reason)
+			}
+		})
+	}
+	realm.Stop()
+	if code, _ := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %v after Stop", code)
+	}
+	if code, _ := probe("/other"); code != http.StatusNotFound {
+		t.Errorf("/other = %v", code)
+	}
+}
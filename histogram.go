@@ -0,0 +1,144 @@
+package tcpf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the histograms of the tunnels closed, unless WithHistogramBuckets
+// sets others: lifetimes from a tenth of a second to an hour, and bytes from
+// 1KB to 1GB in steps of 4
+var (
+	defaultDurationBuckets = []time.Duration{
+		100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second, 10 * time.Second,
+		30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute, time.Hour,
+	}
+	defaultByteBuckets = []int64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30}
+)
+
+// Histogram is the distribution of the values observed across buckets
+type Histogram struct {
+	// Upper bounds of the buckets, ascending; the last bucket, of the values
+	// above them all, has none
+	Bounds []float64
+	// Number of values in each bucket, one more than the bounds
+	Counts []int64
+	// Number of values and their sum
+	Count int64
+	Sum   float64
+}
+
+// add adds the values of other to the histogram, returning false if the two
+// don't have the same buckets
+func (h *Histogram) add(other Histogram) bool {
+	if h.Counts == nil {
+		*h = Histogram{Bounds: other.Bounds, Counts: make([]int64, len(other.Counts))}
+	}
+	if len(h.Bounds) != len(other.Bounds) {
+		return false
+	}
+	for i, bound := range h.Bounds {
+		if bound != other.Bounds[i] {
+			return false
+		}
+	}
+	for i, n := range other.Counts {
+		h.Counts[i] += n
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+	return true
+}
+
+// histogram counts the values observed in a realm
+type histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []int64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// durationBounds returns the bounds of the buckets of durations, in seconds
+func durationBounds(buckets []time.Duration) []float64 {
+	bounds := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		bounds[i] = bucket.Seconds()
+	}
+	return bounds
+}
+
+// byteBounds returns the bounds of the buckets of bytes
+func byteBounds(buckets []int64) []float64 {
+	bounds := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		bounds[i] = float64(bucket)
+	}
+	return bounds
+}
+
+func (h *histogram) observe(value float64) {
+	// The bucket of a value is the first one bounded by it or more
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[i]++
+	h.sum += value
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	snapshot := Histogram{Bounds: h.bounds, Counts: append([]int64(nil), h.counts...), Sum: h.sum}
+	for _, n := range h.counts {
+		snapshot.Count += n
+	}
+	return snapshot
+}
+
+// ParseDurationBuckets parses a comma separated list of ascending durations,
+// e.g. 1s,1m,1h, bounding the buckets of a histogram of tunnel lifetimes
+func ParseDurationBuckets(list string) ([]time.Duration, error) {
+	var buckets []time.Duration
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		bucket, err := time.ParseDuration(item)
+		if err != nil || bucket <= 0 {
+			return nil, fmt.Errorf("invalid bucket %q, expected a positive duration", item)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %q isn't larger than the one before it", item)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// ParseByteBuckets parses a comma separated list of ascending numbers of
+// bytes bounding the buckets of a histogram of the bytes tunnels forward
+func ParseByteBuckets(list string) ([]int64, error) {
+	var buckets []int64
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		bucket, err := strconv.ParseInt(item, 10, 64)
+		if err != nil || bucket <= 0 {
+			return nil, fmt.Errorf("invalid bucket %q, expected a positive number of bytes", item)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %q isn't larger than the one before it", item)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
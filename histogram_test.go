@@ -0,0 +1,84 @@
+package tcpf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	h := newHistogram([]float64{1, 10, 100})
+	// Values on a bound count in its bucket, as Prometheus' le means
+	for _, value := range []float64{0, 1, 1.5, 10, 99, 100, 101, 1e9} {
+		h.observe(value)
+	}
+	snapshot := h.snapshot()
+	if want := []int64{2, 2, 2, 2}; !reflect.DeepEqual(snapshot.Counts, want) {
+		t.Errorf("counts are %v, want %v", snapshot.Counts, want)
+	}
+	if snapshot.Count != 8 || snapshot.Sum != 0+1+1.5+10+99+100+101+1e9 {
+		t.Errorf("count %d and sum %v", snapshot.Count, snapshot.Sum)
+	}
+	// The snapshot doesn't change with later values
+	h.observe(5)
+	if snapshot.Counts[1] != 2 {
+		t.Error("snapshot shares its counts with the histogram")
+	}
+}
+
+func TestHistogramAdd(t *testing.T) {
+	a, b := newHistogram([]float64{1, 2}), newHistogram([]float64{1, 2})
+	a.observe(0.5)
+	b.observe(1.5)
+	b.observe(3)
+	var total Histogram
+	if !total.add(a.snapshot()) || !total.add(b.snapshot()) {
+		t.Fatal("histograms with the same buckets don't add up")
+	}
+	if want := []int64{1, 1, 1}; !reflect.DeepEqual(total.Counts, want) || total.Count != 3 || total.Sum != 5 {
+		t.Errorf("sum of the histograms is %+v", total)
+	}
+	for _, bounds := range [][]float64{{1}, {1, 3}} {
+		if total.add(newHistogram(bounds).snapshot()) {
+			t.Errorf("added a histogram with the buckets %v to one with %v", bounds, total.Bounds)
+		}
+	}
+}
+
+func TestTunnelHistograms(t *testing.T) {
+	realm, addr := startRealm(t, startEcho(t), WithHistogramBuckets([]time.Duration{time.Minute}, []int64{8}))
+	for _, msg := range []string{"short", "longer than 8"} {
+		roundTrip(t, addr, []byte(msg))
+	}
+	waitFor(t, "the tunnels to close", func() bool { return realm.Stats().Durations.Count == 2 })
+	stats := realm.Stats()
+	if want := []int64{2, 0}; !reflect.DeepEqual(stats.Durations.Counts, want) {
+		t.Errorf("durations are %v, want %v", stats.Durations.Counts, want)
+	}
+	for _, h := range []Histogram{stats.TunnelBytesIn, stats.TunnelBytesOut} {
+		if want := []int64{1, 1}; !reflect.DeepEqual(h.Counts, want) || h.Sum != 18 {
+			t.Errorf("bytes are %v summing up to %v, want %v and 18", h.Counts, h.Sum, want)
+		}
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	durations, err := ParseDurationBuckets("100ms, 1s,1m")
+	if err != nil || !reflect.DeepEqual(durations, []time.Duration{100 * time.Millisecond, time.Second, time.Minute}) {
+		t.Errorf("ParseDurationBuckets() = %v, %v", durations, err)
+	}
+	sizes, err := ParseByteBuckets("1024,65536")
+	if err != nil || !reflect.DeepEqual(sizes, []int64{1024, 65536}) {
+		t.Errorf("ParseByteBuckets() = %v, %v", sizes, err)
+	}
+	for _, list := range []string{"1s,1s", "1m,1s", "0s", "-1s", "one"} {
+		if _, err := ParseDurationBuckets(list); err == nil {
+			t.Errorf("ParseDurationBuckets(%q) succeeded", list)
+		}
+	}
+	for _, list := range []string{"10,10", "10,5", "0", "1.5", "1KB"} {
+		if _, err := ParseByteBuckets(list); err == nil {
+			t.Errorf("ParseByteBuckets(%q) succeeded", list)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+)
+
+// hostRouter routes plaintext HTTP connections by the Host header of their
+// first request
+type hostRouter struct {
+	routes map[string]string
+}
+
+func (r *hostRouter) String() string {
+	return "HTTP host"
+}
+
+func (r *hostRouter) route(reader *bufio.Reader) (string, error) {
+	host, err := peekHost(reader)
+	if err != nil || host == "" {
+		return "", err
+	}
+	return routeByName(r.routes, host), nil
+}
+
+// peekHost returns the lower-cased host name, without its port, of the Host
+// header of the HTTP/1.x request the reader starts with, or "" if the
+// connection doesn't speak HTTP/1.x or its request has no Host header
+func peekHost(reader *bufio.Reader) (string, error) {
+	if protocol, err := sniffProtocol(reader); err != nil || protocol != ProtocolHTTP {
+		return "", err
+	}
+	header, err := peekHeader(reader)
+	if err != nil {
+		return "", err
+	}
+	// The request line comes before the first header line
+	for _, line := range bytes.Split(header, []byte("\n"))[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(name), "Host") {
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(string(value)))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]"), nil
+	}
+	return "", nil
+}
+
+// peekHeader peeks the header of the HTTP/1.x request or response the reader
+// starts with, up to the empty line which ends it. It returns nil if the
+// header doesn't fit in the reader's buffer.
+func peekHeader(reader *bufio.Reader) ([]byte, error) {
+	for n := 1; ; n = reader.Buffered() + 1 {
+		b, err := reader.Peek(n)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b = b[:reader.Buffered()]
+		if end := bytes.Index(b, []byte("\r\n\r\n")); end >= 0 {
+			return b[:end+2], nil
+		}
+		if end := bytes.Index(b, []byte("\n\n")); end >= 0 {
+			return b[:end+1], nil
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPeekHost(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"Host", "GET / HTTP/1.1\r\nHost: App.Example.COM\r\n\r\n", "app.example.com"},
+		{"Host with a port", "GET / HTTP/1.1\r\nUser-Agent: test\r\nHost: app.test:8080\r\n\r\n", "app.test"},
+		{"IPv6 literal", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n", "2001:db8::1"},
+		{"header name case", "POST /form HTTP/1.1\r\nhOST:app.test\r\nContent-Length: 0\r\n\r\n", "app.test"},
+		{"bare line feeds", "GET / HTTP/1.1\nHost: app.test\n\n", "app.test"},
+		{"no Host", "GET / HTTP/1.0\r\nUser-Agent: test\r\n\r\n", ""},
+		{"other header ending in Host", "GET / HTTP/1.1\r\nX-Forwarded-Host: app.test\r\n\r\n", ""},
+		{"not HTTP", "SSH-2.0-OpenSSH_9.6\r\n", ""},
+		{"header too large", "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("x", routeBufSize) + "\r\nHost: app.test\r\n\r\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReaderSize(bytes.NewReader([]byte(test.data)), routeBufSize)
+			host, err := peekHost(reader)
+			if err != nil || host != test.want {
+				t.Errorf("peekHost() = %q, %v, want %q", host, err, test.want)
+			}
+			// The request is peeked, not consumed
+			if data, _ := io.ReadAll(reader); string(data) != test.data {
+				t.Errorf("read %q after peeking, want the request", data)
+			}
+		})
+	}
+	// A client closing in the middle of the header can't be routed
+	reader := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: app.test\r\n"))
+	if _, err := peekHost(reader); err == nil {
+		t.Error("peekHost() succeeded on a truncated header")
+	}
+}
+
+func TestHostRoutes(t *testing.T) {
+	routes := map[string]string{
+		"app.test":    startTagged(t, "app"),
+		"*.wild.test": startTagged(t, "wild"),
+	}
+	_, addr := startRealm(t, startTagged(t, "default"), WithHostRoutes(routes))
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{"Host", "GET / HTTP/1.1\r\nHost: app.test\r\n\r\n", "app"},
+		{"Host with a port", "GET / HTTP/1.1\r\nHost: app.test:8080\r\n\r\n", "app"},
+		{"wildcard", "GET / HTTP/1.1\r\nHost: API.wild.test\r\n\r\n", "wild"},
+		{"unknown host", "GET / HTTP/1.1\r\nHost: other.test\r\n\r\n", "default"},
+		{"no Host", "GET / HTTP/1.0\r\n\r\n", "default"},
+		{"not HTTP", "SSH-2.0-OpenSSH_9.6\r\n", "default"},
+		// The requests following the first one on the connection go with
+		// it, whatever their Host
+		{"kept alive", "POST /a HTTP/1.1\r\nHost: app.test\r\nContent-Length: 4\r\n\r\nbodyGET /b HTTP/1.1\r\nHost: other.test\r\n\r\n", "app"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := routedTo(t, addr, []byte(test.request)); got != test.want {
+				t.Errorf("routed to %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package tcpf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// httpConnectServer negotiates the destination of a connection as an HTTP
+// forward proxy supporting the CONNECT method
+type httpConnectServer struct{}
+
+func (server *httpConnectServer) String() string {
+	return "HTTP CONNECT"
+}
+
+func (server *httpConnectServer) destination(conn net.Conn) (string, net.Conn, error) {
+	buffered := newBufferedConn(conn)
+	request, err := http.ReadRequest(buffered.reader)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return "", nil, fmt.Errorf("can't read HTTP request: %v", err)
+	}
+	if request.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed, "Allow: CONNECT")
+		return "", nil, fmt.Errorf("unsupported HTTP method %v", request.Method)
+	}
+	if _, _, err := net.SplitHostPort(request.Host); err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return "", nil, fmt.Errorf("invalid CONNECT target %q: %v", request.Host, err)
+	}
+	return request.Host, buffered, nil
+}
+
+func (server *httpConnectServer) reply(conn net.Conn, outbound net.Conn, err error) error {
+	switch {
+	case err == nil:
+		_, err = fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		return err
+	case errors.Is(err, errTargetNotAllowed):
+		return writeHTTPStatus(conn, http.StatusForbidden)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return writeHTTPStatus(conn, http.StatusGatewayTimeout)
+	default:
+		return writeHTTPStatus(conn, http.StatusBadGateway)
+	}
+}
+
+// writeHTTPStatus writes a response with the status and extra headers and
+// no body, as the connection is closed right after
+func writeHTTPStatus(conn net.Conn, status int, headers ...string) error {
+	response := fmt.Sprintf("HTTP/1.1 %d %v\r\n", status, http.StatusText(status))
+	for _, header := range headers {
+		response += header + "\r\n"
+	}
+	_, err := fmt.Fprint(conn, response+"Connection: close\r\nContent-Length: 0\r\n\r\n")
+	return err
+}
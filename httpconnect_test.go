@@ -0,0 +1,77 @@
+package tcpf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// readHTTPResponse reads the proxy's response to a request of the method
+func readHTTPResponse(t *testing.T, reader *bufio.Reader, method string) *http.Response {
+	t.Helper()
+	response, err := http.ReadResponse(reader, &http.Request{Method: method})
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	return response
+}
+
+func TestHTTPConnect(t *testing.T) {
+	_, proxy := startRealm(t, closedPort(t), WithHTTPConnect())
+	echo := startEcho(t)
+	conn := dialRealm(t, proxy)
+	// The first bytes of the tunnel follow the request right away, before
+	// the response is read
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\nearly", echo, echo)
+	reader := bufio.NewReader(conn)
+	response := readHTTPResponse(t, reader, http.MethodConnect)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT responded %v", response.Status)
+	}
+	conn.Write([]byte(" and later"))
+	reply := make([]byte, len("early and later"))
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "early and later" {
+		t.Errorf("got %q back, want %q", reply, "early and later")
+	}
+}
+
+func TestHTTPConnectFailures(t *testing.T) {
+	denied, _ := ParsePortRanges("1-1023")
+	_, proxy := startRealm(t, closedPort(t), WithHTTPConnect(), WithDenyPorts(denied), WithDialTimeout(time.Second))
+	closed := closedPort(t)
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"refused", "CONNECT " + closed + " HTTP/1.1\r\nHost: " + closed + "\r\n\r\n", http.StatusBadGateway},
+		{"port denied", "CONNECT 127.0.0.1:22 HTTP/1.1\r\nHost: 127.0.0.1:22\r\n\r\n", http.StatusForbidden},
+		{"no port", "CONNECT 127.0.0.1 HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n", http.StatusBadRequest},
+		{"GET", "GET http://" + closed + "/ HTTP/1.1\r\nHost: " + closed + "\r\n\r\n", http.StatusMethodNotAllowed},
+		{"malformed", "CONNECT\r\n\r\n", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialRealm(t, proxy)
+			conn.Write([]byte(test.request))
+			reader := bufio.NewReader(conn)
+			response := readHTTPResponse(t, reader, http.MethodConnect)
+			if response.StatusCode != test.status {
+				t.Errorf("responded %v, want %d", response.Status, test.status)
+			}
+			if test.status == http.StatusMethodNotAllowed && response.Header.Get("Allow") != http.MethodConnect {
+				t.Errorf("Allow header is %q", response.Header.Get("Allow"))
+			}
+			// The connection is closed after the failure
+			if n, err := reader.Read(make([]byte, 1)); err == nil {
+				t.Errorf("read %d bytes after the response", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest HTTP header parsed; the connections sending larger ones are
+// forwarded unchanged from then on, unless the stream is strict
+const maxHTTPHeader = 64 << 10
+
+// Errors of a strict httpStream reading framing it can't follow
+var (
+	errHeaderTooLarge = errors.New("HTTP header too large")
+	errMalformedChunk = errors.New("malformed HTTP chunk size")
+)
+
+// States of the HTTP/1.x messages read through an httpStream
+const (
+	httpHeader = iota
+	httpBody
+	httpChunkSize
+	httpChunk
+	httpTrailer
+	// A response body delimited by the server closing the connection
+	httpUntilClose
+	// Not HTTP/1.x or upgraded to another protocol: forwarded unchanged
+	httpPassthrough
+)
+
+// httpStream reads the HTTP/1.x messages one side of a connection sends,
+// following their framing, Content-Length and chunked bodies, so that every
+// message of a kept-alive connection is seen however the messages are split
+// across reads
+type httpStream struct {
+	reader *bufio.Reader
+	// Called with the header of every message, returns the header to read
+	// in its place along with the state its body is read in and, for
+	// httpBody, the length of the body
+	onHeader func(header []byte) (rewritten []byte, state int, length int64)
+	// Called once the message is read, or once its header is for a message
+	// after which the stream passes through, if not nil
+	onEnd func()
+	state int
+	// Bytes left of the body or chunk being read
+	remaining int64
+	// Bytes of the message being read, including its header
+	messageBytes int64
+	// Header bytes not read yet
+	pending []byte
+	// Fail with errHeaderTooLarge or errMalformedChunk instead of passing
+	// through framing which can't be followed, so that no message gets past
+	// onHeader
+	strict bool
+}
+
+func (stream *httpStream) read(b []byte) (int, error) {
+	for len(stream.pending) == 0 {
+		switch stream.state {
+		case httpPassthrough:
+			return stream.reader.Read(b)
+		case httpUntilClose:
+			n, err := stream.reader.Read(b)
+			stream.messageBytes += int64(n)
+			return n, err
+		case httpBody, httpChunk:
+			if int64(len(b)) > stream.remaining {
+				b = b[:stream.remaining]
+			}
+			n, err := stream.reader.Read(b)
+			stream.messageBytes += int64(n)
+			if stream.remaining -= int64(n); stream.remaining == 0 && stream.state == httpBody {
+				stream.end()
+			} else if stream.remaining == 0 {
+				stream.state = httpChunkSize
+			}
+			return n, err
+		}
+		if err := stream.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, stream.pending)
+	stream.pending = stream.pending[n:]
+	return n, nil
+}
+
+// body sets the state the body of the message whose header was just read is
+// read in; a message without a body ends right away
+func (stream *httpStream) body(state int, length int64) {
+	switch {
+	case state == httpBody && length <= 0:
+		stream.end()
+	case state == httpPassthrough:
+		stream.state = state
+		if stream.onEnd != nil {
+			stream.onEnd()
+		}
+	default:
+		stream.state, stream.remaining = state, length
+	}
+}
+
+// end ends the message being read; the next one starts with its header
+func (stream *httpStream) end() {
+	stream.state = httpHeader
+	if stream.onEnd != nil {
+		stream.onEnd()
+	}
+}
+
+// next reads the next bit of framing of the messages into pending: a
+// header, a chunk size line or a trailer
+func (stream *httpStream) next() error {
+	switch stream.state {
+	case httpChunkSize:
+		line, err := stream.reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+		stream.pending = append([]byte(nil), line...)
+		stream.messageBytes += int64(len(line))
+		size, _, _ := strings.Cut(strings.TrimSpace(string(line)), ";")
+		n, perr := strconv.ParseInt(size, 16, 64)
+		switch {
+		case (err != nil || perr != nil || n < 0) && stream.strict:
+			return errMalformedChunk
+		case err != nil || perr != nil || n < 0:
+			stream.state = httpPassthrough
+		case n == 0:
+			stream.state = httpTrailer
+		default:
+			// The chunk data is followed by CRLF
+			stream.state, stream.remaining = httpChunk, n+2
+		}
+		return nil
+	case httpTrailer:
+		trailer, err := stream.readHeader()
+		if err != nil {
+			return err
+		}
+		stream.pending = trailer
+		stream.messageBytes += int64(len(trailer))
+		if stream.state != httpPassthrough {
+			stream.end()
+		}
+		return nil
+	}
+	header, err := stream.readHeader()
+	// Empty lines may precede a message
+	if err != nil || stream.state == httpPassthrough || len(bytes.TrimSpace(header)) == 0 {
+		stream.pending = header
+		return err
+	}
+	rewritten, state, length := stream.onHeader(header)
+	stream.pending, stream.messageBytes = rewritten, int64(len(rewritten))
+	stream.body(state, length)
+	return nil
+}
+
+// readHeader reads lines up to the empty one ending a header or trailer,
+// however long the lines are. A header larger than maxHTTPHeader, or the
+// bytes read when the peer closes in the middle of one, are returned
+// unchanged with the stream passing through from then on; a strict stream
+// fails with errHeaderTooLarge instead of passing a large header through.
+func (stream *httpStream) readHeader() ([]byte, error) {
+	var header []byte
+	for {
+		line, err := stream.reader.ReadSlice('\n')
+		header = append(header, line...)
+		if len(header) > maxHTTPHeader {
+			if stream.strict {
+				return nil, errHeaderTooLarge
+			}
+			stream.state = httpPassthrough
+			return header, nil
+		}
+		// The rest of a line longer than the buffer comes next
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if len(header) > 0 {
+				stream.state = httpPassthrough
+				return header, nil
+			}
+			return nil, err
+		}
+		if len(line) == 2 && line[0] == '\r' || len(line) == 1 {
+			return header, nil
+		}
+	}
+}
+
+// headerLines splits a message header into its lines, with their line
+// endings, the first one being the request or status line and the last one
+// the empty line ending the header
+func headerLines(header []byte) [][]byte {
+	// The header ends with a line ending, after which SplitAfter adds an
+	// empty line
+	lines := bytes.SplitAfter(header, []byte("\n"))
+	return lines[:len(lines)-1]
+}
+
+// headerField splits a header line into its lower-cased name and its value
+func headerField(line []byte) (string, string) {
+	name, value, _ := strings.Cut(string(line), ":")
+	return strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+}
+
+// requestConn is a client connection speaking HTTP/1.x whose requests are
+// parsed as they are read, to append the client's IP address to their
+// X-Forwarded-For header and to queue them for the access log
+type requestConn struct {
+	net.Conn
+	httpStream
+	// IP address appended to X-Forwarded-For, none if empty
+	xff string
+	// Requests waiting for their responses, nil without an access log
+	exchanges *exchanges
+}
+
+// newRequestConn wraps the client connection so that the client's address
+// is added to its requests with xff, unless it has no IP address, e.g. over
+// Unix sockets, and so that its requests are queued to exchanges if not nil.
+// Adding the address, the connection is strict: a request whose header is
+// too large or whose chunks can't be followed is answered with an error
+// status and fails the read, since passing it through would let the client
+// forge X-Forwarded-For.
+func newRequestConn(conn net.Conn, xff bool, exchanges *exchanges) net.Conn {
+	wrapped := &requestConn{Conn: conn, exchanges: exchanges}
+	wrapped.reader = bufio.NewReader(conn)
+	wrapped.onHeader = wrapped.rewrite
+	if ip, ok := clientIP(conn.RemoteAddr()); ok && xff {
+		wrapped.xff = ip.String()
+		wrapped.strict = true
+	}
+	return wrapped
+}
+
+func (conn *requestConn) Read(b []byte) (int, error) {
+	n, err := conn.read(b)
+	switch {
+	case errors.Is(err, errHeaderTooLarge):
+		conn.reject("431 Request Header Fields Too Large")
+	case errors.Is(err, errMalformedChunk):
+		conn.reject("400 Bad Request")
+	}
+	return n, err
+}
+
+// reject answers the request which can't be forwarded with the status,
+// before the tunnel closes
+func (conn *requestConn) reject(status string) {
+	conn.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn.Conn, "HTTP/1.1 "+status+"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+}
+
+func (conn *requestConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+// rewrite returns the request header with the client's IP address appended
+// to its X-Forwarded-For header, which is added if it is missing; several
+// X-Forwarded-For headers are joined into one, in their order. It also
+// queues the request for the access log.
+func (conn *requestConn) rewrite(header []byte) ([]byte, int, int64) {
+	lines := headerLines(header)
+	requestLine := string(bytes.TrimSpace(lines[0]))
+	if !strings.Contains(requestLine, " HTTP/1.") {
+		// HTTP/2 or not HTTP at all
+		return header, httpPassthrough, 0
+	}
+	var forwarded []string
+	var length int64
+	var chunked, upgrade bool
+	exchange := &exchange{time: time.Now(), requestLine: requestLine}
+	exchange.method, _, _ = strings.Cut(requestLine, " ")
+	rewritten := make([]byte, 0, len(header)+len("X-Forwarded-For: ")+len(conn.xff)+2)
+	rewritten = append(rewritten, lines[0]...)
+	for _, line := range lines[1 : len(lines)-1] {
+		name, value := headerField(line)
+		switch name {
+		case "x-forwarded-for":
+			if conn.xff == "" {
+				break
+			}
+			if value != "" {
+				forwarded = append(forwarded, value)
+			}
+			continue
+		case "content-length":
+			length, _ = strconv.ParseInt(value, 10, 64)
+		case "transfer-encoding":
+			chunked = strings.HasSuffix(strings.ToLower(value), "chunked")
+		case "upgrade":
+			upgrade = true
+		case "host":
+			exchange.host = value
+		case "referer":
+			exchange.referer = value
+		case "user-agent":
+			exchange.userAgent = value
+		}
+		rewritten = append(rewritten, line...)
+	}
+	if conn.exchanges != nil {
+		conn.exchanges.push(exchange)
+	}
+	if conn.xff != "" {
+		forwarded = append(forwarded, conn.xff)
+		rewritten = append(rewritten, "X-Forwarded-For: "+strings.Join(forwarded, ", ")+"\r\n"...)
+	}
+	rewritten = append(rewritten, lines[len(lines)-1]...)
+	switch {
+	case upgrade || exchange.method == "CONNECT":
+		// E.g. WebSocket: what follows the request is no longer HTTP
+		return rewritten, httpPassthrough, 0
+	case chunked:
+		// Chunked encoding takes precedence over Content-Length
+		return rewritten, httpChunkSize, 0
+	}
+	return rewritten, httpBody, length
+}
@@ -0,0 +1,151 @@
+package tcpf
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startXFFServer runs an HTTP destination answering every request with a
+// 204 and sending the path and X-Forwarded-For of the request to the
+// channel returned
+func startXFFServer(t *testing.T) (string, chan string) {
+	t.Helper()
+	received := make(chan string, 16)
+	addr := startServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		for {
+			request, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, request.Body)
+			received <- request.URL.Path + " " + strings.Join(request.Header.Values("X-Forwarded-For"), "|")
+			io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+		}
+	})
+	return addr, received
+}
+
+// nextRequest returns what the destination of startXFFServer received next
+func nextRequest(t *testing.T, received chan string) string {
+	t.Helper()
+	select {
+	case request := <-received:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the destination to get a request")
+	}
+	return ""
+}
+
+func TestXForwardedFor(t *testing.T) {
+	dst, received := startXFFServer(t)
+	_, addr := startRealm(t, dst, WithXForwardedFor())
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{"added", "GET /added HTTP/1.1\r\nHost: dest.test\r\n\r\n", "/added 127.0.0.1"},
+		{"appended to the chain", "GET /chain HTTP/1.1\r\nHost: dest.test\r\nX-Forwarded-For: 6.6.6.6, 10.0.0.1\r\n\r\n", "/chain 6.6.6.6, 10.0.0.1, 127.0.0.1"},
+		{"several headers joined", "GET /joined HTTP/1.1\r\nX-Forwarded-For: 6.6.6.6\r\nHost: dest.test\r\nx-forwarded-for: 10.0.0.1\r\n\r\n", "/joined 6.6.6.6, 10.0.0.1, 127.0.0.1"},
+		// Lines longer than the buffer of the reader are still parsed
+		{"long header line", "GET /long HTTP/1.1\r\nHost: dest.test\r\nX-Forwarded-For: 6.6.6.6\r\nCookie: " + strings.Repeat("c", 5000) + "\r\n\r\n", "/long 6.6.6.6, 127.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialRealm(t, addr)
+			io.WriteString(conn, test.request)
+			if got := nextRequest(t, received); got != test.want {
+				t.Errorf("destination got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestXForwardedForSplitReads(t *testing.T) {
+	dst, received := startXFFServer(t)
+	_, addr := startRealm(t, dst, WithXForwardedFor())
+	conn := dialRealm(t, addr)
+	// The header arrives a few bytes at a time, split inside its lines
+	request := "POST /split HTTP/1.1\r\nHost: dest.test\r\nX-Forwarded-For: 6.6.6.6\r\nContent-Length: 4\r\n\r\nbody"
+	for i := 0; i < len(request); i += 7 {
+		io.WriteString(conn, request[i:min(i+7, len(request))])
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := nextRequest(t, received), "/split 6.6.6.6, 127.0.0.1"; got != want {
+		t.Errorf("destination got %q, want %q", got, want)
+	}
+}
+
+func TestXForwardedForPipelined(t *testing.T) {
+	dst, received := startXFFServer(t)
+	_, addr := startRealm(t, dst, WithXForwardedFor())
+	conn := dialRealm(t, addr)
+	// Every request of a kept-alive connection is rewritten, after bodies
+	// of either framing
+	io.WriteString(conn, "POST /first HTTP/1.1\r\nHost: dest.test\r\nContent-Length: 30\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n...."+
+		"POST /second HTTP/1.1\r\nHost: dest.test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"+
+		"GET /third HTTP/1.1\r\nHost: dest.test\r\nX-Forwarded-For: 6.6.6.6\r\n\r\n")
+	for _, want := range []string{"/first 127.0.0.1", "/second 127.0.0.1", "/third 6.6.6.6, 127.0.0.1"} {
+		if got := nextRequest(t, received); got != want {
+			t.Errorf("destination got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestXForwardedForRejected(t *testing.T) {
+	dst, received := startXFFServer(t)
+	_, addr := startRealm(t, dst, WithXForwardedFor())
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"header too large", "GET /large HTTP/1.1\r\nHost: dest.test\r\nX-Forwarded-For: 6.6.6.6\r\nCookie: " + strings.Repeat("c", maxHTTPHeader) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"malformed chunk", "POST /chunked HTTP/1.1\r\nHost: dest.test\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The requests which can't be rewritten are refused, along with
+			// whatever follows them on the connection
+			conn := dialRealm(t, addr)
+			io.WriteString(conn, test.request+"GET /after HTTP/1.1\r\nX-Forwarded-For: 6.6.6.6\r\n\r\n")
+			reader := bufio.NewReader(conn)
+			for {
+				response, err := http.ReadResponse(reader, nil)
+				if err != nil {
+					t.Fatalf("reading the response: %v", err)
+				}
+				// The chunked request reached the destination before its
+				// body turned out malformed
+				if response.StatusCode == http.StatusNoContent {
+					continue
+				}
+				if response.StatusCode != test.status {
+					t.Errorf("responded %v, want %d", response.Status, test.status)
+				}
+				break
+			}
+			if n, err := reader.Read(make([]byte, 1)); err == nil {
+				t.Errorf("read %d bytes after the rejection", n)
+			}
+		})
+	}
+	// Only the header of the chunked request got through
+	for {
+		select {
+		case request := <-received:
+			if !strings.HasPrefix(request, "/chunked ") {
+				t.Errorf("destination got %q", request)
+			}
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package tcpf
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// LogFile is a log file which is rotated by size: once a write would grow it
+// beyond maxSize bytes, path.1 becomes path.2 and so on, path becomes path.1
+// and a new file is started, keeping maxBackups rotated files. Writes are
+// serialized, so a LogFile may be shared by the loggers of all realms and
+// every line written in one write ends up whole in one file.
+type LogFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenLogFile opens the log file at path for appending, creating it if it
+// is missing; a maxSize of zero never rotates it
+func OpenLogFile(path string, maxSize int64, maxBackups int) (*LogFile, error) {
+	f := &LogFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("can't open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("can't open log file: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the file as long as it can be written
+			fmt.Fprintf(os.Stderr, "tcpf: %v\n", err)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files, dropping the oldest one, and starts a new
+// file
+func (f *LogFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("can't rotate log file: %w", err)
+	}
+	f.file = nil
+	var err error
+	if f.maxBackups <= 0 {
+		err = os.Remove(f.path)
+	} else {
+		os.Remove(f.backup(f.maxBackups))
+		for n := f.maxBackups - 1; n > 0; n-- {
+			if _, serr := os.Stat(f.backup(n)); serr == nil {
+				os.Rename(f.backup(n), f.backup(n+1))
+			}
+		}
+		err = os.Rename(f.path, f.backup(1))
+	}
+	if oerr := f.open(); oerr != nil {
+		return oerr
+	}
+	if err != nil {
+		return fmt.Errorf("can't rotate log file: %w", err)
+	}
+	return nil
+}
+
+// backup returns the path of the nth rotated file
+func (f *LogFile) backup(n int) string {
+	return f.path + "." + strconv.Itoa(n)
+}
+
+// Close closes the file; writes after Close fail
+func (f *LogFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,129 @@
+package tcpf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readLog returns the content of a log file, or "" if it doesn't exist
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcpf.log")
+	f, err := OpenLogFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// A file reaching the size exactly is only rotated by the next write
+	for _, line := range []string{"12345\n", "678\n", "abcdef\n", "ghijklmnop\n", "tail\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{
+		path:        "tail\n",
+		path + ".1": "ghijklmnop\n",
+		path + ".2": "abcdef\n",
+		// The oldest rotated file is dropped
+		path + ".3": "",
+	}
+	for file, content := range want {
+		if got := readLog(t, file); got != content {
+			t.Errorf("%v holds %q, want %q", filepath.Base(file), got, content)
+		}
+	}
+}
+
+func TestLogFileWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcpf.log")
+	f, err := OpenLogFile(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	if got := readLog(t, path); got != "second\n" {
+		t.Errorf("log holds %q, want %q", got, "second\n")
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("rotated file kept without backups: %v", err)
+	}
+}
+
+func TestLogFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcpf.log")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The size of the existing content counts towards the limit
+	f, err := OpenLogFile(path, 12, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("later\n"))
+	f.Close()
+	if got := readLog(t, path); got != "later\n" {
+		t.Errorf("log holds %q, want %q", got, "later\n")
+	}
+	if got := readLog(t, path+".1"); got != "earlier\n" {
+		t.Errorf("rotated log holds %q, want %q", got, "earlier\n")
+	}
+	if _, err := f.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestLogFileConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcpf.log")
+	f, err := OpenLogFile(path, 1000, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := 0; i < 50; i++ {
+				fmt.Fprintf(f, "writer %d line %02d\n", w, i)
+			}
+		}()
+	}
+	writers.Wait()
+	f.Close()
+	// Every line is whole in one of the files, none larger than the limit
+	var all bytes.Buffer
+	files, _ := filepath.Glob(path + "*")
+	for _, file := range files {
+		content := readLog(t, file)
+		if len(content) > 1000 {
+			t.Errorf("%v is %d bytes", filepath.Base(file), len(content))
+		}
+		all.WriteString(content)
+	}
+	lines := strings.Split(strings.TrimSuffix(all.String(), "\n"), "\n")
+	if len(lines) != 400 {
+		t.Fatalf("%d lines logged, want 400", len(lines))
+	}
+	for _, line := range lines {
+		var w, i int
+		if n, _ := fmt.Sscanf(line, "writer %d line %d", &w, &i); n != 2 {
+			t.Errorf("torn line %q", line)
+		}
+	}
+}
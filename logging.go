@@ -0,0 +1,166 @@
+package tcpf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log event
+type Level int32
+
+// Levels of log events, from the most severe to the most verbose
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+func (level Level) String() string {
+	if level < LevelError || level > LevelDebug {
+		return strconv.Itoa(int(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel returns the Level named error, warn, info or debug
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if name == levelName {
+			return Level(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Fields are the structured details of a log event, e.g. the tunnel_id,
+// src and dst of a tunnel
+type Fields map[string]interface{}
+
+// Logger writes the events of realms and tunnels. The event names what
+// happened (e.g. "join" or "leave"), fields hold its details and msg is its
+// human readable form.
+type Logger interface {
+	Log(level Level, event string, fields Fields, msg string)
+}
+
+// Logger of all realms, the text one unless replaced with SetLogger
+var logger atomic.Value
+
+// Most verbose level of the events written to the logger
+var logLevel atomic.Int32
+
+func init() {
+	SetLogger(NewTextLogger())
+	SetLogLevel(LevelInfo)
+}
+
+// SetLogger replaces the Logger all realms write their events to
+func SetLogger(l Logger) {
+	logger.Store(&l)
+}
+
+// SetLogLevel sets the most verbose level of the events realms log, LevelInfo
+// by default
+func SetLogLevel(level Level) {
+	logLevel.Store(int32(level))
+}
+
+// logEvent formats the message of the event and writes it to the logger,
+// unless the event is more verbose than the log level
+func logEvent(level Level, event string, fields Fields, format string, args ...interface{}) {
+	if level > Level(logLevel.Load()) {
+		return
+	}
+	(*logger.Load().(*Logger)).Log(level, event, fields, fmt.Sprintf(format, args...))
+}
+
+type textLogger struct{}
+
+// NewTextLogger returns a Logger writing just the messages of events through
+// the standard log package, which is the default; errors and warnings are
+// prefixed with their level
+func NewTextLogger() Logger {
+	return textLogger{}
+}
+
+func (textLogger) Log(level Level, event string, fields Fields, msg string) {
+	if level <= LevelWarn {
+		msg = strings.ToUpper(level.String()) + ": " + msg
+	}
+	log.Print(msg)
+}
+
+type jsonLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONLogger returns a Logger writing every event to w as a line of JSON
+// with the time, level, event and msg followed by the fields of the event
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+func (l *jsonLogger) Log(level Level, event string, fields Fields, msg string) {
+	line := []byte(`{"time":`)
+	line = appendJSON(line, time.Now().Format(time.RFC3339Nano))
+	line = append(line, `,"level":`...)
+	line = appendJSON(line, level)
+	line = append(line, `,"event":`...)
+	line = appendJSON(line, event)
+	line = append(line, `,"msg":`...)
+	line = appendJSON(line, msg)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line = append(line, ',')
+		line = appendJSON(line, key)
+		line = append(line, ':')
+		line = appendJSON(line, fields[key])
+	}
+	line = append(line, "}\n"...)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.w.Write(line)
+}
+
+// appendJSON appends the JSON encoding of value to line; errors and other
+// values JSON can't encode are written as strings
+func appendJSON(line []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	// Addresses are full of "=>" and "->", which are fine outside of HTML
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		encoded.Reset()
+		encoder.Encode(fmt.Sprint(value))
+	}
+	return append(line, bytes.TrimSuffix(encoded.Bytes(), []byte("\n"))...)
+}
+
+// with adds the field to f and returns f
+func (f Fields) with(key string, value interface{}) Fields {
+	f[key] = value
+	return f
+}
@@ -0,0 +1,99 @@
+package tcpf
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	activeTunnelsDesc = prometheus.NewDesc("tcpf_active_tunnels",
+		"Number of open TCP tunnels.", nil, nil)
+	tunnelsTotalDesc = prometheus.NewDesc("tcpf_tunnels_total",
+		"Number of TCP tunnels opened.", nil, nil)
+	bytesForwardedDesc = prometheus.NewDesc("tcpf_bytes_forwarded_total",
+		"Number of bytes forwarded through TCP tunnels, in from clients and out to them.", []string{"direction"}, nil)
+	dialErrorsDesc = prometheus.NewDesc("tcpf_dial_errors_total",
+		"Number of failed attempts to dial a destination.", nil, nil)
+	errorsDesc = prometheus.NewDesc("tcpf_errors_total",
+		"Number of errors by type: dial, tls, read, write, timeout and middleware.", []string{"type"}, nil)
+	tunnelDurationDesc = prometheus.NewDesc("tcpf_tunnel_duration_seconds",
+		"Lifetime of the closed TCP tunnels.", nil, nil)
+	tunnelBytesDesc = prometheus.NewDesc("tcpf_tunnel_bytes",
+		"Number of bytes the closed TCP tunnels forwarded, in from clients and out to them.", []string{"direction"}, nil)
+	breakersOpenDesc = prometheus.NewDesc("tcpf_circuit_breakers_open",
+		"Number of realms whose circuit breaker of the destination is open.", []string{"destination"}, nil)
+)
+
+// MetricsHandler returns an HTTP handler exposing the statistics of the
+// realms, summed up, in the Prometheus exposition formats. The histograms
+// only sum up the realms with the same buckets as the first one.
+func MetricsHandler(realms ...*TunnelRealm) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(realmCollector(realms))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// realmCollector collects the statistics of the realms when scraped, which
+// the realms keep counting themselves
+type realmCollector []*TunnelRealm
+
+func (realms realmCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{activeTunnelsDesc, tunnelsTotalDesc, bytesForwardedDesc, dialErrorsDesc, errorsDesc, tunnelDurationDesc, tunnelBytesDesc, breakersOpenDesc} {
+		ch <- desc
+	}
+}
+
+func (realms realmCollector) Collect(ch chan<- prometheus.Metric) {
+	total := Stats{Errors: make(map[string]int64)}
+	// Number of realms with the circuit breaker of each destination open
+	breakers := make(map[string]int)
+	for _, realm := range realms {
+		for address, open := range realm.DestinationBreakers() {
+			n := breakers[address]
+			if open {
+				n++
+			}
+			breakers[address] = n
+		}
+		stats := realm.Stats()
+		total.ActiveTunnels += stats.ActiveTunnels
+		total.TunnelsTotal += stats.TunnelsTotal
+		total.BytesIn += stats.BytesIn
+		total.BytesOut += stats.BytesOut
+		total.DialErrors += stats.DialErrors
+		for kind, n := range stats.Errors {
+			total.Errors[kind] += n
+		}
+		total.Durations.add(stats.Durations)
+		total.TunnelBytesIn.add(stats.TunnelBytesIn)
+		total.TunnelBytesOut.add(stats.TunnelBytesOut)
+	}
+	ch <- prometheus.MustNewConstMetric(activeTunnelsDesc, prometheus.GaugeValue, float64(total.ActiveTunnels))
+	ch <- prometheus.MustNewConstMetric(tunnelsTotalDesc, prometheus.CounterValue, float64(total.TunnelsTotal))
+	ch <- prometheus.MustNewConstMetric(bytesForwardedDesc, prometheus.CounterValue, float64(total.BytesIn), "in")
+	ch <- prometheus.MustNewConstMetric(bytesForwardedDesc, prometheus.CounterValue, float64(total.BytesOut), "out")
+	ch <- prometheus.MustNewConstMetric(dialErrorsDesc, prometheus.CounterValue, float64(total.DialErrors))
+	for kind, n := range total.Errors {
+		ch <- prometheus.MustNewConstMetric(errorsDesc, prometheus.CounterValue, float64(n), kind)
+	}
+	ch <- constHistogram(tunnelDurationDesc, total.Durations)
+	ch <- constHistogram(tunnelBytesDesc, total.TunnelBytesIn, "in")
+	ch <- constHistogram(tunnelBytesDesc, total.TunnelBytesOut, "out")
+	for address, n := range breakers {
+		ch <- prometheus.MustNewConstMetric(breakersOpenDesc, prometheus.GaugeValue, float64(n), address)
+	}
+}
+
+// constHistogram returns the histogram as a Prometheus one, whose counts of
+// the buckets are cumulative
+func constHistogram(desc *prometheus.Desc, h Histogram, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	var count int64
+	for i, bound := range h.Bounds {
+		count += h.Counts[i]
+		buckets[bound] = uint64(count)
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(h.Count), h.Sum, buckets, labels...)
+}
@@ -0,0 +1,341 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sample is a sample of the Prometheus text format
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// parseExposition parses the Prometheus text format, version 0.0.4, failing
+// on whatever doesn't conform to it: malformed lines, samples of families
+// without a type or split up, families typed twice, and histograms whose
+// buckets aren't cumulative or don't add up to their count
+func parseExposition(r io.Reader) (map[string]string, []sample, error) {
+	types := make(map[string]string)
+	var samples []sample
+	done := make(map[string]bool)
+	current := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		if comment, ok := strings.CutPrefix(text, "# "); ok {
+			fields := strings.SplitN(comment, " ", 3)
+			if len(fields) < 3 || fields[0] != "HELP" && fields[0] != "TYPE" {
+				continue
+			}
+			if !metricName.MatchString(fields[1]) {
+				return nil, nil, fmt.Errorf("line %d: invalid metric name %q", line, fields[1])
+			}
+			if fields[0] == "TYPE" {
+				switch fields[2] {
+				case "counter", "gauge", "histogram", "summary", "untyped":
+				default:
+					return nil, nil, fmt.Errorf("line %d: invalid type %q", line, fields[2])
+				}
+				if _, ok := types[fields[1]]; ok {
+					return nil, nil, fmt.Errorf("line %d: %v typed twice", line, fields[1])
+				}
+				types[fields[1]] = fields[2]
+			}
+			continue
+		}
+		s, err := parseSample(text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		family := s.name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base, ok := strings.CutSuffix(s.name, suffix); ok && types[base] == "histogram" {
+				family = base
+			}
+		}
+		if types[family] == "" {
+			return nil, nil, fmt.Errorf("line %d: %v has no type", line, family)
+		}
+		if family != current {
+			if done[family] {
+				return nil, nil, fmt.Errorf("line %d: samples of %v are split up", line, family)
+			}
+			done[current], current = true, family
+		}
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return types, samples, checkHistograms(types, samples)
+}
+
+// parseSample parses a line of the form name{label="value",...} value
+func parseSample(text string) (sample, error) {
+	s := sample{labels: make(map[string]string)}
+	end := strings.IndexAny(text, "{ ")
+	if end < 0 {
+		return s, fmt.Errorf("sample without a value: %q", text)
+	}
+	s.name, text = text[:end], text[end:]
+	if !metricName.MatchString(s.name) {
+		return s, fmt.Errorf("invalid metric name %q", s.name)
+	}
+	if rest, ok := strings.CutPrefix(text, "{"); ok {
+		for text = rest; !strings.HasPrefix(text, "}"); {
+			name, rest, ok := strings.Cut(text, "=")
+			if !ok || !labelName.MatchString(name) || !strings.HasPrefix(rest, `"`) {
+				return s, fmt.Errorf("malformed label in %q", text)
+			}
+			// The value is a quoted string with \\, \" and \n escaped
+			var value strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+					switch rest[i] {
+					case '\\', '"':
+						value.WriteByte(rest[i])
+					case 'n':
+						value.WriteByte('\n')
+					default:
+						return s, fmt.Errorf("invalid escape in %q", rest)
+					}
+					continue
+				}
+				value.WriteByte(rest[i])
+			}
+			if i >= len(rest) {
+				return s, fmt.Errorf("unterminated label value in %q", rest)
+			}
+			if _, ok := s.labels[name]; ok {
+				return s, fmt.Errorf("label %v repeated", name)
+			}
+			s.labels[name] = value.String()
+			text = strings.TrimPrefix(rest[i+1:], ",")
+		}
+		text = text[1:]
+	}
+	fields := strings.Fields(text)
+	if len(fields) != 1 && len(fields) != 2 || !strings.HasPrefix(text, " ") {
+		return s, fmt.Errorf("malformed value %q", text)
+	}
+	var err error
+	switch fields[0] {
+	case "+Inf":
+		s.value = math.Inf(1)
+	case "-Inf":
+		s.value = math.Inf(-1)
+	case "NaN":
+		s.value = math.NaN()
+	default:
+		if s.value, err = strconv.ParseFloat(fields[0], 64); err != nil {
+			return s, fmt.Errorf("invalid value %q", fields[0])
+		}
+	}
+	if len(fields) == 2 {
+		if _, err := strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return s, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+	}
+	return s, nil
+}
+
+// checkHistograms checks that the buckets of every histogram are cumulative,
+// ascending and end with +Inf, which counts as many samples as _count
+func checkHistograms(types map[string]string, samples []sample) error {
+	type series struct {
+		le      []float64
+		counts  []float64
+		count   float64
+		counted bool
+	}
+	histograms := make(map[string]*series)
+	get := func(name string, labels map[string]string) *series {
+		var key []string
+		for label, value := range labels {
+			if label != "le" {
+				key = append(key, label+"="+value)
+			}
+		}
+		sort.Strings(key)
+		id := name + "{" + strings.Join(key, ",") + "}"
+		if histograms[id] == nil {
+			histograms[id] = &series{}
+		}
+		return histograms[id]
+	}
+	for _, s := range samples {
+		if base, ok := strings.CutSuffix(s.name, "_bucket"); ok && types[base] == "histogram" {
+			le, ok := s.labels["le"]
+			if !ok {
+				return fmt.Errorf("bucket of %v without le", base)
+			}
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				return fmt.Errorf("invalid le %q of %v", le, base)
+			}
+			h := get(base, s.labels)
+			h.le, h.counts = append(h.le, bound), append(h.counts, s.value)
+		} else if base, ok := strings.CutSuffix(s.name, "_count"); ok && types[base] == "histogram" {
+			h := get(base, s.labels)
+			h.count, h.counted = s.value, true
+		}
+	}
+	for id, h := range histograms {
+		if len(h.le) == 0 || !math.IsInf(h.le[len(h.le)-1], 1) {
+			return fmt.Errorf("%v has no +Inf bucket", id)
+		}
+		for i := 1; i < len(h.le); i++ {
+			if h.le[i] <= h.le[i-1] || h.counts[i] < h.counts[i-1] {
+				return fmt.Errorf("buckets of %v aren't ascending and cumulative", id)
+			}
+		}
+		if !h.counted || h.counts[len(h.counts)-1] != h.count {
+			return fmt.Errorf("+Inf bucket of %v doesn't match its count", id)
+		}
+	}
+	return nil
+}
+
+// sampleValue returns the value of the sample with the name and labels, given as
+// name=value pairs
+func sampleValue(t *testing.T, samples []sample, name string, labels ...string) float64 {
+	t.Helper()
+	for _, s := range samples {
+		if s.name != name || len(s.labels) != len(labels) {
+			continue
+		}
+		match := true
+		for _, label := range labels {
+			key, want, _ := strings.Cut(label, "=")
+			if s.labels[key] != want {
+				match = false
+			}
+		}
+		if match {
+			return s.value
+		}
+	}
+	t.Fatalf("no sample %v%v", name, labels)
+	return 0
+}
+
+func TestParseExposition(t *testing.T) {
+	// Besides malformed expositions, the parser refuses samples without a
+	// type, which tcpf always declares
+	tests := []string{
+		"tcpf_x 1\n",
+		"# TYPE tcpf_x counter\ntcpf_x one\n",
+		"# TYPE tcpf_x counter\n# TYPE tcpf_x counter\ntcpf_x 1\n",
+		"# TYPE tcpf_x counter\ntcpf_x{a=\"1} 1\n",
+		"# TYPE tcpf_x counter\ntcpf_x{1a=\"1\"} 1\n",
+		"# TYPE tcpf_x counter\n# TYPE tcpf_y counter\ntcpf_x 1\ntcpf_y 1\ntcpf_x{a=\"b\"} 1\n",
+		"# TYPE tcpf_h histogram\ntcpf_h_bucket{le=\"1\"} 2\ntcpf_h_bucket{le=\"+Inf\"} 1\ntcpf_h_count 1\n",
+		"# TYPE tcpf_h histogram\ntcpf_h_bucket{le=\"1\"} 1\ntcpf_h_count 1\n",
+		"# TYPE tcpf_h histogram\ntcpf_h_bucket{le=\"+Inf\"} 2\ntcpf_h_count 1\n",
+	}
+	for _, text := range tests {
+		if _, _, err := parseExposition(strings.NewReader(text)); err == nil {
+			t.Errorf("parsed malformed exposition:\n%s", text)
+		}
+	}
+	valid := "# HELP tcpf_x Some \\\\ help.\n# TYPE tcpf_x counter\ntcpf_x{a=\"q\\\"uote\",b=\"\\n\"} 1.5e+06 1700000000000\n"
+	if _, samples, err := parseExposition(strings.NewReader(valid)); err != nil {
+		t.Error(err)
+	} else if samples[0].labels["a"] != `q"uote` || samples[0].value != 1.5e6 {
+		t.Errorf("parsed %+v", samples[0])
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	realm, addr := startRealm(t, startEcho(t), WithHistogramBuckets([]time.Duration{time.Millisecond, time.Minute}, []int64{4, 1024}))
+	for _, msg := range []string{"ab", "hello, metrics"} {
+		if reply := roundTrip(t, addr, []byte(msg)); string(reply) != msg {
+			t.Fatalf("got %q back, want %q", reply, msg)
+		}
+	}
+	waitFor(t, "the tunnels to close", func() bool { return realm.Stats().Durations.Count == 2 })
+	// A destination which can't be dialed counts as an error
+	host, port, _ := net.SplitHostPort(closedPort(t))
+	failing := NewTunnelRealm("127.0.0.1", "0", host, port, WithDialTimeout(time.Second), WithCircuitBreaker(1, time.Minute))
+	if err := failing.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer failing.Stop()
+	if conn, err := net.Dial("tcp", realmAddr(failing)); err == nil {
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	waitFor(t, "the dial to fail", func() bool { return failing.Stats().DialErrors == 1 })
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler(realm, failing).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is %q", contentType)
+	}
+	body := recorder.Body.Bytes()
+	types, samples, err := parseExposition(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("%v in:\n%s", err, body)
+	}
+	for name, want := range map[string]string{
+		"tcpf_active_tunnels":          "gauge",
+		"tcpf_tunnels_total":           "counter",
+		"tcpf_bytes_forwarded_total":   "counter",
+		"tcpf_dial_errors_total":       "counter",
+		"tcpf_errors_total":            "counter",
+		"tcpf_tunnel_duration_seconds": "histogram",
+		"tcpf_tunnel_bytes":            "histogram",
+		"tcpf_circuit_breakers_open":   "gauge",
+	} {
+		if types[name] != want {
+			t.Errorf("%v is of type %q, want %q", name, types[name], want)
+		}
+	}
+	checks := []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"tcpf_active_tunnels", nil, 0},
+		{"tcpf_tunnels_total", nil, 2},
+		{"tcpf_bytes_forwarded_total", []string{"direction=in"}, 16},
+		{"tcpf_bytes_forwarded_total", []string{"direction=out"}, 16},
+		{"tcpf_dial_errors_total", nil, 1},
+		{"tcpf_errors_total", []string{"type=dial"}, 1},
+		{"tcpf_tunnel_duration_seconds_count", nil, 2},
+		{"tcpf_tunnel_duration_seconds_bucket", []string{"le=60"}, 2},
+		{"tcpf_tunnel_bytes_bucket", []string{"direction=in", "le=4"}, 1},
+		{"tcpf_tunnel_bytes_bucket", []string{"direction=in", "le=1024"}, 2},
+		{"tcpf_tunnel_bytes_bucket", []string{"direction=out", "le=+Inf"}, 2},
+		{"tcpf_tunnel_bytes_sum", []string{"direction=in"}, 16},
+		{"tcpf_circuit_breakers_open", []string{"destination=" + net.JoinHostPort(host, port)}, 1},
+	}
+	for _, check := range checks {
+		if got := sampleValue(t, samples, check.name, check.labels...); got != check.want {
+			t.Errorf("%v%v = %v, want %v", check.name, check.labels, got, check.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package tcpf
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Direction tells which way bytes flow through a TCP tunnel
+type Direction int
+
+const (
+	// DirectionIn is the direction of the bytes from the client to the
+	// destination
+	DirectionIn Direction = iota
+	// DirectionOut is the direction of the bytes from the destination back to
+	// the client
+	DirectionOut
+)
+
+func (d Direction) String() string {
+	if d == DirectionIn {
+		return "in"
+	}
+	return "out"
+}
+
+// direction returns the Direction the copies of a tunnel call in
+func direction(in bool) Direction {
+	if in {
+		return DirectionIn
+	}
+	return DirectionOut
+}
+
+// Middleware processes the bytes a TCP tunnel forwards, in between reading
+// them from one side and writing them to the other. The bytes go through the
+// middleware of the tunnel in turn, each one given what the previous one
+// returned. Both directions are processed at the same time, but the calls for
+// one direction never overlap.
+type Middleware interface {
+	// Process returns the bytes to forward in place of b: b itself, modified
+	// or not, other bytes, or none to hold b back. b is valid only until
+	// Process returns, and the bytes returned until the next call for the
+	// same direction. An error closes the tunnel.
+	Process(direction Direction, b []byte) ([]byte, error)
+}
+
+// Flusher is implemented by the Middleware which hold bytes back, to pass
+// them on once the client or the destination is done sending
+type Flusher interface {
+	Flush(direction Direction) ([]byte, error)
+}
+
+// MiddlewareFunc lets a function processing the bytes of every tunnel alike
+// be used as a Middleware
+type MiddlewareFunc func(direction Direction, b []byte) ([]byte, error)
+
+func (f MiddlewareFunc) Process(direction Direction, b []byte) ([]byte, error) {
+	return f(direction, b)
+}
+
+// MiddlewareFactory creates the Middleware of a new tunnel, which may keep
+// state of its own for the tunnel, or returns nil to leave the tunnel as is
+type MiddlewareFactory func(tunnel *TCPTunnel) Middleware
+
+// DumpMiddleware returns the factory of a Middleware which writes a hex dump
+// of the bytes tunnels forward to w, e.g. to debug a protocol
+func DumpMiddleware(w io.Writer) MiddlewareFactory {
+	lock := &sync.Mutex{}
+	return func(tunnel *TCPTunnel) Middleware {
+		return MiddlewareFunc(func(direction Direction, b []byte) ([]byte, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			fmt.Fprintf(w, "Tunnel %v, %d bytes %v:\n%s", tunnel.id, len(b), direction, hex.Dump(b))
+			return b, nil
+		})
+	}
+}
+
+// buildChains sets up the middleware the bytes of the tunnel go through in
+// each direction: the capture records them as read, the rate limits hold them
+// back, then the replacements and the middleware of the realm rewrite them,
+// and the mirror gets a copy of what is forwarded from the client
+func (tunnel *TCPTunnel) buildChains() {
+	realm := tunnel.realm
+	var shared []Middleware
+	if len(realm.replacements) > 0 {
+		shared = append(shared, &replacer{replacements: realm.replacements})
+	}
+	for _, factory := range realm.middleware {
+		if m := factory(tunnel); m != nil {
+			shared = append(shared, m)
+		}
+	}
+	for _, d := range []Direction{DirectionIn, DirectionOut} {
+		var chain []Middleware
+		if realm.capture != nil {
+			chain = append(chain, captureMiddleware{tunnel})
+		}
+		limits := tunnel.limitsIn
+		if d == DirectionOut {
+			limits = tunnel.limitsOut
+		}
+		if len(limits) > 0 {
+			chain = append(chain, rateLimiter{tunnel.ctx, limits})
+		}
+		chain = append(chain, shared...)
+		if d == DirectionIn && tunnel.mirror != nil {
+			chain = append(chain, mirrorMiddleware{tunnel.mirror})
+		}
+		tunnel.chains[d] = chain
+	}
+}
+
+// middlewareWriter writes the bytes written through it to the writer once
+// the middleware of the direction have processed them
+type middlewareWriter struct {
+	writer    io.Writer
+	chain     []Middleware
+	direction Direction
+}
+
+func (w middlewareWriter) Write(p []byte) (int, error) {
+	if err := w.process(p, 0); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// process passes b through the middleware from the one at index from
+func (w middlewareWriter) process(b []byte, from int) error {
+	for _, m := range w.chain[from:] {
+		var err error
+		if b, err = m.Process(w.direction, b); err != nil {
+			return &copyError{middlewareError, err}
+		}
+		if len(b) == 0 {
+			return nil
+		}
+	}
+	if _, err := w.writer.Write(b); err != nil {
+		return &copyError{writeError, err}
+	}
+	return nil
+}
+
+// flush writes the bytes held back by the middleware, through the middleware
+// following them, once the stream of the direction has ended
+func (w middlewareWriter) flush() error {
+	for i, m := range w.chain {
+		flusher, ok := m.(Flusher)
+		if !ok {
+			continue
+		}
+		b, err := flusher.Flush(w.direction)
+		if err == nil && len(b) > 0 {
+			err = w.process(b, i+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureMiddleware records the bytes of the tunnel, with WithCapture
+type captureMiddleware struct {
+	tunnel *TCPTunnel
+}
+
+func (m captureMiddleware) Process(direction Direction, b []byte) ([]byte, error) {
+	m.tunnel.capture(direction == DirectionIn, b)
+	return b, nil
+}
+
+// rateLimiter holds the bytes of a direction back as long as its limits
+// require
+type rateLimiter struct {
+	ctx    context.Context
+	limits []*tokenBucket
+}
+
+func (m rateLimiter) Process(direction Direction, b []byte) ([]byte, error) {
+	for _, limit := range m.limits {
+		if err := limit.take(m.ctx, len(b)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// mirrorMiddleware sends a copy of the bytes from the client to the mirror
+// of the tunnel, with WithMirror
+type mirrorMiddleware struct {
+	mirror *mirror
+}
+
+func (m mirrorMiddleware) Process(direction Direction, b []byte) ([]byte, error) {
+	m.mirror.write(b)
+	return b, nil
+}
@@ -0,0 +1,163 @@
+package tcpf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tagMiddleware returns the factory of a middleware appending its tag to the
+// bytes of both directions and recording its calls in calls
+func tagMiddleware(tag string, lock *sync.Mutex, calls *[]string) MiddlewareFactory {
+	return func(tunnel *TCPTunnel) Middleware {
+		return MiddlewareFunc(func(direction Direction, b []byte) ([]byte, error) {
+			lock.Lock()
+			*calls = append(*calls, tag+" "+direction.String())
+			lock.Unlock()
+			return append(append([]byte{}, b...), tag...), nil
+		})
+	}
+}
+
+// dialRealm connects to a realm with a deadline bounding the test
+func dialRealm(t *testing.T, addr string) *net.TCPConn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*net.TCPConn)
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	received := make(chan []byte, 1)
+	dst := startServer(t, func(conn net.Conn) {
+		b := make([]byte, len("hiAB"))
+		io.ReadFull(conn, b)
+		received <- b
+		conn.Write([]byte("ok"))
+	})
+	var lock sync.Mutex
+	var calls []string
+	_, addr := startRealm(t, dst, WithMiddleware(tagMiddleware("A", &lock, &calls), tagMiddleware("B", &lock, &calls)))
+	conn := dialRealm(t, addr)
+	conn.Write([]byte("hi"))
+	reply := make([]byte, len("okAB"))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	// The middleware run in the order they were added in both directions
+	if b := <-received; string(b) != "hiAB" {
+		t.Errorf("destination received %q, want %q", b, "hiAB")
+	}
+	if string(reply) != "okAB" {
+		t.Errorf("client received %q, want %q", reply, "okAB")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if got := strings.Join(calls, ", "); got != "A in, B in, A out, B out" {
+		t.Errorf("middleware called as %v", got)
+	}
+}
+
+func TestMiddlewareErrorClosesTunnel(t *testing.T) {
+	closed := make(chan error, 1)
+	dst := startServer(t, func(conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.Copy(io.Discard, conn)
+		closed <- err
+	})
+	refuse := func(tunnel *TCPTunnel) Middleware {
+		return MiddlewareFunc(func(direction Direction, b []byte) ([]byte, error) {
+			if bytes.Contains(b, []byte("boom")) {
+				return nil, errors.New("refused")
+			}
+			return b, nil
+		})
+	}
+	realm, addr := startRealm(t, dst, WithMiddleware(refuse))
+	conn := dialRealm(t, addr)
+	conn.Write([]byte("fine"))
+	waitFor(t, "the tunnel to open", func() bool { return len(realm.Tunnels()) == 1 })
+	conn.Write([]byte("boom"))
+	// Both sides of the tunnel are closed
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("client connection still open after a middleware error: %v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("destination connection not closed: %v", err)
+	}
+	waitFor(t, "the tunnel to leave", func() bool { return len(realm.Tunnels()) == 0 })
+}
+
+// holdAll holds back all the bytes of a direction until it is flushed
+type holdAll struct {
+	held [2][]byte
+}
+
+func (m *holdAll) Process(direction Direction, b []byte) ([]byte, error) {
+	m.held[direction] = append(m.held[direction], b...)
+	return nil, nil
+}
+
+func (m *holdAll) Flush(direction Direction) ([]byte, error) {
+	return m.held[direction], nil
+}
+
+func TestMiddlewareFlushOnHalfClose(t *testing.T) {
+	_, addr := startRealm(t, startEcho(t), WithMiddleware(func(tunnel *TCPTunnel) Middleware {
+		return &holdAll{}
+	}))
+	conn := dialRealm(t, addr)
+	conn.Write([]byte("held "))
+	conn.Write([]byte("back"))
+	// Nothing reaches the echo until the client is done sending
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes before the middleware was flushed", n)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "held back" {
+		t.Errorf("got %q back, want %q", reply, "held back")
+	}
+}
+
+func TestDumpMiddleware(t *testing.T) {
+	var dump bytes.Buffer
+	dumping := DumpMiddleware(&dump)
+	// The dump is written under a lock of its own, read once the tunnel is done
+	var lock sync.Mutex
+	realm, addr := startRealm(t, startEcho(t), WithMiddleware(func(tunnel *TCPTunnel) Middleware {
+		m := dumping(tunnel)
+		return MiddlewareFunc(func(direction Direction, b []byte) ([]byte, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return m.Process(direction, b)
+		})
+	}))
+	msg := []byte("dumped bytes")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+	waitFor(t, "the tunnel to leave", func() bool { return len(realm.Tunnels()) == 0 })
+	lock.Lock()
+	defer lock.Unlock()
+	for _, want := range []string{"12 bytes in", "12 bytes out", "dumped bytes"} {
+		if !strings.Contains(dump.String(), want) {
+			t.Errorf("dump is missing %q:\n%s", want, dump.String())
+		}
+	}
+}
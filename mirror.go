@@ -0,0 +1,92 @@
+package tcpf
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Number of chunks of client bytes queued for the mirror before it is
+// considered too slow to keep up with the tunnel
+const mirrorQueueLen = 64
+
+// mirror receives a copy of the bytes a tunnel forwards from its client,
+// with WithMirror. Whatever happens to the mirror never holds up or breaks the
+// tunnel: the mirror is dropped once it fails or falls behind, and what it
+// sends back is discarded.
+type mirror struct {
+	conn net.Conn
+	// Written only by the copy from the tunnel's client, which closes it
+	// once the client is done sending
+	chunks  chan []byte
+	dropped atomic.Bool
+}
+
+// openMirror dials the realm's mirror for the tunnel, or returns nil if it
+// can't be dialed
+func (realm *TunnelRealm) openMirror(tunnel *TCPTunnel) *mirror {
+	network, endpoint := splitEndpoint(realm.mirror)
+	dialer := realm.dialer(network)
+	conn, err := dialer.DialContext(tunnel.ctx, network, endpoint)
+	if err != nil {
+		logEvent(LevelWarn, "mirror_error", tunnel.fields().with("mirror", realm.mirror).with("error", err), "Can't mirror tunnel [%v] to %v: %v", tunnel, realm.mirror, err)
+		return nil
+	}
+	realm.tune(conn)
+	m := &mirror{conn: conn, chunks: make(chan []byte, mirrorQueueLen)}
+	context.AfterFunc(tunnel.ctx, func() { conn.Close() })
+	realm.tunnelsLive.Add(2)
+	go func() {
+		defer realm.tunnelsLive.Done()
+		io.Copy(io.Discard, conn)
+	}()
+	go m.send(tunnel)
+	return m
+}
+
+// send writes the queued chunks to the mirror until the tunnel's client is
+// done sending, then half-closes the mirror
+func (m *mirror) send(tunnel *TCPTunnel) {
+	defer tunnel.realm.tunnelsLive.Done()
+	for {
+		select {
+		case chunk, ok := <-m.chunks:
+			if !ok {
+				closeWrite(m.conn)
+				return
+			}
+			if _, err := m.conn.Write(chunk); err != nil {
+				logEvent(errorLevel(err), "mirror_error", tunnel.fields().with("mirror", tunnel.realm.mirror).with("error", err), "Stopped mirroring tunnel [%v] to %v: %v", tunnel, tunnel.realm.mirror, err)
+				m.drop()
+				return
+			}
+		case <-tunnel.ctx.Done():
+			return
+		}
+	}
+}
+
+// write queues a copy of p for the mirror, dropping the mirror if its queue
+// is full, as the mirror would see a gap in the stream otherwise
+func (m *mirror) write(p []byte) {
+	if m.dropped.Load() {
+		return
+	}
+	select {
+	case m.chunks <- append([]byte(nil), p...):
+	default:
+		m.drop()
+	}
+}
+
+// done tells the mirror that no more bytes are coming
+func (m *mirror) done() {
+	close(m.chunks)
+}
+
+// drop stops mirroring the tunnel
+func (m *mirror) drop() {
+	m.dropped.Store(true)
+	m.conn.Close()
+}
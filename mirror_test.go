@@ -0,0 +1,86 @@
+package tcpf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startMirror runs a mirror which answers every connection with noise,
+// waits for release to be closed, then hands what it read until the tunnel
+// or the realm closed the connection to the channel
+func startMirror(t *testing.T, release chan struct{}) (string, chan []byte) {
+	t.Helper()
+	mirrored := make(chan []byte, 16)
+	addr := startServer(t, func(conn net.Conn) {
+		io.WriteString(conn, "noise from the mirror")
+		<-release
+		data, _ := io.ReadAll(conn)
+		mirrored <- data
+	})
+	return addr, mirrored
+}
+
+// nextMirrored returns what the mirror read from the next connection
+func nextMirrored(t *testing.T, mirrored chan []byte) []byte {
+	t.Helper()
+	select {
+	case data := <-mirrored:
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the mirror")
+		return nil
+	}
+}
+
+func TestMirror(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	mirror, mirrored := startMirror(t, release)
+	realm, addr := startRealm(t, startEcho(t), WithMirror(mirror))
+	conn := dialRealm(t, addr)
+	// The client only gets the responses of the destination
+	converse(t, conn, []byte("first chunk, "), []byte("first chunk, "))
+	converse(t, conn, []byte("second chunk"), []byte("second chunk"))
+	conn.CloseWrite()
+	if rest, err := io.ReadAll(conn); err != nil || len(rest) != 0 {
+		t.Errorf("client read %q, %v after the echo", rest, err)
+	}
+	if data := nextMirrored(t, mirrored); string(data) != "first chunk, second chunk" {
+		t.Errorf("mirror got %q", data)
+	}
+	waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 0 })
+
+	// A mirror which can't be dialed doesn't affect the tunnels
+	_, addr = startRealm(t, startEcho(t), WithMirror(closedPort(t)))
+	if reply := roundTrip(t, addr, []byte("unmirrored")); string(reply) != "unmirrored" {
+		t.Errorf("got %q back without a mirror", reply)
+	}
+}
+
+func TestMirrorStalled(t *testing.T) {
+	// The mirror reads nothing until the tunnel is done, so it falls far
+	// enough behind for the realm to drop it
+	release := make(chan struct{})
+	mirror, mirrored := startMirror(t, release)
+	_, addr := startRealm(t, startEcho(t), WithMirror(mirror))
+	conn := dialRealm(t, addr)
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	data := make([]byte, 32<<20)
+	rand.Read(data)
+	go func() {
+		conn.Write(data)
+		conn.CloseWrite()
+	}()
+	echoed, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(echoed, data) {
+		t.Fatalf("got %d of %d bytes back with a stalled mirror: %v", len(echoed), len(data), err)
+	}
+	close(release)
+	if got := nextMirrored(t, mirrored); len(got) >= len(data) || !bytes.Equal(got, data[:len(got)]) {
+		t.Errorf("stalled mirror got %d of %d bytes, want a prefix of them before it was dropped", len(got), len(data))
+	}
+}
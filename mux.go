@@ -0,0 +1,584 @@
+package tcpf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frames of the protocol multiplexing tunnels over one connection between
+// two tcpf instances. Every frame is a header of muxHeaderSize bytes, the
+// frame type, the stream ID and the length of the payload, followed by the
+// payload. The client opens the streams, with odd IDs.
+const (
+	// Opens a stream to the host:port in the payload
+	muxOpen = iota + 1
+	// Answers muxOpen, with the error in the payload if the destination
+	// can't be dialed
+	muxReply
+	muxData
+	// Lets the peer send as many more bytes as the 32-bit payload tells
+	muxWindow
+	// No more data follows from the sender
+	muxFin
+	// Closes the stream in both directions
+	muxReset
+)
+
+const (
+	muxHeaderSize = 7
+	// Largest payload of a data frame, small enough that the streams of a
+	// session interleave
+	muxMaxPayload = 16 << 10
+	// Largest payload of any frame, which the 16-bit length can tell
+	muxMaxFrame = math.MaxUint16
+	// Bytes either side may send on a stream before the other one has read
+	// them, which keeps a stream nobody reads from stalling the others
+	muxWindowSize = 256 << 10
+	// Time the client has to send the preamble
+	muxPreambleTimeout = 10 * time.Second
+)
+
+// Preamble the client starts a session with
+const muxPreamble = "TCPF-MUX/1\n"
+
+var (
+	errMuxReset  = errors.New("stream reset by the mux peer")
+	errMuxClosed = errors.New("mux session closed")
+	errMuxFrame  = errors.New("mux frame payload too large")
+)
+
+// muxSession multiplexes streams over one connection to a peer tcpf
+type muxSession struct {
+	conn net.Conn
+	// Serializes the frames written by the streams
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	streams   map[uint32]*muxStream
+	lastID    uint32
+	// Why the session closed, once it has
+	err  error
+	done chan struct{}
+	// Called with every stream the peer opens, nil on the client side
+	accept func(stream *muxStream)
+}
+
+func newMuxSession(conn net.Conn, accept func(stream *muxStream)) *muxSession {
+	return &muxSession{conn: conn, streams: make(map[uint32]*muxStream), done: make(chan struct{}), accept: accept}
+}
+
+func (session *muxSession) String() string {
+	return session.conn.RemoteAddr().String()
+}
+
+// run reads the frames of the session and hands them to their streams until
+// the connection fails or is closed
+func (session *muxSession) run() error {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(session.conn, header); err != nil {
+			return session.close(err)
+		}
+		kind, id := header[0], binary.BigEndian.Uint32(header[1:])
+		payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+		if _, err := io.ReadFull(session.conn, payload); err != nil {
+			return session.close(err)
+		}
+		if err := session.dispatch(kind, id, payload); err != nil {
+			return session.close(err)
+		}
+	}
+}
+
+// dispatch handles a frame received for the stream id
+func (session *muxSession) dispatch(kind byte, id uint32, payload []byte) error {
+	session.lock.Lock()
+	stream := session.streams[id]
+	if kind == muxOpen {
+		if session.accept == nil || stream != nil || id%2 == 0 {
+			session.lock.Unlock()
+			return fmt.Errorf("unexpected stream %d opened by the peer", id)
+		}
+		stream = newMuxStream(session, id)
+		stream.target = string(payload)
+		session.streams[id] = stream
+		session.lock.Unlock()
+		session.accept(stream)
+		return nil
+	}
+	session.lock.Unlock()
+	if stream == nil {
+		// Frames in flight when the stream was closed
+		return nil
+	}
+	if kind == muxReset {
+		session.remove(id)
+	}
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	switch kind {
+	case muxReply:
+		var err error
+		if len(payload) > 0 {
+			err = errors.New(string(payload))
+		}
+		select {
+		case stream.replied <- err:
+		default:
+		}
+	case muxData:
+		if len(stream.buf)+len(payload) > muxWindowSize {
+			return fmt.Errorf("stream %d overran its window", id)
+		}
+		stream.buf = append(stream.buf, payload...)
+		notify(stream.readable)
+	case muxWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("malformed window update of stream %d", id)
+		}
+		stream.credit += int64(binary.BigEndian.Uint32(payload))
+		notify(stream.writable)
+	case muxFin:
+		stream.finReceived = true
+		notify(stream.readable)
+	case muxReset:
+		stream.err = errMuxReset
+		notify(stream.readable)
+		notify(stream.writable)
+		select {
+		case stream.replied <- errMuxReset:
+		default:
+		}
+	default:
+		return fmt.Errorf("unknown frame type %d", kind)
+	}
+	return nil
+}
+
+// writeFrame sends a frame of the stream id, refusing payloads the header
+// can't tell the length of
+func (session *muxSession) writeFrame(kind byte, id uint32, payload []byte) error {
+	if len(payload) > muxMaxFrame {
+		return errMuxFrame
+	}
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+	if _, err := session.conn.Write(frame); err != nil {
+		session.close(err)
+		return err
+	}
+	return nil
+}
+
+// open opens a stream to the target host:port, which the peer dials
+func (session *muxSession) open(ctx context.Context, target string) (*muxStream, error) {
+	if len(target) > muxMaxFrame {
+		return nil, fmt.Errorf("target of %d bytes is too long for a mux stream", len(target))
+	}
+	session.lock.Lock()
+	if session.err != nil {
+		session.lock.Unlock()
+		return nil, session.err
+	}
+	session.lastID += 2
+	stream := newMuxStream(session, session.lastID-1)
+	session.streams[stream.id] = stream
+	session.lock.Unlock()
+	if err := session.writeFrame(muxOpen, stream.id, []byte(target)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	select {
+	case err := <-stream.replied:
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	case <-session.done:
+		return nil, session.err
+	case <-ctx.Done():
+		stream.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (session *muxSession) remove(id uint32) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	delete(session.streams, id)
+}
+
+// close closes the connection and resets the streams of the session, and
+// returns why it was closed
+func (session *muxSession) close(err error) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.err != nil {
+		return session.err
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = errMuxClosed
+	}
+	session.err = err
+	session.conn.Close()
+	for id, stream := range session.streams {
+		stream.lock.Lock()
+		if stream.err == nil {
+			stream.err = err
+		}
+		notify(stream.readable)
+		notify(stream.writable)
+		stream.lock.Unlock()
+		delete(session.streams, id)
+	}
+	close(session.done)
+	return err
+}
+
+// notify wakes up the goroutine waiting on the channel, if any
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// muxStream is a connection to a destination multiplexed over a muxSession
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	// Destination the peer opened the stream to, on the server side
+	target string
+	// Answer to muxOpen, on the client side
+	replied chan error
+	lock    sync.Mutex
+	// Received bytes not read yet
+	buf         []byte
+	finReceived bool
+	finSent     bool
+	closed      bool
+	// The stream was reset or its session closed
+	err error
+	// Bytes which may still be sent, and bytes read since the last window
+	// update sent to the peer
+	credit   int64
+	consumed int64
+	// Wake up Read and Write
+	readable      chan struct{}
+	writable      chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:  session,
+		id:       id,
+		replied:  make(chan error, 1),
+		credit:   muxWindowSize,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func (stream *muxStream) Read(b []byte) (int, error) {
+	for {
+		stream.lock.Lock()
+		if len(stream.buf) > 0 {
+			n := copy(b, stream.buf)
+			stream.buf = stream.buf[n:]
+			stream.consumed += int64(n)
+			var update int64
+			if stream.consumed >= muxWindowSize/2 {
+				update, stream.consumed = stream.consumed, 0
+			}
+			stream.lock.Unlock()
+			if update > 0 {
+				payload := binary.BigEndian.AppendUint32(nil, uint32(update))
+				stream.session.writeFrame(muxWindow, stream.id, payload)
+			}
+			return n, nil
+		}
+		closed, fin, err, deadline := stream.closed, stream.finReceived, stream.err, stream.readDeadline
+		stream.lock.Unlock()
+		switch {
+		case closed:
+			return 0, net.ErrClosed
+		case fin:
+			return 0, io.EOF
+		case err != nil:
+			return 0, err
+		}
+		if err := wait(stream.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (stream *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		stream.lock.Lock()
+		closed, err, deadline := stream.closed || stream.finSent, stream.err, stream.writeDeadline
+		if closed || err != nil || stream.credit == 0 {
+			stream.lock.Unlock()
+			if closed {
+				return written, net.ErrClosed
+			}
+			if err != nil {
+				return written, err
+			}
+			if err := wait(stream.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b), muxMaxPayload, int(stream.credit))
+		stream.credit -= int64(n)
+		stream.lock.Unlock()
+		if err := stream.session.writeFrame(muxData, stream.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// wait waits for the channel to be notified, which closing the stream or its
+// session does too, or for the deadline to pass
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// CloseWrite tells the peer no more data follows, which it reads as EOF
+func (stream *muxStream) CloseWrite() error {
+	stream.lock.Lock()
+	if stream.finSent || stream.closed || stream.err != nil {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.finSent = true
+	stream.lock.Unlock()
+	return stream.session.writeFrame(muxFin, stream.id, nil)
+}
+
+// Close resets the stream, unless the peer or the session already did
+func (stream *muxStream) Close() error {
+	stream.lock.Lock()
+	if stream.closed {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.closed = true
+	reset := stream.err == nil
+	notify(stream.readable)
+	notify(stream.writable)
+	stream.lock.Unlock()
+	stream.session.remove(stream.id)
+	if reset {
+		return stream.session.writeFrame(muxReset, stream.id, nil)
+	}
+	return nil
+}
+
+func (stream *muxStream) LocalAddr() net.Addr {
+	return stream.session.conn.LocalAddr()
+}
+
+func (stream *muxStream) RemoteAddr() net.Addr {
+	return stream.session.conn.RemoteAddr()
+}
+
+func (stream *muxStream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of Read, waking up a Read waiting for
+// data to check it
+func (stream *muxStream) SetReadDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.readDeadline = t
+	stream.lock.Unlock()
+	notify(stream.readable)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write waiting for the peer to let
+// it send more; the frames themselves are written by the session
+func (stream *muxStream) SetWriteDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.writeDeadline = t
+	stream.lock.Unlock()
+	notify(stream.writable)
+	return nil
+}
+
+// muxClient multiplexes the tunnels of a realm created with WithMux over
+// one connection to the peer, which is dialed when the first tunnel opens
+// and dialed again once it breaks
+type muxClient struct {
+	address string
+	lock    sync.Mutex
+	session *muxSession
+}
+
+// dialMux opens a stream to the destination address through the mux peer
+func (realm *TunnelRealm) dialMux(ctx context.Context, address string) (net.Conn, error) {
+	if realm.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, realm.dialTimeout)
+		defer cancel()
+	}
+	session, err := realm.muxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.open(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("destination address %v is not available through mux peer %v: %w", address, realm.mux.address, err)
+	}
+	return stream, nil
+}
+
+// muxSession returns the session with the mux peer, establishing it first
+// unless there is a live one
+func (realm *TunnelRealm) muxSession(ctx context.Context) (*muxSession, error) {
+	client := realm.mux
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.session != nil {
+		select {
+		case <-client.session.done:
+		default:
+			return client.session, nil
+		}
+	}
+	// Opening the session is not part of the tunnel, so it goes without the
+	// PROXY header
+	conn, err := realm.dialOnce(ctx, client.address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("mux peer %w", err)
+	}
+	if _, err := io.WriteString(conn, muxPreamble); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("can't open mux session with %v: %w", client.address, err)
+	}
+	session := newMuxSession(conn, nil)
+	client.session = session
+	logEvent(LevelInfo, "mux_open", Fields{"realm": realm, "peer": client.address}, "Opened mux session with %v", client.address)
+	go func() {
+		stop := context.AfterFunc(realm.ctx, func() {
+			session.close(errMuxClosed)
+		})
+		defer stop()
+		err := session.run()
+		logEvent(LevelInfo, "mux_close", Fields{"realm": realm, "peer": client.address, "error": err}, "Mux session with %v closed: %v", client.address, err)
+	}()
+	return session, nil
+}
+
+// muxServer is the negotiator of a realm created with WithMuxServer, whose
+// clients are mux sessions: the destinations of their streams are the ones
+// the peer opened them to
+type muxServer struct{}
+
+func (muxServer) String() string {
+	return "mux"
+}
+
+func (muxServer) destination(conn net.Conn) (string, net.Conn, error) {
+	stream, ok := conn.(*muxStream)
+	if !ok {
+		return "", nil, fmt.Errorf("%v is not a mux stream", conn.RemoteAddr())
+	}
+	return stream.target, conn, nil
+}
+
+func (muxServer) reply(conn net.Conn, outbound net.Conn, err error) error {
+	stream := conn.(*muxStream)
+	var payload []byte
+	if err != nil {
+		payload = []byte(err.Error())
+		if len(payload) == 0 || len(payload) > muxMaxPayload {
+			payload = []byte("destination not available")
+		}
+	}
+	return stream.session.writeFrame(muxReply, stream.id, payload)
+}
+
+// serveMux serves a mux session accepted by a realm created with
+// WithMuxServer, feeding the streams the peer opens to the realm as if they
+// were accepted connections
+func (realm *TunnelRealm) serveMux(conn net.Conn) {
+	defer realm.running.Done()
+	if realm.acceptProxy {
+		proxied, err := readProxyHeaderV2(conn)
+		if err != nil {
+			logEvent(LevelWarn, "proxy_error", Fields{"src": conn.RemoteAddr(), "error": err}, "Malformed PROXY header from %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+	if realm.tlsConfig != nil {
+		tlsConn, _, err := realm.handshakeTLS(conn)
+		if err != nil {
+			logEvent(LevelWarn, "tls_error", Fields{"src": conn.RemoteAddr(), "error": err}, "TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+	preamble := make([]byte, len(muxPreamble))
+	conn.SetReadDeadline(time.Now().Add(muxPreambleTimeout))
+	if _, err := io.ReadFull(conn, preamble); err != nil || string(preamble) != muxPreamble {
+		logEvent(LevelWarn, "mux_error", Fields{"src": conn.RemoteAddr(), "error": err}, "Connection from %v is not a mux session", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	session := newMuxSession(conn, func(stream *muxStream) {
+		select {
+		case realm.joining <- stream:
+		case <-realm.ctx.Done():
+			stream.Close()
+		}
+	})
+	stop := context.AfterFunc(realm.ctx, func() {
+		session.close(errMuxClosed)
+	})
+	defer stop()
+	logEvent(LevelInfo, "mux_open", Fields{"realm": realm, "peer": conn.RemoteAddr()}, "Accepted mux session from %v", conn.RemoteAddr())
+	err := session.run()
+	logEvent(LevelInfo, "mux_close", Fields{"realm": realm, "peer": conn.RemoteAddr(), "error": err}, "Mux session from %v closed: %v", conn.RemoteAddr(), err)
+}
@@ -0,0 +1,300 @@
+package tcpf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// muxPair runs the client and server sessions of a loopback connection,
+// handing the streams the client opens to accept
+func muxPair(t *testing.T, accept func(stream *muxStream)) (*muxSession, *muxSession) {
+	t.Helper()
+	accepted := make(chan *muxSession, 1)
+	addr := startServer(t, func(conn net.Conn) {
+		session := newMuxSession(conn, accept)
+		accepted <- session
+		session.run()
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newMuxSession(conn, nil)
+	go client.run()
+	server := <-accepted
+	t.Cleanup(func() {
+		client.close(errMuxClosed)
+		server.close(errMuxClosed)
+	})
+	return client, server
+}
+
+// openStream opens a stream through the client session, failing the test if
+// it can't
+func openStream(t *testing.T, client *muxSession, target string) *muxStream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.open(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	return stream
+}
+
+// acceptEcho accepts streams by echoing what comes in until the client is
+// done sending
+func acceptEcho(stream *muxStream) {
+	stream.session.writeFrame(muxReply, stream.id, nil)
+	go func() {
+		defer stream.Close()
+		io.Copy(stream, stream)
+		stream.CloseWrite()
+	}()
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, _ := muxPair(t, acceptEcho)
+	// Each stream sends more than its window, which the echo only makes
+	// room for as it reads
+	var streams sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			stream := openStream(t, client, fmt.Sprintf("stream %d", i))
+			defer stream.Close()
+			msg := make([]byte, 3*muxWindowSize+i)
+			rand.Read(msg)
+			go func() {
+				stream.Write(msg)
+				stream.CloseWrite()
+			}()
+			reply, err := io.ReadAll(stream)
+			if err != nil {
+				t.Errorf("stream %d: %v", i, err)
+			} else if !bytes.Equal(reply, msg) {
+				t.Errorf("stream %d got %d bytes back, want the %d sent", i, len(reply), len(msg))
+			}
+		}()
+	}
+	streams.Wait()
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	// The server reads until the client's FIN, then answers on its side,
+	// which is still open
+	client, _ := muxPair(t, func(stream *muxStream) {
+		stream.session.writeFrame(muxReply, stream.id, nil)
+		go func() {
+			defer stream.Close()
+			request, _ := io.ReadAll(stream)
+			fmt.Fprintf(stream, "got %q for %v", request, stream.target)
+			stream.CloseWrite()
+		}()
+	})
+	stream := openStream(t, client, "dest.test:80")
+	stream.Write([]byte("request"))
+	stream.CloseWrite()
+	if _, err := stream.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() after CloseWrite = %v, want %v", err, net.ErrClosed)
+	}
+	reply, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `got "request" for dest.test:80`; string(reply) != want {
+		t.Errorf("got %q back, want %q", reply, want)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	accepted := make(chan *muxStream, 2)
+	client, server := muxPair(t, func(stream *muxStream) {
+		if stream.target == "refused" {
+			stream.session.writeFrame(muxReply, stream.id, []byte("connection refused"))
+			stream.Close()
+			return
+		}
+		stream.session.writeFrame(muxReply, stream.id, nil)
+		accepted <- stream
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.open(ctx, "refused"); err == nil || err.Error() != "connection refused" {
+		t.Errorf("open() = %v, want the error of the peer", err)
+	}
+
+	// A stream the peer resets fails both ways, the others go on
+	stream := openStream(t, client, "reset")
+	other := openStream(t, client, "other")
+	(<-accepted).Close()
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, errMuxReset) {
+		t.Errorf("Read() = %v, want %v", err, errMuxReset)
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, errMuxReset) {
+		t.Errorf("Write() = %v, want %v", err, errMuxReset)
+	}
+	other.Write([]byte("still open"))
+	peer := <-accepted
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len("still open"))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "still open" {
+		t.Errorf("peer read %q and %v from the other stream", got, err)
+	}
+	server.lock.Lock()
+	if len(server.streams) != 1 {
+		t.Errorf("server has %d streams, want 1", len(server.streams))
+	}
+	server.lock.Unlock()
+
+	// Closing the session fails the streams left
+	server.close(errMuxClosed)
+	if _, err := other.Read(make([]byte, 1)); !errors.Is(err, errMuxClosed) {
+		t.Errorf("Read() after the session closed = %v, want %v", err, errMuxClosed)
+	}
+	if _, err := client.open(ctx, "after close"); !errors.Is(err, errMuxClosed) {
+		t.Errorf("open() after the session closed = %v, want %v", err, errMuxClosed)
+	}
+}
+
+func TestMuxDeadline(t *testing.T) {
+	client, _ := muxPair(t, func(stream *muxStream) {
+		stream.session.writeFrame(muxReply, stream.id, nil)
+	})
+	stream := openStream(t, client, "silent")
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	// Nothing reads the stream, so writing stalls once the window is used
+	stream.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := stream.Write(make([]byte, 2*muxWindowSize))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != muxWindowSize {
+		t.Errorf("Write() = %d, %v, want %d, %v", n, err, muxWindowSize, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestMuxProtocolErrors(t *testing.T) {
+	frame := func(kind byte, id uint32, payload []byte) []byte {
+		header := []byte{kind}
+		header = binary.BigEndian.AppendUint32(header, id)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+		return append(header, payload...)
+	}
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"even stream ID", [][]byte{frame(muxOpen, 2, []byte("dest"))}},
+		{"stream opened twice", [][]byte{frame(muxOpen, 1, []byte("dest")), frame(muxOpen, 1, []byte("dest"))}},
+		{"unknown frame type", [][]byte{frame(muxOpen, 1, []byte("dest")), frame(muxReset+1, 1, nil)}},
+		{"malformed window update", [][]byte{frame(muxOpen, 1, []byte("dest")), frame(muxWindow, 1, []byte{1})}},
+		{"window overrun", [][]byte{
+			frame(muxOpen, 1, []byte("dest")),
+			frame(muxData, 1, make([]byte, 0xffff)), frame(muxData, 1, make([]byte, 0xffff)),
+			frame(muxData, 1, make([]byte, 0xffff)), frame(muxData, 1, make([]byte, 0xffff)),
+			frame(muxData, 1, make([]byte, 5)),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			session := newMuxSession(server, func(stream *muxStream) {})
+			done := make(chan error, 1)
+			go func() { done <- session.run() }()
+			go func() {
+				for _, frame := range test.frames {
+					if _, err := client.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+			select {
+			case err := <-done:
+				if err == nil || errors.Is(err, errMuxClosed) {
+					t.Errorf("session ended with %v, want a protocol error", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the session kept running")
+			}
+		})
+	}
+}
+
+func TestMuxRealms(t *testing.T) {
+	_, server := startRealm(t, closedPort(t), WithMuxServer())
+	// The sessions to the server are counted on their way
+	var sessions atomic.Int64
+	counting := startServer(t, func(conn net.Conn) {
+		sessions.Add(1)
+		peer, err := net.Dial("tcp", server)
+		if err != nil {
+			return
+		}
+		defer peer.Close()
+		go func() {
+			io.Copy(peer, conn)
+			closeWrite(peer)
+		}()
+		io.Copy(conn, peer)
+	})
+	_, addr := startRealm(t, startEcho(t), WithMux(counting))
+	var tunnels sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		tunnels.Add(1)
+		go func() {
+			defer tunnels.Done()
+			msg := []byte(fmt.Sprintf("tunnel %d", i))
+			if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+				t.Errorf("got %q back, want %q", reply, msg)
+			}
+		}()
+	}
+	tunnels.Wait()
+	if n := sessions.Load(); n != 1 {
+		t.Errorf("%d mux sessions for 4 tunnels, want 1", n)
+	}
+
+	// A destination the server can't dial closes the tunnel
+	_, refused := startRealm(t, closedPort(t), WithMux(counting))
+	conn := dialRealm(t, refused)
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a tunnel to a closed port", n)
+	}
+}
+
+func TestMuxFrameLimits(t *testing.T) {
+	client, _ := muxPair(t, acceptEcho)
+	if err := client.writeFrame(muxData, 1, make([]byte, muxMaxFrame+1)); !errors.Is(err, errMuxFrame) {
+		t.Errorf("writeFrame() = %v with an oversized payload, want %v", err, errMuxFrame)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.open(ctx, string(make([]byte, muxMaxFrame+1))); err == nil {
+		t.Error("open() succeeded with a target too long for a frame")
+	}
+	// The session is still usable, nothing was written
+	stream := openStream(t, client, string(bytes.Repeat([]byte("x"), muxMaxFrame)))
+	defer stream.Close()
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read %q, %v, want ping", buf, err)
+	}
+}
@@ -0,0 +1,34 @@
+package tcpf
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// Time a client has to tell where its connection should be forwarded to
+	negotiationTimeout = 10 * time.Second
+)
+
+// negotiator learns the destination of an inbound connection from the client
+// itself, as proxy protocols like SOCKS5 or HTTP CONNECT do, instead of
+// forwarding it to the realm's fixed destination
+type negotiator interface {
+	fmt.Stringer
+	// destination reads the client's request and returns the address to dial
+	// along with the connection to use from now on, which wraps conn when
+	// the request was read through a buffer
+	destination(conn net.Conn) (string, net.Conn, error)
+	// reply tells the client whether its destination could be reached, err
+	// being the error which happened when dialing the outbound connection
+	reply(conn net.Conn, outbound net.Conn, err error) error
+}
+
+// negotiate reads the destination requested by the client, making sure a
+// silent client doesn't hold the connection forever
+func negotiate(n negotiator, conn net.Conn) (string, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(negotiationTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return n.destination(conn)
+}
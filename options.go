@@ -0,0 +1,837 @@
+package tcpf
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// Default time a UDP session may stay idle before it expires
+	defaultUDPIdleTimeout = time.Minute
+	// Default interval of TCP keepalive probes, the one of the net package
+	defaultKeepAlive = 15 * time.Second
+	// Default time to wait for the destination to accept a connection
+	defaultDialTimeout = 10 * time.Second
+	// Default delay before the first retry of a failed dial
+	defaultDialRetryBackoff = 100 * time.Millisecond
+)
+
+// Option configures a realm created by NewTunnelRealm or NewUDPRealm
+type Option func(*options)
+
+type options struct {
+	idleTimeout time.Duration
+	// Longest a single read or write of a tunnel may block
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// Bytes a tunnel may forward in both directions together, zero means
+	// no limit
+	maxBytes int64
+	// Time after which tunnels are closed however active, zero means no
+	// limit
+	maxLifetime time.Duration
+	// Bounds of the buckets of the histograms of the tunnels closed
+	durationBuckets []time.Duration
+	byteBuckets     []int64
+	// Identify tunnels with random UUIDs instead of sequence numbers
+	uuidIDs bool
+	// Byte sequences replaced in the traffic of the tunnels, and the
+	// middleware processing it after them
+	replacements []Replacement
+	middleware   []MiddlewareFactory
+	tlsConfig    *tls.Config
+	// TLS configuration used to connect to the destination
+	dstTLSConfig *tls.Config
+	sendProxy    bool
+	addXFF       bool
+	// Compress the traffic to a peer tcpf destination, or decompress the
+	// traffic from peer tcpf clients
+	compress   bool
+	decompress bool
+	// Address of the peer tcpf the tunnels are multiplexed to, and whether
+	// the clients are such peers
+	mux         string
+	muxServer   bool
+	acceptProxy bool
+	// Learns the destination from the client instead of dstHost/dstPort
+	negotiator negotiator
+	// Dial the destination only once the client has sent something
+	lazyDial bool
+	maxConns int
+	// Zero means no limit
+	maxConnsPerIP int
+	connRate      int
+	// Zero disables TCP keepalive
+	keepAlive time.Duration
+	noDelay   bool
+	reusePort bool
+	// Connections the listening socket queues until they are accepted, zero
+	// means the system's default
+	backlog int
+	// How long a listener which can't be bound is retried for, zero fails at
+	// once
+	bindRetry time.Duration
+	// Accept connections diverted with TPROXY and dial the destinations from
+	// the addresses of the clients
+	transparent bool
+	// Zero leaves the DSCP of the connections as is
+	dscp int
+	// Idle connections kept per destination, zero disables the pool
+	poolSize     int
+	poolLifetime time.Duration
+	// Connections per destination dialed as the realm starts, with WithPrewarm
+	prewarmConns int
+	// Zero leaves resolving the destination hosts to every dial
+	resolveTTL time.Duration
+	// Nil resolves the destination hosts with the system resolver
+	resolver *net.Resolver
+	// Local address of the TCP connections to the destinations, if valid
+	srcAddr netip.Addr
+	// Zero means the default of the net package, negative disables the
+	// fallback to the other address family
+	fallbackDelay time.Duration
+	// Zero means the operating system's timeout
+	dialTimeout      time.Duration
+	dialRetries      int
+	dialRetryBackoff time.Duration
+	backup           string
+	mirror           string
+	// Proxy the destinations are dialed through
+	upstream upstream
+	// Address of the control server to accept connections from instead of
+	// listening
+	reverse        string
+	capture        *PcapWriter
+	accessLog      *AccessLog
+	events         *Events
+	healthInterval time.Duration
+	healthFailures int
+	// Zero disables the circuit breakers of the destinations
+	breakerFailures int
+	breakerCooldown time.Duration
+	balance         Balance
+	bufSize         int
+	// Buffer sizes of each direction overriding bufSize, unless zero
+	bufSizes       [2]int
+	rateLimit      int64
+	totalRateLimit int64
+	// Networks clients may and may not connect from
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	// Countries clients may and may not connect from, looked up in geoIP
+	geoIP          *GeoIP
+	geoIPFailOpen  bool
+	allowCountries []string
+	denyCountries  []string
+	// Picks the destinations of connections by their first bytes
+	router router
+	// Destinations the clients of the proxy modes may and may not request
+	allowPorts []PortRange
+	denyPorts  []PortRange
+	allowHosts []string
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		dialTimeout:      defaultDialTimeout,
+		dialRetryBackoff: defaultDialRetryBackoff,
+		bufSize:          readBufSize,
+		keepAlive:        defaultKeepAlive,
+		noDelay:          true,
+		durationBuckets:  defaultDurationBuckets,
+		byteBuckets:      defaultByteBuckets,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithIdleTimeout sets how long a TCP tunnel or a UDP session may stay idle,
+// with no bytes flowing in either direction, before it is closed. Idle TCP
+// tunnels are kept open by default, UDP sessions expire after a minute.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = timeout
+	}
+}
+
+// WithReadWriteTimeouts bounds how long a TCP tunnel may wait to read from
+// either of its connections, and how long writing to either of them may
+// block, e.g. on a wedged peer which stopped reading; the tunnel is closed
+// when a timeout expires. Zero timeouts leave reads and writes unbounded.
+func WithReadWriteTimeouts(read time.Duration, write time.Duration) Option {
+	return func(o *options) {
+		o.readTimeout = read
+		o.writeTimeout = write
+	}
+}
+
+// WithMaxBytes closes the TCP tunnels which have forwarded n bytes in both
+// directions together, e.g. to meter clients; zero means no limit
+func WithMaxBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBytes = n
+	}
+}
+
+// WithMaxLifetime closes the TCP tunnels open for longer than lifetime, even
+// active ones, so that clients reconnect periodically, e.g. to rebalance them
+// across the destinations; zero means no limit
+func WithMaxLifetime(lifetime time.Duration) Option {
+	return func(o *options) {
+		o.maxLifetime = lifetime
+	}
+}
+
+// WithReplacements rewrites the traffic of the TCP tunnels in both directions,
+// replacing every occurrence of the From of a replacement with its To, e.g.
+// to rewrite host names in simple protocols. Protocols framing their messages
+// with lengths or checksums break unless From and To are as long, and bytes
+// which may start a match are held back until the next bytes arrive.
+func WithReplacements(replacements []Replacement) Option {
+	return func(o *options) {
+		o.replacements = replacements
+	}
+}
+
+// WithMiddleware adds middleware which every TCP tunnel passes the bytes it
+// forwards through, in the order they were added, after the rate limits and
+// the replacements and before the mirror; the factory is called for every
+// tunnel. Tunnels with middleware are never spliced.
+func WithMiddleware(factories ...MiddlewareFactory) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, factories...)
+	}
+}
+
+// WithHistogramBuckets sets the upper bounds of the buckets, in ascending
+// order, which the lifetimes of the closed TCP tunnels and the bytes they
+// forwarded in each direction are counted in; nil keeps the default buckets
+// of either histogram
+func WithHistogramBuckets(durations []time.Duration, bytes []int64) Option {
+	return func(o *options) {
+		if durations != nil {
+			o.durationBuckets = durations
+		}
+		if bytes != nil {
+			o.byteBuckets = bytes
+		}
+	}
+}
+
+// WithUUIDs identifies the tunnels of a realm in the logs, the stats and the
+// admin API with random UUIDs, which are unique across realms and restarts,
+// e.g. to correlate the logs of several tcpf, instead of the shorter numbers
+// counting the tunnels of the process
+func WithUUIDs() Option {
+	return func(o *options) {
+		o.uuidIDs = true
+	}
+}
+
+// WithTLS makes a TunnelRealm terminate TLS on accepted connections, so the
+// traffic is forwarded to the destination decrypted
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithDestinationTLS makes a TunnelRealm connect to the destination over TLS,
+// so the traffic accepted in plain text is forwarded encrypted. Unless set in
+// the config, the server name is the destination host.
+func WithDestinationTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.dstTLSConfig = config
+	}
+}
+
+// WithAccessLog makes a TunnelRealm parse the plaintext HTTP/1.x traffic of
+// its tunnels to write every request, along with the status and size of its
+// response, to the access log. Connections which don't speak HTTP/1.x, or
+// switch to another protocol, are forwarded unchanged.
+func WithAccessLog(log *AccessLog) Option {
+	return func(o *options) {
+		o.accessLog = log
+	}
+}
+
+// WithEvents makes a TunnelRealm hand every tunnel joining and leaving it
+// to the subscribers of events
+func WithEvents(events *Events) Option {
+	return func(o *options) {
+		o.events = events
+	}
+}
+
+// WithXForwardedFor makes a TunnelRealm append the IP address of the client
+// to the X-Forwarded-For header of every HTTP/1.x request it forwards, which
+// is added if the request has none, so that HTTP backends learn the original
+// client address. Connections which don't speak HTTP/1.x, or switch to
+// another protocol, are forwarded unchanged; requests whose header is over
+// 64KB, or whose chunked body is malformed, are refused with 431 and 400,
+// closing the tunnel, instead of reaching the backends with the header the
+// client sent.
+func WithXForwardedFor() Option {
+	return func(o *options) {
+		o.addXFF = true
+	}
+}
+
+// WithCompression makes a TunnelRealm compress the traffic of its tunnels to
+// the destination, which has to be another tcpf instance decompressing it
+// with WithDecompression, e.g. to save bandwidth over a slow WAN link; the
+// responses are decompressed. Traffic which is already compressed or
+// encrypted, such as TLS, won't get any smaller.
+func WithCompression() Option {
+	return func(o *options) {
+		o.compress = true
+	}
+}
+
+// WithDecompression makes a TunnelRealm decompress the traffic of its
+// clients, which have to be another tcpf instance compressing it with
+// WithCompression, before forwarding it to the destination; the responses
+// are compressed. Clients sending anything else are disconnected.
+func WithDecompression() Option {
+	return func(o *options) {
+		o.decompress = true
+	}
+}
+
+// WithMux makes a TunnelRealm multiplex its tunnels over a single long-lived
+// connection to address, another tcpf instance created with WithMuxServer,
+// instead of dialing a connection to the destination for every tunnel: every
+// tunnel is a stream of the connection, which the peer forwards to the
+// destination chosen for the tunnel as the peer resolves and dials it. The
+// connection is dialed like a destination, e.g. over TLS with
+// WithDestinationTLS, when the first tunnel opens and again once it breaks,
+// which resets its tunnels. The dial timeout bounds opening a stream,
+// including the peer dialing the destination. The pool is disabled.
+func WithMux(address string) Option {
+	return func(o *options) {
+		o.mux = address
+	}
+}
+
+// WithMuxServer makes a TunnelRealm accept connections from tcpf instances
+// created with WithMux, whose streams it forwards to the destinations they
+// were opened to; the destinations may be restricted with WithAllowPorts,
+// WithDenyPorts and WithAllowHosts, without which the realm is an open relay
+// to anyone who can connect to it. The PROXY header and TLS are handled per
+// connection, while the limits of tunnels apply to the streams.
+func WithMuxServer() Option {
+	return func(o *options) {
+		o.negotiator = muxServer{}
+		o.muxServer = true
+	}
+}
+
+// WithSendProxy makes a TunnelRealm send the PROXY protocol v1 header to the
+// destination, so it can learn the original client address
+func WithSendProxy() Option {
+	return func(o *options) {
+		o.sendProxy = true
+	}
+}
+
+// WithAcceptProxy makes a TunnelRealm expect the PROXY protocol v2 header on
+// every accepted connection, e.g. from a load balancer in front of it. The
+// header is stripped and the original client address is used for the tunnel.
+func WithAcceptProxy() Option {
+	return func(o *options) {
+		o.acceptProxy = true
+	}
+}
+
+// WithSOCKS5 makes a TunnelRealm act as a SOCKS5 server: every client tells
+// the destination to connect to with the CONNECT command, and the realm's own
+// destination is not used. Clients have to authenticate with one of the given
+// username/password pairs, or with no authentication if there are none.
+func WithSOCKS5(credentials map[string]string) Option {
+	return func(o *options) {
+		o.negotiator = &socks5Server{credentials: credentials}
+	}
+}
+
+// WithHTTPConnect makes a TunnelRealm act as an HTTP forward proxy: every
+// client tells the destination to connect to with the CONNECT method, and the
+// realm's own destination is not used
+func WithHTTPConnect() Option {
+	return func(o *options) {
+		o.negotiator = &httpConnectServer{}
+	}
+}
+
+// WithMaxConns limits the number of concurrent tunnels of a TunnelRealm:
+// connections beyond the limit are closed right away, without dialing the
+// destination. Zero means no limit.
+func WithMaxConns(limit int) Option {
+	return func(o *options) {
+		o.maxConns = limit
+	}
+}
+
+// WithMaxConnsPerIP limits the number of concurrent tunnels of a TunnelRealm
+// from a single client IP: further connections from the IP are closed right
+// away, without dialing the destination. A UDPRealm limits the sessions of
+// the IP, one per client port, dropping the datagrams of further ones. Zero
+// means no limit.
+func WithMaxConnsPerIP(limit int) Option {
+	return func(o *options) {
+		o.maxConnsPerIP = limit
+	}
+}
+
+// WithConnRate limits the number of new tunnels a TunnelRealm opens per
+// second, allowing bursts of up to the same number: further connections are
+// closed right away, without dialing the destination. Zero means no limit.
+func WithConnRate(perSecond int) Option {
+	return func(o *options) {
+		o.connRate = perSecond
+	}
+}
+
+// WithKeepAlive sets the interval of the TCP keepalive probes a TunnelRealm
+// sends on both connections of its tunnels, 15 seconds by default, so that
+// the operating system detects dead peers and the tunnel is closed. Zero
+// disables keepalive.
+func WithKeepAlive(period time.Duration) Option {
+	return func(o *options) {
+		o.keepAlive = period
+	}
+}
+
+// WithNoDelay sets TCP_NODELAY on both connections of the tunnels of a
+// TunnelRealm, which is the default: small writes are sent right away for
+// the lowest latency. Disabling it turns Nagle's algorithm on, which
+// coalesces small writes into fewer packets for bulk transfers.
+func WithNoDelay(noDelay bool) Option {
+	return func(o *options) {
+		o.noDelay = noDelay
+	}
+}
+
+// WithDSCP marks the packets of both connections of the tunnels of a
+// TunnelRealm with the DSCP value (1-63, e.g. 46 for Expedited Forwarding),
+// so that QoS-aware routers can classify them. It is ignored with a warning
+// on platforms other than Linux and BSDs.
+func WithDSCP(dscp int) Option {
+	return func(o *options) {
+		o.dscp = dscp
+	}
+}
+
+// WithReusePort sets SO_REUSEPORT on the listening socket of a TunnelRealm,
+// so that a new process can bind the same port while the old one drains its
+// tunnels. It is only supported on Linux and BSDs, elsewhere Start fails.
+func WithReusePort() Option {
+	return func(o *options) {
+		o.reusePort = true
+	}
+}
+
+// WithBacklog sets how many connections the listening socket of a TunnelRealm
+// queues until they are accepted, so that bursts of connections aren't dropped
+// before the realm catches up; zero keeps the system's default, which is also
+// the largest backlog Linux allows, net.core.somaxconn. It is only supported
+// on Linux and BSDs, elsewhere Start fails.
+func WithBacklog(backlog int) Option {
+	return func(o *options) {
+		o.backlog = backlog
+	}
+}
+
+// WithBindRetry makes Start retry binding a listener which fails to bind, as
+// when the port is still held by the process being replaced in a rolling
+// restart, with an exponential backoff for up to retry before it gives up.
+// Stopping the realm meanwhile ends the retries.
+func WithBindRetry(retry time.Duration) Option {
+	return func(o *options) {
+		o.bindRetry = retry
+	}
+}
+
+// WithTransparent makes a TunnelRealm a transparent proxy: IP_TRANSPARENT is
+// set on its listening socket, so that it accepts the connections diverted to
+// it with the TPROXY target of iptables, and its destinations are dialed from
+// the IP addresses of the clients, which they see instead of tcpf's without
+// the PROXY protocol. The replies of the destinations have to be routed back
+// through tcpf's host. It needs CAP_NET_ADMIN and is only supported on Linux,
+// elsewhere Start fails.
+func WithTransparent() Option {
+	return func(o *options) {
+		o.transparent = true
+	}
+}
+
+// WithPool makes a TunnelRealm keep up to size connections to each of its
+// destinations dialed ahead, which new tunnels take instead of dialing,
+// discarding the ones idle for longer than lifetime unless it is zero.
+// Connections are not reused once their tunnel is done, but a destination
+// sees them opened before any client connects, so the pool is unsafe for
+// stateful protocols, e.g. ones in which the server speaks first or which
+// time idle connections out. The pool is disabled with WithSendProxy.
+func WithPool(size int, lifetime time.Duration) Option {
+	return func(o *options) {
+		o.poolSize = size
+		o.poolLifetime = lifetime
+	}
+}
+
+// WithPrewarm makes a TunnelRealm dial n connections to each of its
+// destinations as it starts, before it accepts any client, so that even the
+// first tunnels don't wait for a dial. Each connection a tunnel takes is
+// replaced in the background. The connections go to the pool of WithPool,
+// which keeps up to the larger of both sizes and discards them after its
+// lifetime, and are just as unsafe for stateful protocols: only use it with
+// destinations which don't mind connections opened ahead of their clients.
+func WithPrewarm(n int) Option {
+	return func(o *options) {
+		o.prewarmConns = n
+	}
+}
+
+// WithLazyDial defers dialing the destination of a tunnel until the client
+// has sent its first bytes, which are then replayed to the destination, so
+// that connections which never send anything (e.g. port scans) don't reach
+// the destinations. It doesn't work with protocols in which the server
+// speaks first (e.g. SMTP) and has no effect with a proxy negotiator.
+func WithLazyDial(lazy bool) Option {
+	return func(o *options) {
+		o.lazyDial = lazy
+	}
+}
+
+// WithResolveTTL makes a TunnelRealm resolve the host names of its
+// destinations itself, caching the addresses for ttl and dialing them in
+// turn, so that tunnels are balanced across all the A/AAAA records of a host
+// and follow changes of the records once the cache expires. A UDPRealm
+// resolves its destination for every new session instead of once at Start.
+func WithResolveTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.resolveTTL = ttl
+	}
+}
+
+// WithResolver sets the resolver to look the destination hosts up with, both
+// when dialing them and when WithResolveTTL caches their addresses
+func WithResolver(resolver *net.Resolver) Option {
+	return func(o *options) {
+		o.resolver = resolver
+	}
+}
+
+// WithSourceAddress makes a TunnelRealm dial its destinations, and the other
+// TCP connections it opens, from the local IP address, e.g. for policy
+// routing or firewall rules keyed on the source address of a multi-homed host
+func WithSourceAddress(addr netip.Addr) Option {
+	return func(o *options) {
+		o.srcAddr = addr
+	}
+}
+
+// WithFallbackDelay sets how long dialing a destination host which resolves
+// to both IPv4 and IPv6 addresses waits for the preferred family before also
+// racing the other one, 300ms by default; a negative delay disables the
+// fallback. With WithResolveTTL every dial goes to a single address instead.
+func WithFallbackDelay(delay time.Duration) Option {
+	return func(o *options) {
+		o.fallbackDelay = delay
+	}
+}
+
+// WithDialTimeout sets how long a TunnelRealm waits for the destination to
+// accept a connection, 10 seconds by default. Zero means no timeout other
+// than the operating system's one.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithDialRetries makes a TunnelRealm retry a failed dial to the destination
+// up to the given number of times before giving up on the client connection.
+// The delay before the first retry is backoff (100ms by default), and it is
+// doubled for every next one.
+func WithDialRetries(retries int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.dialRetries = retries
+		if backoff > 0 {
+			o.dialRetryBackoff = backoff
+		}
+	}
+}
+
+// WithBackup sets a backup destination address, as host:port or unix:/path,
+// which a TunnelRealm dials when none of its destinations can be dialed
+func WithBackup(address string) Option {
+	return func(o *options) {
+		o.backup = address
+	}
+}
+
+// WithReverse makes a TunnelRealm accept its connections from the control
+// server at address instead of listening on bindIF:bindPort, e.g. to expose a
+// destination behind NAT: the realm connects out to the control server, and
+// opens a data connection to it for every client connection it relays, which
+// is forwarded to the destinations like any other. For every client
+// connection, the control server sends over the control connection a frame
+// of type 1 followed by a 32-bit big-endian stream ID, which the realm sends
+// back in a frame of type 2 at the start of the data connection.
+func WithReverse(address string) Option {
+	return func(o *options) {
+		o.reverse = address
+	}
+}
+
+// WithUpstreamSOCKS5 makes a TunnelRealm dial its destinations through the
+// SOCKS5 proxy at address, e.g. when they are only reachable through one,
+// authenticating with the username and password if username is not empty.
+// Destination host names are resolved by the proxy, unless resolved by the
+// realm with WithResolveTTL.
+func WithUpstreamSOCKS5(address string, username string, password string) Option {
+	return func(o *options) {
+		o.upstream = &socks5Upstream{proxy: address, username: username, password: password}
+	}
+}
+
+// WithUpstreamHTTPProxy makes a TunnelRealm dial its destinations through
+// the HTTP proxy at address with the CONNECT method, e.g. to reach them from
+// behind a corporate proxy, authenticating with basic authentication if
+// username is not empty
+func WithUpstreamHTTPProxy(address string, username string, password string) Option {
+	return func(o *options) {
+		o.upstream = &httpUpstream{proxy: address, username: username, password: password}
+	}
+}
+
+// WithMirror makes a TunnelRealm send a copy of the bytes every tunnel
+// forwards from its client to the mirror address, discarding what the mirror
+// sends back. A mirror which can't be dialed, fails or can't keep up with the
+// tunnel is dropped without affecting the tunnel.
+func WithMirror(address string) Option {
+	return func(o *options) {
+		o.mirror = address
+	}
+}
+
+// WithCapture makes a TunnelRealm record the bytes its tunnels forward in
+// both directions to the pcap file written by pcap
+func WithCapture(pcap *PcapWriter) Option {
+	return func(o *options) {
+		o.capture = pcap
+	}
+}
+
+// WithHealthCheck makes a TunnelRealm dial each of its destinations every
+// interval, and skip the ones which failed the given number of checks in a
+// row when opening new tunnels, until a check succeeds again
+func WithHealthCheck(interval time.Duration, failures int) Option {
+	return func(o *options) {
+		o.healthInterval = interval
+		o.healthFailures = failures
+		if o.healthFailures < 1 {
+			o.healthFailures = 1
+		}
+	}
+}
+
+// WithCircuitBreaker makes a TunnelRealm stop dialing a destination for
+// cooldown once it failed to be dialed the given number of times in a row,
+// so that new tunnels fail fast or go to the other destinations instead.
+// After the cooldown a single tunnel probes the destination again, closing
+// the breaker if it succeeds, or opening it for another cooldown otherwise.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.breakerFailures = failures
+		o.breakerCooldown = cooldown
+	}
+}
+
+// WithBalance sets the algorithm a TunnelRealm with several destinations
+// picks the destination of a new tunnel with, BalanceRoundRobin by default
+func WithBalance(balance Balance) Option {
+	return func(o *options) {
+		o.balance = balance
+	}
+}
+
+// WithBufferSize sets the size of the buffers a TunnelRealm copies tunnel
+// traffic through, 1KB by default; 32-64KB suit bulk transfers much better.
+// Sizes other than positive ones are ignored, and sizes above 1MB are
+// reported in the log as likely a mistake.
+func WithBufferSize(size int) Option {
+	return func(o *options) {
+		if validBufferSize(size) {
+			o.bufSize = size
+		}
+	}
+}
+
+// WithBufferSizes sets the sizes of the buffers a TunnelRealm copies the
+// traffic from the clients to the destinations through, and back, e.g. a
+// small one for the requests and a large one for the downloads of an
+// asymmetric workload. A direction whose size isn't positive keeps the size
+// of WithBufferSize.
+func WithBufferSizes(in int, out int) Option {
+	return func(o *options) {
+		if validBufferSize(in) {
+			o.bufSizes[DirectionIn] = in
+		}
+		if validBufferSize(out) {
+			o.bufSizes[DirectionOut] = out
+		}
+	}
+}
+
+// validBufferSize tells whether size may be a buffer size, reporting the
+// ones above 1MB
+func validBufferSize(size int) bool {
+	if size <= 0 {
+		return false
+	}
+	if size > maxReasonableBufSize {
+		logEvent(LevelWarn, "config", Fields{"buf_size": size}, "Buffer size of %d bytes is unusually large, every tunnel allocates buffers of its own", size)
+	}
+	return true
+}
+
+// bufferSize returns the size of the buffers the traffic in the direction is
+// copied through
+func (o *options) bufferSize(direction Direction) int {
+	if size := o.bufSizes[direction]; size > 0 {
+		return size
+	}
+	return o.bufSize
+}
+
+// WithRateLimit caps the number of bytes per second every tunnel of a
+// TunnelRealm forwards in each direction. Zero means no limit.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.rateLimit = bytesPerSecond
+	}
+}
+
+// WithTotalRateLimit caps the number of bytes per second all the tunnels of
+// a TunnelRealm forward together in each direction, so that they share the
+// budget. Zero means no limit.
+func WithTotalRateLimit(bytesPerSecond int64) Option {
+	return func(o *options) {
+		o.totalRateLimit = bytesPerSecond
+	}
+}
+
+// WithAllow restricts the clients of a TunnelRealm or UDPRealm to the given
+// networks; no networks means clients may connect from anywhere not denied
+func WithAllow(prefixes []netip.Prefix) Option {
+	return func(o *options) {
+		o.allow = prefixes
+	}
+}
+
+// WithDeny refuses the clients of a TunnelRealm or UDPRealm connecting from
+// the given networks, even if they are allowed with WithAllow
+func WithDeny(prefixes []netip.Prefix) Option {
+	return func(o *options) {
+		o.deny = prefixes
+	}
+}
+
+// WithProtocolRoutes routes the connections of a TunnelRealm by the protocol
+// detected in their first bytes: routes maps ProtocolTLS, ProtocolHTTP or
+// ProtocolSSH to the host:port to forward the connections of the protocol
+// to. Connections of other protocols, and clients which send nothing for a
+// few seconds, are forwarded to the realm's destination. The bytes peeked
+// are forwarded as well, so that one port can serve several protocols.
+func WithProtocolRoutes(routes map[string]string) Option {
+	return func(o *options) {
+		o.router = &protocolRouter{routes: routes}
+	}
+}
+
+// WithSNIRoutes routes the TLS connections of a TunnelRealm by the server
+// name of their ClientHello, without terminating TLS: routes maps the server
+// names, or wildcard patterns such as *.example.com, to the host:port to
+// forward their connections to. Unknown server names, connections without
+// one and clients which send nothing for a few seconds are forwarded to the
+// realm's destination, and so are ClientHellos which don't fit in the first
+// TLS record, as only that one is peeked. The ClientHello is forwarded
+// unchanged.
+func WithSNIRoutes(routes map[string]string) Option {
+	return func(o *options) {
+		o.router = &sniRouter{routes: routes}
+	}
+}
+
+// WithHostRoutes routes the plaintext HTTP connections of a TunnelRealm by
+// the Host header of their first request: routes maps the host names, or
+// wildcard patterns such as *.example.com, to the host:port to forward their
+// connections to. The request is forwarded unchanged, and the requests which
+// follow on a kept-alive connection go to the same destination. Unknown hosts,
+// connections which don't speak HTTP/1.x and clients which send nothing for a
+// few seconds are forwarded to the realm's destination.
+func WithHostRoutes(routes map[string]string) Option {
+	return func(o *options) {
+		o.router = &hostRouter{routes: routes}
+	}
+}
+
+// WithAllowPorts restricts the destinations clients of a TunnelRealm in a
+// proxy mode (SOCKS5 or HTTP CONNECT) may request to the given ports; no
+// ranges means any port not denied
+func WithAllowPorts(ranges []PortRange) Option {
+	return func(o *options) {
+		o.allowPorts = ranges
+	}
+}
+
+// WithDenyPorts refuses the destinations of the given ports to the clients
+// of the proxy modes, even if they are allowed with WithAllowPorts
+func WithDenyPorts(ranges []PortRange) Option {
+	return func(o *options) {
+		o.denyPorts = ranges
+	}
+}
+
+// WithAllowHosts restricts the destinations clients of a TunnelRealm in a
+// proxy mode may request to the host patterns parsed by ParseHostPatterns.
+// Host names not matching any glob are resolved and allowed if they resolve
+// into one of the networks. No patterns means any host.
+func WithAllowHosts(patterns []string) Option {
+	return func(o *options) {
+		o.allowHosts = patterns
+	}
+}
+
+// WithGeoIP sets the database the countries of the clients of a TunnelRealm
+// or UDPRealm are looked up in for WithAllowCountries and WithDenyCountries. Clients
+// whose country can't be found are let in if failOpen is set, and refused
+// otherwise.
+func WithGeoIP(db *GeoIP, failOpen bool) Option {
+	return func(o *options) {
+		o.geoIP = db
+		o.geoIPFailOpen = failOpen
+	}
+}
+
+// WithAllowCountries restricts the clients of a TunnelRealm or UDPRealm to
+// the given countries, ISO 3166-1 codes such as "DE", looked up with WithGeoIP
+func WithAllowCountries(countries []string) Option {
+	return func(o *options) {
+		o.allowCountries = countries
+	}
+}
+
+// WithDenyCountries refuses the clients of a TunnelRealm or UDPRealm
+// connecting from the given countries, even if they are allowed with
+// WithAllowCountries
+func WithDenyCountries(countries []string) Option {
+	return func(o *options) {
+		o.denyCountries = countries
+	}
+}
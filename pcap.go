@@ -0,0 +1,215 @@
+package tcpf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Link type of packets starting with their IPv4 or IPv6 header
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+	// Most bytes of a tunnel recorded in one synthesized packet, so that the
+	// packet fits the 16-bit lengths of the IP headers
+	pcapMaxPayload = 65000
+)
+
+// PcapWriter records the bytes tunnels forward to a file in the pcap format,
+// e.g. for Wireshark, with WithCapture. Every chunk of bytes a tunnel reads
+// is written as a TCP segment between its client and its destination, with
+// synthesized IP and TCP headers whose sequence numbers let the bytes be
+// reassembled into streams. A PcapWriter may be shared by several realms.
+type PcapWriter struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+}
+
+// NewPcapWriter creates the pcap file at path, which is renamed to path.1
+// for a new file to be started whenever it grows beyond maxSize bytes,
+// unless maxSize is zero
+func NewPcapWriter(path string, maxSize int64) (*PcapWriter, error) {
+	pcap := &PcapWriter{path: path, maxSize: maxSize}
+	if err := pcap.open(); err != nil {
+		return nil, err
+	}
+	return pcap, nil
+}
+
+// open starts a new file with the pcap global header
+func (pcap *PcapWriter) open() error {
+	file, err := os.Create(pcap.path)
+	if err != nil {
+		return fmt.Errorf("can't create pcap file: %w", err)
+	}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	pcap.file, pcap.writer, pcap.size = file, bufio.NewWriter(file), 0
+	return pcap.write(header)
+}
+
+func (pcap *PcapWriter) write(b []byte) error {
+	n, err := pcap.writer.Write(b)
+	pcap.size += int64(n)
+	return err
+}
+
+// rotate moves the full file aside and starts a new one
+func (pcap *PcapWriter) rotate() error {
+	if err := pcap.closeFile(); err != nil {
+		return err
+	}
+	if err := os.Rename(pcap.path, pcap.path+".1"); err != nil {
+		return fmt.Errorf("can't rotate pcap file: %w", err)
+	}
+	return pcap.open()
+}
+
+func (pcap *PcapWriter) closeFile() error {
+	err := pcap.writer.Flush()
+	if cerr := pcap.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close flushes the packets recorded and closes the file
+func (pcap *PcapWriter) Close() error {
+	pcap.mutex.Lock()
+	defer pcap.mutex.Unlock()
+	if pcap.file == nil {
+		return nil
+	}
+	err := pcap.closeFile()
+	pcap.file = nil
+	return err
+}
+
+// record writes the payload sent from src to dst as TCP segments starting at
+// sequence number seq and acknowledging ack
+func (pcap *PcapWriter) record(src, dst netip.AddrPort, seq, ack uint32, payload []byte) error {
+	pcap.mutex.Lock()
+	defer pcap.mutex.Unlock()
+	if pcap.file == nil {
+		return os.ErrClosed
+	}
+	now := time.Now()
+	for len(payload) > 0 {
+		chunk := payload[:min(len(payload), pcapMaxPayload)]
+		payload = payload[len(chunk):]
+		packet := segment(src, dst, seq, ack, chunk)
+		seq += uint32(len(chunk))
+		header := make([]byte, 16)
+		binary.LittleEndian.PutUint32(header[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(header[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(header[12:], uint32(len(packet)))
+		if err := pcap.write(header); err != nil {
+			return err
+		}
+		if err := pcap.write(packet); err != nil {
+			return err
+		}
+	}
+	if pcap.maxSize > 0 && pcap.size > pcap.maxSize {
+		return pcap.rotate()
+	}
+	return nil
+}
+
+// segment builds the IP packet of a TCP segment carrying payload. Both
+// addresses are IPv4 ones unless either of them is IPv6.
+func segment(src, dst netip.AddrPort, seq, ack uint32, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	// PSH and ACK
+	tcp[13] = 0x18
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	tcp = append(tcp, payload...)
+
+	srcIP, dstIP := src.Addr(), dst.Addr()
+	if srcIP.Is4() && dstIP.Is4() {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		// Don't fragment
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8] = 64
+		ip[9] = 6
+		src4, dst4 := srcIP.As4(), dstIP.As4()
+		copy(ip[12:], src4[:])
+		copy(ip[16:], dst4[:])
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, tcp...)
+	}
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6
+	ip[7] = 64
+	src16, dst16 := srcIP.As16(), dstIP.As16()
+	copy(ip[8:], src16[:])
+	copy(ip[24:], dst16[:])
+	return append(ip, tcp...)
+}
+
+// checksum returns the Internet checksum of the IPv4 header
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// addrPort returns the IP address and port of addr, or the unspecified IPv4
+// address and port 0 for addresses which are not IP ones, e.g. Unix sockets
+func addrPort(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		addrPort := tcpAddr.AddrPort()
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	}
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
+
+// capture records the bytes forwarded through the tunnel in the direction
+// given by in to the realm's pcap file, if any
+func (tunnel *TCPTunnel) capture(in bool, p []byte) {
+	pcap := tunnel.realm.capture
+	if pcap == nil {
+		return
+	}
+	client := addrPort((*tunnel.inbound).RemoteAddr())
+	server := addrPort((*tunnel.outbound).RemoteAddr())
+	// The sequence numbers start at 1 and are only advanced by the copy of
+	// their own direction
+	sent, received := &tunnel.seqIn, &tunnel.seqOut
+	if !in {
+		client, server = server, client
+		sent, received = received, sent
+	}
+	seq := sent.Add(uint32(len(p))) - uint32(len(p))
+	if err := pcap.record(client, server, seq+1, received.Load()+1, p); err != nil {
+		logEvent(LevelWarn, "pcap_error", tunnel.fields().with("error", err), "Can't capture tunnel [%v]: %v", tunnel, err)
+	}
+}
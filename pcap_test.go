@@ -0,0 +1,196 @@
+package tcpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// packet is a TCP segment read back from a pcap file
+type packet struct {
+	src, dst netip.AddrPort
+	seq, ack uint32
+	payload  []byte
+}
+
+// readPcap parses the pcap file written by PcapWriter, failing on whatever
+// doesn't conform to the format: the global header, the record headers,
+// and the IP and TCP headers of the packets
+func readPcap(t *testing.T, path string) []packet {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 24 {
+		t.Fatalf("%v has a global header of %d bytes", path, len(data))
+	}
+	header := data[:24]
+	magic, major, minor := binary.LittleEndian.Uint32(header), binary.LittleEndian.Uint16(header[4:]), binary.LittleEndian.Uint16(header[6:])
+	snapLen, linkType := binary.LittleEndian.Uint32(header[16:]), binary.LittleEndian.Uint32(header[20:])
+	if magic != 0xa1b2c3d4 || major != 2 || minor != 4 || snapLen != pcapSnapLen || linkType != pcapLinkTypeRaw {
+		t.Fatalf("global header of %v is % x", path, header)
+	}
+	var packets []packet
+	for data = data[24:]; len(data) > 0; {
+		if len(data) < 16 {
+			t.Fatalf("record header truncated to %d bytes", len(data))
+		}
+		included, original := binary.LittleEndian.Uint32(data[8:]), binary.LittleEndian.Uint32(data[12:])
+		if included != original || included > snapLen || int(included) > len(data)-16 {
+			t.Fatalf("record of %d bytes, %d originally, with %d left", included, original, len(data)-16)
+		}
+		packets = append(packets, parsePacket(t, data[16:16+included]))
+		data = data[16+included:]
+	}
+	return packets
+}
+
+// parsePacket parses an IPv4 or IPv6 packet carrying a TCP segment
+func parsePacket(t *testing.T, ip []byte) packet {
+	t.Helper()
+	var p packet
+	var tcp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		if ip[0]&0x0f != 5 || int(binary.BigEndian.Uint16(ip[2:])) != len(ip) || ip[9] != 6 || checksum(ip[:20]) != 0 {
+			t.Fatalf("malformed IPv4 header % x", ip[:20])
+		}
+		src, dst := netip.AddrFrom4([4]byte(ip[12:16])), netip.AddrFrom4([4]byte(ip[16:20]))
+		p.src, p.dst, tcp = netip.AddrPortFrom(src, 0), netip.AddrPortFrom(dst, 0), ip[20:]
+	case 6:
+		if int(binary.BigEndian.Uint16(ip[4:])) != len(ip)-40 || ip[6] != 6 {
+			t.Fatalf("malformed IPv6 header % x", ip[:40])
+		}
+		src, dst := netip.AddrFrom16([16]byte(ip[8:24])), netip.AddrFrom16([16]byte(ip[24:40]))
+		p.src, p.dst, tcp = netip.AddrPortFrom(src, 0), netip.AddrPortFrom(dst, 0), ip[40:]
+	default:
+		t.Fatalf("packet of IP version %d", ip[0]>>4)
+	}
+	if len(tcp) < 20 || tcp[12]>>4 != 5 {
+		t.Fatalf("malformed TCP header % x", tcp)
+	}
+	p.src = netip.AddrPortFrom(p.src.Addr(), binary.BigEndian.Uint16(tcp))
+	p.dst = netip.AddrPortFrom(p.dst.Addr(), binary.BigEndian.Uint16(tcp[2:]))
+	p.seq, p.ack, p.payload = binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:]), tcp[20:]
+	return p
+}
+
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.pcap")
+	pcap, err := NewPcapWriter(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client4, server4 := netip.MustParseAddrPort("192.0.2.1:50000"), netip.MustParseAddrPort("198.51.100.1:80")
+	client6, server6 := netip.MustParseAddrPort("[2001:db8::1]:50001"), netip.MustParseAddrPort("[2001:db8::2]:443")
+	large := bytes.Repeat([]byte("0123456789"), 15000)
+	records := []packet{
+		{client4, server4, 1, 1, []byte("request")},
+		{server4, client4, 1, 8, []byte("response")},
+		{client6, server6, 100, 200, []byte("over IPv6")},
+		{client4, server4, 8, 9, large},
+	}
+	for _, record := range records {
+		if err := pcap.record(record.src, record.dst, record.seq, record.ack, record.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pcap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pcap.record(client4, server4, 1, 1, []byte("late")); err == nil {
+		t.Error("recorded a packet after Close")
+	}
+
+	// The large payload is split into segments whose sequence numbers
+	// follow each other
+	want := records[:3]
+	for seq, rest := uint32(8), large; len(rest) > 0; {
+		n := min(len(rest), pcapMaxPayload)
+		want = append(want, packet{client4, server4, seq, 9, rest[:n]})
+		seq, rest = seq+uint32(n), rest[n:]
+	}
+	packets := readPcap(t, path)
+	if len(packets) != len(want) {
+		t.Fatalf("read %d packets, want %d", len(packets), len(want))
+	}
+	for i, p := range packets {
+		w := want[i]
+		if p.src != w.src || p.dst != w.dst || p.seq != w.seq || p.ack != w.ack || !bytes.Equal(p.payload, w.payload) {
+			t.Errorf("packet %d is %v > %v seq %d ack %d with %d bytes, want %v > %v seq %d ack %d with %d bytes",
+				i, p.src, p.dst, p.seq, p.ack, len(p.payload), w.src, w.dst, w.seq, w.ack, len(w.payload))
+		}
+	}
+}
+
+func TestPcapRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.pcap")
+	// Every packet takes 16+40+100 bytes after the global header of 24, so
+	// the file grows beyond the limit with its second packet
+	pcap, err := NewPcapWriter(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, dst := netip.MustParseAddrPort("192.0.2.1:1"), netip.MustParseAddrPort("192.0.2.2:2")
+	for i := 0; i < 5; i++ {
+		payload := []byte(fmt.Sprintf("%-100d", i))
+		if err := pcap.record(src, dst, uint32(1+100*i), 1, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pcap.Close()
+	// The first file was moved aside by the fourth packet, overwriting the
+	// one moved by the second
+	rotated := readPcap(t, path+".1")
+	if len(rotated) != 2 || !bytes.HasPrefix(rotated[0].payload, []byte("2 ")) || !bytes.HasPrefix(rotated[1].payload, []byte("3 ")) {
+		t.Errorf("rotated file has %d packets: %v", len(rotated), rotated)
+	}
+	current := readPcap(t, path)
+	if len(current) != 1 || !bytes.HasPrefix(current[0].payload, []byte("4 ")) {
+		t.Errorf("current file has %d packets: %v", len(current), current)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.pcap")
+	pcap, err := NewPcapWriter(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := startEcho(t)
+	realm, addr := startRealm(t, dst, WithCapture(pcap))
+	conn := dialRealm(t, addr)
+	sent := []string{"first ", "second ", "third"}
+	for _, msg := range sent {
+		converse(t, conn, []byte(msg), []byte(msg))
+	}
+	client := netip.MustParseAddrPort(conn.LocalAddr().String())
+	conn.Close()
+	waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 0 })
+	pcap.Close()
+
+	// Each direction reassembles into the stream it carried, between the
+	// client and the destination
+	server := netip.MustParseAddrPort(dst)
+	streams := map[netip.AddrPort][]byte{}
+	next := map[netip.AddrPort]uint32{client: 1, server: 1}
+	for _, p := range readPcap(t, path) {
+		if !(p.src == client && p.dst == server || p.src == server && p.dst == client) {
+			t.Fatalf("packet from %v to %v, want between %v and %v", p.src, p.dst, client, server)
+		}
+		if p.seq != next[p.src] {
+			t.Errorf("packet from %v has seq %d, want %d", p.src, p.seq, next[p.src])
+		}
+		next[p.src] += uint32(len(p.payload))
+		streams[p.src] = append(streams[p.src], p.payload...)
+	}
+	want := "first second third"
+	if string(streams[client]) != want || string(streams[server]) != want {
+		t.Errorf("captured %q from the client and %q from the destination, want %q", streams[client], streams[server], want)
+	}
+}
@@ -0,0 +1,132 @@
+package tcpf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PortRange is a range of ports from First to Last, both included
+type PortRange struct {
+	First int
+	Last  int
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// errTargetNotAllowed is wrapped by the errors of destinations which the
+// clients of the proxy modes are not allowed to connect to
+var errTargetNotAllowed = errors.New("destination not allowed")
+
+// ParsePortRanges parses a comma separated list of ports and ranges of ports
+// of the form first-last, e.g. 80,443,8000-8100
+func ParsePortRanges(list string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		first, last, ok := ParsePortRange(item)
+		if !ok {
+			return nil, fmt.Errorf("invalid port or port range %q", item)
+		}
+		ranges = append(ranges, PortRange{First: first, Last: last})
+	}
+	return ranges, nil
+}
+
+// ParseHostPatterns parses a comma separated list of destination host
+// patterns: networks in CIDR notation or IP addresses, and host name globs
+// such as *.example.com, matched case-insensitively
+func ParseHostPatterns(list string) ([]string, error) {
+	var patterns []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item == "" {
+			continue
+		}
+		if _, err := ParsePrefixes(item); err != nil {
+			if _, err := path.Match(item, ""); err != nil || strings.ContainsAny(item, "/:") {
+				return nil, fmt.Errorf("invalid host pattern %q, expected a CIDR, an IP address or a host name glob", item)
+			}
+		}
+		patterns = append(patterns, item)
+	}
+	return patterns, nil
+}
+
+// permittedTarget checks the destination host:port a client of a proxy mode
+// requested against the port and host policies of the realm, and returns the
+// address to dial. A host name which none of the globs match is resolved and
+// checked against the networks, and the address it resolved to is dialed, so
+// that it can't resolve differently in between.
+func (realm *TunnelRealm) permittedTarget(ctx context.Context, address string) (string, error) {
+	if len(realm.allowPorts) == 0 && len(realm.denyPorts) == 0 && len(realm.allowHosts) == 0 {
+		return address, nil
+	}
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portName)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid port %q", errTargetNotAllowed, portName)
+	}
+	for _, r := range realm.denyPorts {
+		if r.contains(port) {
+			return "", fmt.Errorf("%w: port %d is denied", errTargetNotAllowed, port)
+		}
+	}
+	if !portAllowed(realm.allowPorts, port) {
+		return "", fmt.Errorf("%w: port %d is not allowed", errTargetNotAllowed, port)
+	}
+	if len(realm.allowHosts) == 0 {
+		return address, nil
+	}
+	var networks []netip.Prefix
+	for _, pattern := range realm.allowHosts {
+		if prefixes, err := ParsePrefixes(pattern); err == nil {
+			networks = append(networks, prefixes...)
+		} else if matched, _ := path.Match(pattern, strings.ToLower(host)); matched {
+			return address, nil
+		}
+	}
+	ips := []netip.Addr{}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = append(ips, ip.Unmap())
+	} else if len(networks) > 0 {
+		resolver := realm.resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		if ips, err = resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return "", err
+		}
+	}
+	for _, ip := range ips {
+		for _, network := range networks {
+			if network.Contains(ip.Unmap()) {
+				return net.JoinHostPort(ip.Unmap().String(), portName), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: host %v is not allowed", errTargetNotAllowed, host)
+}
+
+func portAllowed(ranges []PortRange, port int) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package tcpf
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestPermittedTarget(t *testing.T) {
+	ports := func(list string) []PortRange {
+		ranges, err := ParsePortRanges(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ranges
+	}
+	hosts := func(list string) []string {
+		patterns, err := ParseHostPatterns(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return patterns
+	}
+	tests := []struct {
+		opts    []Option
+		address string
+		// Address to dial, "" if the target is not allowed
+		want string
+	}{
+		{nil, "anything.test:1", "anything.test:1"},
+		{[]Option{WithAllowPorts(ports("80,443,8000-8100"))}, "a.test:443", "a.test:443"},
+		{[]Option{WithAllowPorts(ports("80,443,8000-8100"))}, "a.test:8100", "a.test:8100"},
+		{[]Option{WithAllowPorts(ports("80,443,8000-8100"))}, "a.test:8101", ""},
+		{[]Option{WithDenyPorts(ports("1-1023"))}, "a.test:22", ""},
+		{[]Option{WithDenyPorts(ports("1-1023"))}, "a.test:1024", "a.test:1024"},
+		// Denied ports win over allowed ones
+		{[]Option{WithAllowPorts(ports("20-30")), WithDenyPorts(ports("22"))}, "a.test:22", ""},
+		{[]Option{WithDenyPorts(ports("22"))}, "a.test:ssh", ""},
+		{[]Option{WithAllowHosts(hosts("*.Example.com"))}, "API.example.COM:80", "API.example.COM:80"},
+		{[]Option{WithAllowHosts(hosts("*.example.com"))}, "example.com:80", ""},
+		{[]Option{WithAllowHosts(hosts("10.0.0.0/8,192.0.2.1"))}, "10.1.2.3:80", "10.1.2.3:80"},
+		{[]Option{WithAllowHosts(hosts("10.0.0.0/8,192.0.2.1"))}, "192.0.2.1:80", "192.0.2.1:80"},
+		{[]Option{WithAllowHosts(hosts("10.0.0.0/8,192.0.2.1"))}, "192.0.2.2:80", ""},
+		{[]Option{WithAllowHosts(hosts("10.0.0.0/8"))}, "[::ffff:10.0.0.1]:80", "10.0.0.1:80"},
+		// Host names are dialed at the address they resolved to
+		{[]Option{WithAllowHosts(hosts("127.0.0.0/8"))}, "localhost:80", "127.0.0.1:80"},
+		{[]Option{WithAllowHosts(hosts("10.0.0.0/8"))}, "localhost:80", ""},
+	}
+	for _, test := range tests {
+		realm := NewTunnelRealm("127.0.0.1", "0", "127.0.0.1", "1", test.opts...)
+		got, err := realm.permittedTarget(context.Background(), test.address)
+		if test.want == "" {
+			if !errors.Is(err, errTargetNotAllowed) {
+				t.Errorf("permittedTarget(%v) = %q, %v, want it not allowed", test.address, got, err)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("permittedTarget(%v) = %q, %v, want %q", test.address, got, err, test.want)
+		}
+	}
+}
+
+func TestParsePolicies(t *testing.T) {
+	ranges, err := ParsePortRanges("80, 443,8000-8100,")
+	if want := []PortRange{{80, 80}, {443, 443}, {8000, 8100}}; err != nil || !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ParsePortRanges() = %v, %v, want %v", ranges, err, want)
+	}
+	for _, list := range []string{"http", "0", "65536", "100-10", "1-2-3"} {
+		if _, err := ParsePortRanges(list); err == nil {
+			t.Errorf("ParsePortRanges(%q) succeeded", list)
+		}
+	}
+	patterns, err := ParseHostPatterns("*.Example.com, 10.0.0.0/8,::1")
+	if want := []string{"*.example.com", "10.0.0.0/8", "::1"}; err != nil || !reflect.DeepEqual(patterns, want) {
+		t.Errorf("ParseHostPatterns() = %v, %v, want %v", patterns, err, want)
+	}
+	for _, list := range []string{"[a-", "example.com:80", "10.0.0.0/33"} {
+		if _, err := ParseHostPatterns(list); err == nil {
+			t.Errorf("ParseHostPatterns(%q) succeeded", list)
+		}
+	}
+}
+
+func TestAllowHostsProxy(t *testing.T) {
+	_, port, _ := net.SplitHostPort(startEcho(t))
+	_, proxy := startRealm(t, closedPort(t), WithHTTPConnect(), WithAllowHosts([]string{"127.0.0.0/8"}))
+	tests := []struct {
+		target string
+		status int
+	}{
+		{net.JoinHostPort("localhost", port), http.StatusOK},
+		{net.JoinHostPort("127.0.0.1", port), http.StatusOK},
+		{net.JoinHostPort("192.0.2.1", port), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		conn := dialRealm(t, proxy)
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", test.target, test.target)
+		response := readHTTPResponse(t, bufio.NewReader(conn), http.MethodConnect)
+		if response.StatusCode != test.status {
+			t.Errorf("CONNECT %v responded %v, want %d", test.target, response.Status, test.status)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package tcpf
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// How often the pool is topped up besides when its connections are taken
+const poolFillInterval = time.Second
+
+// connPool keeps connections to the destinations dialed ahead of the
+// tunnels which are going to use them, with WithPool. The connections are
+// not returned to the pool once their tunnel is done with them, as the
+// tunnel may have half-closed them and the state of the protocol spoken over
+// them is unknown.
+type connPool struct {
+	mutex       sync.Mutex
+	maxIdle     int
+	maxLifetime time.Duration
+	idle        map[string][]pooledConn
+	// Wakes fill up when connections are taken
+	taken chan struct{}
+}
+
+type pooledConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+func newConnPool(maxIdle int, maxLifetime time.Duration) *connPool {
+	return &connPool{
+		maxIdle:     maxIdle,
+		maxLifetime: maxLifetime,
+		idle:        make(map[string][]pooledConn),
+		taken:       make(chan struct{}, 1),
+	}
+}
+
+// get checks out a connection to the destination address, or returns nil if
+// the pool has none which has been idle for less than maxLifetime
+func (pool *connPool) get(address string) net.Conn {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for conns := pool.idle[address]; len(conns) > 0; conns = pool.idle[address] {
+		pooled := conns[0]
+		pool.idle[address] = conns[1:]
+		select {
+		case pool.taken <- struct{}{}:
+		default:
+		}
+		if pool.expired(pooled) {
+			pooled.conn.Close()
+			continue
+		}
+		return pooled.conn
+	}
+	return nil
+}
+
+// put adds the connection to the destination address to the pool, or closes
+// it if the pool of the destination is full already
+func (pool *connPool) put(address string, conn net.Conn) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if len(pool.idle[address]) >= pool.maxIdle {
+		conn.Close()
+		return
+	}
+	pool.idle[address] = append(pool.idle[address], pooledConn{conn: conn, dialed: time.Now()})
+}
+
+// missing closes the connections to the destination address which have
+// outlived maxLifetime and returns how many the pool is short of
+func (pool *connPool) missing(address string) int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	conns := pool.idle[address][:0]
+	for _, pooled := range pool.idle[address] {
+		if pool.expired(pooled) {
+			pooled.conn.Close()
+		} else {
+			conns = append(conns, pooled)
+		}
+	}
+	pool.idle[address] = conns
+	return pool.maxIdle - len(conns)
+}
+
+func (pool *connPool) expired(pooled pooledConn) bool {
+	return pool.maxLifetime > 0 && time.Since(pooled.dialed) > pool.maxLifetime
+}
+
+// close closes all the connections in the pool
+func (pool *connPool) close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for address, conns := range pool.idle {
+		for _, pooled := range conns {
+			pooled.conn.Close()
+		}
+		delete(pool.idle, address)
+	}
+}
+
+// fill keeps the pool of the realm topped up with connections to each of its
+// destinations which is up, until the realm is stopped
+func (realm *TunnelRealm) fill() {
+	defer realm.running.Done()
+	defer realm.pool.close()
+	ticker := time.NewTicker(poolFillInterval)
+	defer ticker.Stop()
+	for {
+		health := realm.destinations.health()
+		for address, up := range health {
+			for n := realm.pool.missing(address); up && n > 0 && realm.ctx.Err() == nil; n-- {
+				conn, err := realm.dialOnce(realm.ctx, address, nil)
+				if err != nil {
+					realm.counters.dialFailed(err)
+					logEvent(LevelDebug, "pool_error", Fields{"dst": address, "error": err}, "Can't add connection to %v to the pool: %v", address, err)
+					break
+				}
+				realm.pool.put(address, conn)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-realm.pool.taken:
+		case <-realm.ctx.Done():
+			return
+		}
+	}
+}
+
+// prewarm fills the pool of the realm with the connections of WithPrewarm to
+// each of its destinations, dialing them all at once, before the realm
+// accepts its first client. The destinations which can't be dialed are left
+// to fill to retry.
+func (realm *TunnelRealm) prewarm() {
+	var dialing sync.WaitGroup
+	for address := range realm.destinations.health() {
+		for i := 0; i < realm.prewarmConns; i++ {
+			dialing.Add(1)
+			go func() {
+				defer dialing.Done()
+				conn, err := realm.dialOnce(realm.ctx, address, nil)
+				if err != nil {
+					realm.counters.dialFailed(err)
+					logEvent(LevelWarn, "pool_error", Fields{"dst": address, "error": err}, "Can't prewarm connection to %v: %v", address, err)
+					return
+				}
+				realm.pool.put(address, conn)
+			}()
+		}
+	}
+	dialing.Wait()
+	logEvent(LevelDebug, "prewarm", Fields{"realm": realm, "conns": realm.prewarmConns}, "Prewarmed %d connections to each destination of %v", realm.prewarmConns, realm)
+}
+
+// pooled returns a connection to the destination address from the pool, if
+// the realm has one with a connection available
+func (realm *TunnelRealm) pooled(ctx context.Context, address string) net.Conn {
+	if realm.pool == nil || ctx.Err() != nil {
+		return nil
+	}
+	return realm.pool.get(address)
+}
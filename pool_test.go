@@ -0,0 +1,71 @@
+package tcpf
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startCountingEcho runs an echo server counting the connections it accepts
+func startCountingEcho(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	accepted := &atomic.Int64{}
+	return startServer(t, func(conn net.Conn) {
+		accepted.Add(1)
+		io.Copy(conn, conn)
+	}), accepted
+}
+
+// idleConns returns how many connections to address the pool of the realm has
+func idleConns(realm *TunnelRealm, address string) int {
+	realm.pool.mutex.Lock()
+	defer realm.pool.mutex.Unlock()
+	return len(realm.pool.idle[address])
+}
+
+func TestPool(t *testing.T) {
+	dst, accepted := startCountingEcho(t)
+	realm, addr := startRealm(t, dst, WithPool(2, 0))
+	waitFor(t, "the pool to fill", func() bool { return idleConns(realm, dst) == 2 })
+	msg := []byte("pooled")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+	// The tunnel took a pooled connection, which is replaced
+	waitFor(t, "the pool to refill", func() bool { return idleConns(realm, dst) == 2 && accepted.Load() == 3 })
+}
+
+func TestPoolLifetime(t *testing.T) {
+	dst, accepted := startCountingEcho(t)
+	realm, _ := startRealm(t, dst, WithPool(1, 50*time.Millisecond))
+	// The connection outlives its lifetime and is dialed again by the next
+	// fill of the pool
+	waitFor(t, "the expired connection to be replaced", func() bool { return accepted.Load() >= 2 && idleConns(realm, dst) == 1 })
+}
+
+func TestPrewarm(t *testing.T) {
+	dst, accepted := startCountingEcho(t)
+	realm, addr := startRealm(t, dst, WithPrewarm(3))
+	// The connections are dialed before Start returns
+	if n := idleConns(realm, dst); n != 3 {
+		t.Fatalf("%d connections prewarmed, want 3", n)
+	}
+	for i := 0; i < 2; i++ {
+		msg := []byte("prewarmed")
+		if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+			t.Errorf("got %q back, want %q", reply, msg)
+		}
+	}
+	waitFor(t, "the taken connections to be replaced", func() bool { return idleConns(realm, dst) == 3 && accepted.Load() == 5 })
+}
+
+func TestPrewarmDisabledWithSendProxy(t *testing.T) {
+	dst, _ := startCountingEcho(t)
+	realm, _ := startRealm(t, dst, WithPrewarm(2), WithSendProxy())
+	if realm.pool != nil {
+		t.Error("prewarmed connections which can't carry the PROXY header of their clients")
+	}
+}
@@ -0,0 +1,65 @@
+package tcpf
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParsePortRange parses a range of ports of the form first-last, e.g.
+// 8000-8100. A single port is a range of one port.
+func ParsePortRange(ports string) (first int, last int, ok bool) {
+	from, to, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		to = from
+	}
+	first, ferr := strconv.Atoi(from)
+	last, lerr := strconv.Atoi(to)
+	if ferr != nil || lerr != nil || first <= 0 || last > 65535 || first > last {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// ports returns the ports the realm listens on: every port of the range
+// bindPort is, or bindPort itself otherwise
+func (realm *TunnelRealm) ports() []string {
+	first, last, ok := ParsePortRange(realm.bindPort)
+	if !ok || first == last {
+		return []string{realm.bindPort}
+	}
+	ports := make([]string, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return ports
+}
+
+// portOffset returns how far the port a connection was accepted on is from
+// the first port of the realm's range, which is how far the port it is
+// forwarded to is from the destination port
+func (realm *TunnelRealm) portOffset(local net.Addr) int {
+	first, last, ok := ParsePortRange(realm.bindPort)
+	addr, isTCP := local.(*net.TCPAddr)
+	if !ok || first == last || !isTCP {
+		return 0
+	}
+	return addr.Port - first
+}
+
+// shiftPort returns host:port of the address with the port moved by offset;
+// Unix sockets and addresses without a numeric port are left as is
+func shiftPort(address string, offset int) string {
+	if offset == 0 {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return address
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+offset))
+}
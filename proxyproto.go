@@ -0,0 +1,130 @@
+package tcpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// Time a client has to send the PROXY protocol header
+	proxyHeaderTimeout = 10 * time.Second
+)
+
+// Signature opening the PROXY protocol v2 header
+var proxySignatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn is an inbound connection which came through a proxy, with the
+// addresses of the original connection learnt from the PROXY protocol header
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (conn *proxiedConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+func (conn *proxiedConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *proxiedConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+// proxyHeaderV1 returns the PROXY protocol v1 header describing a connection
+// from src to dst, see https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+func proxyHeaderV1(src net.Addr, dst net.Addr) string {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return "PROXY UNKNOWN\r\n"
+	}
+	proto := "TCP6"
+	srcIP, dstIP := srcTCP.IP.To16(), dstTCP.IP.To16()
+	if src4, dst4 := srcTCP.IP.To4(), dstTCP.IP.To4(); src4 != nil && dst4 != nil {
+		proto = "TCP4"
+		srcIP, dstIP = src4, dst4
+	} else if src4 != nil || dst4 != nil {
+		// The protocol can't describe a connection between address families
+		return "PROXY UNKNOWN\r\n"
+	}
+	return fmt.Sprintf("PROXY %v %v %v %d %d\r\n", proto, srcIP, dstIP, srcTCP.Port, dstTCP.Port)
+}
+
+// sendProxyHeaderV1 writes the PROXY protocol v1 header for the inbound
+// connection to the outbound one, before any tunnel data flows
+func sendProxyHeaderV1(inbound net.Conn, outbound net.Conn) error {
+	_, err := outbound.Write([]byte(proxyHeaderV1(inbound.RemoteAddr(), inbound.LocalAddr())))
+	return err
+}
+
+// readProxyHeaderV2 reads and strips the binary PROXY protocol v2 header from
+// the connection. The returned connection reports the original client and
+// destination addresses, unless the header has the LOCAL command (e.g. health
+// checks of the proxy itself) or describes a non-TCP connection, in which
+// case the connection's own addresses are kept.
+func readProxyHeaderV2(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("can't read PROXY header: %v", err)
+	}
+	if !bytes.Equal(header[:12], proxySignatureV2) {
+		return nil, errors.New("invalid PROXY v2 signature")
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	command := header[12] & 0x0F
+	family, transport := header[13]>>4, header[13]&0x0F
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, fmt.Errorf("can't read PROXY header: %v", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return conn, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY command %d", command)
+	}
+	var ipLen int
+	switch family {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	case 0x0, 0x3: // AF_UNSPEC, AF_UNIX
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY address family %d", family)
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, fmt.Errorf("PROXY header addresses are truncated: %d bytes", len(body))
+	}
+	if transport != 0x1 { // not SOCK_STREAM
+		return conn, nil
+	}
+	ports := body[2*ipLen:]
+	return &proxiedConn{
+		Conn: conn,
+		remote: &net.TCPAddr{
+			IP:   net.IP(body[:ipLen]),
+			Port: int(binary.BigEndian.Uint16(ports[0:2])),
+		},
+		local: &net.TCPAddr{
+			IP:   net.IP(body[ipLen : 2*ipLen]),
+			Port: int(binary.BigEndian.Uint16(ports[2:4])),
+		},
+	}, nil
+}
@@ -0,0 +1,209 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// proxyHeaderV2 returns a PROXY protocol v2 header with the version and
+// command byte, the family and transport byte, and the body
+func proxyHeaderV2(command byte, family byte, body []byte) []byte {
+	header := append([]byte{}, proxySignatureV2...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+// proxyAddrsV2 returns the address block of a PROXY v2 header for a
+// connection from src to dst
+func proxyAddrsV2(src, dst netip.AddrPort) []byte {
+	body := append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+	body = binary.BigEndian.AppendUint16(body, src.Port())
+	return binary.BigEndian.AppendUint16(body, dst.Port())
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	tcp := func(ip string, port int) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	tests := []struct {
+		src  net.Addr
+		dst  net.Addr
+		want string
+	}{
+		{tcp("192.0.2.1", 56324), tcp("198.51.100.7", 443), "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n"},
+		{tcp("2001:db8::1", 1), tcp("2001:db8::ff", 65535), "PROXY TCP6 2001:db8::1 2001:db8::ff 1 65535\r\n"},
+		// IPv4-mapped IPv6 addresses are sent as IPv4
+		{tcp("::ffff:192.0.2.1", 80), tcp("192.0.2.2", 81), "PROXY TCP4 192.0.2.1 192.0.2.2 80 81\r\n"},
+		{tcp("192.0.2.1", 80), tcp("2001:db8::1", 81), "PROXY UNKNOWN\r\n"},
+		{&net.UnixAddr{Name: "/run/tcpf.sock", Net: "unix"}, tcp("192.0.2.1", 80), "PROXY UNKNOWN\r\n"},
+	}
+	for _, test := range tests {
+		if got := proxyHeaderV1(test.src, test.dst); got != test.want {
+			t.Errorf("proxyHeaderV1(%v, %v) = %q, want %q", test.src, test.dst, got, test.want)
+		}
+	}
+}
+
+func TestSendProxy(t *testing.T) {
+	// The destination answers with the header it got, then echoes
+	dst := startServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, header)
+		io.Copy(conn, reader)
+	})
+	_, addr := startRealm(t, dst, WithSendProxy())
+	conn := dialRealm(t, addr)
+	client, realm := conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+	// The header comes first even though the client sends nothing yet
+	want := fmt.Sprintf("PROXY TCP4 %v %v %d %d\r\n", client.IP, realm.IP, client.Port, realm.Port)
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != want {
+		t.Errorf("destination got the header %q, want %q", header, want)
+	}
+	conn.Write([]byte("data"))
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(reader, data); err != nil || string(data) != "data" {
+		t.Errorf("got %q and %v after the header", data, err)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	src4, dst4 := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.7:443")
+	src6, dst6 := netip.MustParseAddrPort("[2001:db8::1]:1"), netip.MustParseAddrPort("[2001:db8::ff]:65535")
+	// Addresses of the connection itself, which are kept unless the header
+	// describes a proxied TCP connection
+	const own = "pipe"
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+	}{
+		{"IPv4", proxyHeaderV2(0x21, 0x11, proxyAddrsV2(src4, dst4)), src4.String(), dst4.String()},
+		{"IPv6", proxyHeaderV2(0x21, 0x21, proxyAddrsV2(src6, dst6)), src6.String(), dst6.String()},
+		// TLVs following the addresses are skipped
+		{"TLVs", proxyHeaderV2(0x21, 0x11, append(proxyAddrsV2(src4, dst4), 0x04, 0x00, 0x01, 0x00)), src4.String(), dst4.String()},
+		{"LOCAL", proxyHeaderV2(0x20, 0x00, nil), own, own},
+		{"LOCAL with addresses", proxyHeaderV2(0x20, 0x11, proxyAddrsV2(src4, dst4)), own, own},
+		{"UDP", proxyHeaderV2(0x21, 0x12, proxyAddrsV2(src4, dst4)), own, own},
+		{"AF_UNSPEC", proxyHeaderV2(0x21, 0x00, nil), own, own},
+		{"AF_UNIX", proxyHeaderV2(0x21, 0x31, make([]byte, 216)), own, own},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(append(test.header, "data"...))
+				client.Close()
+			}()
+			conn, err := readProxyHeaderV2(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote, local := conn.RemoteAddr().String(), conn.LocalAddr().String(); remote != test.remote || local != test.local {
+				t.Errorf("connection is from %v to %v, want %v to %v", remote, local, test.remote, test.local)
+			}
+			// Nothing past the header was consumed
+			if data, err := io.ReadAll(conn); err != nil || string(data) != "data" {
+				t.Errorf("read %q, %v after the header, want data", data, err)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderV2Errors(t *testing.T) {
+	addrs := proxyAddrsV2(netip.MustParseAddrPort("192.0.2.1:1"), netip.MustParseAddrPort("192.0.2.2:2"))
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"bad signature", append([]byte("\r\n\r\n\x00\r\nQUIT!"), 0x21, 0x11, 0, 0), "signature"},
+		{"PROXY v1", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 2\r\n"), "signature"},
+		{"version 1", proxyHeaderV2(0x11, 0x11, addrs), "version"},
+		{"unknown command", proxyHeaderV2(0x22, 0x11, addrs), "command"},
+		{"unknown family", proxyHeaderV2(0x21, 0x41, addrs), "family"},
+		{"truncated addresses", proxyHeaderV2(0x21, 0x11, addrs[:6]), "truncated"},
+		{"IPv6 with IPv4 addresses", proxyHeaderV2(0x21, 0x21, addrs), "truncated"},
+		{"truncated header", proxySignatureV2[:8], "can't read"},
+		{"truncated body", proxyHeaderV2(0x21, 0x11, addrs)[:20], "can't read"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(test.header)
+				client.Close()
+			}()
+			if _, err := readProxyHeaderV2(server); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("readProxyHeaderV2() = %v, want an error about %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	dst := startEcho(t)
+	var buf bytes.Buffer
+	log := NewAccessLog(&buf)
+	denied := []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+	realm, addr := startRealm(t, dst, WithAcceptProxy(), WithDeny(denied), WithAccessLog(log))
+
+	// The original client is the one shown and logged, while the realm
+	// still dials the destination itself
+	conn := dialRealm(t, addr)
+	src, dstAddr := netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.7:80")
+	conn.Write(proxyHeaderV2(0x21, 0x11, proxyAddrsV2(src, dstAddr)))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: proxied.test\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || line != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("got %q, %v back through the tunnel", line, err)
+	}
+	tunnels := realm.Tunnels()
+	if len(tunnels) != 1 || tunnels[0].Src != src.String() {
+		t.Errorf("tunnels are %+v, want one from %v", tunnels, src)
+	}
+	conn.Close()
+	if lines := accessLogLines(t, log, &buf, 1); !strings.HasPrefix(lines[0], "proxied.test 192.0.2.1 ") {
+		t.Errorf("access log line %q, want the request from 192.0.2.1", lines[0])
+	}
+
+	// The access lists apply to the original client, not to the proxy
+	conn = dialRealm(t, addr)
+	conn.Write(proxyHeaderV2(0x21, 0x11, proxyAddrsV2(netip.MustParseAddrPort("203.0.113.9:1234"), dstAddr)))
+	conn.Write([]byte("data"))
+	if n, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Errorf("denied client read %d bytes, want the connection closed", n)
+	}
+	if stats := realm.Stats(); stats.TunnelsTotal != 1 {
+		t.Errorf("%d tunnels were opened, want only the allowed one", stats.TunnelsTotal)
+	}
+
+	// Health checks of the proxy itself come from the proxy
+	conn = dialRealm(t, addr)
+	conn.Write(proxyHeaderV2(0x20, 0x00, nil))
+	request := "GET /health HTTP/1.1\r\nHost: proxy.test\r\n\r\n"
+	converse(t, conn, []byte(request), []byte(request))
+	conn.Close()
+	if lines := accessLogLines(t, log, &buf, 2); !strings.HasPrefix(lines[1], "proxy.test 127.0.0.1 ") {
+		t.Errorf("access log line %q, want the request from 127.0.0.1", lines[1])
+	}
+}
@@ -0,0 +1,83 @@
+package tcpf
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of bytes (or connections) passing through it. Takers may run
+// into debt, and then wait until the bucket refills, so every read is let
+// through whole and the rate still averages out.
+type tokenBucket struct {
+	mutex sync.Mutex
+	// Bytes per second, and the most bytes which may pass at once
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket letting rate bytes per second
+// through, or nil if rate is zero which means no limit
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// limits returns the buckets which limit a rate, leaving out the nil ones
+func limits(buckets ...*tokenBucket) []*tokenBucket {
+	var limits []*tokenBucket
+	for _, bucket := range buckets {
+		if bucket != nil {
+			limits = append(limits, bucket)
+		}
+	}
+	return limits
+}
+
+// refill adds the tokens accumulated since the last refill, must be called
+// with the mutex held
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token from the bucket if it has one, without waiting
+func (b *tokenBucket) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// take takes n bytes from the bucket, waiting until the debt they leave is
+// paid off or ctx is done
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	b.mutex.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	debt := b.tokens
+	b.mutex.Unlock()
+	if debt >= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(-debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,108 @@
+package tcpf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0) != nil {
+		t.Error("a zero rate is limited")
+	}
+	b := newTokenBucket(1000)
+	ctx := context.Background()
+	// The burst of a full bucket passes right away, and the debt of what
+	// exceeds it is paid off at the rate
+	start := time.Now()
+	if err := b.take(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("burst took %v", elapsed)
+	}
+	start = time.Now()
+	if err := b.take(ctx, 200); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("200 bytes over the burst took %v, want about 200ms", elapsed)
+	}
+	// A take running into debt gives up once its context is done
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := b.take(ctx, 10000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("take() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	b := newTokenBucket(2)
+	if !b.allow() || !b.allow() {
+		t.Fatal("the burst isn't allowed")
+	}
+	if b.allow() {
+		t.Error("allowed past the burst")
+	}
+	time.Sleep(600 * time.Millisecond)
+	if !b.allow() {
+		t.Error("the bucket didn't refill")
+	}
+}
+
+// sendAll sends n bytes through addr with the echo behind it and returns how
+// long it takes for them to come back
+func sendAll(t *testing.T, addr string, n int) time.Duration {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	msg := bytes.Repeat([]byte("x"), n)
+	start := time.Now()
+	go conn.Write(msg)
+	if _, err := io.ReadFull(conn, make([]byte, n)); err != nil {
+		t.Error(err)
+	}
+	return time.Since(start)
+}
+
+func TestRateLimit(t *testing.T) {
+	_, addr := startRealm(t, startEcho(t), WithRateLimit(50000))
+	// Twice the burst of a second takes another second in each direction,
+	// which are limited at the same time
+	if elapsed := sendAll(t, addr, 100000); elapsed < 800*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("100KB at 50KB/s took %v, want about a second", elapsed)
+	}
+	// Every tunnel has a limit of its own
+	if elapsed := sendAll(t, addr, 40000); elapsed > 500*time.Millisecond {
+		t.Errorf("a new tunnel within its burst took %v", elapsed)
+	}
+}
+
+func TestTotalRateLimit(t *testing.T) {
+	_, addr := startRealm(t, startEcho(t), WithTotalRateLimit(50000))
+	// Each of the tunnels would fit in the burst alone, but they share the
+	// bucket, so together they take about a second more
+	start := time.Now()
+	var tunnels sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		tunnels.Add(1)
+		go func() {
+			defer tunnels.Done()
+			sendAll(t, addr, 50000)
+		}()
+	}
+	tunnels.Wait()
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("2 x 50KB at 50KB/s in total took %v, want about a second", elapsed)
+	}
+}
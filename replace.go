@@ -0,0 +1,105 @@
+package tcpf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Replacement replaces the byte sequence From with To in the traffic of the
+// TCP tunnels
+type Replacement struct {
+	From []byte
+	To   []byte
+}
+
+// ParseReplacement parses a replacement of the form from=to, where from is
+// not empty and may not contain "=", while to may be empty to delete from
+func ParseReplacement(value string) (Replacement, error) {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok || from == "" {
+		return Replacement{}, fmt.Errorf("invalid replacement %q, expected from=to", value)
+	}
+	return Replacement{From: []byte(from), To: []byte(to)}, nil
+}
+
+// replacer is the Middleware replacing the byte sequences of WithReplacements
+// in both directions of a tunnel. Bytes at the end of a read which may be the
+// start of a match are held back until the next read tells, so that matches
+// spanning reads are replaced too, and flushed once the stream ends. The
+// output doesn't depend on how the stream is split into reads.
+type replacer struct {
+	replacements []Replacement
+	// State of each direction, which are processed at the same time
+	directions [2]replaceState
+}
+
+type replaceState struct {
+	pending []byte
+	out     []byte
+}
+
+func (r *replacer) Process(direction Direction, b []byte) ([]byte, error) {
+	state := &r.directions[direction]
+	state.pending = append(state.pending, b...)
+	return r.replace(state, false), nil
+}
+
+// replace replaces the matches in the pending bytes of a direction and
+// returns the bytes to pass on. The leftmost match wins, and the first of the
+// replacements matching at the same offset. Unless the stream has ended, the
+// bytes from the leftmost partial match on are held back if it starts at or
+// before the leftmost match, as the next read may complete it and make it win.
+func (r *replacer) replace(state *replaceState, ended bool) []byte {
+	state.out = state.out[:0]
+	rest := state.pending
+	for {
+		at, match := -1, Replacement{}
+		for _, replacement := range r.replacements {
+			if i := bytes.Index(rest, replacement.From); i >= 0 && (at < 0 || i < at) {
+				at, match = i, replacement
+			}
+		}
+		if !ended {
+			if partial := r.partialMatch(rest); partial >= 0 && (at < 0 || partial <= at) {
+				state.out = append(state.out, rest[:partial]...)
+				rest = rest[partial:]
+				break
+			}
+		}
+		if at < 0 {
+			state.out = append(state.out, rest...)
+			rest = nil
+			break
+		}
+		state.out = append(state.out, rest[:at]...)
+		state.out = append(state.out, match.To...)
+		rest = rest[at+len(match.From):]
+	}
+	state.pending = append(state.pending[:0], rest...)
+	return state.out
+}
+
+// partialMatch returns the offset of the longest suffix of b which is the
+// start of one of the replacements but not the whole of it, or -1 if none is
+func (r *replacer) partialMatch(b []byte) int {
+	longest := 0
+	for _, replacement := range r.replacements {
+		for n := min(len(replacement.From)-1, len(b)); n > longest; n-- {
+			if bytes.HasPrefix(replacement.From, b[len(b)-n:]) {
+				longest = n
+				break
+			}
+		}
+	}
+	if longest == 0 {
+		return -1
+	}
+	return len(b) - longest
+}
+
+// Flush replaces the matches in the bytes held back and passes them on, as
+// partial matches can't be completed any more once the stream has ended
+func (r *replacer) Flush(direction Direction) ([]byte, error) {
+	return r.replace(&r.directions[direction], true), nil
+}
@@ -0,0 +1,119 @@
+package tcpf
+
+import (
+	"bytes"
+	"testing"
+)
+
+// replaceChunks passes the chunks of a stream through a new replacer of the
+// rules and returns what comes out, flush included
+func replaceChunks(t testing.TB, rules []string, chunks ...string) string {
+	t.Helper()
+	r := &replacer{}
+	for _, rule := range rules {
+		replacement, err := ParseReplacement(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.replacements = append(r.replacements, replacement)
+	}
+	var out []byte
+	for _, chunk := range chunks {
+		b, err := r.Process(DirectionIn, []byte(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, b...)
+	}
+	b, err := r.Flush(DirectionIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(append(out, b...))
+}
+
+func TestReplacer(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		in    string
+		want  string
+	}{
+		{"none", []string{"foo=bar"}, "hello", "hello"},
+		{"single", []string{"foo=bar"}, "a foo b", "a bar b"},
+		{"several", []string{"foo=bar"}, "foofoo foo", "barbar bar"},
+		{"delete", []string{"foo="}, "afoob", "ab"},
+		{"longer", []string{"a=xyz"}, "banana", "bxyznxyznxyz"},
+		{"leftmost wins", []string{"bcd=Y", "abc=X"}, "abcd", "Xd"},
+		{"first of the same offset wins", []string{"ab=X", "abc=Y"}, "abcd", "Xcd"},
+		{"nested", []string{"abcd=X", "bc=Y"}, "zabcdz", "zXz"},
+		{"nested incomplete", []string{"abcd=X", "bc=Y"}, "zabcz", "zaYz"},
+		{"partial at the end", []string{"abcd=X", "bc=Y"}, "zabc", "zaY"},
+		{"overlapping", []string{"aa=b"}, "aaaaa", "bba"},
+		{"not replaced again", []string{"a=aa"}, "aa", "aaaa"},
+		{"prefix left over", []string{"foo=bar"}, "fofo", "fofo"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := replaceChunks(t, test.rules, test.in); got != test.want {
+				t.Errorf("replaced %q into %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReplacerSplits(t *testing.T) {
+	tests := []struct {
+		rules []string
+		in    string
+	}{
+		{[]string{"abcd=X", "bc=Y"}, "zabcdz zabcz zabc"},
+		{[]string{"bcd=Y", "abc=X"}, "abcd abcabcd"},
+		{[]string{"ab=X", "abc=Y"}, "abcd abab"},
+		{[]string{"aa=b", "aaa=c"}, "aaaaaaa"},
+		{[]string{"foo=bar", "oof=zab", "o="}, "foofoof ofoo"},
+		{[]string{"aab=X", "ab=Y", "b=Z"}, "aaab aab ab b"},
+	}
+	for _, test := range tests {
+		whole := replaceChunks(t, test.rules, test.in)
+		for i := 0; i <= len(test.in); i++ {
+			for j := i; j <= len(test.in); j++ {
+				if got := replaceChunks(t, test.rules, test.in[:i], test.in[i:j], test.in[j:]); got != whole {
+					t.Errorf("%v: replaced %q read as %q, %q, %q into %q, but %q when read whole",
+						test.rules, test.in, test.in[:i], test.in[i:j], test.in[j:], got, whole)
+				}
+			}
+		}
+		chunks := make([]string, len(test.in))
+		for i := range test.in {
+			chunks[i] = test.in[i : i+1]
+		}
+		if got := replaceChunks(t, test.rules, chunks...); got != whole {
+			t.Errorf("%v: replaced %q read a byte at a time into %q, but %q when read whole", test.rules, test.in, got, whole)
+		}
+	}
+}
+
+func TestParseReplacement(t *testing.T) {
+	replacement, err := ParseReplacement("old.example.com=new.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(replacement.From) != "old.example.com" || string(replacement.To) != "new.example.com" {
+		t.Errorf("parsed %q => %q", replacement.From, replacement.To)
+	}
+	for _, value := range []string{"", "no-equals", "=to"} {
+		if _, err := ParseReplacement(value); err == nil {
+			t.Errorf("ParseReplacement(%q) succeeded", value)
+		}
+	}
+}
+
+func TestReplacementsInTunnel(t *testing.T) {
+	replacement, _ := ParseReplacement("ping=pong")
+	_, addr := startRealm(t, startEcho(t), WithReplacements([]Replacement{replacement}))
+	// The echo sends pong back, which doesn't match any more
+	if reply := roundTrip(t, addr, []byte("ping ping")); !bytes.Equal(reply, []byte("pong pong")) {
+		t.Errorf("got %q back, want %q", reply, "pong pong")
+	}
+}
@@ -0,0 +1,91 @@
+package tcpf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NewResolver returns a resolver sending its queries to the DNS server at
+// address, port 53 unless address includes one, instead of the servers the
+// system is configured with
+func NewResolver(address string) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("DNS server %v is not an IP address", address)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}, nil
+}
+
+// dnsCache resolves destination host names and keeps the addresses for a
+// while, handing them out round-robin
+type dnsCache struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	resolver *net.Resolver
+	entries  map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+	// Index of the address to hand out next
+	next int
+}
+
+func newDNSCache(ttl time.Duration, resolver *net.Resolver) *dnsCache {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &dnsCache{ttl: ttl, resolver: resolver, entries: make(map[string]*dnsEntry)}
+}
+
+// resolve returns the endpoint to dial for a tcp host:port endpoint: the
+// next of the addresses the host resolves to, looked up again once the ones
+// cached have expired. IP addresses are returned as they are.
+func (cache *dnsCache) resolve(ctx context.Context, endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil || net.ParseIP(host) != nil {
+		return endpoint, nil
+	}
+	cache.mutex.Lock()
+	entry, ok := cache.entries[host]
+	if ok && time.Now().Before(entry.expires) {
+		addr := entry.addrs[entry.next%len(entry.addrs)]
+		entry.next++
+		cache.mutex.Unlock()
+		return net.JoinHostPort(addr, port), nil
+	}
+	cache.mutex.Unlock()
+
+	ips, err := cache.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry = &dnsEntry{addrs: addrs, expires: time.Now().Add(cache.ttl)}
+	if old, ok := cache.entries[host]; ok {
+		// Keep rotating from where the expired addresses left off
+		entry.next = old.next
+	}
+	cache.entries[host] = entry
+	addr := entry.addrs[entry.next%len(entry.addrs)]
+	entry.next++
+	return net.JoinHostPort(addr, port), nil
+}
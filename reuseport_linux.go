@@ -0,0 +1,4 @@
+package tcpf
+
+// SO_REUSEPORT, which the syscall package doesn't define for Linux
+const soReusePort = 0xf
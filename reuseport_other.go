@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package tcpf
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// reusePort fails, SO_REUSEPORT is only available on Linux and BSDs
+func reusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("tcpf: SO_REUSEPORT is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,153 @@
+package tcpf
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Frames of the reverse tunnel protocol, spoken with the control server of a
+// realm created with WithReverse. A frame is its type byte followed by a
+// 32-bit big-endian stream ID. The realm keeps a control connection open to
+// the control server, which sends frameOpen for every client connection it
+// relays. The realm then opens a data connection to the control server,
+// starting it with frameAccept carrying the ID of the stream; the rest of the
+// data connection is the relayed client connection.
+const (
+	frameOpen   = 1
+	frameAccept = 2
+	frameLen    = 5
+)
+
+// Bounds of the delay before reconnecting a failed control connection
+const (
+	minReverseDelay = time.Second
+	maxReverseDelay = time.Minute
+)
+
+// reverseAddr is the address of the control server a reverse realm accepts
+// connections from
+type reverseAddr string
+
+func (addr reverseAddr) Network() string { return "tcp" }
+func (addr reverseAddr) String() string  { return string(addr) }
+
+// reverseListener is the listener of a realm created with WithReverse: it
+// accepts the data connections the realm opens to its control server
+type reverseListener struct {
+	realm  *TunnelRealm
+	conns  chan net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// listenReverse connects to the control server of the realm, and keeps
+// reconnecting whenever the control connection fails until the listener is
+// closed
+func (realm *TunnelRealm) listenReverse() *reverseListener {
+	listener := &reverseListener{realm: realm, conns: make(chan net.Conn)}
+	listener.ctx, listener.cancel = context.WithCancel(realm.ctx)
+	realm.running.Add(1)
+	go listener.run()
+	return listener
+}
+
+func (listener *reverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *reverseListener) Close() error {
+	listener.cancel()
+	return nil
+}
+
+func (listener *reverseListener) Addr() net.Addr {
+	return reverseAddr(listener.realm.reverse)
+}
+
+func (listener *reverseListener) run() {
+	defer listener.realm.running.Done()
+	delay := minReverseDelay
+	for {
+		connected, err := listener.control()
+		if listener.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = minReverseDelay
+		}
+		logEvent(LevelWarn, "reverse_error", Fields{"realm": listener.realm, "error": err}, "Control connection to %v failed: %v; reconnecting in %v", listener.realm.reverse, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-listener.ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxReverseDelay {
+			delay = maxReverseDelay
+		}
+	}
+}
+
+// control opens a control connection and serves the streams requested over
+// it until it fails; connected tells whether it could be opened at all
+func (listener *reverseListener) control() (connected bool, err error) {
+	conn, err := listener.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(listener.ctx, func() { conn.Close() })
+	defer stop()
+	logEvent(LevelInfo, "reverse_connect", Fields{"realm": listener.realm}, "Connected to control server %v", listener.realm.reverse)
+	frame := make([]byte, frameLen)
+	for {
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return true, err
+		}
+		if frame[0] != frameOpen {
+			return true, fmt.Errorf("unexpected frame of type %d", frame[0])
+		}
+		go listener.accept(binary.BigEndian.Uint32(frame[1:]))
+	}
+}
+
+// accept opens the data connection of the stream with the given ID and
+// hands it over to the realm
+func (listener *reverseListener) accept(id uint32) {
+	conn, err := listener.dial()
+	if err == nil {
+		frame := make([]byte, frameLen)
+		frame[0] = frameAccept
+		binary.BigEndian.PutUint32(frame[1:], id)
+		if _, err = conn.Write(frame); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		logEvent(LevelWarn, "reverse_error", Fields{"realm": listener.realm, "stream": id, "error": err}, "Can't open stream %d from %v: %v", id, listener.realm.reverse, err)
+		return
+	}
+	select {
+	case listener.conns <- conn:
+	case <-listener.ctx.Done():
+		conn.Close()
+	}
+}
+
+func (listener *reverseListener) dial() (net.Conn, error) {
+	dialer := listener.realm.dialer("tcp")
+	conn, err := dialer.DialContext(listener.ctx, "tcp", listener.realm.reverse)
+	if err != nil {
+		return nil, err
+	}
+	listener.realm.tune(conn)
+	return conn, nil
+}
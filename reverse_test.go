@@ -0,0 +1,104 @@
+package tcpf
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startControl runs a fake control server for realms created with
+// WithReverse, handing the connections they open to it in order
+func startControl(t *testing.T) (string, chan net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			accepted <- conn
+		}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+// nextConn returns the next connection the realm opens to the control server
+func nextConn(t *testing.T, accepted chan net.Conn, what string) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-accepted:
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the %v connection", what)
+		return nil
+	}
+}
+
+// openReverse asks the realm over the control connection for the stream id,
+// and returns its data connection once the realm accepted it
+func openReverse(t *testing.T, control net.Conn, accepted chan net.Conn, id uint32) net.Conn {
+	t.Helper()
+	frame := binary.BigEndian.AppendUint32([]byte{frameOpen}, id)
+	if _, err := control.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	data := nextConn(t, accepted, "data")
+	if _, err := io.ReadFull(data, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != frameAccept || binary.BigEndian.Uint32(frame[1:]) != id {
+		t.Fatalf("data connection starts with % x, want the accept of stream %d", frame, id)
+	}
+	return data
+}
+
+func TestReverse(t *testing.T) {
+	controlAddr, accepted := startControl(t)
+	host, port, _ := net.SplitHostPort(startEcho(t))
+	realm := NewTunnelRealm("", "", host, port, WithReverse(controlAddr))
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer realm.Stop()
+	if addr := realmAddr(realm); addr != controlAddr {
+		t.Errorf("realm listens on %v, want the control server %v", addr, controlAddr)
+	}
+
+	control := nextConn(t, accepted, "control")
+	first := openReverse(t, control, accepted, 7)
+	second := openReverse(t, control, accepted, 8)
+	converse(t, first, []byte("first"), []byte("first"))
+	converse(t, second, []byte("second"), []byte("second"))
+	waitFor(t, "two tunnels", func() bool { return len(realm.Tunnels()) == 2 })
+
+	// Once the control connection drops, the realm connects again, while
+	// the streams already open go on
+	control.Close()
+	control = nextConn(t, accepted, "new control")
+	converse(t, first, []byte("still"), []byte("still"))
+	third := openReverse(t, control, accepted, 9)
+	converse(t, third, []byte("third"), []byte("third"))
+
+	// So it does after a protocol error
+	control.Write([]byte{frameAccept, 0, 0, 0, 1})
+	control = nextConn(t, accepted, "control after the error")
+	fourth := openReverse(t, control, accepted, 10)
+	converse(t, fourth, []byte("fourth"), []byte("fourth"))
+
+	// Closing the data connection closes the tunnel
+	second.Close()
+	waitFor(t, "the tunnel to close", func() bool { return len(realm.Tunnels()) == 3 })
+	if stats := realm.Stats(); stats.TunnelsTotal != 4 {
+		t.Errorf("%d tunnels were opened, want 4", stats.TunnelsTotal)
+	}
+}
@@ -0,0 +1,160 @@
+package tcpf
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// Time a client has to send the first bytes a connection is routed by;
+	// clients which stay silent, as in protocols where the server speaks
+	// first, are forwarded to the realm's destination
+	routeTimeout = 3 * time.Second
+	// Size of the buffer the first bytes are peeked through, which holds the
+	// largest TLS record with its header
+	routeBufSize = 5 + 16384
+)
+
+// router picks the destination of a connection from its first bytes, which
+// it peeks so that they are still forwarded to the destination
+type router interface {
+	fmt.Stringer
+	// route returns the address to forward the connection to, or "" to
+	// forward it to the realm's destination
+	route(reader *bufio.Reader) (string, error)
+}
+
+// Protocols detected by WithProtocolRoutes
+const (
+	ProtocolTLS  = "tls"
+	ProtocolHTTP = "http"
+	ProtocolSSH  = "ssh"
+)
+
+// Methods an HTTP/1.x request starts with, and the HTTP/2 connection preface
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE ", "PRI * HTTP/2"}
+
+// protocolRouter routes connections by the protocol they speak
+type protocolRouter struct {
+	routes map[string]string
+}
+
+func (r *protocolRouter) String() string {
+	return "protocol"
+}
+
+func (r *protocolRouter) route(reader *bufio.Reader) (string, error) {
+	protocol, err := sniffProtocol(reader)
+	if err != nil {
+		return "", err
+	}
+	return r.routes[protocol], nil
+}
+
+// sniffProtocol tells which of the protocols the first bytes of the reader
+// belong to, or returns "" for other protocols
+func sniffProtocol(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case first[0] == 0x16:
+		// Handshake record of TLS 1.0 or a later version
+		if hasPrefix(reader, "\x16\x03") {
+			return ProtocolTLS, nil
+		}
+	case first[0] == 'S':
+		if hasPrefix(reader, "SSH-") {
+			return ProtocolSSH, nil
+		}
+	}
+	for _, method := range httpMethods {
+		if method[0] == first[0] && hasPrefix(reader, method) {
+			return ProtocolHTTP, nil
+		}
+	}
+	return "", nil
+}
+
+// hasPrefix tells whether the reader starts with the prefix, waiting for as
+// many bytes as the prefix has
+func hasPrefix(reader *bufio.Reader, prefix string) bool {
+	b, _ := reader.Peek(len(prefix))
+	return string(b) == prefix
+}
+
+// routeByName returns the route of the exact host name, or else of the
+// longest wildcard pattern such as *.example.com matching it
+func routeByName(routes map[string]string, name string) string {
+	if address, ok := routes[name]; ok {
+		return address
+	}
+	best, route := "", ""
+	for pattern, address := range routes {
+		if !strings.Contains(pattern, "*") || len(pattern) <= len(best) {
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			best, route = pattern, address
+		}
+	}
+	return route
+}
+
+// route peeks the first bytes from the client to pick the destination of the
+// connection with the realm's router, and returns it along with the connection
+// replaying the peeked bytes. It returns "" if the connection isn't routed,
+// also when the client sends nothing for routeTimeout.
+func (realm *TunnelRealm) route(conn net.Conn) (string, net.Conn, error) {
+	buffered := &bufferedConn{Conn: conn, reader: bufio.NewReaderSize(conn, routeBufSize)}
+	conn.SetReadDeadline(time.Now().Add(routeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	stop := context.AfterFunc(realm.ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	address, err := realm.router.route(buffered.reader)
+	if errors.Is(err, os.ErrDeadlineExceeded) && realm.ctx.Err() == nil {
+		return "", buffered, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return address, buffered, nil
+}
+
+// ParseRoutes parses a comma separated list of routes of the form
+// key=host:port, where host:port may be a Unix socket unix:/path/to.sock;
+// keys are lower-cased, as protocols and host names are matched regardless
+// of case
+func ParseRoutes(list string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, address, ok := strings.Cut(item, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if address = strings.TrimSpace(address); !ok || key == "" {
+			return nil, fmt.Errorf("invalid route %q, expected key=host:port", item)
+		}
+		if !strings.HasPrefix(address, unixPrefix) {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return nil, fmt.Errorf("invalid destination of route %q, expected host:port", item)
+			}
+		}
+		if _, ok := routes[key]; ok {
+			return nil, fmt.Errorf("duplicate route for %q", key)
+		}
+		routes[key] = address
+	}
+	return routes, nil
+}
@@ -0,0 +1,77 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"TLS 1.0 record", "\x16\x03\x01\x02\x00\x01", ProtocolTLS},
+		{"TLS 1.2 record", "\x16\x03\x03\x00\x05", ProtocolTLS},
+		{"SSH", "SSH-2.0-OpenSSH_9.6\r\n", ProtocolSSH},
+		{"GET", "GET / HTTP/1.1\r\n", ProtocolHTTP},
+		{"CONNECT", "CONNECT dest.test:443 HTTP/1.1\r\n", ProtocolHTTP},
+		{"HTTP/2 preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", ProtocolHTTP},
+		{"SSLv2", "\x80\x2e\x01\x03\x01", ""},
+		{"handshake of SSL 2", "\x16\x02\x00", ""},
+		{"lower-case method", "get / HTTP/1.1\r\n", ""},
+		{"method without a space", "GETAWAY", ""},
+		{"SMTP", "EHLO mail.test\r\n", ""},
+		{"S but not SSH", "SSL", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader([]byte(test.data)))
+			protocol, err := sniffProtocol(reader)
+			if err != nil || protocol != test.want {
+				t.Errorf("sniffProtocol() = %q, %v, want %q", protocol, err, test.want)
+			}
+			// Nothing was consumed
+			if buffered, _ := reader.Peek(reader.Buffered()); string(buffered) != test.data {
+				t.Errorf("buffered %q after sniffing, want %q", buffered, test.data)
+			}
+		})
+	}
+}
+
+func TestProtocolRoutes(t *testing.T) {
+	routes := map[string]string{
+		ProtocolTLS:  startTagged(t, "tls"),
+		ProtocolHTTP: startTagged(t, "http"),
+		ProtocolSSH:  startTagged(t, "ssh"),
+	}
+	_, addr := startRealm(t, startTagged(t, "default"), WithProtocolRoutes(routes))
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"TLS", clientHello(t, "dest.test"), "tls"},
+		{"HTTP", []byte("GET / HTTP/1.1\r\nHost: dest.test\r\n\r\n"), "http"},
+		{"SSH", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "ssh"},
+		{"unknown protocol", []byte("EHLO mail.test\r\n"), "default"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := routedTo(t, addr, test.data); got != test.want {
+				t.Errorf("routed to %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// A client which never speaks goes to the default route once the realm
+	// stops waiting for it
+	conn := dialRealm(t, addr)
+	conn.SetDeadline(time.Now().Add(routeTimeout + 5*time.Second))
+	reader := bufio.NewReader(conn)
+	if tag, err := reader.ReadString('\n'); err != nil || tag != "default\n" {
+		t.Errorf("silent client got %q, %v, want the default route", tag, err)
+	}
+}
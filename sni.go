@@ -0,0 +1,113 @@
+package tcpf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// sniRouter routes TLS connections by the server name their ClientHello
+// asks for, without terminating TLS
+type sniRouter struct {
+	routes map[string]string
+}
+
+func (r *sniRouter) String() string {
+	return "SNI"
+}
+
+func (r *sniRouter) route(reader *bufio.Reader) (string, error) {
+	name, err := peekServerName(reader)
+	if err != nil || name == "" {
+		return "", err
+	}
+	return routeByName(r.routes, name), nil
+}
+
+var errNotClientHello = errors.New("malformed TLS ClientHello")
+
+// peekServerName returns the lower-cased server name of the TLS ClientHello
+// the reader starts with, or "" if the connection isn't TLS or doesn't send
+// the server_name extension. Only the first record is peeked, so a
+// ClientHello split across records reads as truncated and returns "" too.
+func peekServerName(reader *bufio.Reader) (string, error) {
+	header, err := reader.Peek(5)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != 0x16 || header[1] != 0x03 {
+		return "", nil
+	}
+	record, err := reader.Peek(5 + int(binary.BigEndian.Uint16(header[3:])))
+	if err != nil {
+		return "", err
+	}
+	name, err := parseServerName(record[5:])
+	if err != nil {
+		// Not ours to reject: the destination answers with the TLS alert
+		return "", nil
+	}
+	return strings.ToLower(name), nil
+}
+
+// parseServerName parses the server_name extension (RFC 6066) out of the
+// ClientHello handshake message at the start of b
+func parseServerName(b []byte) (string, error) {
+	// Handshake type and length, client version and random
+	if len(b) < 4+2+32 || b[0] != 0x01 {
+		return "", errNotClientHello
+	}
+	b = b[4+2+32:]
+	// Session ID, cipher suites and compression methods
+	for _, lengthSize := range []int{1, 2, 1} {
+		var ok bool
+		if _, b, ok = cutVector(b, lengthSize); !ok {
+			return "", errNotClientHello
+		}
+	}
+	if len(b) == 0 {
+		// No extensions at all
+		return "", nil
+	}
+	extensions, _, ok := cutVector(b, 2)
+	if !ok {
+		return "", errNotClientHello
+	}
+	for len(extensions) >= 4 {
+		kind := binary.BigEndian.Uint16(extensions)
+		var data []byte
+		if data, extensions, ok = cutVector(extensions[2:], 2); !ok {
+			return "", errNotClientHello
+		}
+		if kind != 0 {
+			continue
+		}
+		names, _, ok := cutVector(data, 2)
+		for ok && len(names) >= 3 {
+			nameType := names[0]
+			var name []byte
+			if name, names, ok = cutVector(names[1:], 2); ok && nameType == 0 {
+				return string(name), nil
+			}
+		}
+		return "", errNotClientHello
+	}
+	return "", nil
+}
+
+// cutVector splits b into the vector at its start, prefixed with its length
+// of lengthSize bytes, and the rest
+func cutVector(b []byte, lengthSize int) (vector []byte, rest []byte, ok bool) {
+	if len(b) < lengthSize {
+		return nil, nil, false
+	}
+	n := 0
+	for _, c := range b[:lengthSize] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < lengthSize+n {
+		return nil, nil, false
+	}
+	return b[lengthSize : lengthSize+n], b[lengthSize+n:], true
+}
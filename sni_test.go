@@ -0,0 +1,186 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startTagged runs a destination which answers every connection with its
+// tag on a line of its own, then echoes
+func startTagged(t *testing.T, tag string) string {
+	t.Helper()
+	return startServer(t, func(conn net.Conn) {
+		io.WriteString(conn, tag+"\n")
+		io.Copy(conn, conn)
+	})
+}
+
+// routedTo sends msg through the realm and returns the tag of the
+// destination it reached, failing the test unless msg is echoed intact
+func routedTo(t *testing.T, addr string, msg []byte) string {
+	t.Helper()
+	conn := dialRealm(t, addr)
+	defer conn.Close()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	tag, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the destination's tag: %v", err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(reader, echoed); err != nil || !bytes.Equal(echoed, msg) {
+		t.Fatalf("the destination got %q, %v, want %q", echoed, err, msg)
+	}
+	return strings.TrimSuffix(tag, "\n")
+}
+
+// clientHello returns the TLS record with the ClientHello crypto/tls sends
+// to serverName, without the server_name extension if empty
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return record
+}
+
+// tlsRecord returns a handshake record holding the fragment
+func tlsRecord(fragment []byte) []byte {
+	record := binary.BigEndian.AppendUint16([]byte{0x16, 0x03, 0x01}, uint16(len(fragment)))
+	return append(record, fragment...)
+}
+
+func TestParseServerName(t *testing.T) {
+	hello := clientHello(t, "Example.COM")[5:]
+	if name, err := parseServerName(hello); err != nil || name != "Example.COM" {
+		t.Errorf("parseServerName() = %q, %v, want Example.COM", name, err)
+	}
+	if name, err := parseServerName(clientHello(t, "")[5:]); err != nil || name != "" {
+		t.Errorf("parseServerName() = %q, %v without SNI", name, err)
+	}
+	// No truncation of the hello yields the name, nor panics
+	for n := range hello {
+		if name, err := parseServerName(hello[:n]); name != "" {
+			t.Fatalf("parseServerName() = %q, %v with %d of %d bytes", name, err, n, len(hello))
+		}
+	}
+	serverHello := append([]byte{0x02}, hello[1:]...)
+	if _, err := parseServerName(serverHello); !errors.Is(err, errNotClientHello) {
+		t.Errorf("parseServerName() = %v on a ServerHello, want %v", err, errNotClientHello)
+	}
+}
+
+func TestPeekServerName(t *testing.T) {
+	hello := clientHello(t, "a.test")
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"ClientHello", hello, "a.test"},
+		{"not TLS", []byte("GET / HTTP/1.1\r\n\r\n"), ""},
+		{"SSLv2", []byte{0x80, 0x2e, 0x01, 0x03, 0x01}, ""},
+		{"malformed ClientHello", tlsRecord([]byte{0x01, 0x00, 0x00, 0x02, 0x03, 0x03}), ""},
+		{"split across records", append(tlsRecord(hello[5:100]), tlsRecord(hello[100:])...), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReaderSize(bytes.NewReader(test.data), routeBufSize)
+			name, err := peekServerName(reader)
+			if err != nil || name != test.want {
+				t.Errorf("peekServerName() = %q, %v, want %q", name, err, test.want)
+			}
+			// The bytes are peeked, not consumed
+			if peeked, _ := io.ReadAll(reader); !bytes.Equal(peeked, test.data) {
+				t.Errorf("read %q after peeking, want %q", peeked, test.data)
+			}
+		})
+	}
+	// A client closing in the middle of the record can't be routed
+	reader := bufio.NewReader(bytes.NewReader(hello[:20]))
+	if _, err := peekServerName(reader); err == nil {
+		t.Error("peekServerName() succeeded on a truncated record")
+	}
+}
+
+func TestSNIRoutes(t *testing.T) {
+	routes := map[string]string{
+		"a.test":      startTagged(t, "a"),
+		"*.wild.test": startTagged(t, "wild"),
+		"*.test":      startTagged(t, "test"),
+	}
+	_, addr := startRealm(t, startTagged(t, "default"), WithSNIRoutes(routes))
+	hello := clientHello(t, "x.wild.test")
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"exact name", clientHello(t, "a.test"), "a"},
+		{"longest wildcard", hello, "wild"},
+		{"case", clientHello(t, "X.Wild.TEST"), "wild"},
+		{"shorter wildcard", clientHello(t, "b.test"), "test"},
+		{"unknown name", clientHello(t, "example.com"), "default"},
+		{"no SNI", clientHello(t, ""), "default"},
+		{"not TLS", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "default"},
+		{"malformed ClientHello", tlsRecord([]byte{0x01, 0x00, 0x00, 0x02, 0x03, 0x03}), "default"},
+		{"split across records", append(tlsRecord(hello[5:100]), tlsRecord(hello[100:])...), "default"},
+		// What follows the ClientHello is forwarded after it
+		{"more data", append(append([]byte{}, hello...), "rest"...), "wild"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := routedTo(t, addr, test.data); got != test.want {
+				t.Errorf("routed to %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSNIRoutesHandshake(t *testing.T) {
+	// TLS isn't terminated, so the client completes its handshake with the
+	// backend the route leads to
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	routes := map[string]string{"secure.test": backend.Listener.Addr().String()}
+	_, addr := startRealm(t, startTagged(t, "default"), WithSNIRoutes(routes))
+	conn := tls.Client(dialRealm(t, addr), &tls.Config{ServerName: "secure.test", InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().PeerCertificates[0].Equal(backend.Certificate()) {
+		t.Error("the handshake wasn't with the backend")
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: secure.test\r\nConnection: close\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if body, _ := io.ReadAll(response.Body); string(body) != "backend" {
+		t.Errorf("got %q from the backend", body)
+	}
+}
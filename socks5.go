@@ -0,0 +1,211 @@
+package tcpf
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// Constants of the SOCKS5 protocol, see RFC 1928 and RFC 1929
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoAccept   = 0xFF
+	socks5PasswordVer    = 0x01
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5Succeeded      = 0x00
+	socks5GeneralFailure = 0x01
+	socks5NotAllowed     = 0x02
+	socks5HostUnreach    = 0x04
+	socks5ConnRefused    = 0x05
+	socks5CmdUnsupported = 0x07
+	socks5AddrUnsupport  = 0x08
+)
+
+// socks5Server negotiates the destination of a connection as a SOCKS5 server
+// supporting the CONNECT command, with either no authentication or
+// username/password authentication when credentials are configured
+type socks5Server struct {
+	credentials map[string]string
+}
+
+// socks5Error is a failure of the SOCKS5 negotiation which the client has to
+// be told about with the given reply code
+type socks5Error struct {
+	code byte
+	msg  string
+}
+
+func (err *socks5Error) Error() string {
+	return err.msg
+}
+
+func (server *socks5Server) String() string {
+	return "SOCKS5"
+}
+
+func (server *socks5Server) destination(conn net.Conn) (string, net.Conn, error) {
+	address, err := server.request(conn)
+	return address, conn, err
+}
+
+// request authenticates the client and reads the address of its CONNECT request
+func (server *socks5Server) request(conn net.Conn) (string, error) {
+	if err := server.authenticate(conn); err != nil {
+		return "", err
+	}
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", fmt.Errorf("can't read SOCKS5 request: %v", err)
+	}
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("can't read SOCKS5 request: %v", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		domain, err := readSOCKS5String(conn)
+		if err != nil {
+			return "", fmt.Errorf("can't read SOCKS5 request: %v", err)
+		}
+		host = domain
+	default:
+		return "", server.fail(conn, &socks5Error{socks5AddrUnsupport, fmt.Sprintf("unsupported SOCKS5 address type %d", request[3])})
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("can't read SOCKS5 request: %v", err)
+	}
+	if request[1] != socks5CmdConnect {
+		return "", server.fail(conn, &socks5Error{socks5CmdUnsupported, fmt.Sprintf("unsupported SOCKS5 command %d", request[1])})
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// authenticate reads the client's greeting and performs the authentication
+// method selected for it
+func (server *socks5Server) authenticate(conn net.Conn) error {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return fmt.Errorf("can't read SOCKS5 greeting: %v", err)
+	}
+	if greeting[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("can't read SOCKS5 greeting: %v", err)
+	}
+	method := byte(socks5AuthNone)
+	if len(server.credentials) > 0 {
+		method = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return errors.New("client offered no acceptable SOCKS5 authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthNone {
+		return nil
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return fmt.Errorf("can't read SOCKS5 credentials: %v", err)
+	}
+	if version[0] != socks5PasswordVer {
+		return fmt.Errorf("unsupported SOCKS5 authentication version %d", version[0])
+	}
+	username, err := readSOCKS5String(conn)
+	if err != nil {
+		return fmt.Errorf("can't read SOCKS5 credentials: %v", err)
+	}
+	password, err := readSOCKS5String(conn)
+	if err != nil {
+		return fmt.Errorf("can't read SOCKS5 credentials: %v", err)
+	}
+	expected, ok := server.credentials[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		conn.Write([]byte{socks5PasswordVer, 0x01})
+		return fmt.Errorf("SOCKS5 authentication failed for user %q", username)
+	}
+	_, err = conn.Write([]byte{socks5PasswordVer, 0x00})
+	return err
+}
+
+func (server *socks5Server) reply(conn net.Conn, outbound net.Conn, err error) error {
+	if err != nil {
+		code := byte(socks5HostUnreach)
+		var serr *socks5Error
+		if errors.As(err, &serr) {
+			code = serr.code
+		} else if errors.Is(err, errTargetNotAllowed) {
+			code = socks5NotAllowed
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			code = socks5ConnRefused
+		}
+		return writeSOCKS5Reply(conn, code, nil)
+	}
+	return writeSOCKS5Reply(conn, socks5Succeeded, outbound.LocalAddr())
+}
+
+// fail replies to the client with the SOCKS5 error and returns it
+func (server *socks5Server) fail(conn net.Conn, err *socks5Error) error {
+	writeSOCKS5Reply(conn, err.code, nil)
+	return err
+}
+
+func readSOCKS5String(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	value := make([]byte, length[0])
+	if _, err := io.ReadFull(r, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// writeSOCKS5Reply writes a reply with the given code and bound address,
+// which is reported as 0.0.0.0:0 when unknown
+func writeSOCKS5Reply(w io.Writer, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	reply := []byte{socks5Version, code, 0x00, socks5AddrIPv4}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, ip4...)
+	} else {
+		reply[3] = socks5AddrIPv6
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
@@ -0,0 +1,196 @@
+package tcpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startSOCKS5 starts a realm acting as a SOCKS5 server and returns its address
+func startSOCKS5(t *testing.T, opts ...Option) string {
+	t.Helper()
+	// The destination of the realm is never dialed
+	_, addr := startRealm(t, closedPort(t), opts...)
+	return addr
+}
+
+// converse writes msg to conn and reads a reply as long as want, failing the
+// test unless it is want
+func converse(t *testing.T, conn net.Conn, msg []byte, want []byte) {
+	t.Helper()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("reading the reply to % x: %v", msg, err)
+	}
+	if !bytes.Equal(reply, want) {
+		t.Fatalf("replied % x to % x, want % x", reply, msg, want)
+	}
+}
+
+// socks5Request encodes a request of the command to the address, given as an
+// address type and its bytes
+func socks5Request(command byte, addrType byte, addr []byte, port int) []byte {
+	request := []byte{socks5Version, command, 0x00, addrType}
+	if addrType == socks5AddrDomain {
+		request = append(request, byte(len(addr)))
+	}
+	request = append(request, addr...)
+	return binary.BigEndian.AppendUint16(request, uint16(port))
+}
+
+// readSOCKS5Reply reads a reply to a request and returns its code
+func readSOCKS5Reply(t *testing.T, conn net.Conn) byte {
+	t.Helper()
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	if reply[0] != socks5Version || reply[2] != 0 {
+		t.Fatalf("malformed reply % x", reply)
+	}
+	bound := net.IPv4len
+	if reply[3] == socks5AddrIPv6 {
+		bound = net.IPv6len
+	} else if reply[3] != socks5AddrIPv4 {
+		t.Fatalf("reply of address type %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, bound+2)); err != nil {
+		t.Fatalf("reading the bound address: %v", err)
+	}
+	return reply[1]
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	proxy := startSOCKS5(t, WithSOCKS5(nil))
+	_, portName, _ := net.SplitHostPort(startEcho(t))
+	port, _ := strconv.Atoi(portName)
+	tests := []struct {
+		name     string
+		addrType byte
+		addr     []byte
+		port     int
+	}{
+		{"IPv4", socks5AddrIPv4, net.IPv4(127, 0, 0, 1).To4(), port},
+		{"domain", socks5AddrDomain, []byte("localhost"), port},
+	}
+	if listener, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+		tests = append(tests, struct {
+			name     string
+			addrType byte
+			addr     []byte
+			port     int
+		}{"IPv6", socks5AddrIPv6, net.IPv6loopback, listener.Addr().(*net.TCPAddr).Port})
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialRealm(t, proxy)
+			// The client offers two methods, the server picks no
+			// authentication
+			converse(t, conn, []byte{socks5Version, 2, socks5AuthPassword, socks5AuthNone}, []byte{socks5Version, socks5AuthNone})
+			conn.Write(socks5Request(socks5CmdConnect, test.addrType, test.addr, test.port))
+			if code := readSOCKS5Reply(t, conn); code != socks5Succeeded {
+				t.Fatalf("reply code %d", code)
+			}
+			converse(t, conn, []byte("through SOCKS5"), []byte("through SOCKS5"))
+		})
+	}
+}
+
+func TestSOCKS5Password(t *testing.T) {
+	proxy := startSOCKS5(t, WithSOCKS5(map[string]string{"user": "secret"}))
+	echo := startEcho(t)
+	_, portName, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(portName)
+	auth := func(password string) []byte {
+		msg := []byte{socks5PasswordVer, 4}
+		msg = append(msg, "user"...)
+		msg = append(msg, byte(len(password)))
+		return append(msg, password...)
+	}
+
+	conn := dialRealm(t, proxy)
+	converse(t, conn, []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}, []byte{socks5Version, socks5AuthPassword})
+	converse(t, conn, auth("secret"), []byte{socks5PasswordVer, 0x00})
+	conn.Write(socks5Request(socks5CmdConnect, socks5AddrIPv4, net.IPv4(127, 0, 0, 1).To4(), port))
+	if code := readSOCKS5Reply(t, conn); code != socks5Succeeded {
+		t.Fatalf("reply code %d", code)
+	}
+	converse(t, conn, []byte("authenticated"), []byte("authenticated"))
+
+	// A wrong password fails and closes the connection
+	conn = dialRealm(t, proxy)
+	converse(t, conn, []byte{socks5Version, 1, socks5AuthPassword}, []byte{socks5Version, socks5AuthPassword})
+	converse(t, conn, auth("wrong"), []byte{socks5PasswordVer, 0x01})
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes after failing to authenticate", n)
+	}
+
+	// A client not offering to authenticate is told no method is acceptable
+	conn = dialRealm(t, proxy)
+	converse(t, conn, []byte{socks5Version, 1, socks5AuthNone}, []byte{socks5Version, socks5AuthNoAccept})
+}
+
+func TestSOCKS5Failures(t *testing.T) {
+	denied, _ := ParsePortRanges("1-1023")
+	proxy := startSOCKS5(t, WithSOCKS5(nil), WithDenyPorts(denied), WithDialTimeout(time.Second))
+	_, closedPortName, _ := net.SplitHostPort(closedPort(t))
+	closed, _ := strconv.Atoi(closedPortName)
+	localhost := net.IPv4(127, 0, 0, 1).To4()
+	tests := []struct {
+		name    string
+		request []byte
+		code    byte
+	}{
+		{"BIND", socks5Request(0x02, socks5AddrIPv4, localhost, closed), socks5CmdUnsupported},
+		{"UDP ASSOCIATE", socks5Request(0x03, socks5AddrIPv4, localhost, closed), socks5CmdUnsupported},
+		{"address type", socks5Request(socks5CmdConnect, 0x05, localhost, closed), socks5AddrUnsupport},
+		{"refused", socks5Request(socks5CmdConnect, socks5AddrIPv4, localhost, closed), socks5ConnRefused},
+		{"port denied", socks5Request(socks5CmdConnect, socks5AddrIPv4, localhost, 22), socks5NotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialRealm(t, proxy)
+			converse(t, conn, []byte{socks5Version, 1, socks5AuthNone}, []byte{socks5Version, socks5AuthNone})
+			conn.Write(test.request)
+			if code := readSOCKS5Reply(t, conn); code != test.code {
+				t.Errorf("reply code %d, want %d", code, test.code)
+			}
+			if n, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Errorf("read %d bytes after a failed request", n)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Malformed(t *testing.T) {
+	proxy := startSOCKS5(t, WithSOCKS5(nil))
+	for _, greeting := range [][]byte{{0x04, 1, 0}, {socks5Version, 0}} {
+		conn := dialRealm(t, proxy)
+		conn.Write(greeting)
+		// Either no method is acceptable, or the connection is closed
+		reply, _ := io.ReadAll(conn)
+		if len(reply) > 0 && !bytes.Equal(reply, []byte{socks5Version, socks5AuthNoAccept}) {
+			t.Errorf("replied % x to the greeting % x", reply, greeting)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package tcpf
+
+import "net"
+
+// splice copies from src to dst inside the kernel with splice(2) when both
+// are plain TCP connections, which net.TCPConn.ReadFrom does on Linux; it
+// returns the number of bytes copied and whether it did the copy
+func splice(dst net.Conn, src net.Conn) (int64, bool, error) {
+	d, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	s, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := d.ReadFrom(s)
+	return n, true, err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tcpf
+
+import "net"
+
+// splice is only available on Linux, elsewhere tunnels copy through buffers
+func splice(dst net.Conn, src net.Conn) (int64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,141 @@
+package tcpf
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errorKind is the kind of the errors counted in Stats.Errors
+type errorKind int
+
+const (
+	// Failed dials of the destinations, and their TLS handshakes
+	dialError errorKind = iota
+	tlsError
+	// Errors reading from or writing to either side of a tunnel, other than
+	// timeouts
+	readError
+	writeError
+	timeoutError
+	middlewareError
+	errorKinds
+)
+
+var errorKindNames = [errorKinds]string{"dial", "tls", "read", "write", "timeout", "middleware"}
+
+func (kind errorKind) String() string {
+	return errorKindNames[kind]
+}
+
+// counters are the totals of a TunnelRealm since it was created
+type counters struct {
+	tunnelsTotal atomic.Int64
+	// Bytes forwarded from clients to destinations, and back
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	dialErrors atomic.Int64
+	errors     [errorKinds]atomic.Int64
+	// Lifetimes of the tunnels closed, and the bytes they forwarded in each
+	// direction
+	durations *histogram
+	tunnelIn  *histogram
+	tunnelOut *histogram
+}
+
+// Stats are the statistics of a TunnelRealm
+type Stats struct {
+	// Number of tunnels currently open
+	ActiveTunnels int
+	// Number of tunnels opened since the realm was created
+	TunnelsTotal int64
+	// Bytes forwarded from clients to destinations, and back; bytes of the
+	// tunnels spliced inside the kernel are counted when they close
+	BytesIn  int64
+	BytesOut int64
+	// Number of failed attempts to dial a destination
+	DialErrors int64
+	// Number of errors by kind: dial, tls (handshakes with clients and
+	// destinations), read, write, timeout (of reads and writes) and
+	// middleware
+	Errors map[string]int64
+	// Distributions of the lifetimes of the tunnels closed, in seconds, and
+	// of the bytes they forwarded in each direction
+	Durations      Histogram
+	TunnelBytesIn  Histogram
+	TunnelBytesOut Histogram
+	// Whether new connections are refused, with Pause
+	Paused bool
+	// Summaries of the tunnels currently open
+	Tunnels []TunnelInfo
+}
+
+// TunnelInfo is a summary of a tunnel of a TunnelRealm
+type TunnelInfo struct {
+	ID       string
+	Src      string
+	Dst      string
+	BytesIn  int64
+	BytesOut int64
+	Age      time.Duration
+}
+
+// info returns the summary of the tunnel
+func (tunnel *TCPTunnel) info() TunnelInfo {
+	return TunnelInfo{
+		ID:       tunnel.id,
+		Src:      (*tunnel.inbound).RemoteAddr().String(),
+		Dst:      (*tunnel.outbound).RemoteAddr().String(),
+		BytesIn:  tunnel.bytesIn.Load(),
+		BytesOut: tunnel.bytesOut.Load(),
+		Age:      tunnel.age(),
+	}
+}
+
+// Tunnels returns the summaries of the tunnels currently open in the realm
+func (realm *TunnelRealm) Tunnels() []TunnelInfo {
+	tunnels := realm.snapshot()
+	infos := make([]TunnelInfo, len(tunnels))
+	for i, tunnel := range tunnels {
+		infos[i] = tunnel.info()
+	}
+	return infos
+}
+
+// Stats returns the statistics of the realm
+func (realm *TunnelRealm) Stats() Stats {
+	tunnels := realm.Tunnels()
+	return Stats{
+		ActiveTunnels:  len(tunnels),
+		TunnelsTotal:   realm.counters.tunnelsTotal.Load(),
+		BytesIn:        realm.counters.bytesIn.Load(),
+		BytesOut:       realm.counters.bytesOut.Load(),
+		DialErrors:     realm.counters.dialErrors.Load(),
+		Errors:         realm.counters.errorCounts(),
+		Durations:      realm.counters.durations.snapshot(),
+		TunnelBytesIn:  realm.counters.tunnelIn.snapshot(),
+		TunnelBytesOut: realm.counters.tunnelOut.snapshot(),
+		Paused:         realm.paused.Load(),
+		Tunnels:        tunnels,
+	}
+}
+
+// dialFailed counts a failed attempt to dial a destination, as a TLS error if
+// the handshake with the destination failed
+func (c *counters) dialFailed(err error) {
+	c.dialErrors.Add(1)
+	if errors.Is(err, errTLSHandshake) {
+		c.errors[tlsError].Add(1)
+	} else {
+		c.errors[dialError].Add(1)
+	}
+}
+
+// errorCounts returns the numbers of errors by the name of their kind
+func (c *counters) errorCounts() map[string]int64 {
+	counts := make(map[string]int64, errorKinds)
+	for kind := errorKind(0); kind < errorKinds; kind++ {
+		counts[kind.String()] = c.errors[kind].Load()
+	}
+	return counts
+}
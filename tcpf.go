@@ -1,23 +1,20 @@
-package main
+// Package tcpf implements a simple TCP port forwarder: a TunnelRealm listens
+// to TCP traffic on a locally bound port and redirects all the traffic to a
+// remote TCP endpoint both ways.
+package tcpf
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
-	"os"
+	"runtime"
 	"strconv"
-)
-
-const (
-	// Default socket read buffer size
-	readBufSize = 1024
-)
-
-var (
-	// Generator of IDs for tunnels
-	id = 0
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // TunnelRealm describes the common properties of TCP tunnels, such as:
@@ -29,12 +26,79 @@ type TunnelRealm struct {
 	bindPort string
 	dstHost  string
 	dstPort  string
+	options
+	// Destinations dstHost resolves to
+	destinations *balancer
+	counters     counters
+	// Limits of the bytes per second all tunnels forward in each direction
+	totalLimitIn  *tokenBucket
+	totalLimitOut *tokenBucket
+	// Connections dialed ahead of the tunnels, with WithPool
+	pool *connPool
+	// Session the tunnels are multiplexed over, with WithMux
+	mux *muxClient
+	// Addresses of the destination hosts, with WithResolveTTL
+	dnsCache *dnsCache
+	// Limit of the new tunnels per second
+	connLimit *tokenBucket
+	// Set while new connections are refused, with Pause
+	paused atomic.Bool
+	// Copy buffers of closed tunnels of each direction, reused by the new ones
+	bufPools [2]sync.Pool
 	tunnels  map[string]*TCPTunnel
-	joining  chan net.Conn
+	// Guards tunnels, which is modified from the realm's and tunnels' goroutines
+	tunnelsLock sync.RWMutex
+	// Number of tunnels of every client IP, with WithMaxConnsPerIP
+	connsPerIP ipCounts
+	// Number of admitted connections, either tunnels or about to become ones
+	conns     atomic.Int64
+	joining   chan net.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners []net.Listener
+	// Cleared once the listeners are closed
+	listening bool
+	// Set while Start binds the listeners, which may unlock mutex to retry
+	starting  bool
+	acceptErr error
+	mutex     sync.Mutex
+	stop      sync.Once
+	// Goroutines of the realm itself and of its tunnels
+	running     sync.WaitGroup
+	tunnelsLive sync.WaitGroup
+}
+
+const (
+	// Bounds of the delay before retrying a temporarily failed Accept
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+	// Bounds of the delay before retrying a failed bind, with WithBindRetry
+	minBindDelay = 100 * time.Millisecond
+	maxBindDelay = 5 * time.Second
+	// How often Shutdown checks whether all the tunnels have finished
+	drainPollInterval = 50 * time.Millisecond
+)
+
+var (
+	errRealmStarted = errors.New("tcpf: realm is already started")
+	errRealmStopped = errors.New("tcpf: realm is stopped")
+)
+
+// NewTunnelRealm creates a new TunnelRealm with given bind IP:port and destination IP:port.
+// The bind IP may be a comma separated list of addresses, each of which gets
+// a listener of its own, and the bind port a range of ports first-last: a
+// connection accepted on the port first+N is forwarded to the destination
+// port+N (or to first+N of a destination port range).
+// The destination host may be a comma separated list of hosts, which new
+// tunnels are distributed across round-robin (or as set with WithBalance);
+// a host given as host=weight gets a proportional share of them.
+func NewTunnelRealm(bindIF string, bindPort string, dstHost string, dstPort string, opts ...Option) *TunnelRealm {
+	return NewTunnelRealmContext(context.Background(), bindIF, bindPort, dstHost, dstPort, opts...)
 }
 
-// NewTunnelRealm creates a new TunnelRealm with given bind IP:port and destination IP:port
-func NewTunnelRealm(bindIF string, bindPort string, dstHost string, dstPort string) *TunnelRealm {
+// NewTunnelRealmContext creates a new TunnelRealm like NewTunnelRealm does.
+// Cancelling ctx stops the realm the same way Stop does.
+func NewTunnelRealmContext(ctx context.Context, bindIF string, bindPort string, dstHost string, dstPort string, opts ...Option) *TunnelRealm {
 	realm := &TunnelRealm{
 		tunnels:  make(map[string]*TCPTunnel),
 		joining:  make(chan net.Conn),
@@ -42,163 +106,656 @@ func NewTunnelRealm(bindIF string, bindPort string, dstHost string, dstPort stri
 		bindPort: bindPort,
 		dstHost:  dstHost,
 		dstPort:  dstPort,
+		options:  newOptions(opts),
+	}
+	if first, _, ok := ParsePortRange(dstPort); ok {
+		dstPort = strconv.Itoa(first)
+	}
+	realm.destinations = splitDestinations(dstHost, dstPort, realm.balance)
+	realm.totalLimitIn = newTokenBucket(realm.totalRateLimit)
+	realm.totalLimitOut = newTokenBucket(realm.totalRateLimit)
+	realm.connLimit = newTokenBucket(int64(realm.connRate))
+	realm.counters.durations = newHistogram(durationBounds(realm.durationBuckets))
+	realm.counters.tunnelIn = newHistogram(byteBounds(realm.byteBuckets))
+	realm.counters.tunnelOut = newHistogram(byteBounds(realm.byteBuckets))
+	if realm.options.mux != "" {
+		realm.mux = &muxClient{address: realm.options.mux}
+	}
+	if realm.poolSize > 0 || realm.prewarmConns > 0 {
+		if realm.sendProxy {
+			logEvent(LevelWarn, "config", Fields{"realm": realm}, "Connection pool is disabled: PROXY headers can't be sent over pooled connections")
+		} else if realm.mux != nil {
+			logEvent(LevelWarn, "config", Fields{"realm": realm}, "Connection pool is disabled: tunnels are multiplexed to %v", realm.mux.address)
+		} else if realm.transparent {
+			logEvent(LevelWarn, "config", Fields{"realm": realm}, "Connection pool is disabled: pooled connections can't be dialed from the addresses of the clients")
+		} else {
+			realm.pool = newConnPool(max(realm.poolSize, realm.prewarmConns), realm.poolLifetime)
+		}
+	}
+	if realm.dscp > 0 && !dscpSupported {
+		logEvent(LevelWarn, "config", Fields{"realm": realm}, "DSCP marking is not supported on %v and is disabled", runtime.GOOS)
+	}
+	if realm.resolveTTL > 0 {
+		realm.dnsCache = newDNSCache(realm.resolveTTL, realm.resolver)
 	}
-	realm.listen()
+	for _, direction := range []Direction{DirectionIn, DirectionOut} {
+		size := realm.bufferSize(direction)
+		realm.bufPools[direction].New = func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+	realm.ctx, realm.cancel = context.WithCancel(ctx)
 	return realm
 }
 
 func (realm *TunnelRealm) listen() {
-	go func() {
-		for {
-			select {
-			case conn := <-realm.joining:
-				realm.join(conn)
+	defer realm.running.Done()
+	for {
+		select {
+		case conn := <-realm.joining:
+			if !realm.admit(conn) {
+				conn.Close()
+				continue
 			}
+			// Joining may take a while (PROXY header, dialing the destination),
+			// so it doesn't hold up the other connections
+			realm.tunnelsLive.Add(1)
+			go realm.join(conn)
+		case <-realm.ctx.Done():
+			return
 		}
-	}()
+	}
 }
 
-func (realm *TunnelRealm) listTunnels() {
-	log.Printf("The realm has the following tunnels: [%v]", realm.tunnels)
+func (realm *TunnelRealm) String() string {
+	if realm.negotiator != nil {
+		return fmt.Sprintf("%v => %v", strings.Join(realm.endpoints(realm.bindPort), ","), realm.negotiator)
+	}
+	if realm.reverse != "" {
+		return fmt.Sprintf("reverse %v => %v", realm.reverse, realm.destinations)
+	}
+	return fmt.Sprintf("%v => %v", strings.Join(realm.endpoints(realm.bindPort), ","), realm.destinations)
 }
 
-func (realm *TunnelRealm) join(conn net.Conn) {
-	tunnel := newTCPTunnel(conn, realm)
-	id := tunnel.id
-	realm.tunnels[id] = tunnel
-	log.Printf("Added tunnel: %v:[%v]", id, tunnel)
-	realm.listTunnels()
+// endpoints returns the endpoints of the port, one per address of bindIF
+func (realm *TunnelRealm) endpoints(port string) []string {
+	var endpoints []string
+	for _, bindIF := range strings.Split(realm.bindIF, ",") {
+		endpoints = append(endpoints, joinEndpoint(strings.TrimSpace(bindIF), port))
+	}
+	return endpoints
 }
 
-func (realm *TunnelRealm) leave(tunnel *TCPTunnel) {
-	log.Printf("Tunnel leaving realm and being closed: [%v]", tunnel)
-	delete(realm.tunnels, tunnel.id)
-	(*tunnel.inbound).Close()
-	(*tunnel.outbound).Close()
-	realm.listTunnels()
+// Start binds the realm's listener to bindIF:bindPort and starts accepting
+// incoming connections on it in the background. An empty bindIF means all
+// interfaces, while bindIF of the form unix:/path/to.sock binds a Unix
+// socket, replacing a socket file no process accepts connections on any more;
+// the file is removed on Stop.
+// A comma separated bindIF binds a listener to every address in it, and a
+// range of ports to every port of the range; Start fails unless all of them
+// can be bound, after retrying for the time set with WithBindRetry.
+// A realm created with WithReverse connects to its control server instead.
+// A realm can only be started once.
+func (realm *TunnelRealm) Start() error {
+	realm.mutex.Lock()
+	defer realm.mutex.Unlock()
+	if realm.ctx.Err() != nil {
+		return errRealmStopped
+	}
+	if realm.listeners != nil || realm.starting {
+		return errRealmStarted
+	}
+	if realm.reverse != "" {
+		realm.serve(realm.listenReverse())
+		return nil
+	}
+	realm.starting = true
+	defer func() { realm.starting = false }()
+	var listeners []net.Listener
+	bound := make(map[string]bool)
+	for _, port := range realm.ports() {
+		for _, endpoint := range realm.endpoints(port) {
+			// Unix sockets have no ports, so are bound once
+			if bound[endpoint] {
+				continue
+			}
+			bound[endpoint] = true
+			var serverSock net.Listener
+			err := retryBind(realm.ctx, &realm.mutex, realm.bindRetry, realm, endpoint, func() (err error) {
+				serverSock, err = realm.bind(endpoint)
+				return err
+			})
+			if err != nil {
+				for _, listener := range listeners {
+					listener.Close()
+				}
+				return err
+			}
+			listeners = append(listeners, serverSock)
+		}
+	}
+	realm.serve(listeners...)
+	return nil
 }
 
-// TCPTunnel contains connection properties of a TCP tunnel:
-// * inbound and outbound socket connections
-// * channels for exchanging streams of bytes between inbound/outbound sockets
-// * pointer to the realm (TunnelRealm)
-type TCPTunnel struct {
-	id       string
-	local    chan []byte
-	remote   chan []byte
-	inbound  *net.Conn
-	outbound *net.Conn
-	realm    *TunnelRealm
+// bind creates the listener of an endpoint returned by joinEndpoint
+func (realm *TunnelRealm) bind(endpoint string) (net.Listener, error) {
+	network, address := splitEndpoint(endpoint)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	var config net.ListenConfig
+	if network != "unix" {
+		config.Control = realm.listenControl()
+	}
+	// Closing a Unix listener also removes its socket file
+	listener, err := config.Listen(context.Background(), network, address)
+	if err != nil || realm.backlog == 0 {
+		return listener, err
+	}
+	if max := maxBacklog(); max > 0 && realm.backlog > max {
+		logEvent(LevelWarn, "config", Fields{"realm": realm, "backlog": realm.backlog}, "Listen backlog %d is capped at %d by net.core.somaxconn", realm.backlog, max)
+	}
+	raw, err := listener.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	}).SyscallConn()
+	if err == nil {
+		err = setBacklog(raw, realm.backlog)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("can't set the listen backlog of %v: %w", endpoint, err)
+	}
+	return listener, nil
 }
 
-func generateID() string {
-	id++
-	return strconv.Itoa(id)
+// retryBind calls bind until it succeeds or, with WithBindRetry, retry has
+// passed, waiting longer and longer in between. mutex, held by Start, is
+// unlocked while waiting, so that the realm can be stopped meanwhile.
+func retryBind(ctx context.Context, mutex *sync.Mutex, retry time.Duration, realm fmt.Stringer, endpoint string, bind func() error) error {
+	err := bind()
+	if err == nil || retry <= 0 {
+		return err
+	}
+	deadline := time.Now().Add(retry)
+	for delay := minBindDelay; ; delay = min(2*delay, maxBindDelay) {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("can't bind %v within %v: %w", endpoint, retry, err)
+		}
+		wait := min(delay, left.Round(time.Millisecond))
+		logEvent(LevelWarn, "bind_retry", Fields{"realm": realm, "endpoint": endpoint, "error": err}, "Can't bind %v: %v; retrying in %v", endpoint, err, wait)
+		timer := time.NewTimer(wait)
+		mutex.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+		mutex.Lock()
+		if ctx.Err() != nil {
+			return errRealmStopped
+		}
+		if err = bind(); err == nil {
+			logEvent(LevelInfo, "bind", Fields{"realm": realm, "endpoint": endpoint}, "Bound %v after retrying", endpoint)
+			return nil
+		}
+	}
 }
 
-func newTCPTunnel(conn net.Conn, realm *TunnelRealm) *TCPTunnel {
-	address := realm.dstHost + ":" + realm.dstPort
-	outbound, err := net.Dial("tcp", address)
-	if err != nil {
-		log.Printf("Destination address is not available: %v. Error: %v", address, err)
-		os.Exit(1)
+// listenControl returns the function setting the socket options of the
+// realm's TCP listeners, or nil if there are none to set
+func (realm *TunnelRealm) listenControl() func(network, address string, c syscall.RawConn) error {
+	if !realm.reusePort && !realm.transparent {
+		return nil
 	}
-	tunnel := &TCPTunnel{
-		id:       generateID(),
-		local:    make(chan []byte),
-		remote:   make(chan []byte),
-		inbound:  &conn,
-		outbound: &outbound,
-		realm:    realm,
+	return func(network, address string, c syscall.RawConn) error {
+		if realm.reusePort {
+			if err := reusePort(network, address, c); err != nil {
+				return err
+			}
+		}
+		if realm.transparent {
+			return transparent(network, address, c)
+		}
+		return nil
 	}
-	tunnel.listen()
-	return tunnel
 }
 
-func (tunnel *TCPTunnel) String() string {
-	local := (*tunnel.inbound).RemoteAddr()
-	remote := (*tunnel.outbound).RemoteAddr()
-	return fmt.Sprintf("%v -> %v", local, remote)
+// serve starts accepting connections on the listeners of the started realm,
+// along with the background tasks of the realm
+func (realm *TunnelRealm) serve(listeners ...net.Listener) {
+	if realm.pool != nil && realm.prewarmConns > 0 {
+		realm.prewarm()
+	}
+	realm.listeners, realm.listening = listeners, true
+	realm.running.Add(1 + len(listeners))
+	go realm.listen()
+	for _, serverSock := range listeners {
+		go realm.accept(serverSock)
+	}
+	if realm.idleTimeout > 0 {
+		realm.running.Add(1)
+		go realm.expire()
+	}
+	if realm.healthInterval > 0 {
+		realm.running.Add(1)
+		go realm.check()
+	}
+	if realm.pool != nil {
+		realm.running.Add(1)
+		go realm.fill()
+	}
+	context.AfterFunc(realm.ctx, func() { realm.Stop() })
 }
 
-func (tunnel *TCPTunnel) listen() {
-	go tunnel.readFromInbound()
-	go tunnel.writeToOutbound()
-	go tunnel.readFromOutbound()
-	go tunnel.writeToInbound()
+// Serve starts the realm and blocks until it is stopped. Serve returns nil
+// after Stop, the error which prevented the realm from being started, or the
+// permanent error which made the realm stop accepting connections.
+func (realm *TunnelRealm) Serve() error {
+	if err := realm.Start(); err != nil {
+		return err
+	}
+	<-realm.ctx.Done()
+	realm.Stop()
+	realm.mutex.Lock()
+	defer realm.mutex.Unlock()
+	return realm.acceptErr
 }
 
-func readFromConn(conn *net.Conn, channel *chan []byte) error {
+// accept hands over incoming connections to the realm. Temporary errors
+// (e.g. running out of file descriptors) are retried with an exponential
+// backoff, while a permanent error closes the listener and stops the realm,
+// along with its other listeners.
+func (realm *TunnelRealm) accept(serverSock net.Listener) {
+	defer realm.running.Done()
+	var delay time.Duration
 	for {
-		bytes := make([]byte, readBufSize)
-		n, err := (*conn).Read(bytes)
+		conn, err := serverSock.Accept()
 		if err != nil {
-			return err
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && (ne.Temporary() || ne.Timeout()) {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				logEvent(LevelWarn, "accept_error", Fields{"realm": realm, "error": err}, "Error occured: %v; retrying in %v", err, delay)
+				select {
+				case <-time.After(delay):
+				case <-realm.ctx.Done():
+					return
+				}
+				continue
+			}
+			logEvent(LevelError, "accept_error", Fields{"realm": realm, "error": err}, "Error occured: %v; no longer accepting connections", err)
+			realm.mutex.Lock()
+			realm.acceptErr = err
+			realm.mutex.Unlock()
+			serverSock.Close()
+			realm.cancel()
+			return
+		}
+		delay = 0
+		realm.tune(conn)
+		logEvent(LevelDebug, "accept", Fields{"realm": realm, "src": conn.RemoteAddr()}, "Realm [%v] accepted connection from %v", realm, conn.RemoteAddr())
+		if realm.muxServer {
+			realm.running.Add(1)
+			go realm.serveMux(conn)
+			continue
+		}
+		select {
+		case realm.joining <- conn:
+		case <-realm.ctx.Done():
+			conn.Close()
+			return
 		}
-		*channel <- bytes[:n]
 	}
 }
 
-func writeToConn(conn *net.Conn, channel *chan []byte) error {
-	for {
-		bytes := <-*channel
-		_, err := (*conn).Write(bytes)
-		if err != nil {
-			return err
+// Stop stops accepting new connections, closes all the tunnels of the realm
+// and returns once all of the realm's goroutines have exited. It is safe to
+// call Stop more than once.
+func (realm *TunnelRealm) Stop() error {
+	var err error
+	realm.stop.Do(func() {
+		realm.mutex.Lock()
+		// Cancelling the realm's context cancels the contexts of its tunnels
+		realm.cancel()
+		realm.listening = false
+		for _, listener := range realm.listeners {
+			if closeErr := listener.Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) && err == nil {
+				err = closeErr
+			}
 		}
+		realm.mutex.Unlock()
+		realm.running.Wait()
+		realm.tunnelsLive.Wait()
+	})
+	return err
+}
+
+// StopListening closes the realm's listeners, freeing their addresses for
+// another realm to bind, while the active tunnels keep running until the
+// realm is shut down or stopped
+func (realm *TunnelRealm) StopListening() {
+	realm.mutex.Lock()
+	defer realm.mutex.Unlock()
+	realm.listening = false
+	for _, listener := range realm.listeners {
+		listener.Close()
 	}
 }
 
-func (tunnel *TCPTunnel) closeTunnel() {
-	log.Printf("Connection closed for %v", tunnel)
-	tunnel.realm.leave(tunnel)
+// Pause makes the realm refuse new connections, closing them as soon as they
+// are accepted, while the active tunnels keep running, e.g. for maintenance
+// of the destinations. The realm keeps its listeners, so clients can tell a
+// paused realm from one which isn't running.
+func (realm *TunnelRealm) Pause() {
+	if !realm.paused.Swap(true) {
+		logEvent(LevelInfo, "pause", Fields{"realm": realm}, "Realm [%v] paused, refusing new connections", realm)
+	}
 }
 
-func (tunnel *TCPTunnel) readFromInbound() {
-	err := readFromConn(tunnel.inbound, &tunnel.remote)
-	if err != io.EOF {
-		log.Printf("Error occured: %v", err)
+// Resume makes a paused realm accept new connections again
+func (realm *TunnelRealm) Resume() {
+	if realm.paused.Swap(false) {
+		logEvent(LevelInfo, "resume", Fields{"realm": realm}, "Realm [%v] resumed", realm)
 	}
-	tunnel.closeTunnel()
 }
 
-func (tunnel *TCPTunnel) readFromOutbound() {
-	err := readFromConn(tunnel.outbound, &tunnel.local)
-	if err != io.EOF {
-		log.Printf("Error occured: %v", err)
+// Paused tells whether the realm is paused
+func (realm *TunnelRealm) Paused() bool {
+	return realm.paused.Load()
+}
+
+// Shutdown gracefully stops the realm: it stops accepting new connections and
+// waits for the active tunnels to finish until ctx is done, then stops the
+// realm, closing the tunnels left. Shutdown returns ctx.Err() if some tunnels
+// had to be closed forcibly.
+func (realm *TunnelRealm) Shutdown(ctx context.Context) error {
+	realm.StopListening()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for realm.conns.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logEvent(LevelWarn, "drain_timeout", Fields{"realm": realm, "tunnels": realm.conns.Load()}, "Realm [%v] drain timed out, force closing %d tunnels", realm, realm.conns.Load())
+			realm.Stop()
+			return ctx.Err()
+		}
 	}
-	tunnel.closeTunnel()
+	return realm.Stop()
 }
 
-func (tunnel *TCPTunnel) writeToInbound() {
-	err := writeToConn(tunnel.inbound, &tunnel.local)
-	if err != io.EOF {
-		log.Printf("Error occured: %v", err)
+// Close is equivalent to Stop
+func (realm *TunnelRealm) Close() error {
+	return realm.Stop()
+}
+
+// expire periodically closes the tunnels idle for longer than idleTimeout
+func (realm *TunnelRealm) expire() {
+	defer realm.running.Done()
+	ticker := time.NewTicker(realm.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, tunnel := range realm.snapshot() {
+				if tunnel.idle() > realm.idleTimeout {
+					logEvent(LevelInfo, "idle", tunnel.fields(), "Tunnel idle for longer than %v: [%v]", realm.idleTimeout, tunnel)
+					tunnel.closeTunnel()
+				}
+			}
+		case <-realm.ctx.Done():
+			return
+		}
 	}
-	tunnel.closeTunnel()
 }
 
-func (tunnel *TCPTunnel) writeToOutbound() {
-	err := writeToConn(tunnel.outbound, &tunnel.remote)
-	if err != io.EOF {
-		log.Printf("Error occured: %v", err)
+// snapshot returns the tunnels currently registered in the realm
+func (realm *TunnelRealm) snapshot() []*TCPTunnel {
+	realm.tunnelsLock.RLock()
+	defer realm.tunnelsLock.RUnlock()
+	tunnels := make([]*TCPTunnel, 0, len(realm.tunnels))
+	for _, tunnel := range realm.tunnels {
+		tunnels = append(tunnels, tunnel)
 	}
-	tunnel.closeTunnel()
+	return tunnels
 }
 
-func main() {
-	flag.Parse()
-	bindPort := flag.Arg(0)
-	remoteHost := flag.Arg(1)
-	remotePort := flag.Arg(2)
-	log.Printf("Starting TCPF on port %v => %v:%v...", bindPort, remoteHost, remotePort)
-	realm := NewTunnelRealm("", bindPort, remoteHost, remotePort)
-	serverSock, _ := net.Listen("tcp", "127.0.0.1:"+bindPort)
-	for {
-		conn, err := serverSock.Accept()
+func (realm *TunnelRealm) listTunnels() {
+	realm.tunnelsLock.RLock()
+	defer realm.tunnelsLock.RUnlock()
+	logEvent(LevelDebug, "tunnels", Fields{"realm": realm, "tunnels": len(realm.tunnels)}, "The realm has the following tunnels: [%v]", realm.tunnels)
+}
+
+// admit decides whether an accepted connection may join the realm, reserving
+// a place for its tunnel if so
+func (realm *TunnelRealm) admit(conn net.Conn) bool {
+	if realm.paused.Load() {
+		logEvent(LevelDebug, "refuse", Fields{"realm": realm, "src": conn.RemoteAddr()}, "Refusing connection from %v: realm is paused", conn.RemoteAddr())
+		return false
+	}
+	if realm.maxConns > 0 && realm.conns.Load() >= int64(realm.maxConns) {
+		logEvent(LevelWarn, "refuse", Fields{"realm": realm, "src": conn.RemoteAddr()}, "Refusing connection from %v: realm has reached the limit of %d tunnels", conn.RemoteAddr(), realm.maxConns)
+		return false
+	}
+	if realm.connLimit != nil && !realm.connLimit.allow() {
+		logEvent(LevelWarn, "refuse", Fields{"realm": realm, "src": conn.RemoteAddr()}, "Refusing connection from %v: realm has reached the limit of %d new tunnels per second", conn.RemoteAddr(), realm.connRate)
+		return false
+	}
+	realm.conns.Add(1)
+	return true
+}
+
+// TunnelCount returns the number of currently active tunnels of the realm
+func (realm *TunnelRealm) TunnelCount() int {
+	realm.tunnelsLock.RLock()
+	defer realm.tunnelsLock.RUnlock()
+	return len(realm.tunnels)
+}
+
+// Addrs returns the addresses the listeners of the realm are bound to, e.g.
+// to learn the port of a realm bound to port 0, or nil unless it is listening
+func (realm *TunnelRealm) Addrs() []net.Addr {
+	realm.mutex.Lock()
+	defer realm.mutex.Unlock()
+	if !realm.listening {
+		return nil
+	}
+	addrs := make([]net.Addr, len(realm.listeners))
+	for i, listener := range realm.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
+
+func (realm *TunnelRealm) join(conn net.Conn) {
+	defer realm.tunnelsLive.Done()
+	tunnel := realm.open(conn)
+	if tunnel == nil {
+		realm.conns.Add(-1)
+		return
+	}
+	// The tunnel is registered before it starts forwarding, so that it can't
+	// leave the realm before joining it, nor its subscribers hear of it
+	// leaving first
+	realm.tunnelsLock.Lock()
+	realm.tunnels[tunnel.id] = tunnel
+	realm.publish("join", tunnel)
+	realm.tunnelsLock.Unlock()
+	realm.destinations.acquire(tunnel.address)
+	realm.counters.tunnelsTotal.Add(1)
+	tunnel.listen()
+	if tunnel.clientCN != "" {
+		logEvent(LevelInfo, "join", tunnel.fields(), "Added tunnel: %v:[%v] for client certificate CN=%q", tunnel.id, tunnel, tunnel.clientCN)
+	} else {
+		logEvent(LevelDebug, "join", tunnel.fields(), "Added tunnel: %v:[%v]", tunnel.id, tunnel)
+	}
+	realm.listTunnels()
+}
+
+// open prepares the tunnel for an admitted connection: handles the PROXY
+// header, TLS and the proxy negotiation or routing if enabled, and dials the
+// destination, after the client has sent its first bytes with WithLazyDial.
+// The connection is closed if the tunnel can't be opened.
+func (realm *TunnelRealm) open(conn net.Conn) (tunnel *TCPTunnel) {
+	// Taken before the PROXY header replaces the local address
+	offset := realm.portOffset(conn.LocalAddr())
+	// Mux sessions read the PROXY header and terminate TLS for all their
+	// streams
+	if realm.acceptProxy && !realm.muxServer {
+		proxied, err := readProxyHeaderV2(conn)
+		if err != nil {
+			logEvent(LevelWarn, "proxy_error", Fields{"src": conn.RemoteAddr(), "error": err}, "Malformed PROXY header from %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+		if proxied.RemoteAddr() != conn.RemoteAddr() {
+			logEvent(LevelDebug, "proxied", Fields{"src": proxied.RemoteAddr(), "proxy": conn.RemoteAddr()}, "Connection from %v is proxied for %v", conn.RemoteAddr(), proxied.RemoteAddr())
+		}
+		conn = proxied
+	}
+	if !realm.permitted(conn.RemoteAddr()) {
+		logEvent(LevelWarn, "refuse", Fields{"realm": realm, "src": conn.RemoteAddr()}, "Refusing connection from %v: not allowed by the access lists", conn.RemoteAddr())
+		conn.Close()
+		return nil
+	}
+	if country, ok := realm.permittedCountry(conn.RemoteAddr()); !ok {
+		logEvent(LevelWarn, "refuse", Fields{"realm": realm, "src": conn.RemoteAddr(), "country": country}, "Refusing connection from %v: country %q is not allowed", conn.RemoteAddr(), country)
+		conn.Close()
+		return nil
+	}
+	if !realm.connsPerIP.acquire(conn.RemoteAddr(), realm.maxConnsPerIP) {
+		logEvent(LevelWarn, "refuse", Fields{"realm": realm, "src": conn.RemoteAddr()}, "Refusing connection from %v: the client has reached the limit of %d tunnels", conn.RemoteAddr(), realm.maxConnsPerIP)
+		conn.Close()
+		return nil
+	}
+	client := conn.RemoteAddr()
+	defer func() {
+		if tunnel == nil {
+			realm.connsPerIP.release(client, realm.maxConnsPerIP)
+		}
+	}()
+	var clientCN string
+	if realm.tlsConfig != nil && !realm.muxServer {
+		tlsConn, cn, err := realm.handshakeTLS(conn)
+		if err != nil {
+			logEvent(LevelWarn, "tls_error", Fields{"src": conn.RemoteAddr(), "error": err}, "TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+		conn, clientCN = tlsConn, cn
+	}
+	if realm.decompress {
+		conn = newCompressedConn(conn)
+	}
+	addresses, backup := realm.destinations.candidates(conn.RemoteAddr()), true
+	if realm.negotiator != nil {
+		negotiated, requested, err := negotiate(realm.negotiator, conn)
 		if err != nil {
-			log.Printf("Error occured: %v", err)
+			logEvent(LevelWarn, "negotiate_error", Fields{"src": conn.RemoteAddr(), "error": err}, "Can't negotiate %v destination for %v: %v", realm.negotiator, conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+		target, err := realm.permittedTarget(realm.ctx, negotiated)
+		if err != nil {
+			logEvent(LevelWarn, "refuse", Fields{"realm": realm, "src": conn.RemoteAddr(), "dst": negotiated, "error": err}, "Refusing %v destination %v for %v: %v", realm.negotiator, negotiated, conn.RemoteAddr(), err)
+			realm.negotiator.reply(requested, nil, err)
+			requested.Close()
+			return nil
+		}
+		addresses, backup, conn, offset = []string{target}, false, requested, 0
+	}
+	if realm.router != nil && realm.negotiator == nil {
+		address, routed, err := realm.route(conn)
+		if err != nil {
+			logEvent(LevelDebug, "route_error", Fields{"src": conn.RemoteAddr(), "error": err}, "Can't route connection from %v by %v: %v", conn.RemoteAddr(), realm.router, err)
+			conn.Close()
+			return nil
+		}
+		if address != "" {
+			logEvent(LevelDebug, "route", Fields{"src": conn.RemoteAddr(), "dst": address}, "Routing connection from %v by %v to %v", conn.RemoteAddr(), realm.router, address)
+			addresses = []string{address}
+		}
+		conn = routed
+	}
+	var exchanges *exchanges
+	if (realm.addXFF || realm.accessLog != nil) && realm.negotiator == nil {
+		if realm.accessLog != nil {
+			exchanges = newExchanges(conn, realm.accessLog)
+		}
+		conn = newRequestConn(conn, realm.addXFF, exchanges)
+	}
+	var first []byte
+	if realm.lazyDial && realm.negotiator == nil && realm.router == nil {
+		var err error
+		if first, err = realm.firstData(conn); err != nil {
+			logEvent(LevelDebug, "lazy_close", Fields{"src": conn.RemoteAddr(), "error": err}, "Connection from %v closed before sending any data: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+	}
+	tunnel, err := realm.connect(conn, addresses, backup, offset)
+	if err == nil && exchanges != nil {
+		*tunnel.outbound = newResponseConn(*tunnel.outbound, exchanges)
+	}
+	if err == nil && realm.mirror != "" {
+		tunnel.mirror = realm.openMirror(tunnel)
+	}
+	if err == nil {
+		tunnel.buildChains()
+	}
+	if err == nil && first != nil {
+		chain := middlewareWriter{*tunnel.outbound, tunnel.chains[DirectionIn], DirectionIn}
+		if _, werr := chain.Write(first); werr != nil {
+			err = fmt.Errorf("can't send the first %d bytes to %v: %v", len(first), tunnel.address, werr)
+			tunnel.cancel()
+		} else {
+			tunnel.forwarded(true, int64(len(first)))
 		}
-		realm.joining <- conn
 	}
+	if realm.negotiator != nil {
+		var outbound net.Conn
+		if tunnel != nil {
+			outbound = *tunnel.outbound
+		}
+		if rerr := realm.negotiator.reply(conn, outbound, err); rerr != nil && err == nil {
+			err = fmt.Errorf("can't reply to %v client: %v", realm.negotiator, rerr)
+			tunnel.cancel()
+		}
+	}
+	if err != nil {
+		logEvent(LevelError, "open_error", Fields{"src": conn.RemoteAddr(), "error": err}, "Can't open tunnel for %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil
+	}
+	tunnel.clientCN = clientCN
+	return tunnel
+}
+
+func (realm *TunnelRealm) leave(tunnel *TCPTunnel) {
+	logEvent(LevelInfo, "leave", tunnel.fields(), "Tunnel leaving realm and being closed: [%v]", tunnel)
+	realm.tunnelsLock.Lock()
+	delete(realm.tunnels, tunnel.id)
+	realm.tunnelsLock.Unlock()
+	realm.destinations.release(tunnel.address)
+	realm.connsPerIP.release((*tunnel.inbound).RemoteAddr(), realm.maxConnsPerIP)
+	realm.conns.Add(-1)
+	realm.counters.durations.observe(tunnel.age().Seconds())
+	realm.counters.tunnelIn.observe(float64(tunnel.bytesIn.Load()))
+	realm.counters.tunnelOut.observe(float64(tunnel.bytesOut.Load()))
+	realm.publish("leave", tunnel)
+	tunnel.cancel()
+	(*tunnel.inbound).Close()
+	(*tunnel.outbound).Close()
+	realm.listTunnels()
 }
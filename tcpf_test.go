@@ -0,0 +1,398 @@
+package tcpf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The realms log every tunnel, which would bury the output of the tests
+	SetLogger(NewJSONLogger(io.Discard))
+	os.Exit(m.Run())
+}
+
+// startEcho runs a TCP server on the loopback interface writing back whatever
+// its clients send, and returns its address
+func startEcho(t testing.TB) string {
+	t.Helper()
+	return startServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+}
+
+// startServer runs a TCP server on the loopback interface handling every
+// connection with handle, which closes the connection on return, and returns
+// its address
+func startServer(t testing.TB, handle func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startRealm starts a realm on a free port of the loopback interface
+// forwarding to dst, stopped when the test ends, and returns it with the
+// address it listens on
+func startRealm(t testing.TB, dst string, opts ...Option) (*TunnelRealm, string) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm := NewTunnelRealm("127.0.0.1", "0", host, port, opts...)
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { realm.Stop() })
+	return realm, realmAddr(realm)
+}
+
+// closedPort returns an address of the loopback interface nothing listens on
+func closedPort(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// realmAddr returns the address the first listener of a started realm is
+// bound to
+func realmAddr(realm *TunnelRealm) string {
+	return realm.Addrs()[0].String()
+}
+
+// roundTrip sends msg through a new connection to addr and returns what comes
+// back, failing the test unless it is as long as msg
+func roundTrip(t testing.TB, addr string, msg []byte) []byte {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go conn.Write(msg)
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("reading the reply from %v: %v", addr, err)
+	}
+	return reply
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within a
+// few seconds
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestForward(t *testing.T) {
+	_, addr := startRealm(t, startEcho(t))
+	msg := []byte("hello, tcpf")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+}
+
+func TestBindInterface(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes all of 127.0.0.0/8 to the loopback interface")
+	}
+	dst := startEcho(t)
+	_, addr := startRealm(t, dst)
+	_, port, _ := net.SplitHostPort(addr)
+	// The realm is bound to 127.0.0.1 only, so another loopback address of
+	// the host is refused
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.2", port), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("connected to 127.0.0.2:%v, which the realm isn't bound to", port)
+	}
+
+	// An empty bindIF binds all the interfaces
+	host, dstPort, _ := net.SplitHostPort(dst)
+	realm := NewTunnelRealm("", "0", host, dstPort)
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer realm.Stop()
+	_, port, _ = net.SplitHostPort(realmAddr(realm))
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		msg := []byte("via " + ip)
+		if reply := roundTrip(t, net.JoinHostPort(ip, port), msg); !bytes.Equal(reply, msg) {
+			t.Errorf("got %q back through %v, want %q", reply, ip, msg)
+		}
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	dst := startEcho(t)
+	host, port, _ := net.SplitHostPort(dst)
+	realm := NewTunnelRealm("127.0.0.1", "0", host, port)
+	// Stopping a realm never started does nothing
+	if err := realm.Stop(); err != nil {
+		t.Fatalf("Stop() before Start = %v", err)
+	}
+	if err := realm.Start(); err != errRealmStopped {
+		t.Errorf("Start() after Stop = %v, want %v", err, errRealmStopped)
+	}
+
+	realm = NewTunnelRealm("127.0.0.1", "0", host, port)
+	if addrs := realm.Addrs(); addrs != nil {
+		t.Errorf("realm listens on %v before Start", addrs)
+	}
+	served := make(chan error, 1)
+	go func() { served <- realm.Serve() }()
+	waitFor(t, "the realm to start", func() bool { return realm.Addrs() != nil })
+	if err := realm.Start(); err != errRealmStarted {
+		t.Errorf("Start() of a started realm = %v, want %v", err, errRealmStarted)
+	}
+	addr := realmAddr(realm)
+	conn := dialRealm(t, addr)
+	conn.Write([]byte("open"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop closes the open tunnels and frees the address, and is safe to
+	// call again
+	if err := realm.Stop(); err != nil {
+		t.Errorf("Stop() = %v", err)
+	}
+	if addrs := realm.Addrs(); addrs != nil {
+		t.Errorf("stopped realm listens on %v", addrs)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a tunnel of a stopped realm", n)
+	}
+	if count := realm.TunnelCount(); count != 0 {
+		t.Errorf("stopped realm has %d tunnels", count)
+	}
+	if err := realm.Stop(); err != nil {
+		t.Errorf("second Stop() = %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve() = %v after Stop", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() didn't return after Stop")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("address of the stopped realm is still bound: %v", err)
+	}
+	listener.Close()
+}
+
+func TestRealmContext(t *testing.T) {
+	host, port, _ := net.SplitHostPort(startEcho(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	realm := NewTunnelRealmContext(ctx, "127.0.0.1", "0", host, port)
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialRealm(t, realmAddr(realm))
+	conn.Write([]byte("open"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	// Cancelling the context stops the realm, closing its tunnels, like
+	// Stop
+	cancel()
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a tunnel after cancelling the context", n)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		realm.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the goroutines of the realm didn't exit")
+	}
+	if err := realm.Start(); err != errRealmStopped {
+		t.Errorf("Start() after cancelling = %v, want %v", err, errRealmStopped)
+	}
+
+	// A realm created with a done context doesn't start
+	realm = NewTunnelRealmContext(ctx, "127.0.0.1", "0", host, port)
+	if err := realm.Start(); err != errRealmStopped {
+		t.Errorf("Start() with a done context = %v, want %v", err, errRealmStopped)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	realm, addr := startRealm(t, startEcho(t), WithMaxConns(2))
+	first := dialRealm(t, addr)
+	dialRealm(t, addr)
+	waitFor(t, "the tunnels to open", func() bool { return realm.TunnelCount() == 2 })
+	// The connection over the limit is accepted, then closed right away
+	refused := dialRealm(t, addr)
+	if n, err := refused.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a tunnel over the limit", n)
+	}
+	if count := realm.TunnelCount(); count != 2 {
+		t.Errorf("realm has %d tunnels, want 2", count)
+	}
+	// Closing a tunnel makes room for another one
+	first.Close()
+	waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 1 })
+	msg := []byte("again")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+}
+
+func TestMultipleBinds(t *testing.T) {
+	bindIF := "127.0.0.1,::1"
+	if listener, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		if runtime.GOOS != "linux" {
+			t.Skipf("no IPv6 loopback address: %v", err)
+		}
+		bindIF = "127.0.0.1,127.0.0.2"
+	} else {
+		listener.Close()
+	}
+	host, port, _ := net.SplitHostPort(startEcho(t))
+	realm := NewTunnelRealm(bindIF, "0", host, port)
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer realm.Stop()
+	var addrs []string
+	for _, addr := range realm.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("realm listens on %v, want an address of each of %v", addrs, bindIF)
+	}
+	for _, addr := range addrs {
+		msg := []byte("via " + addr)
+		if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+			t.Errorf("got %q back through %v, want %q", reply, addr, msg)
+		}
+	}
+	// Stopping the realm closes all of its listeners
+	realm.Stop()
+	for _, addr := range addrs {
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			t.Errorf("connected to %v after Stop", addr)
+		}
+	}
+}
+
+func TestBindRetry(t *testing.T) {
+	host, port, _ := net.SplitHostPort(startEcho(t))
+	taken := func(t *testing.T) (net.Listener, string) {
+		t.Helper()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		_, bindPort, _ := net.SplitHostPort(listener.Addr().String())
+		return listener, bindPort
+	}
+
+	t.Run("in use", func(t *testing.T) {
+		_, bindPort := taken(t)
+		realm := NewTunnelRealm("127.0.0.1", bindPort, host, port)
+		defer realm.Stop()
+		if err := realm.Start(); !errors.Is(err, syscall.EADDRINUSE) {
+			t.Fatalf("Start() = %v on a port in use, want an address in use error", err)
+		}
+		// The realm isn't left half started
+		realm.mutex.Lock()
+		defer realm.mutex.Unlock()
+		if realm.listeners != nil || realm.listening {
+			t.Error("realm has listeners after failing to bind")
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		_, bindPort := taken(t)
+		realm := NewTunnelRealm("127.0.0.1", bindPort, host, port, WithBindRetry(250*time.Millisecond))
+		defer realm.Stop()
+		start := time.Now()
+		err := realm.Start()
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			t.Errorf("Start() = %v after retrying, want an address in use error", err)
+		}
+		if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+			t.Errorf("Start() gave up after %v, before the retry time", elapsed)
+		}
+	})
+
+	t.Run("freed", func(t *testing.T) {
+		listener, bindPort := taken(t)
+		realm := NewTunnelRealm("127.0.0.1", bindPort, host, port, WithBindRetry(5*time.Second))
+		defer realm.Stop()
+		// The port is freed while Start waits to retry
+		time.AfterFunc(150*time.Millisecond, func() { listener.Close() })
+		if err := realm.Start(); err != nil {
+			t.Fatalf("Start() = %v once the port was freed", err)
+		}
+		msg := []byte("bound late")
+		if reply := roundTrip(t, net.JoinHostPort("127.0.0.1", bindPort), msg); !bytes.Equal(reply, msg) {
+			t.Errorf("got %q back, want %q", reply, msg)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		_, bindPort := taken(t)
+		realm := NewTunnelRealm("127.0.0.1", bindPort, host, port, WithBindRetry(time.Minute))
+		started := make(chan error, 1)
+		go func() { started <- realm.Start() }()
+		time.Sleep(50 * time.Millisecond)
+		// Stopping the realm ends the retries without waiting for them
+		if err := realm.Stop(); err != nil {
+			t.Errorf("Stop() = %v while retrying", err)
+		}
+		select {
+		case err := <-started:
+			if err != errRealmStopped {
+				t.Errorf("Start() = %v after Stop, want %v", err, errRealmStopped)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Start() kept retrying after Stop")
+		}
+	})
+}
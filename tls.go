@@ -0,0 +1,75 @@
+package tcpf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Time a client has to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// LoadTLSConfig loads the given certificate/key pairs into a tls.Config which
+// can be passed to WithTLS. When several pairs are given, the certificate is
+// selected by the server name (SNI) the client asks for, falling back to the
+// first pair for clients without SNI or asking for an unknown name.
+func LoadTLSConfig(certFiles []string, keyFiles []string) (*tls.Config, error) {
+	if len(certFiles) == 0 || len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("tcpf: got %d TLS certificates and %d keys, expected matching pairs", len(certFiles), len(keyFiles))
+	}
+	certs := make([]tls.Certificate, 0, len(certFiles))
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, fmt.Errorf("tcpf: can't load TLS certificate %v with key %v: %v", certFiles[i], keyFiles[i], err)
+		}
+		certs = append(certs, cert)
+	}
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			for i := range certs {
+				if hello.SupportsCertificate(&certs[i]) == nil {
+					return &certs[i], nil
+				}
+			}
+			return &certs[0], nil
+		},
+	}, nil
+}
+
+// LoadClientCAs loads the PEM encoded CA certificates of caFile into a pool,
+// which can be set as ClientCAs of a tls.Config passed to WithTLS, along
+// with tls.RequireAndVerifyClientCert as its ClientAuth, to only admit the
+// clients with certificates signed by the CAs
+func LoadClientCAs(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("tcpf: can't load client CA certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tcpf: no client CA certificates found in %v", caFile)
+	}
+	return pool, nil
+}
+
+// handshakeTLS terminates TLS on conn, returning the TLS connection and the
+// common name of the client certificate, if the client presented one
+func (realm *TunnelRealm) handshakeTLS(conn net.Conn) (net.Conn, string, error) {
+	tlsConn := tls.Server(conn, realm.tlsConfig)
+	ctx, cancel := context.WithTimeout(realm.ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		realm.counters.errors[tlsError].Add(1)
+		return nil, "", err
+	}
+	var cn string
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		cn = certs[0].Subject.CommonName
+	}
+	return tlsConn, cn, nil
+}
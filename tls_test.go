@@ -0,0 +1,252 @@
+package tcpf
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated for a test, with its key, both also
+// written to PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert generates a certificate for the common name and DNS names,
+// issued by the CA, or a self-signed CA if nil
+func newTestCert(t *testing.T, ca *testCert, cn string, names ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	generated := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	if err := os.WriteFile(generated.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(generated.keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return generated
+}
+
+// pool returns a pool of the certificate alone
+func (cert *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.cert)
+	return pool
+}
+
+// tlsCertificate returns the certificate with its key for a tls.Config
+func (cert *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key, Leaf: cert.cert}
+}
+
+// startRecorder runs an echo destination which also hands every line it
+// reads to the channel
+func startRecorder(t *testing.T) (string, chan string) {
+	t.Helper()
+	lines := make(chan string, 16)
+	addr := startServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+			io.WriteString(conn, line)
+		}
+	})
+	return addr, lines
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	ca := newTestCert(t, nil, "Test CA")
+	a := newTestCert(t, ca, "a.test", "a.test")
+	b := newTestCert(t, ca, "b.test", "b.test", "*.b.test")
+	config, err := LoadTLSConfig([]string{a.certFile, b.certFile}, []string{a.keyFile, b.keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, lines := startRecorder(t)
+	realm, addr := startRealm(t, dst, WithTLS(config))
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"a.test", "a.test"},
+		{"b.test", "b.test"},
+		{"api.b.test", "b.test"},
+		// Unknown names and clients without SNI get the first certificate
+		{"c.test", "a.test"},
+		{"", "a.test"},
+	}
+	for _, test := range tests {
+		t.Run(test.serverName, func(t *testing.T) {
+			conn := tls.Client(dialRealm(t, addr), &tls.Config{ServerName: test.serverName, InsecureSkipVerify: true})
+			if err := conn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != test.want {
+				t.Errorf("got the certificate of %v, want %v", cn, test.want)
+			}
+			// The destination gets the traffic decrypted
+			converse(t, conn, []byte("plaintext\n"), []byte("plaintext\n"))
+			select {
+			case line := <-lines:
+				if line != "plaintext\n" {
+					t.Errorf("destination got %q", line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the destination got nothing")
+			}
+		})
+	}
+	// The certificate verifies against the CA for its names
+	conn := tls.Client(dialRealm(t, addr), &tls.Config{ServerName: "api.b.test", RootCAs: ca.pool()})
+	if err := conn.Handshake(); err != nil {
+		t.Errorf("verifying the certificate of api.b.test: %v", err)
+	}
+
+	// Clients which don't speak TLS are counted as TLS errors
+	plain := dialRealm(t, addr)
+	plain.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	io.ReadAll(plain)
+	waitFor(t, "the TLS error", func() bool { return realm.Stats().Errors["tls"] == 1 })
+
+	failures := []struct {
+		name  string
+		certs []string
+		keys  []string
+	}{
+		{"no certificates", nil, nil},
+		{"missing key", []string{a.certFile, b.certFile}, []string{a.keyFile}},
+		{"mismatched key", []string{a.certFile}, []string{b.keyFile}},
+		{"missing file", []string{filepath.Join(t.TempDir(), "missing.pem")}, []string{a.keyFile}},
+	}
+	for _, test := range failures {
+		if _, err := LoadTLSConfig(test.certs, test.keys); err == nil {
+			t.Errorf("LoadTLSConfig() succeeded with %v", test.name)
+		}
+	}
+}
+
+func TestClientCAs(t *testing.T) {
+	ca := newTestCert(t, nil, "Test CA")
+	server := newTestCert(t, ca, "tcpf.test", "tcpf.test")
+	config, err := LoadTLSConfig([]string{server.certFile}, []string{server.keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientCAs, err = LoadClientCAs(ca.certFile); err != nil {
+		t.Fatal(err)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	dst, lines := startRecorder(t)
+	realm, addr := startRealm(t, dst, WithTLS(config))
+	other := newTestCert(t, nil, "Other CA")
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"no certificate", nil, false},
+		{"signed by another CA", []tls.Certificate{newTestCert(t, other, "intruder").tlsCertificate()}, false},
+		{"self-signed", []tls.Certificate{newTestCert(t, nil, "client").tlsCertificate()}, false},
+		{"signed by the CA", []tls.Certificate{newTestCert(t, ca, "client").tlsCertificate()}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsErrors := realm.Stats().Errors["tls"]
+			conn := tls.Client(dialRealm(t, addr), &tls.Config{ServerName: "tcpf.test", RootCAs: ca.pool(), Certificates: test.certs})
+			// With TLS 1.3 the client learns that its certificate was
+			// refused when it reads
+			err := conn.Handshake()
+			if err == nil {
+				io.WriteString(conn, "hello\n")
+				_, err = bufio.NewReader(conn).ReadString('\n')
+			}
+			if test.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if line := <-lines; line != "hello\n" {
+					t.Errorf("destination got %q", line)
+				}
+				realm.tunnelsLock.RLock()
+				defer realm.tunnelsLock.RUnlock()
+				if len(realm.tunnels) != 1 {
+					t.Fatalf("%d tunnels open, want 1", len(realm.tunnels))
+				}
+				for _, tunnel := range realm.tunnels {
+					if tunnel.clientCN != "client" {
+						t.Errorf("tunnel has the client CN %q, want client", tunnel.clientCN)
+					}
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("the client was admitted")
+			}
+			waitFor(t, "the TLS error", func() bool { return realm.Stats().Errors["tls"] == tlsErrors+1 })
+			select {
+			case line := <-lines:
+				t.Errorf("destination got %q from a refused client", line)
+			default:
+			}
+		})
+	}
+
+	if _, err := LoadClientCAs(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("LoadClientCAs() succeeded with a missing file")
+	}
+	if _, err := LoadClientCAs(ca.keyFile); err == nil {
+		t.Error("LoadClientCAs() succeeded with a file without certificates")
+	}
+}
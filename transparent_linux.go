@@ -0,0 +1,26 @@
+package tcpf
+
+import (
+	"syscall"
+)
+
+// IPV6_TRANSPARENT, which the syscall package doesn't define
+const ipv6Transparent = 0x4b
+
+// transparent sets IP_TRANSPARENT, or IPV6_TRANSPARENT, on the socket: a
+// listener accepts the connections TPROXY diverts to it, whatever address
+// they were sent to, and a dialing socket may bind a source address which
+// isn't local, such as the client's
+func transparent(network, address string, c syscall.RawConn) error {
+	level, option := syscall.IPPROTO_IP, syscall.IP_TRANSPARENT
+	if network == "tcp6" {
+		level, option = syscall.IPPROTO_IPV6, ipv6Transparent
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), level, option, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package tcpf
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// transparent fails, transparent proxying with TPROXY is only available on
+// Linux
+func transparent(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("tcpf: IP_TRANSPARENT is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,375 @@
+package tcpf
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default socket read buffer size
+	readBufSize = 1024
+	// Buffer sizes above this one are likely a mistake
+	maxReasonableBufSize = 1 << 20
+)
+
+// errMaxBytes ends the copies of a tunnel which reached the byte limit of
+// WithMaxBytes
+var errMaxBytes = errors.New("byte limit reached")
+
+// Generator of the numeric IDs for tunnels, shared by all realms
+var lastID int64
+
+// TCPTunnel contains connection properties of a TCP tunnel:
+// * inbound and outbound socket connections
+// * pointer to the realm (TunnelRealm)
+type TCPTunnel struct {
+	id       string
+	inbound  *net.Conn
+	outbound *net.Conn
+	realm    *TunnelRealm
+	// Destination address the tunnel was opened to
+	address string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// Common name of the client's TLS certificate, if it presented one
+	clientCN string
+	// Receives a copy of the bytes from the client, with WithMirror
+	mirror *mirror
+	// Bytes captured in each direction, with WithCapture
+	seqIn  atomic.Uint32
+	seqOut atomic.Uint32
+	// Time the destination accepted the tunnel
+	createdAt time.Time
+	// Time bytes last flowed in either direction
+	lastActive atomic.Int64
+	// Bytes forwarded from the client to the destination, and back
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// Limits of the bytes per second forwarded in each direction: the
+	// tunnel's own and the ones it shares with the realm's other tunnels
+	limitsIn  []*tokenBucket
+	limitsOut []*tokenBucket
+	// Middleware the bytes go through in each direction, see buildChains
+	chains [2][]Middleware
+	// Both copy goroutines close the tunnel, but teardown happens only once
+	closeOnce sync.Once
+	// Copy goroutines still running; the tunnel leaves the realm, with the
+	// final byte counts, only once they have all returned
+	copies sync.WaitGroup
+}
+
+// generateID returns the ID of a new tunnel: the next number, or a random
+// (version 4) UUID with WithUUIDs
+func generateID(uuid bool) string {
+	if !uuid {
+		return strconv.FormatInt(atomic.AddInt64(&lastID, 1), 10)
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// newTCPTunnel dials the destination address, with its port moved by offset,
+// for conn; forwarding traffic between the two starts with listen. The tunnel is closed when ctx is cancelled.
+func newTCPTunnel(ctx context.Context, conn net.Conn, realm *TunnelRealm, address string, offset int) (*TCPTunnel, error) {
+	outbound, err := realm.dial(ctx, shiftPort(address, offset), conn)
+	if err != nil {
+		return nil, err
+	}
+	if realm.compress {
+		outbound = newCompressedConn(outbound)
+	}
+	tunnel := &TCPTunnel{
+		id:        generateID(realm.uuidIDs),
+		inbound:   &conn,
+		outbound:  &outbound,
+		realm:     realm,
+		address:   address,
+		createdAt: time.Now(),
+		limitsIn:  limits(newTokenBucket(realm.rateLimit), realm.totalLimitIn),
+		limitsOut: limits(newTokenBucket(realm.rateLimit), realm.totalLimitOut),
+	}
+	tunnel.touch()
+	tunnel.ctx, tunnel.cancel = context.WithCancel(ctx)
+	context.AfterFunc(tunnel.ctx, func() {
+		conn.Close()
+		outbound.Close()
+	})
+	return tunnel, nil
+}
+
+func (tunnel *TCPTunnel) String() string {
+	local := (*tunnel.inbound).RemoteAddr()
+	remote := (*tunnel.outbound).RemoteAddr()
+	return fmt.Sprintf("%v -> %v (in %d, out %d bytes, open for %v)", local, remote, tunnel.bytesIn.Load(), tunnel.bytesOut.Load(), tunnel.age().Round(time.Millisecond))
+}
+
+// age returns how long the tunnel has been open, as of now
+func (tunnel *TCPTunnel) age() time.Duration {
+	return time.Since(tunnel.createdAt)
+}
+
+// fields returns the details of the tunnel logged with its events
+func (tunnel *TCPTunnel) fields() Fields {
+	fields := Fields{
+		"tunnel_id": tunnel.id,
+		"src":       (*tunnel.inbound).RemoteAddr(),
+		"dst":       (*tunnel.outbound).RemoteAddr(),
+		"bytes":     map[string]int64{"in": tunnel.bytesIn.Load(), "out": tunnel.bytesOut.Load()},
+		"age":       tunnel.age().Seconds(),
+	}
+	if tunnel.clientCN != "" {
+		fields["client_cn"] = tunnel.clientCN
+	}
+	return fields
+}
+
+// BytesIn returns the number of bytes forwarded from the client to the
+// destination so far
+func (tunnel *TCPTunnel) BytesIn() int64 {
+	return tunnel.bytesIn.Load()
+}
+
+// BytesOut returns the number of bytes forwarded from the destination back
+// to the client so far
+func (tunnel *TCPTunnel) BytesOut() int64 {
+	return tunnel.bytesOut.Load()
+}
+
+func (tunnel *TCPTunnel) listen() {
+	tunnel.realm.tunnelsLive.Add(1)
+	tunnel.copies.Add(2)
+	go tunnel.copy(tunnel.outbound, tunnel.inbound, true)
+	go tunnel.copy(tunnel.inbound, tunnel.outbound, false)
+	go tunnel.reap()
+	if lifetime := tunnel.realm.maxLifetime; lifetime > 0 {
+		timer := time.AfterFunc(lifetime-tunnel.age(), func() {
+			logEvent(LevelInfo, "max_lifetime", tunnel.fields().with("max_lifetime", lifetime.String()), "Tunnel open for longer than %v: [%v]", lifetime, tunnel)
+			tunnel.closeTunnel()
+		})
+		context.AfterFunc(tunnel.ctx, func() {
+			timer.Stop()
+		})
+	}
+}
+
+// reap makes the tunnel leave the realm once both copies have returned, so
+// that neither of them uses the connections after leave closes them
+func (tunnel *TCPTunnel) reap() {
+	defer tunnel.realm.tunnelsLive.Done()
+	tunnel.copies.Wait()
+	tunnel.closeTunnel()
+	tunnel.realm.leave(tunnel)
+}
+
+// copy forwards the bytes read from src to dst until either side is closed;
+// in tells the direction the bytes are counted in. When src is done sending,
+// dst is half-closed and the other direction keeps flowing until it is done
+// too, otherwise the tunnel is closed right away.
+//
+// There is no queue between reading and writing: a chunk is written before
+// the next one is read, so a slow dst stops the copy from reading src, and
+// TCP flow control pushes back on the peer sending to src instead of bytes
+// piling up in memory. A dst which stops reading altogether is caught by
+// WithReadWriteTimeouts.
+func (tunnel *TCPTunnel) copy(dst *net.Conn, src *net.Conn, in bool) {
+	defer tunnel.copies.Done()
+	var spliced bool
+	var err error
+	if tunnel.spliceable(in) {
+		var n int64
+		n, spliced, err = splice(*dst, *src)
+		tunnel.forwarded(in, n)
+	}
+	if !spliced {
+		err = tunnel.copyBuffer(*dst, *src, in)
+	}
+	if in && tunnel.mirror != nil {
+		tunnel.mirror.done()
+	}
+	if err != nil || closeWrite(*dst) != nil {
+		tunnel.failed(err, in)
+		tunnel.closeTunnel()
+	}
+}
+
+// failed counts and logs the error which ended the copy in the direction
+// given by in. Errors of the other copy, cut short by the teardown, aren't
+// worth it, and the benign ones are only logged at debug level.
+func (tunnel *TCPTunnel) failed(err error, in bool) {
+	if err == nil || tunnel.ctx.Err() != nil {
+		return
+	}
+	client, destination := "client", "destination"
+	if !in {
+		client, destination = destination, client
+	}
+	counters := &tunnel.realm.counters
+	var copyErr *copyError
+	switch {
+	case errors.Is(err, errMaxBytes):
+		logEvent(LevelInfo, "max_bytes", tunnel.fields().with("max_bytes", tunnel.realm.maxBytes), "Tunnel [%v] reached the limit of %d bytes", tunnel, tunnel.realm.maxBytes)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		counters.errors[timeoutError].Add(1)
+		logEvent(LevelInfo, "timeout", tunnel.fields().with("error", err), "Tunnel [%v] timed out: %v", tunnel, err)
+	case errors.As(err, &copyErr):
+		level, fields := errorLevel(err), tunnel.fields().with("error", copyErr.err)
+		if !benignError(err) {
+			counters.errors[copyErr.kind].Add(1)
+		}
+		switch copyErr.kind {
+		case readError:
+			logEvent(level, "read_error", fields, "Read error from the %v of tunnel [%v]: %v", client, tunnel, copyErr.err)
+		case writeError:
+			logEvent(level, "write_error", fields, "Write error to the %v of tunnel [%v]: %v", destination, tunnel, copyErr.err)
+		default:
+			logEvent(LevelWarn, "middleware_error", fields, "Middleware error in tunnel [%v]: %v", tunnel, copyErr.err)
+		}
+	default:
+		logEvent(errorLevel(err), "copy_error", tunnel.fields().with("error", err), "Tunnel [%v] failed: %v", tunnel, err)
+	}
+}
+
+// copyError tells the kind of an error of a copy: reading from its source,
+// writing to its destination, or processing the bytes in between
+type copyError struct {
+	kind errorKind
+	err  error
+}
+
+func (e *copyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *copyError) Unwrap() error {
+	return e.err
+}
+
+// spliceable tells whether the bytes copied in the direction given by in may
+// be spliced: idle tracking, timeouts, the byte limit and the middleware of
+// the direction need to see the bytes, which splice keeps in the kernel until
+// the tunnel closes
+func (tunnel *TCPTunnel) spliceable(in bool) bool {
+	realm := tunnel.realm
+	if realm.idleTimeout > 0 || realm.readTimeout > 0 || realm.writeTimeout > 0 || realm.maxBytes > 0 {
+		return false
+	}
+	return len(tunnel.chains[direction(in)]) == 0
+}
+
+// copyBuffer copies from src to dst through a buffer of the realm's pool of
+// the direction and its middleware
+func (tunnel *TCPTunnel) copyBuffer(dst net.Conn, src net.Conn, in bool) error {
+	// The buffer goes back to the pool only once the copy no longer uses it
+	pool := &tunnel.realm.bufPools[direction(in)]
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	var writer io.Writer = dst
+	if tunnel.realm.writeTimeout > 0 {
+		writer = deadlineWriter{dst, tunnel.realm.writeTimeout}
+	}
+	// Without a ReadFrom of its own, chain makes io.CopyBuffer use the
+	// buffer given
+	chain := middlewareWriter{writer, tunnel.chains[direction(in)], direction(in)}
+	if _, err := io.CopyBuffer(chain, activityReader{tunnel, src, in}, *buf); err != nil {
+		return err
+	}
+	return chain.flush()
+}
+
+// forwarded counts n bytes forwarded through the tunnel in the direction
+// given by in
+func (tunnel *TCPTunnel) forwarded(in bool, n int64) {
+	if in {
+		tunnel.bytesIn.Add(n)
+		tunnel.realm.counters.bytesIn.Add(n)
+	} else {
+		tunnel.bytesOut.Add(n)
+		tunnel.realm.counters.bytesOut.Add(n)
+	}
+}
+
+// deadlineWriter bounds how long every write to the conn may block
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// activityReader touches the tunnel whenever bytes are read from the conn and
+// counts them in the direction given by in. Reads stop short of the burst of
+// the rate limits of the direction, which their middleware takes the bytes
+// from, and of the byte limit of the tunnel, failing with errMaxBytes once it
+// is reached.
+type activityReader struct {
+	tunnel *TCPTunnel
+	conn   net.Conn
+	in     bool
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	limits := r.tunnel.limitsOut
+	if r.in {
+		limits = r.tunnel.limitsIn
+	}
+	for _, limit := range limits {
+		if len(p) > int(limit.burst) {
+			p = p[:int(limit.burst)]
+		}
+	}
+	if max := r.tunnel.realm.maxBytes; max > 0 {
+		left := max - r.tunnel.bytesIn.Load() - r.tunnel.bytesOut.Load()
+		if left <= 0 {
+			return 0, errMaxBytes
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	if timeout := r.tunnel.realm.readTimeout; timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.tunnel.touch()
+		r.tunnel.forwarded(r.in, int64(n))
+	}
+	// io.CopyBuffer tells EOF by equality
+	if err != nil && err != io.EOF {
+		err = &copyError{readError, err}
+	}
+	return n, err
+}
+
+func (tunnel *TCPTunnel) touch() {
+	tunnel.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle returns how long no bytes have flowed through the tunnel
+func (tunnel *TCPTunnel) idle() time.Duration {
+	return time.Since(time.Unix(0, tunnel.lastActive.Load()))
+}
+
+// closeTunnel closes both connections of the tunnel, which ends the copy
+// goroutines and makes the tunnel leave the realm
+func (tunnel *TCPTunnel) closeTunnel() {
+	tunnel.closeOnce.Do(func() {
+		logEvent(LevelDebug, "close", tunnel.fields(), "Connection closed for %v", tunnel)
+		tunnel.cancel()
+	})
+}
@@ -0,0 +1,591 @@
+package tcpf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHalfClose(t *testing.T) {
+	// This destination answers once the client is done sending
+	dst := startServer(t, func(conn net.Conn) {
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "got %q", request)
+	})
+	// This destination closes its writing side first and reports what it
+	// reads afterwards
+	late := make(chan string, 1)
+	sender := startServer(t, func(conn net.Conn) {
+		conn.Write([]byte("early"))
+		closeWrite(conn)
+		b, _ := io.ReadAll(conn)
+		late <- string(b)
+	})
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"spliced", nil},
+		// Timeouts take the tunnel off the splice path
+		{"buffered", []Option{WithIdleTimeout(time.Minute)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, addr := startRealm(t, dst, test.opts...)
+			conn := dialRealm(t, addr)
+			conn.Write([]byte("request"))
+			conn.CloseWrite()
+			reply, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(reply) != `got "request"` {
+				t.Errorf("got %q back after closing the writing side", reply)
+			}
+
+			// A destination closing its writing side first can still read
+			// the client
+			_, addr = startRealm(t, sender, test.opts...)
+			conn = dialRealm(t, addr)
+			if reply, err := io.ReadAll(conn); err != nil || string(reply) != "early" {
+				t.Fatalf("read %q and %v, want %q and EOF", reply, err, "early")
+			}
+			conn.Write([]byte("after EOF"))
+			conn.CloseWrite()
+			select {
+			case got := <-late:
+				if got != "after EOF" {
+					t.Errorf("destination read %q after its EOF", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("timed out waiting for the destination to read")
+			}
+		})
+	}
+}
+
+func TestConcurrentTunnels(t *testing.T) {
+	realm, addr := startRealm(t, startEcho(t))
+	// Tunnels open and close while others list and close them, which the
+	// race detector checks
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, info := range realm.Tunnels() {
+				realm.CloseTunnel(info.ID)
+			}
+			realm.TunnelCount()
+			realm.Stats()
+		}
+	}()
+	var clients sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := 0; j < 10; j++ {
+				conn, err := net.DialTimeout("tcp", addr, time.Second)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				conn.Write([]byte("x"))
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+		}()
+	}
+	clients.Wait()
+	close(done)
+	readers.Wait()
+	waitFor(t, "the tunnels to close", func() bool { return realm.TunnelCount() == 0 })
+	if conns := realm.conns.Load(); conns != 0 {
+		t.Errorf("%d connections counted after all the tunnels closed", conns)
+	}
+}
+
+func TestGenerateID(t *testing.T) {
+	// Numeric IDs are unique across goroutines, as the realms share them
+	ids := make(chan string, 64*100)
+	var generators sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		generators.Add(1)
+		go func() {
+			defer generators.Done()
+			for j := 0; j < 100; j++ {
+				ids <- generateID(false)
+			}
+		}()
+	}
+	generators.Wait()
+	close(ids)
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %v generated twice", id)
+		}
+		seen[id] = true
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for i := 0; i < 100; i++ {
+		if id := generateID(true); !uuid.MatchString(id) {
+			t.Fatalf("%q is not a version 4 UUID", id)
+		}
+	}
+}
+
+func TestTunnelIDs(t *testing.T) {
+	dst := startEcho(t)
+	numeric, numericAddr := startRealm(t, dst)
+	uuids, uuidAddr := startRealm(t, dst, WithUUIDs())
+	// The tunnels are kept open to list them
+	for _, addr := range []string{numericAddr, numericAddr, uuidAddr, uuidAddr} {
+		conn := dialRealm(t, addr)
+		conn.Write([]byte("x"))
+		conn.Read(make([]byte, 1))
+	}
+	seen := make(map[string]bool)
+	for _, realm := range []*TunnelRealm{numeric, uuids} {
+		for _, info := range realm.Tunnels() {
+			if seen[info.ID] {
+				t.Errorf("ID %v of two tunnels", info.ID)
+			}
+			seen[info.ID] = true
+			if _, err := strconv.Atoi(info.ID); (err == nil) != (realm == numeric) {
+				t.Errorf("tunnel ID %v of realm [%v]", info.ID, realm)
+			}
+		}
+	}
+	if len(seen) != 4 {
+		t.Errorf("%d tunnels listed, want 4", len(seen))
+	}
+}
+
+func TestDialFailure(t *testing.T) {
+	dst := closedPort(t)
+	realm, addr := startRealm(t, dst)
+	// The client of a destination which can't be dialed is closed, and the
+	// realm goes on accepting
+	for i := 1; i <= 2; i++ {
+		conn := dialRealm(t, addr)
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes from a tunnel to a closed port", n)
+		}
+		waitFor(t, "the dial error to be counted", func() bool { return realm.Stats().DialErrors == int64(i) })
+	}
+	if count := realm.TunnelCount(); count != 0 {
+		t.Errorf("realm has %d tunnels to a closed port", count)
+	}
+	waitFor(t, "the connections to be released", func() bool { return realm.conns.Load() == 0 })
+
+	// Once the destination is up the tunnels go through
+	listener, err := net.Listen("tcp", dst)
+	if err != nil {
+		t.Skipf("can't listen on the closed port again: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	if reply := roundTrip(t, addr, []byte("up")); string(reply) != "up" {
+		t.Errorf("got %q back, want %q", reply, "up")
+	}
+}
+
+func TestCloseTunnelTwice(t *testing.T) {
+	realm, addr := startRealm(t, startEcho(t))
+	conn := dialRealm(t, addr)
+	conn.Write([]byte("x"))
+	conn.Read(make([]byte, 1))
+	tunnels := realm.Tunnels()
+	if len(tunnels) != 1 {
+		t.Fatalf("%d tunnels open, want 1", len(tunnels))
+	}
+	realm.tunnelsLock.RLock()
+	tunnel := realm.tunnels[tunnels[0].ID]
+	realm.tunnelsLock.RUnlock()
+	// Both copies, the admin API and Stop may close a tunnel at once
+	var closers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			tunnel.closeTunnel()
+			realm.CloseTunnel(tunnel.id)
+		}()
+	}
+	closers.Wait()
+	waitFor(t, "the tunnel to leave", func() bool { return realm.TunnelCount() == 0 })
+	if realm.CloseTunnel(tunnel.id) {
+		t.Error("closed a tunnel which has left")
+	}
+	tunnel.closeTunnel()
+	if conns := realm.conns.Load(); conns != 0 {
+		t.Errorf("%d connections counted after the tunnel left", conns)
+	}
+	if err := realm.Stop(); err != nil {
+		t.Errorf("Stop() = %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	_, addr := startRealm(t, startEcho(t), WithIdleTimeout(200*time.Millisecond))
+	idle, active := dialRealm(t, addr), dialRealm(t, addr)
+	start := time.Now()
+	// The active tunnel keeps forwarding for longer than the timeout
+	for time.Since(start) < 600*time.Millisecond {
+		active.Write([]byte("x"))
+		if _, err := io.ReadFull(active, make([]byte, 1)); err != nil {
+			t.Fatalf("active tunnel closed after %v: %v", time.Since(start), err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// while the idle one was closed meanwhile
+	if n, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes from an idle tunnel", n)
+	}
+	// Tunnels are checked every half timeout, so one going idle is closed
+	// after one to one and a half timeouts
+	active.SetDeadline(time.Now().Add(5 * time.Second))
+	start = time.Now()
+	if n, err := active.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes from a tunnel going idle", n)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("tunnel closed after being idle for %v, want 200-300ms", elapsed)
+	}
+}
+
+func TestByteCounters(t *testing.T) {
+	// The destination answers every read with it twice
+	dst := startServer(t, func(conn net.Conn) {
+		b := make([]byte, 1024)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			conn.Write(append(b[:n:n], b[:n]...))
+		}
+	})
+	tests := []struct {
+		name string
+		opts []Option
+		// Spliced bytes are counted when their tunnel closes
+		live bool
+	}{
+		{"spliced", nil, false},
+		{"buffered", []Option{WithIdleTimeout(time.Minute)}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			realm, addr := startRealm(t, dst, test.opts...)
+			conn := dialRealm(t, addr)
+			conn.Write([]byte("12345"))
+			if _, err := io.ReadFull(conn, make([]byte, 10)); err != nil {
+				t.Fatal(err)
+			}
+			if test.live {
+				id := realm.Tunnels()[0].ID
+				realm.tunnelsLock.RLock()
+				tunnel := realm.tunnels[id]
+				realm.tunnelsLock.RUnlock()
+				waitFor(t, "the bytes to be counted", func() bool { return tunnel.BytesOut() == 10 })
+				if tunnel.BytesIn() != 5 {
+					t.Errorf("tunnel counted %d bytes in, want 5", tunnel.BytesIn())
+				}
+				if s := tunnel.String(); !strings.Contains(s, "(in 5, out 10 bytes") {
+					t.Errorf("tunnel is %q, without its byte counts", s)
+				}
+				if info := realm.Tunnels()[0]; info.BytesIn != 5 || info.BytesOut != 10 {
+					t.Errorf("tunnel listed with %d bytes in and %d out", info.BytesIn, info.BytesOut)
+				}
+			}
+			conn.Close()
+			waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 0 })
+			if stats := realm.Stats(); stats.BytesIn != 5 || stats.BytesOut != 10 {
+				t.Errorf("realm counted %d bytes in and %d out, want 5 and 10", stats.BytesIn, stats.BytesOut)
+			}
+		})
+	}
+}
+
+func TestSlowDestination(t *testing.T) {
+	// The destination doesn't read until told to, then counts the bytes
+	start := make(chan struct{})
+	received := make(chan int64, 1)
+	dst := startServer(t, func(conn net.Conn) {
+		<-start
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	})
+	for _, opts := range [][]Option{nil, {WithIdleTimeout(time.Minute)}} {
+		_, addr := startRealm(t, dst, opts...)
+		conn := dialRealm(t, addr)
+		// Without a queue in the tunnel, the client is held up once the
+		// socket buffers on the way are full, rather than the tunnel
+		// reading all it sends into memory
+		conn.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+		written, err := conn.Write(make([]byte, 256<<20))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Write() = %v, want the deadline to pass", err)
+		}
+		if written > 64<<20 {
+			t.Errorf("tunnel took %d MB from a client of a destination which doesn't read", written>>20)
+		}
+		// Everything written gets through once the destination reads
+		start <- struct{}{}
+		conn.CloseWrite()
+		select {
+		case n := <-received:
+			if n != int64(written) {
+				t.Errorf("destination received %d of the %d bytes written", n, written)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the destination to read")
+		}
+	}
+}
+
+func TestGoroutinesExit(t *testing.T) {
+	dst := startEcho(t)
+	// Goroutines of earlier tests may still be winding down
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+	host, port, _ := net.SplitHostPort(dst)
+	realm := NewTunnelRealm("127.0.0.1", "0", host, port, WithIdleTimeout(time.Minute))
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := realmAddr(realm)
+	for i := 0; i < 50; i++ {
+		roundTrip(t, addr, []byte("x"))
+	}
+	// Tunnels left open are closed by Stop
+	for i := 0; i < 5; i++ {
+		conn := dialRealm(t, addr)
+		conn.Write([]byte("x"))
+		conn.Read(make([]byte, 1))
+	}
+	realm.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left, %d before the realm:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	// The destination sends more than the limit right away
+	dst := startServer(t, func(conn net.Conn) {
+		conn.Write(make([]byte, 5000))
+		io.Copy(io.Discard, conn)
+	})
+	realm, addr := startRealm(t, dst, WithMaxBytes(1000))
+	conn := dialRealm(t, addr)
+	received, _ := io.Copy(io.Discard, conn)
+	if received != 1000 {
+		t.Errorf("received %d bytes through a tunnel limited to 1000", received)
+	}
+	waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 0 })
+
+	// Both directions count towards the limit
+	realm, addr = startRealm(t, startEcho(t), WithMaxBytes(1000))
+	conn = dialRealm(t, addr)
+	sent := 0
+	for ; sent < 5000; sent += 100 {
+		if _, err := conn.Write(make([]byte, 100)); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 100)); err != nil {
+			break
+		}
+	}
+	if sent != 500 {
+		t.Errorf("%d bytes echoed through a tunnel limited to 1000 in both directions, want 500", sent)
+	}
+	waitFor(t, "the tunnel to close", func() bool { return realm.TunnelCount() == 0 })
+	if stats := realm.Stats(); stats.BytesIn+stats.BytesOut > 1000 {
+		t.Errorf("tunnel forwarded %d bytes in and %d out over the limit", stats.BytesIn, stats.BytesOut)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	realm, addr := startRealm(t, startEcho(t), WithMaxLifetime(200*time.Millisecond))
+	conn := dialRealm(t, addr)
+	start := time.Now()
+	// Activity doesn't keep the tunnel open past its lifetime
+	for {
+		conn.Write([]byte("x"))
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("tunnel closed after %v, want about 200ms", elapsed)
+	}
+	waitFor(t, "the tunnel to leave", func() bool { return realm.TunnelCount() == 0 })
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	// Every tunnel takes its buffers from the pool of the realm, so the
+	// bytes allocated per tunnel stay well below the two buffers it copies
+	// through, whichever their size
+	msg := make([]byte, 64<<10)
+	for _, size := range []int{readBufSize, 64 << 10} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			// Timeouts take the tunnel off the splice path
+			_, addr := startRealm(b, startEcho(b), WithBufferSize(size), WithIdleTimeout(time.Minute))
+			reply := make([]byte, len(msg))
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				go conn.Write(msg)
+				_, err = io.ReadFull(conn, reply)
+				conn.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkEcho measures the throughput of a tunnel to an echo destination
+// listening at addr, sending chunk every iteration while the chunks sent
+// earlier are read back
+func benchmarkEcho(b *testing.B, addr string, chunk []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := io.CopyN(io.Discard, conn, int64(b.N)*int64(len(chunk))); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkBufferSize(b *testing.B) {
+	dst := startEcho(b)
+	for _, size := range []int{readBufSize, 4 << 10, 32 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			// Only tunnels off the splice path copy through the buffers
+			_, addr := startRealm(b, dst, WithBufferSize(size), WithIdleTimeout(time.Minute))
+			benchmarkEcho(b, addr, make([]byte, 64<<10))
+		})
+	}
+}
+
+func BenchmarkSplice(b *testing.B) {
+	dst := startEcho(b)
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		// Plain TCP tunnels are spliced on Linux, and buffered elsewhere
+		{"spliced", nil},
+		{"buffered", []Option{WithIdleTimeout(time.Minute)}},
+	}
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			_, addr := startRealm(b, dst, append([]Option{WithBufferSize(32 << 10)}, test.opts...)...)
+			benchmarkEcho(b, addr, make([]byte, 64<<10))
+		})
+	}
+}
+
+func BenchmarkBufferSizes(b *testing.B) {
+	// The destination answers every small request with a large download
+	const requestSize, responseSize = 16, 256 << 10
+	dst := startServer(b, func(conn net.Conn) {
+		request := make([]byte, requestSize)
+		response := make([]byte, responseSize)
+		for {
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			if _, err := conn.Write(response); err != nil {
+				return
+			}
+		}
+	})
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"1KB", WithBufferSize(1 << 10)},
+		{"64KB", WithBufferSize(64 << 10)},
+		// As fast as 64KB buffers, with a small buffer for the requests
+		{"1KB-in-64KB-out", WithBufferSizes(1<<10, 64<<10)},
+	}
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			_, addr := startRealm(b, dst, test.opt, WithIdleTimeout(time.Minute))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			request := make([]byte, requestSize)
+			b.SetBytes(responseSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn.Write(request)
+				if _, err := io.CopyN(io.Discard, conn, responseSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,478 @@
+package tcpf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Size of the buffer large enough to hold any UDP datagram
+	udpBufSize = 65535
+	// Number of datagrams a session keeps while it is being opened
+	udpMaxPending = 64
+)
+
+// UDPRealm describes the common properties of UDP tunnels, such as:
+// * local bind interface and port
+// * destination IP/hostname and port
+// * map of currently active UDPTunnel's (sessions) keyed by client address
+//
+// As UDP has no connections, a session is created for every new client
+// source address and expires after being idle for the configured timeout.
+// The destination is resolved once by Start, or by every new session with
+// WithResolveTTL.
+type UDPRealm struct {
+	bindIF   string
+	bindPort string
+	dstHost  string
+	dstPort  string
+	options
+	// Address of the destination resolved by Start, without WithResolveTTL
+	dstAddr      *net.UDPAddr
+	dnsCache     *dnsCache
+	sessions     map[string]*UDPTunnel
+	sessionsLock sync.Mutex
+	// Number of sessions of every client IP, with WithMaxConnsPerIP
+	sessionsPerIP ipCounts
+	ctx           context.Context
+	cancel        context.CancelFunc
+	conn          *net.UDPConn
+	// Set while Start binds the socket, which may unlock mutex to retry
+	starting bool
+	mutex    sync.Mutex
+	stop     sync.Once
+	// Goroutines of the realm itself and of its sessions
+	running      sync.WaitGroup
+	sessionsLive sync.WaitGroup
+}
+
+// UDPTunnel contains properties of a UDP session:
+// * address of the client the session belongs to
+// * outbound socket connected to the destination
+// * time of the last datagram sent in either direction
+// * pointer to the realm (UDPRealm)
+//
+// The session is opened in the background, keeping the datagrams of the
+// client until the outbound socket is connected.
+type UDPTunnel struct {
+	id     string
+	client *net.UDPAddr
+	// Set before opened is closed, nil until then
+	outbound   *net.UDPConn
+	opened     chan struct{}
+	lastActive atomic.Int64
+	realm      *UDPRealm
+	closeOnce  sync.Once
+	// Guards outbound while the session is opened, and the datagrams
+	// received until then
+	mutex   sync.Mutex
+	pending [][]byte
+	closed  bool
+}
+
+// NewUDPRealm creates a new UDPRealm with given bind IP:port and destination IP:port
+func NewUDPRealm(bindIF string, bindPort string, dstHost string, dstPort string, opts ...Option) *UDPRealm {
+	return NewUDPRealmContext(context.Background(), bindIF, bindPort, dstHost, dstPort, opts...)
+}
+
+// NewUDPRealmContext creates a new UDPRealm like NewUDPRealm does.
+// Cancelling ctx stops the realm the same way Stop does.
+func NewUDPRealmContext(ctx context.Context, bindIF string, bindPort string, dstHost string, dstPort string, opts ...Option) *UDPRealm {
+	realm := &UDPRealm{
+		sessions: make(map[string]*UDPTunnel),
+		bindIF:   bindIF,
+		bindPort: bindPort,
+		dstHost:  dstHost,
+		dstPort:  dstPort,
+		options:  newOptions(opts),
+	}
+	if realm.idleTimeout <= 0 {
+		realm.idleTimeout = defaultUDPIdleTimeout
+	}
+	if realm.resolveTTL > 0 {
+		realm.dnsCache = newDNSCache(realm.resolveTTL, realm.resolver)
+	}
+	realm.ctx, realm.cancel = context.WithCancel(ctx)
+	return realm
+}
+
+func (realm *UDPRealm) String() string {
+	return fmt.Sprintf("udp %v => %v", net.JoinHostPort(realm.bindIF, realm.bindPort), net.JoinHostPort(realm.dstHost, realm.dstPort))
+}
+
+// Start binds the realm's socket to bindIF:bindPort and starts forwarding
+// datagrams in the background. An empty bindIF means all interfaces.
+// Binding is retried for the time set with WithBindRetry. Unless the realm
+// was created with WithResolveTTL, Start also resolves the destination,
+// failing if it can't. A realm can only be started once.
+func (realm *UDPRealm) Start() error {
+	realm.mutex.Lock()
+	defer realm.mutex.Unlock()
+	if realm.ctx.Err() != nil {
+		return errRealmStopped
+	}
+	if realm.conn != nil || realm.starting {
+		return errRealmStarted
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(realm.bindIF, realm.bindPort))
+	if err != nil {
+		return err
+	}
+	if realm.dnsCache == nil {
+		address := net.JoinHostPort(realm.dstHost, realm.dstPort)
+		if realm.dstAddr, err = resolveUDPAddr(realm.ctx, realm.resolver, address); err != nil {
+			return fmt.Errorf("destination address %v is not available: %v", address, err)
+		}
+	}
+	realm.starting = true
+	defer func() { realm.starting = false }()
+	var conn *net.UDPConn
+	err = retryBind(realm.ctx, &realm.mutex, realm.bindRetry, realm, addr.String(), func() (err error) {
+		conn, err = net.ListenUDP("udp", addr)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	realm.conn = conn
+	realm.running.Add(2)
+	go realm.receive()
+	go realm.expire()
+	context.AfterFunc(realm.ctx, func() { realm.Stop() })
+	return nil
+}
+
+// Serve starts the realm and blocks until it is stopped. Serve returns nil
+// after Stop, or the error which prevented the realm from being started.
+func (realm *UDPRealm) Serve() error {
+	if err := realm.Start(); err != nil {
+		return err
+	}
+	<-realm.ctx.Done()
+	return realm.Stop()
+}
+
+// Stop stops forwarding, closes all the sessions of the realm and returns
+// once all of the realm's goroutines have exited. It is safe to call Stop
+// more than once.
+func (realm *UDPRealm) Stop() error {
+	var err error
+	realm.stop.Do(func() {
+		realm.mutex.Lock()
+		realm.cancel()
+		if realm.conn != nil {
+			if err = realm.conn.Close(); errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+		}
+		realm.mutex.Unlock()
+		realm.running.Wait()
+		for _, session := range realm.listSessions() {
+			session.closeTunnel()
+		}
+		realm.sessionsLive.Wait()
+	})
+	return err
+}
+
+// StopListening stops the realm like Stop does, freeing its address for
+// another realm to bind
+func (realm *UDPRealm) StopListening() {
+	realm.Stop()
+}
+
+// Ready tells whether the realm is forwarding datagrams: it has been
+// started and not stopped
+func (realm *UDPRealm) Ready() bool {
+	realm.mutex.Lock()
+	defer realm.mutex.Unlock()
+	return realm.conn != nil && realm.ctx.Err() == nil
+}
+
+// Shutdown stops the realm like Stop does: as there are no connections for
+// datagrams, there is nothing to drain
+func (realm *UDPRealm) Shutdown(ctx context.Context) error {
+	return realm.Stop()
+}
+
+func (realm *UDPRealm) listSessions() []*UDPTunnel {
+	realm.sessionsLock.Lock()
+	defer realm.sessionsLock.Unlock()
+	sessions := make([]*UDPTunnel, 0, len(realm.sessions))
+	for _, session := range realm.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// receive reads datagrams from clients and forwards them to the destination
+// through the client's session, creating the session when needed
+func (realm *UDPRealm) receive() {
+	defer realm.running.Done()
+	bytes := make([]byte, udpBufSize)
+	for {
+		n, client, err := realm.conn.ReadFromUDP(bytes)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logEvent(LevelWarn, "udp_error", Fields{"realm": realm, "error": err}, "Error occured: %v", err)
+			continue
+		}
+		if session := realm.session(client); session != nil {
+			session.forward(bytes[:n])
+		}
+	}
+}
+
+// session returns the session of the client, creating a new one opened in
+// the background if the client has none, or nil if the client may not open
+// one
+func (realm *UDPRealm) session(client *net.UDPAddr) *UDPTunnel {
+	key := client.String()
+	realm.sessionsLock.Lock()
+	session, ok := realm.sessions[key]
+	realm.sessionsLock.Unlock()
+	if ok {
+		return session
+	}
+	if !realm.admit(client) {
+		return nil
+	}
+	session = &UDPTunnel{
+		id:     generateID(realm.uuidIDs),
+		client: client,
+		opened: make(chan struct{}),
+		realm:  realm,
+	}
+	session.touch()
+	realm.sessionsLock.Lock()
+	realm.sessions[key] = session
+	realm.sessionsLock.Unlock()
+	realm.sessionsLive.Add(1)
+	go session.open()
+	return session
+}
+
+// resolveUDPAddr resolves the host:port endpoint with the resolver, or the
+// default one if nil, preferring IPv4 addresses like net.ResolveUDPAddr
+func resolveUDPAddr(ctx context.Context, resolver *net.Resolver, endpoint string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	portNum, err := resolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.Unmap().Is4() {
+			ip = candidate
+			break
+		}
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(portNum))), nil
+}
+
+// admit decides whether a client without a session may open one, counting
+// the session against the limit per IP if so. Refused clients are logged at
+// debug, as every datagram they send is refused anew.
+func (realm *UDPRealm) admit(client *net.UDPAddr) bool {
+	if !realm.permitted(client) {
+		logEvent(LevelDebug, "refuse", Fields{"realm": realm, "src": client}, "Refusing datagram from %v: not allowed by the access lists", client)
+		return false
+	}
+	if country, ok := realm.permittedCountry(client); !ok {
+		logEvent(LevelDebug, "refuse", Fields{"realm": realm, "src": client, "country": country}, "Refusing datagram from %v: country %q is not allowed", client, country)
+		return false
+	}
+	if !realm.sessionsPerIP.acquire(client, realm.maxConnsPerIP) {
+		logEvent(LevelDebug, "refuse", Fields{"realm": realm, "src": client}, "Refusing datagram from %v: the client has reached the limit of %d sessions", client, realm.maxConnsPerIP)
+		return false
+	}
+	return true
+}
+
+// expire periodically closes the sessions idle for longer than idleTimeout
+func (realm *UDPRealm) expire() {
+	defer realm.running.Done()
+	ticker := time.NewTicker(realm.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, session := range realm.listSessions() {
+				if session.idle() > realm.idleTimeout {
+					logEvent(LevelInfo, "idle", session.fields(), "UDP session expired: [%v]", session)
+					session.closeTunnel()
+				}
+			}
+		case <-realm.ctx.Done():
+			return
+		}
+	}
+}
+
+func (session *UDPTunnel) String() string {
+	return fmt.Sprintf("%v -> %v", session.client, session.destination())
+}
+
+// fields returns the details of the session logged with its events
+func (session *UDPTunnel) fields() Fields {
+	return Fields{"tunnel_id": session.id, "src": session.client, "dst": session.destination()}
+}
+
+// destination returns the address the session forwards to, or the
+// destination of the realm until the session is opened
+func (session *UDPTunnel) destination() interface{} {
+	select {
+	case <-session.opened:
+		return session.outbound.RemoteAddr()
+	default:
+		return net.JoinHostPort(session.realm.dstHost, session.realm.dstPort)
+	}
+}
+
+// open connects the outbound socket of the session to the destination,
+// forwards the datagrams the client sent meanwhile and goes on replying
+func (session *UDPTunnel) open() {
+	realm := session.realm
+	addr := realm.dstAddr
+	var err error
+	if realm.dnsCache != nil {
+		var endpoint string
+		endpoint, err = realm.dnsCache.resolve(realm.ctx, net.JoinHostPort(realm.dstHost, realm.dstPort))
+		if err == nil {
+			addr, err = resolveUDPAddr(realm.ctx, realm.resolver, endpoint)
+		}
+	}
+	var outbound *net.UDPConn
+	if err == nil {
+		outbound, err = net.DialUDP("udp", nil, addr)
+	}
+	if err != nil {
+		logEvent(LevelError, "open_error", Fields{"src": session.client, "error": err}, "Can't open UDP session for %v: destination address %v is not available: %v", session.client, session.destination(), err)
+		session.closeOnce.Do(session.remove)
+		realm.sessionsLive.Done()
+		return
+	}
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		outbound.Close()
+		realm.sessionsLive.Done()
+		return
+	}
+	session.outbound = outbound
+	close(session.opened)
+	pending := session.pending
+	session.pending = nil
+	for _, datagram := range pending {
+		if _, err = outbound.Write(datagram); err != nil {
+			break
+		}
+	}
+	session.mutex.Unlock()
+	logEvent(LevelDebug, "join", session.fields(), "Added UDP session: %v:[%v]", session.id, session)
+	if err != nil {
+		logEvent(errorLevel(err), "udp_error", session.fields().with("error", err), "Can't forward datagram from %v to the destination: %v", session.client, err)
+		session.closeTunnel()
+	}
+	session.reply()
+}
+
+// forward sends the datagram of the client to the destination, or keeps it
+// until the session is opened
+func (session *UDPTunnel) forward(datagram []byte) {
+	select {
+	case <-session.opened:
+	default:
+		session.mutex.Lock()
+		if session.outbound == nil {
+			if !session.closed && len(session.pending) < udpMaxPending {
+				session.pending = append(session.pending, append([]byte(nil), datagram...))
+			}
+			session.mutex.Unlock()
+			return
+		}
+		session.mutex.Unlock()
+	}
+	if _, err := session.outbound.Write(datagram); err != nil {
+		logEvent(errorLevel(err), "udp_error", session.fields().with("error", err), "Can't forward datagram from %v to the destination: %v", session.client, err)
+		session.closeTunnel()
+		return
+	}
+	session.touch()
+}
+
+func (session *UDPTunnel) touch() {
+	session.lastActive.Store(time.Now().UnixNano())
+}
+
+func (session *UDPTunnel) idle() time.Duration {
+	return time.Since(time.Unix(0, session.lastActive.Load()))
+}
+
+// reply forwards datagrams received from the destination back to the client
+func (session *UDPTunnel) reply() {
+	defer session.realm.sessionsLive.Done()
+	bytes := make([]byte, udpBufSize)
+	for {
+		n, err := session.outbound.Read(bytes)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logEvent(errorLevel(err), "udp_error", session.fields().with("error", err), "Can't read datagram from the destination of %v: %v", session.client, err)
+				session.closeTunnel()
+			}
+			return
+		}
+		if _, err := session.realm.conn.WriteToUDP(bytes[:n], session.client); err != nil {
+			logEvent(errorLevel(err), "udp_error", session.fields().with("error", err), "Can't forward datagram from the destination to %v: %v", session.client, err)
+			continue
+		}
+		session.touch()
+	}
+}
+
+func (session *UDPTunnel) closeTunnel() {
+	session.closeOnce.Do(func() {
+		logEvent(LevelInfo, "leave", session.fields(), "UDP session leaving realm and being closed: [%v]", session)
+		session.remove()
+		// Once removed, a session being opened closes its own socket
+		session.mutex.Lock()
+		outbound := session.outbound
+		session.mutex.Unlock()
+		if outbound != nil {
+			outbound.Close()
+		}
+	})
+}
+
+// remove takes the session out of its realm, which no longer counts it
+// against the limit per IP, and drops the datagrams it still kept
+func (session *UDPTunnel) remove() {
+	realm := session.realm
+	realm.sessionsLock.Lock()
+	if realm.sessions[session.client.String()] == session {
+		delete(realm.sessions, session.client.String())
+	}
+	realm.sessionsLock.Unlock()
+	realm.sessionsPerIP.release(session.client, realm.maxConnsPerIP)
+	session.mutex.Lock()
+	session.closed, session.pending = true, nil
+	session.mutex.Unlock()
+}
@@ -0,0 +1,250 @@
+package tcpf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startUDPEcho runs a UDP server on the loopback interface sending back every
+// datagram it receives, and returns its address
+func startUDPEcho(t testing.TB) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(b[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// startUDPRealm starts a UDP realm on a free port of the loopback interface
+// forwarding to dst, and returns it with the address it is bound to
+func startUDPRealm(t testing.TB, dst *net.UDPAddr, opts ...Option) (*UDPRealm, *net.UDPAddr) {
+	t.Helper()
+	realm := NewUDPRealm("127.0.0.1", "0", dst.IP.String(), strconv.Itoa(dst.Port), opts...)
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { realm.Stop() })
+	return realm, realm.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// udpExchange sends msg over conn and returns the datagram coming back, or
+// nil if none does within timeout
+func udpExchange(t testing.TB, conn *net.UDPConn, msg []byte, timeout time.Duration) []byte {
+	t.Helper()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	b := make([]byte, 2048)
+	n, err := conn.Read(b)
+	if err != nil {
+		return nil
+	}
+	return b[:n]
+}
+
+func TestUDPForward(t *testing.T) {
+	realm, addr := startUDPRealm(t, startUDPEcho(t))
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, msg := range []string{"one", "two"} {
+		if reply := udpExchange(t, conn, []byte(msg), 2*time.Second); !bytes.Equal(reply, []byte(msg)) {
+			t.Errorf("got %q back, want %q", reply, msg)
+		}
+	}
+	// Both datagrams went through the session of the client
+	if sessions := len(realm.listSessions()); sessions != 1 {
+		t.Errorf("got %d sessions, want 1", sessions)
+	}
+}
+
+func TestUDPRealmContext(t *testing.T) {
+	dst := startUDPEcho(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	realm := NewUDPRealmContext(ctx, "127.0.0.1", "0", dst.IP.String(), strconv.Itoa(dst.Port))
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer realm.Stop()
+	if !realm.Ready() {
+		t.Fatal("started realm isn't ready")
+	}
+	cancel()
+	waitFor(t, "the realm to stop", func() bool { return !realm.Ready() })
+}
+
+// startDNS runs a DNS server answering every A query with 127.0.0.1, and
+// AAAA queries with no records, once release is closed. It returns a
+// resolver sending its queries to the server.
+func startDNS(t *testing.T, release chan struct{}) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			// The question is the name, a sequence of labels ending with an
+			// empty one, followed by its type and class
+			end := 12
+			for end < n && b[end] != 0 {
+				end += 1 + int(b[end])
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			question := append([]byte(nil), b[12:end]...)
+			answer := append(binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(b)), 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+			answer = append(answer, question...)
+			if binary.BigEndian.Uint16(question[len(question)-4:]) == 1 {
+				answer[7] = 1
+				answer = append(answer, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+			go func() {
+				<-release
+				conn.WriteToUDP(answer, addr)
+			}()
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func TestUDPResolve(t *testing.T) {
+	dst := startUDPEcho(t)
+	port := strconv.Itoa(dst.Port)
+	release := make(chan struct{})
+	close(release)
+	tests := []struct {
+		name     string
+		resolver *net.Resolver
+		ok       bool
+	}{
+		{"resolved", startDNS(t, release), true},
+		{"unresolved", &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, errors.New("no DNS server")
+			},
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Start resolves the destination once, failing if it can't
+			realm := NewUDPRealm("127.0.0.1", "0", "echo.test", port, WithResolver(test.resolver))
+			err := realm.Start()
+			if !test.ok {
+				if err == nil {
+					realm.Stop()
+					t.Fatal("started a realm whose destination can't be resolved")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer realm.Stop()
+			conn, err := net.DialUDP("udp", nil, realm.conn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if reply := udpExchange(t, conn, []byte("resolved"), 2*time.Second); string(reply) != "resolved" {
+				t.Errorf("got %q back", reply)
+			}
+		})
+	}
+
+	// With WithResolveTTL the sessions resolve it, and those which can't
+	// are closed
+	realm := NewUDPRealm("127.0.0.1", "0", "echo.test", port, WithResolveTTL(time.Minute), WithResolver(tests[1].resolver))
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer realm.Stop()
+	conn, err := net.DialUDP("udp", nil, realm.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reply := udpExchange(t, conn, []byte("unresolved"), 200*time.Millisecond); reply != nil {
+		t.Errorf("got %q back from a destination which can't be resolved", reply)
+	}
+	waitFor(t, "the session to close", func() bool { return len(realm.listSessions()) == 0 })
+}
+
+func TestUDPSessionOpening(t *testing.T) {
+	// The sessions wait for the destination to be resolved, while the realm
+	// goes on receiving the datagrams of other clients
+	dst := startUDPEcho(t)
+	release := make(chan struct{})
+	realm := NewUDPRealm("127.0.0.1", "0", "echo.test", strconv.Itoa(dst.Port), WithResolveTTL(time.Minute), WithResolver(startDNS(t, release)))
+	if err := realm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer realm.Stop()
+	addr := realm.conn.LocalAddr().(*net.UDPAddr)
+	var clients []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	messages := []string{"first", "second", "third"}
+	for _, msg := range messages {
+		clients[0].Write([]byte(msg))
+	}
+	clients[1].Write([]byte("other"))
+	waitFor(t, "both sessions", func() bool { return len(realm.listSessions()) == 2 })
+
+	// Once they are opened, the datagrams kept meanwhile are forwarded in
+	// the order they came in
+	close(release)
+	b := make([]byte, 2048)
+	clients[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range messages {
+		n, err := clients[0].Read(b)
+		if err != nil || string(b[:n]) != msg {
+			t.Fatalf("got %q, %v back, want %q", b[:n], err, msg)
+		}
+	}
+	if reply := udpExchange(t, clients[1], []byte("again"), 2*time.Second); string(reply) != "other" {
+		t.Errorf("got %q back, want the datagram kept while opening", reply)
+	}
+}
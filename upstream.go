@@ -0,0 +1,231 @@
+package tcpf
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// upstream is a proxy a TunnelRealm dials its destinations through
+type upstream interface {
+	// Address of the proxy to dial
+	address() string
+	// connect asks the proxy, connected to over conn, to connect to the
+	// destination address, and returns the connection which carries the
+	// tunnel's traffic from then on
+	connect(conn net.Conn, address string) (net.Conn, error)
+	String() string
+}
+
+// socks5Upstream is an upstream SOCKS5 proxy, authenticated with a username
+// and password if the username is set
+type socks5Upstream struct {
+	proxy    string
+	username string
+	password string
+}
+
+// Messages of the SOCKS5 reply codes
+var socks5Replies = map[byte]string{
+	0x01:                 "general SOCKS server failure",
+	0x02:                 "connection not allowed by ruleset",
+	0x03:                 "network unreachable",
+	0x04:                 "host unreachable",
+	socks5ConnRefused:    "connection refused",
+	0x06:                 "TTL expired",
+	socks5CmdUnsupported: "command not supported",
+	socks5AddrUnsupport:  "address type not supported",
+}
+
+func (proxy *socks5Upstream) address() string {
+	return proxy.proxy
+}
+
+func (proxy *socks5Upstream) String() string {
+	return "SOCKS5 proxy " + proxy.proxy
+}
+
+func (proxy *socks5Upstream) connect(conn net.Conn, address string) (net.Conn, error) {
+	return conn, proxy.request(conn, address)
+}
+
+// request authenticates with the proxy and asks it to connect to address
+func (proxy *socks5Upstream) request(conn net.Conn, address string) error {
+	if err := proxy.authenticate(conn); err != nil {
+		return err
+	}
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portName, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portName)
+	}
+	request := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long for SOCKS5", host)
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, socks5AddrIPv4), ip4...)
+	} else {
+		request = append(append(request, socks5AddrIPv6), ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("can't read SOCKS5 reply: %v", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", reply[0])
+	}
+	if reply[1] != socks5Succeeded {
+		msg, ok := socks5Replies[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("SOCKS5 reply code %d", reply[1])
+		}
+		if reply[1] == socks5ConnRefused {
+			return fmt.Errorf("SOCKS5 proxy: %w", syscall.ECONNREFUSED)
+		}
+		return errors.New("SOCKS5 proxy: " + msg)
+	}
+	// The address the proxy bound for the connection is of no use
+	var bound int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		bound = net.IPv4len
+	case socks5AddrIPv6:
+		bound = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fmt.Errorf("can't read SOCKS5 reply: %v", err)
+		}
+		bound = int(length[0])
+	default:
+		return fmt.Errorf("unsupported SOCKS5 address type %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, bound+2)); err != nil {
+		return fmt.Errorf("can't read SOCKS5 reply: %v", err)
+	}
+	return nil
+}
+
+// authenticate greets the proxy and authenticates with the username and
+// password if the proxy asks for them
+func (proxy *socks5Upstream) authenticate(conn net.Conn) error {
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if proxy.username != "" {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	choice := make([]byte, 2)
+	if _, err := io.ReadFull(conn, choice); err != nil {
+		return fmt.Errorf("can't read SOCKS5 method selection: %v", err)
+	}
+	if choice[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", choice[0])
+	}
+	switch {
+	case choice[1] == socks5AuthNone:
+		return nil
+	case choice[1] == socks5AuthPassword && proxy.username != "":
+	default:
+		return errors.New("SOCKS5 proxy accepted none of the authentication methods offered")
+	}
+	if len(proxy.username) > 255 || len(proxy.password) > 255 {
+		return errors.New("SOCKS5 credentials are too long")
+	}
+	auth := []byte{socks5PasswordVer, byte(len(proxy.username))}
+	auth = append(auth, proxy.username...)
+	auth = append(auth, byte(len(proxy.password)))
+	auth = append(auth, proxy.password...)
+	if _, err := conn.Write(auth); err != nil {
+		return err
+	}
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("can't read SOCKS5 authentication status: %v", err)
+	}
+	if status[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 authentication failed for user %q", proxy.username)
+	}
+	return nil
+}
+
+// httpUpstream is an upstream HTTP proxy supporting the CONNECT method,
+// authenticated with basic authentication if the username is set
+type httpUpstream struct {
+	proxy    string
+	username string
+	password string
+}
+
+func (proxy *httpUpstream) address() string {
+	return proxy.proxy
+}
+
+func (proxy *httpUpstream) String() string {
+	return "HTTP proxy " + proxy.proxy
+}
+
+func (proxy *httpUpstream) connect(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.username + ":" + proxy.password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+	buffered := newBufferedConn(conn)
+	response, err := http.ReadResponse(buffered.reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("can't read HTTP proxy response: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy responded %v", response.Status)
+	}
+	// Bytes the destination sent right away may have been read along with
+	// the response
+	if buffered.reader.Buffered() > 0 {
+		return buffered, nil
+	}
+	return conn, nil
+}
+
+// connectUpstream asks the realm's upstream proxy, connected to over conn,
+// to connect to the destination address, bounding the exchange with the
+// proxy by the dial timeout
+func (realm *TunnelRealm) connectUpstream(conn net.Conn, address string) (net.Conn, error) {
+	timeout := realm.dialTimeout
+	if timeout == 0 {
+		timeout = negotiationTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	return realm.upstream.connect(conn, address)
+}
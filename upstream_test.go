@@ -0,0 +1,318 @@
+package tcpf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startFakeSOCKS5 runs a SOCKS5 proxy asking for the password "secret" of
+// "user" if password is set, replying code to every request and echoing the
+// traffic of the requests it grants. It returns its address and a channel
+// of the messages it reads from its clients, in order.
+func startFakeSOCKS5(t *testing.T, password bool, code byte) (string, chan []byte) {
+	t.Helper()
+	messages := make(chan []byte, 16)
+	addr := startServer(t, func(conn net.Conn) {
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		methods := make([]byte, int(greeting[1]))
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		messages <- append(greeting, methods...)
+		if !password {
+			conn.Write([]byte{socks5Version, socks5AuthNone})
+		} else {
+			conn.Write([]byte{socks5Version, socks5AuthPassword})
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			username := make([]byte, int(header[1])+1)
+			if _, err := io.ReadFull(conn, username); err != nil {
+				return
+			}
+			secret := make([]byte, int(username[len(username)-1]))
+			if _, err := io.ReadFull(conn, secret); err != nil {
+				return
+			}
+			messages <- append(append(header, username...), secret...)
+			if string(username[:len(username)-1]) != "user" || string(secret) != "secret" {
+				conn.Write([]byte{socks5PasswordVer, 0x01})
+				return
+			}
+			conn.Write([]byte{socks5PasswordVer, 0x00})
+		}
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		var addrLength int
+		switch request[3] {
+		case socks5AddrIPv4:
+			addrLength = net.IPv4len
+		case socks5AddrIPv6:
+			addrLength = net.IPv6len
+		case socks5AddrDomain:
+			length := make([]byte, 1)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			request = append(request, length[0])
+			addrLength = int(length[0])
+		}
+		rest := make([]byte, addrLength+2)
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			return
+		}
+		messages <- append(request, rest...)
+		conn.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		if code == socks5Succeeded {
+			io.Copy(conn, conn)
+		}
+	})
+	return addr, messages
+}
+
+// nextMessage returns the next message the fake proxy read, failing the test
+// if none comes within a few seconds
+func nextMessage(t *testing.T, messages chan []byte) []byte {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message to the proxy")
+		return nil
+	}
+}
+
+func TestUpstreamSOCKS5(t *testing.T) {
+	tests := []struct {
+		name     string
+		dst      string
+		username string
+		messages [][]byte
+	}{
+		{
+			name: "host name",
+			dst:  "dest.test:8080",
+			messages: [][]byte{
+				{socks5Version, 1, socks5AuthNone},
+				append(append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, 9}, "dest.test"...), 0x1f, 0x90),
+			},
+		},
+		{
+			name:     "IPv4 with password",
+			dst:      "192.0.2.1:443",
+			username: "user",
+			messages: [][]byte{
+				{socks5Version, 2, socks5AuthNone, socks5AuthPassword},
+				append(append([]byte{socks5PasswordVer, 4}, "user\x06"...), "secret"...),
+				{socks5Version, socks5CmdConnect, 0x00, socks5AddrIPv4, 192, 0, 2, 1, 0x01, 0xbb},
+			},
+		},
+		{
+			name: "IPv6",
+			dst:  "[2001:db8::1]:80",
+			messages: [][]byte{
+				{socks5Version, 1, socks5AuthNone},
+				append(append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrIPv6}, net.ParseIP("2001:db8::1")...), 0x00, 0x50),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, messages := startFakeSOCKS5(t, test.username != "", socks5Succeeded)
+			_, addr := startRealm(t, test.dst, WithUpstreamSOCKS5(proxy, test.username, "secret"))
+			msg := []byte("through the upstream proxy")
+			if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+				t.Errorf("got %q back, want %q", reply, msg)
+			}
+			for _, want := range test.messages {
+				if got := nextMessage(t, messages); !bytes.Equal(got, want) {
+					t.Errorf("proxy read % x, want % x", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamSOCKS5Failures(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		code     byte
+		err      string
+	}{
+		{"wrong password", "wrong", socks5Succeeded, `authentication failed for user "user"`},
+		{"refused", "secret", socks5ConnRefused, "connection refused"},
+		{"not allowed", "secret", socks5NotAllowed, "connection not allowed by ruleset"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, _ := startFakeSOCKS5(t, true, test.code)
+			conn, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			upstream := &socks5Upstream{proxy: proxy, username: "user", password: test.password}
+			_, err = upstream.connect(conn, "dest.test:80")
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("connect() = %v, want an error containing %q", err, test.err)
+			}
+			if test.code == socks5ConnRefused && !errors.Is(err, syscall.ECONNREFUSED) {
+				t.Errorf("connect() = %v, want %v", err, syscall.ECONNREFUSED)
+			}
+		})
+	}
+
+	// A tunnel the proxy refuses is closed without data
+	proxy, _ := startFakeSOCKS5(t, false, socks5ConnRefused)
+	_, addr := startRealm(t, "dest.test:80", WithUpstreamSOCKS5(proxy, "", ""))
+	conn := dialRealm(t, addr)
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a tunnel the proxy refused", n)
+	}
+}
+
+func TestUpstreamSOCKS5Chain(t *testing.T) {
+	// One realm is the SOCKS5 proxy the other dials the echo through
+	proxy := startSOCKS5(t, WithSOCKS5(map[string]string{"user": "secret"}))
+	realm, addr := startRealm(t, startEcho(t), WithUpstreamSOCKS5(proxy, "user", "secret"))
+	msg := []byte("through two realms")
+	if reply := roundTrip(t, addr, msg); !bytes.Equal(reply, msg) {
+		t.Errorf("got %q back, want %q", reply, msg)
+	}
+	if stats := realm.Stats(); stats.TunnelsTotal != 1 {
+		t.Errorf("%d tunnels opened, want 1", stats.TunnelsTotal)
+	}
+}
+
+// startFakeHTTPProxy runs an HTTP proxy answering every CONNECT request with
+// the status, followed in the same write by the greeting of the destination
+// when it grants the request, and echoing the traffic then. It returns its
+// address and a channel of the requests it reads.
+func startFakeHTTPProxy(t *testing.T, status string, greeting string) (string, chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 16)
+	addr := startServer(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- request
+		response := "HTTP/1.1 " + status + "\r\nContent-Length: 0\r\n\r\n"
+		if !strings.HasPrefix(status, "200 ") {
+			io.WriteString(conn, response)
+			return
+		}
+		io.WriteString(conn, response+greeting)
+		io.Copy(conn, reader)
+	})
+	return addr, requests
+}
+
+func TestUpstreamHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		greeting string
+		auth     string
+	}{
+		{"no authentication", "", "", ""},
+		{"basic authentication", "user", "", "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))},
+		// The destination speaks first, in the same read as the response
+		{"greeting", "", "SSH-2.0-dest\r\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, requests := startFakeHTTPProxy(t, "200 Connection established", test.greeting)
+			_, addr := startRealm(t, "dest.test:8080", WithUpstreamHTTPProxy(proxy, test.username, "secret"))
+			conn := dialRealm(t, addr)
+			if test.greeting != "" {
+				greeting := make([]byte, len(test.greeting))
+				if _, err := io.ReadFull(conn, greeting); err != nil || string(greeting) != test.greeting {
+					t.Fatalf("got the greeting %q, %v, want %q", greeting, err, test.greeting)
+				}
+			}
+			converse(t, conn, []byte("through the upstream proxy"), []byte("through the upstream proxy"))
+			var request *http.Request
+			select {
+			case request = <-requests:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the CONNECT request")
+			}
+			if request.Method != http.MethodConnect || request.RequestURI != "dest.test:8080" || request.Host != "dest.test:8080" {
+				t.Errorf("proxy got %v %v for %v, want CONNECT dest.test:8080", request.Method, request.RequestURI, request.Host)
+			}
+			if auth := request.Header.Get("Proxy-Authorization"); auth != test.auth {
+				t.Errorf("Proxy-Authorization is %q, want %q", auth, test.auth)
+			}
+		})
+	}
+}
+
+func TestUpstreamHTTPProxyFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+	}{
+		{"authentication required", "407 Proxy Authentication Required"},
+		{"forbidden", "403 Forbidden"},
+		{"bad gateway", "502 Bad Gateway"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, _ := startFakeHTTPProxy(t, test.status, "")
+			conn, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			upstream := &httpUpstream{proxy: proxy, username: "user", password: "wrong"}
+			if _, err := upstream.connect(conn, "dest.test:80"); err == nil || !strings.Contains(err.Error(), test.status) {
+				t.Errorf("connect() = %v, want an error with %q", err, test.status)
+			}
+		})
+	}
+
+	// A tunnel the proxy refuses is closed without data, counted as a dial
+	// error
+	proxy, _ := startFakeHTTPProxy(t, "403 Forbidden", "")
+	realm, addr := startRealm(t, "dest.test:80", WithUpstreamHTTPProxy(proxy, "", ""))
+	conn := dialRealm(t, addr)
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a tunnel the proxy refused", n)
+	}
+	waitFor(t, "the dial error", func() bool { return realm.Stats().DialErrors == 1 })
+
+	// Neither is a proxy which doesn't speak HTTP
+	garbage := startServer(t, func(conn net.Conn) {
+		io.WriteString(conn, "SSH-2.0-not-a-proxy\r\n")
+	})
+	rconn, err := net.Dial("tcp", garbage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+	rconn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := (&httpUpstream{proxy: garbage}).connect(rconn, "dest.test:80"); err == nil {
+		t.Error("connect() succeeded with a proxy which doesn't speak HTTP")
+	}
+}